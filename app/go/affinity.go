@@ -0,0 +1,168 @@
+package main
+
+import (
+	"hash/crc32"
+	"log/slog"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// 通知ストリームを購読者のイベントバスを持つインスタンスに寄せるためのaffinityルーティング
+//   - ISUCON_INSTANCES: "name=http://host:port"のカンマ区切り。未指定なら何もしない
+//   - ISUCON_INSTANCE_NAME: 自インスタンスの名前
+//
+// どのインスタンスが椅子/ユーザーを持つかはコンシステントハッシュで決め、
+// レスポンスのヘッダーとCookieで返す。nginxは$cookie_isuride_affinityでupstreamを選べばよい。
+// nginxを通らずに別のインスタンスに来たリクエストは、持ち主のインスタンスにプロキシする。
+const (
+	affinityHeader          = "X-Isuride-Affinity"
+	affinityCookie          = "isuride_affinity"
+	affinityForwardedHeader = "X-Isuride-Forwarded"
+	affinityVirtualNodes    = 128
+)
+
+var (
+	affinityRing = newHashRing(parseInstances(os.Getenv("ISUCON_INSTANCES")))
+	instanceName = os.Getenv("ISUCON_INSTANCE_NAME")
+)
+
+type instance struct {
+	name  string
+	url   *url.URL
+	proxy *httputil.ReverseProxy
+}
+
+func parseInstances(s string) []*instance {
+	var instances []*instance
+	for _, entry := range strings.Split(s, ",") {
+		name, rawURL, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok {
+			continue
+		}
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			panic("invalid instance url in ISUCON_INSTANCES: " + rawURL)
+		}
+
+		proxy := httputil.NewSingleHostReverseProxy(u)
+		// SSEをそのまま流す
+		proxy.FlushInterval = -1
+		instances = append(instances, &instance{
+			name:  name,
+			url:   u,
+			proxy: proxy,
+		})
+	}
+	return instances
+}
+
+type hashRingNode struct {
+	hash     uint32
+	instance *instance
+}
+
+type hashRing struct {
+	nodes []hashRingNode
+}
+
+func newHashRing(instances []*instance) *hashRing {
+	if len(instances) == 0 {
+		return nil
+	}
+
+	nodes := make([]hashRingNode, 0, len(instances)*affinityVirtualNodes)
+	for _, inst := range instances {
+		for i := range affinityVirtualNodes {
+			nodes = append(nodes, hashRingNode{
+				hash:     crc32.ChecksumIEEE([]byte(inst.name + "#" + strconv.Itoa(i))),
+				instance: inst,
+			})
+		}
+	}
+	slices.SortFunc(nodes, func(a, b hashRingNode) int {
+		switch {
+		case a.hash < b.hash:
+			return -1
+		case a.hash > b.hash:
+			return 1
+		default:
+			return strings.Compare(a.instance.name, b.instance.name)
+		}
+	})
+
+	return &hashRing{nodes: nodes}
+}
+
+// owner returns the instance responsible for key.
+func (r *hashRing) owner(key string) *instance {
+	h := crc32.ChecksumIEEE([]byte(key))
+	i, _ := slices.BinarySearchFunc(r.nodes, h, func(n hashRingNode, h uint32) int {
+		switch {
+		case n.hash < h:
+			return -1
+		case n.hash > h:
+			return 1
+		default:
+			return 0
+		}
+	})
+	if i == len(r.nodes) {
+		i = 0
+	}
+
+	return r.nodes[i].instance
+}
+
+// ownerInstance returns the name of the instance holding the event bus for key,
+// or "" when affinity routing is disabled.
+func ownerInstance(key string) string {
+	if affinityRing == nil {
+		return ""
+	}
+	return affinityRing.owner(key).name
+}
+
+// affinityMiddleware must run after the auth middleware so the subscriber is known.
+func affinityMiddleware(next http.Handler) http.Handler {
+	if affinityRing == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var key string
+		if user, ok := r.Context().Value("user").(*User); ok {
+			key = "user:" + user.ID
+		} else if chair, ok := r.Context().Value("chair").(*Chair); ok {
+			key = "chair:" + chair.ID
+		} else {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		owner := affinityRing.owner(key)
+		w.Header().Set(affinityHeader, owner.name)
+		http.SetCookie(w, &http.Cookie{
+			Name:  affinityCookie,
+			Value: owner.name,
+			Path:  "/",
+		})
+
+		// 転送済みのリクエストはループさせない
+		if owner.name == instanceName || r.Header.Get(affinityForwardedHeader) != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		httpLogger.Debug("forwarding request to affinity owner",
+			slog.String("key", key),
+			slog.String("owner", owner.name),
+		)
+		r.Header.Set(affinityForwardedHeader, instanceName)
+		owner.proxy.ServeHTTP(w, r)
+	})
+}
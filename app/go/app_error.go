@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/badger"
+)
+
+// AppError is an error whose code and message can be shown to clients as is.
+// Other errors are logged but only reach clients as a generic message when they are 5xx.
+type AppError struct {
+	Status  int
+	Code    string
+	Message string
+	// Retryable tells clients that the same request may succeed later, after RetryAfter if it is set.
+	Retryable  bool
+	RetryAfter time.Duration
+	// Fields maps request fields that failed validation to the reason.
+	Fields map[string]string
+}
+
+func newAppError(status int, code string, message string) *AppError {
+	return &AppError{
+		Status:  status,
+		Code:    code,
+		Message: message,
+	}
+}
+
+// newRetryableAppError returns an AppError for transient failures such as an unavailable upstream.
+func newRetryableAppError(status int, code string, message string, retryAfter time.Duration) *AppError {
+	return &AppError{
+		Status:     status,
+		Code:       code,
+		Message:    message,
+		Retryable:  true,
+		RetryAfter: retryAfter,
+	}
+}
+
+func (e *AppError) Error() string {
+	return e.Message
+}
+
+var (
+	errInvalidInvitationCode = newAppError(http.StatusBadRequest, "invalid_invitation_code", "この招待コードは使用できません。")
+	errInvalidAccessToken    = newAppError(http.StatusUnauthorized, "invalid_access_token", "invalid access token")
+	errRideNotFound          = newAppError(http.StatusNotFound, "ride_not_found", "ride not found")
+	errRideAlreadyExists     = newAppError(http.StatusConflict, "ride_already_exists", "ride already exists")
+	errRequestTimeout        = newRetryableAppError(http.StatusServiceUnavailable, "request_timeout", "request timed out", time.Second)
+	errPaymentUpstream       = newRetryableAppError(http.StatusBadGateway, "payment_upstream_error", "payment gateway is unavailable", 500*time.Millisecond)
+	errStorageConflict       = newRetryableAppError(http.StatusServiceUnavailable, "storage_conflict", "conflicting update", 50*time.Millisecond)
+	errRideNotMatched        = newAppError(http.StatusBadRequest, "ride_not_matched", "ride has no chair assigned")
+	errInvitationCodeTaken   = newAppError(http.StatusConflict, "invitation_code_taken", "この招待コードは既に使われています。")
+	errOwnerNameTaken        = newAppError(http.StatusConflict, "owner_name_taken", "このオーナー名は既に使われています。")
+	errUserRideInCreation    = newRetryableAppError(http.StatusConflict, "user_ride_in_creation", "作成中のライドがあるため退会できません。", 100*time.Millisecond)
+	errRoleDisabled          = newAppError(http.StatusMisdirectedRequest, "role_disabled", "this instance does not serve this API")
+	errCouponGrantConflict   = newRetryableAppError(http.StatusConflict, "coupon_grant_conflict", "the same coupon is being granted concurrently", time.Second)
+	errInvalidPaymentToken   = newAppError(http.StatusBadRequest, "invalid_payment_token", "この決済トークンは使用できません。")
+)
+
+func badRequest(message string) *AppError {
+	return newAppError(http.StatusBadRequest, "bad_request", message)
+}
+
+func unauthorized(message string) *AppError {
+	return newAppError(http.StatusUnauthorized, "unauthorized", message)
+}
+
+// toAppError converts err into the form returned to clients.
+func toAppError(statusCode int, err error) *AppError {
+	var appErr *AppError
+	if errors.As(err, &appErr) {
+		return appErr
+	}
+	// routeTimeoutMiddlewareの期限切れ
+	if errors.Is(err, context.DeadlineExceeded) {
+		return errRequestTimeout
+	}
+	// 決済の失敗(リトライし尽くした後)とbadgerのトランザクションの競合は、やり直せば通りうる
+	if errors.Is(err, erroredUpstream) {
+		return errPaymentUpstream
+	}
+	if errors.Is(err, badger.ErrConflict) {
+		return errStorageConflict
+	}
+
+	if statusCode >= http.StatusInternalServerError {
+		appErr := newAppError(statusCode, "internal_error", "internal server error")
+		// 502/503/504は上流や混雑によるものなので、500以外はやり直してよいことにする
+		appErr.Retryable = statusCode != http.StatusInternalServerError
+		return appErr
+	}
+
+	// 4xxのうちAppErrorでないものはリクエストのデコード失敗などなので、メッセージはそのまま返す
+	return newAppError(statusCode, strings.ReplaceAll(strings.ToLower(http.StatusText(statusCode)), " ", "_"), err.Error())
+}
@@ -1,19 +1,22 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"database/sql"
 	"errors"
 	"fmt"
+	"log/slog"
 	"net/http"
+	"os"
 	"strconv"
-	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/dgraph-io/badger"
-	"github.com/goccy/go-json"
 	"github.com/motoki317/sc"
 
+	"github.com/isucon/isucon14/webapp/go/geo"
 	"github.com/jmoiron/sqlx"
 	isucache "github.com/mazrean/isucon-go-tools/v2/cache"
 	"github.com/oklog/ulid/v2"
@@ -32,23 +35,21 @@ type appPostUsersResponse struct {
 	InvitationCode string `json:"invitation_code"`
 }
 
-func appPostUsers(w http.ResponseWriter, r *http.Request) {
+func (s *Server) appPostUsers(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	req := &appPostUsersRequest{}
 	if err := bindJSON(r, req); err != nil {
 		writeError(w, r, http.StatusBadRequest, err)
 		return
 	}
-	if req.Username == "" || req.FirstName == "" || req.LastName == "" || req.DateOfBirth == "" {
-		writeError(w, r, http.StatusBadRequest, errors.New("required fields(username, firstname, lastname, date_of_birth) are empty"))
-		return
-	}
 
 	userID := ulid.Make().String()
 	accessToken := secureRandomStr(32)
 	invitationCode := secureRandomStr(15)
+	now := s.clock.Now().Truncate(time.Microsecond)
+	campaign := currentCampaign()
 
-	tx, err := db.Beginx()
+	tx, err := s.db.BeginTxx(ctx, nil)
 	if err != nil {
 		writeError(w, r, http.StatusInternalServerError, err)
 		return
@@ -57,8 +58,8 @@ func appPostUsers(w http.ResponseWriter, r *http.Request) {
 
 	_, err = tx.ExecContext(
 		ctx,
-		"INSERT INTO users (id, username, firstname, lastname, date_of_birth, access_token, invitation_code) VALUES (?, ?, ?, ?, ?, ?, ?)",
-		userID, req.Username, req.FirstName, req.LastName, req.DateOfBirth, accessToken, invitationCode,
+		"INSERT INTO users (id, username, firstname, lastname, date_of_birth, access_token, invitation_code, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		userID, req.Username, req.FirstName, req.LastName, req.DateOfBirth, hashToken(accessToken), invitationCode, now, now,
 	)
 	if err != nil {
 		writeError(w, r, http.StatusInternalServerError, err)
@@ -68,59 +69,78 @@ func appPostUsers(w http.ResponseWriter, r *http.Request) {
 	// 初回登録キャンペーンのクーポンを付与
 	_, err = tx.ExecContext(
 		ctx,
-		"INSERT INTO coupons (user_id, code, discount) VALUES (?, ?, ?)",
-		userID, "CP_NEW2024", 3000,
+		"INSERT INTO coupons (user_id, code, discount, created_at) VALUES (?, ?, ?, ?)",
+		userID, "CP_NEW2024", campaign.NewUserDiscount, now,
 	)
 	if err != nil {
 		writeError(w, r, http.StatusInternalServerError, err)
 		return
 	}
 
+	coupons := []Coupon{{UserID: userID, Code: "CP_NEW2024", Discount: campaign.NewUserDiscount, CreatedAt: now}}
+
 	// 招待コードを使った登録
 	if req.InvitationCode != nil && *req.InvitationCode != "" {
 		// ユーザーチェック
 		var inviter User
-		err = tx.GetContext(ctx, &inviter, "SELECT * FROM users WHERE invitation_code = ?", *req.InvitationCode)
+		err = tx.GetContext(ctx, &inviter, "SELECT "+userColumns+" FROM users WHERE invitation_code = ? AND deactivated_at IS NULL", *req.InvitationCode)
 		if err != nil {
 			if errors.Is(err, sql.ErrNoRows) {
-				writeError(w, r, http.StatusBadRequest, errors.New("この招待コードは使用できません。"))
+				writeError(w, r, http.StatusBadRequest, errInvalidInvitationCode)
 				return
 			}
 			writeError(w, r, http.StatusInternalServerError, err)
 			return
 		}
 
+		// 招待する側の招待数をチェック
+		// 使用回数の行をロックしたまま数えるので、同時に登録されても上限を超えない
+		if err := useInvitationCode(ctx, tx, *req.InvitationCode, campaign.MaxInvitationUses, now); err != nil {
+			writeError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+
 		// 招待クーポン付与
 		// 招待した人にもRewardを付与
+		invCoupon := Coupon{UserID: userID, Code: "INV_" + *req.InvitationCode, Discount: campaign.InviteeDiscount, CreatedAt: now}
+		rwdCoupon := Coupon{UserID: inviter.ID, Code: fmt.Sprintf("RWD_%s_%d", *req.InvitationCode, now.UnixMilli()), Discount: campaign.InviterDiscount, CreatedAt: now}
 		_, err = tx.ExecContext(
 			ctx,
-			"INSERT INTO coupons (user_id, code, discount) VALUES (?, ?, ?), (?, CONCAT(?, '_', FLOOR(UNIX_TIMESTAMP(NOW(3))*1000)), ?)",
-			userID, "INV_"+*req.InvitationCode, 1500, inviter.ID, "RWD_"+*req.InvitationCode, 1000,
+			"INSERT INTO coupons (user_id, code, discount, created_at) VALUES (?, ?, ?, ?), (?, ?, ?, ?)",
+			invCoupon.UserID, invCoupon.Code, invCoupon.Discount, invCoupon.CreatedAt,
+			rwdCoupon.UserID, rwdCoupon.Code, rwdCoupon.Discount, rwdCoupon.CreatedAt,
 		)
 		if err != nil {
 			writeError(w, r, http.StatusInternalServerError, err)
 			return
 		}
 
-		// 招待する側の招待数をチェック
-		var coupons []Coupon
-		err = tx.SelectContext(ctx, &coupons, "SELECT * FROM coupons WHERE code = ?", "INV_"+*req.InvitationCode)
-		if err != nil {
-			writeError(w, r, http.StatusInternalServerError, err)
-			return
-		}
-		if len(coupons) > 3 {
-			writeError(w, r, http.StatusBadRequest, errors.New("この招待コードは使用できません。"))
-			return
-		}
-
+		coupons = append(coupons, invCoupon, rwdCoupon)
 	}
 
 	if err := tx.Commit(); err != nil {
 		writeError(w, r, http.StatusInternalServerError, err)
 		return
 	}
-	accessTokenCache.Forget(accessToken)
+	accessTokenCache.Forget(hashToken(accessToken))
+	for _, coupon := range coupons {
+		addUnusedCoupon(coupon)
+	}
+	indexInvitationCode(invitationCode)
+	if req.InvitationCode != nil && *req.InvitationCode != "" {
+		countInvitationCodeUse(*req.InvitationCode)
+	}
+	userByIDCache.Store(userID, &User{
+		ID:             userID,
+		Username:       req.Username,
+		Firstname:      req.FirstName,
+		Lastname:       req.LastName,
+		DateOfBirth:    req.DateOfBirth,
+		AccessToken:    hashToken(accessToken),
+		InvitationCode: invitationCode,
+		CreatedAt:      now,
+		UpdatedAt:      now,
+	})
 
 	http.SetCookie(w, &http.Cookie{
 		Path:  "/",
@@ -128,7 +148,7 @@ func appPostUsers(w http.ResponseWriter, r *http.Request) {
 		Value: accessToken,
 	})
 
-	userStatusGauge.WithLabelValues("COMPLETED").Inc()
+	recordUserRegistration()
 
 	writeJSON(w, http.StatusCreated, &appPostUsersResponse{
 		ID:             userID,
@@ -140,21 +160,28 @@ type appPostPaymentMethodsRequest struct {
 	Token string `json:"token"`
 }
 
-func appPostPaymentMethods(w http.ResponseWriter, r *http.Request) {
+func (s *Server) appPostPaymentMethods(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	req := &appPostPaymentMethodsRequest{}
 	if err := bindJSON(r, req); err != nil {
 		writeError(w, r, http.StatusBadRequest, err)
 		return
 	}
-	if req.Token == "" {
-		writeError(w, r, http.StatusBadRequest, errors.New("token is required but was empty"))
-		return
-	}
 
 	user := ctx.Value("user").(*User)
 
-	_, err := db.ExecContext(
+	if paymentTokenValidation {
+		if err := requestPaymentGatewayValidateToken(ctx, paymentGatewayURL, req.Token); err != nil {
+			if errors.Is(err, errInvalidPaymentToken) {
+				writeError(w, r, http.StatusBadRequest, err)
+				return
+			}
+			writeError(w, r, http.StatusBadGateway, err)
+			return
+		}
+	}
+
+	_, err := s.db.ExecContext(
 		ctx,
 		`INSERT INTO payment_tokens (user_id, token) VALUES (?, ?)`,
 		user.ID,
@@ -165,7 +192,7 @@ func appPostPaymentMethods(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	paymentTokenCache.Store(user.ID, &PaymentToken{
+	s.paymentTokens.Store(user.ID, &PaymentToken{
 		UserID: user.ID,
 		Token:  req.Token,
 	})
@@ -186,6 +213,9 @@ type getAppRidesResponseItem struct {
 	Evaluation            int                          `json:"evaluation"`
 	RequestedAt           int64                        `json:"requested_at"`
 	CompletedAt           int64                        `json:"completed_at"`
+	// 実際に移動した距離と、乗車(PICKUP)から到着(ARRIVED)までの時間。分からないライドでは省く
+	TravelledDistance   *int   `json:"travelled_distance,omitempty"`
+	TravelledDurationMs *int64 `json:"travelled_duration_ms,omitempty"`
 }
 
 type getAppRidesResponseItemChair struct {
@@ -195,47 +225,22 @@ type getAppRidesResponseItemChair struct {
 	Model string `json:"model"`
 }
 
-func appGetRides(w http.ResponseWriter, r *http.Request) {
+func (s *Server) appGetRides(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	user := ctx.Value("user").(*User)
 
-	tx, err := db.Beginx()
-	if err != nil {
-		writeError(w, r, http.StatusInternalServerError, err)
-		return
-	}
-	defer tx.Rollback()
-
-	rides := []Ride{}
-	if err := tx.SelectContext(
-		ctx,
-		&rides,
-		`SELECT * FROM rides WHERE user_id = ? ORDER BY created_at DESC FOR UPDATE`,
-		user.ID,
-	); err != nil {
-		writeError(w, r, http.StatusInternalServerError, err)
-		return
-	}
-
-	// Collect all ride IDs
-	rideIDs := make([]string, len(rides))
-	for i, ride := range rides {
-		rideIDs[i] = ride.ID
-	}
+	rides := s.rideRepository.ListByUser(user.ID)
 
 	items := []getAppRidesResponseItem{}
-	for _, ride := range rides {
-		newRide, exists := rideCache.Load(ride.ID)
-		if exists {
-			ride = *newRide
-		}
+	for _, cachedRide := range rides {
+		ride := *cachedRide
 
-		status, exists := rideStatusesCache.Load(ride.ID)
-		if !exists || status.Status != "COMPLETED" {
+		status, exists := s.rideStatuses.Load(ride.ID)
+		if exists && status.Status != "COMPLETED" || !exists && !isRideArchived(ride.ID) {
 			continue
 		}
 
-		fare, err := calculateDiscountedFare(ctx, tx, user.ID, &ride, ride.PickupLatitude, ride.PickupLongitude, ride.DestinationLatitude, ride.DestinationLongitude)
+		fare, err := calculateDiscountedFare(ctx, s.couponRepository, &ride)
 		if err != nil {
 			writeError(w, r, http.StatusInternalServerError, err)
 			return
@@ -250,11 +255,16 @@ func appGetRides(w http.ResponseWriter, r *http.Request) {
 			RequestedAt:           ride.CreatedAt.UnixMilli(),
 			CompletedAt:           ride.UpdatedAt.UnixMilli(),
 		}
+		if distance, duration, ok := rideTravelled(ride.ID); ok {
+			durationMs := duration.Milliseconds()
+			item.TravelledDistance = &distance
+			item.TravelledDurationMs = &durationMs
+		}
 
 		item.Chair = getAppRidesResponseItemChair{}
 
-		chair := &Chair{}
-		if err := tx.GetContext(ctx, chair, `SELECT * FROM chairs WHERE id = ?`, ride.ChairID); err != nil {
+		chair, err := s.chairRepository.Get(ctx, ride.ChairID.String)
+		if err != nil {
 			writeError(w, r, http.StatusInternalServerError, err)
 			return
 		}
@@ -262,8 +272,8 @@ func appGetRides(w http.ResponseWriter, r *http.Request) {
 		item.Chair.Name = chair.Name
 		item.Chair.Model = chair.Model
 
-		owner := &Owner{}
-		if err := tx.GetContext(ctx, owner, `SELECT * FROM owners WHERE id = ?`, chair.OwnerID); err != nil {
+		owner, err := getOwnerByID(ctx, chair.OwnerID)
+		if err != nil {
 			writeError(w, r, http.StatusInternalServerError, err)
 			return
 		}
@@ -272,11 +282,6 @@ func appGetRides(w http.ResponseWriter, r *http.Request) {
 		items = append(items, item)
 	}
 
-	if err := tx.Commit(); err != nil {
-		writeError(w, r, http.StatusInternalServerError, err)
-		return
-	}
-
 	writeJSON(w, http.StatusOK, &getAppRidesResponse{
 		Rides: items,
 	})
@@ -299,11 +304,15 @@ type executableGet interface {
 	GetContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error
 }
 
-var rideStatusesCache = isucache.NewAtomicMap[string, *RideStatus]("rideStatusesCache")
+var rideStatusesCache = newSharedAtomicMap[RideStatus]("rideStatusesCache")
+
+func init() {
+	registerReset(rideStatusesCache.Purge)
+}
 
 func initRideStatusesCache() error {
 	var rides []Ride
-	if err := db.Select(&rides, "SELECT * FROM rides"); err != nil {
+	if err := db.Select(&rides, "SELECT "+rideColumns+" FROM rides"); err != nil {
 		return err
 	}
 
@@ -372,6 +381,44 @@ func initRideStatusesCache() error {
 	return nil
 }
 
+var rideCountCache = isucache.NewAtomicMap[string, *atomic.Int64]("rideCountCache")
+
+func init() {
+	registerReset(rideCountCache.Purge)
+}
+
+func initRideCountCache() error {
+	var rideCounts []struct {
+		UserID string `db:"user_id"`
+		Count  int64  `db:"count"`
+	}
+	if err := db.Select(&rideCounts, "SELECT user_id, COUNT(*) AS count FROM rides GROUP BY user_id"); err != nil {
+		return err
+	}
+
+	for _, rideCount := range rideCounts {
+		count := &atomic.Int64{}
+		count.Store(rideCount.Count)
+		rideCountCache.Store(rideCount.UserID, count)
+	}
+
+	return nil
+}
+
+func getRideCount(userID string) int {
+	count, ok := rideCountCache.Load(userID)
+	if !ok {
+		return 0
+	}
+
+	return int(count.Load())
+}
+
+func incrementRideCount(userID string) {
+	count, _ := rideCountCache.LoadOrStore(userID, &atomic.Int64{})
+	count.Add(1)
+}
+
 func getLatestRideStatus(ctx context.Context, tx executableGet, rideID string) (string, error) {
 	rideStatus, ok := rideStatusesCache.Load(rideID)
 	if !ok {
@@ -391,42 +438,36 @@ func getLatestRideStatusWithID(ctx context.Context, tx executableGet, rideID str
 }
 
 // Modified appPostRides function with reduced SQL executions
-func appPostRides(w http.ResponseWriter, r *http.Request) {
+func (s *Server) appPostRides(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	req := &appPostRidesRequest{}
 	if err := bindJSON(r, req); err != nil {
 		writeError(w, r, http.StatusBadRequest, err)
 		return
 	}
-	if req.PickupCoordinate == nil || req.DestinationCoordinate == nil {
-		writeError(w, r, http.StatusBadRequest, errors.New("required fields(pickup_coordinate, destination_coordinate) are empty"))
-		return
-	}
-
-	var l int
-	func() {
-		matchingRidesLock.RLock()
-		defer matchingRidesLock.RUnlock()
 
-		l = len(matchingRides)
-	}()
+	// INSERT待ちのライドもいずれマッチングに回る
+	l := matchingRidesCount() + int(queuedRideCreations.Load())
+	var backoff time.Duration
 	if l > 100 {
-		time.Sleep(5000 * time.Millisecond)
+		backoff = 5000 * time.Millisecond
 	} else if l > 50 {
-		time.Sleep(1000 * time.Millisecond)
+		backoff = 1000 * time.Millisecond
 	}
-	now := time.Now()
+	if backoff > 0 {
+		// タイムアウトより長く待たないようにする
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			writeError(w, r, http.StatusServiceUnavailable, ctx.Err())
+			return
+		}
+	}
+	now := s.clock.Now().Truncate(time.Microsecond)
 
 	user := ctx.Value("user").(*User)
 	rideID := ulid.Make().String()
 
-	tx, err := db.Beginx()
-	if err != nil {
-		writeError(w, r, http.StatusInternalServerError, err)
-		return
-	}
-	defer tx.Rollback()
-
 	// Replace fetching all rides and iterating with a single count query
 	userStatus, err := getUserStatusFromBadger(user.ID)
 	if err != nil {
@@ -435,118 +476,52 @@ func appPostRides(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if userStatus {
-		writeError(w, r, http.StatusConflict, errors.New("ride already exists"))
-		return
-	}
-
-	if _, err := tx.ExecContext(
-		ctx,
-		`INSERT INTO rides (id, user_id, pickup_latitude, pickup_longitude, destination_latitude, destination_longitude, created_at, updated_at)
-				  VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
-		rideID, user.ID, req.PickupCoordinate.Latitude, req.PickupCoordinate.Longitude, req.DestinationCoordinate.Latitude, req.DestinationCoordinate.Longitude, now, now,
-	); err != nil {
-		writeError(w, r, http.StatusInternalServerError, err)
-		return
-	}
-
-	if err := updateUserStatusToBadger(user.ID, true); err != nil {
-		writeError(w, r, http.StatusInternalServerError, err)
-		return
-	}
-
-	var rideCount int
-	if err := tx.GetContext(ctx, &rideCount, `SELECT COUNT(*) FROM rides WHERE user_id = ? `, user.ID); err != nil {
-		writeError(w, r, http.StatusInternalServerError, err)
-		return
-	}
-
-	var coupon Coupon
-	if rideCount == 1 {
-		// 初回利用で、初回利用クーポンがあれば必ず使う
-		if err := tx.GetContext(ctx, &coupon, "SELECT * FROM coupons WHERE user_id = ? AND code = 'CP_NEW2024' AND used_by IS NULL FOR UPDATE", user.ID); err != nil {
-			if !errors.Is(err, sql.ErrNoRows) {
-				writeError(w, r, http.StatusInternalServerError, err)
-				return
-			}
-
-			// 無ければ他のクーポンを付与された順番に使う
-			if err := tx.GetContext(ctx, &coupon, "SELECT * FROM coupons WHERE user_id = ? AND used_by IS NULL ORDER BY created_at LIMIT 1 FOR UPDATE", user.ID); err != nil {
-				if !errors.Is(err, sql.ErrNoRows) {
-					writeError(w, r, http.StatusInternalServerError, err)
-					return
-				}
-			} else {
-				if _, err := tx.ExecContext(
-					ctx,
-					"UPDATE coupons SET used_by = ? WHERE user_id = ? AND code = ?",
-					rideID, user.ID, coupon.Code,
-				); err != nil {
-					writeError(w, r, http.StatusInternalServerError, err)
-					return
-				}
-			}
-		} else {
-			if _, err := tx.ExecContext(
-				ctx,
-				"UPDATE coupons SET used_by = ? WHERE user_id = ? AND code = 'CP_NEW2024'",
-				rideID, user.ID,
-			); err != nil {
-				writeError(w, r, http.StatusInternalServerError, err)
-				return
-			}
+		// フラグだけが残っていることがあるので、本当に進行中のライドがあるか確かめる
+		unfinished, err := s.hasUnfinishedRide(ctx, user.ID)
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, err)
+			return
 		}
-	} else {
-		// 他のクーポンを付与された順番に使う
-		if err := tx.GetContext(ctx, &coupon, "SELECT * FROM coupons WHERE user_id = ? AND used_by IS NULL ORDER BY created_at LIMIT 1 FOR UPDATE", user.ID); err != nil {
-			if !errors.Is(err, sql.ErrNoRows) {
-				writeError(w, r, http.StatusInternalServerError, err)
-				return
-			}
-		} else {
-			if _, err := tx.ExecContext(
-				ctx,
-				"UPDATE coupons SET used_by = ? WHERE user_id = ? AND code = ?",
-				rideID, user.ID, coupon.Code,
-			); err != nil {
-				writeError(w, r, http.StatusInternalServerError, err)
-				return
-			}
+		if unfinished {
+			writeError(w, r, http.StatusConflict, errRideAlreadyExists)
+			return
 		}
 	}
 
-	ride := Ride{}
-	if err := tx.GetContext(ctx, &ride, "SELECT * FROM rides WHERE id = ?", rideID); err != nil {
-		writeError(w, r, http.StatusInternalServerError, err)
-		return
+	ride := Ride{
+		ID:                   rideID,
+		UserID:               user.ID,
+		PickupLatitude:       req.PickupCoordinate.Latitude,
+		PickupLongitude:      req.PickupCoordinate.Longitude,
+		DestinationLatitude:  req.DestinationCoordinate.Latitude,
+		DestinationLongitude: req.DestinationCoordinate.Longitude,
+		CreatedAt:            now,
+		UpdatedAt:            now,
 	}
 
-	fare, err := calculateDiscountedFare(ctx, tx, user.ID, &ride, req.PickupCoordinate.Latitude, req.PickupCoordinate.Longitude, req.DestinationCoordinate.Latitude, req.DestinationCoordinate.Longitude)
-	if err != nil {
-		writeError(w, r, http.StatusInternalServerError, err)
-		return
+	// the counter is incremented only after the ride is stored, so count the ride being created here
+	rideCount := getRideCount(user.ID) + 1
+
+	// 初回利用なら初回利用クーポンを優先し、それ以外は付与された順番に使う
+	intent := &rideCreationIntent{
+		Ride:   ride,
+		Status: *newRideStatus(rideID, "MATCHING", now),
+	}
+	discount := 0
+	if coupon, ok := s.couponRepository.Select(user.ID, rideCount == 1); ok {
+		intent.Coupon = &coupon
+		discount = coupon.Discount
 	}
+	fare := currentFareConfig().fare(calculateDistance(ride.PickupLatitude, ride.PickupLongitude, ride.DestinationLatitude, ride.DestinationLongitude), discount)
 
-	if err := tx.Commit(); err != nil {
+	// ユーザーのフラグと作成の意図を一緒に書いてから反映する
+	endRideCreation := beginRideCreation(user.ID)
+	defer endRideCreation()
+	if err := persistRideCreation(intent); err != nil {
 		writeError(w, r, http.StatusInternalServerError, err)
 		return
 	}
-
-	func() {
-		matchingRidesLock.Lock()
-		defer matchingRidesLock.Unlock()
-
-		matchingRides = append(matchingRides, &ride)
-	}()
-	rideCache.Store(rideID, &ride)
-	rideStatusesCache.Store(rideID, &RideStatus{
-		RideID: rideID,
-		Status: "MATCHING",
-	})
-	UserPublish(ride.UserID, &RideEvent{
-		status:    "MATCHING",
-		updatedAt: now,
-		ride:      &ride,
-	})
+	s.applyRideCreation(intent)
 
 	writeJSON(w, http.StatusAccepted, &appPostRidesResponse{
 		RideID: rideID,
@@ -564,53 +539,36 @@ type appPostRidesEstimatedFareResponse struct {
 	Discount int `json:"discount"`
 }
 
-func appPostRidesEstimatedFare(w http.ResponseWriter, r *http.Request) {
+func (s *Server) appPostRidesEstimatedFare(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	req := &appPostRidesEstimatedFareRequest{}
 	if err := bindJSON(r, req); err != nil {
 		writeError(w, r, http.StatusBadRequest, err)
 		return
 	}
-	if req.PickupCoordinate == nil || req.DestinationCoordinate == nil {
-		writeError(w, r, http.StatusBadRequest, errors.New("required fields(pickup_coordinate, destination_coordinate) are empty"))
-		return
-	}
 
 	user := ctx.Value("user").(*User)
 
-	tx, err := db.Beginx()
-	if err != nil {
-		writeError(w, r, http.StatusInternalServerError, err)
-		return
-	}
-	defer tx.Rollback()
-
-	discounted, err := calculateDiscountedFare(ctx, tx, user.ID, nil, req.PickupCoordinate.Latitude, req.PickupCoordinate.Longitude, req.DestinationCoordinate.Latitude, req.DestinationCoordinate.Longitude)
-	if err != nil {
-		writeError(w, r, http.StatusInternalServerError, err)
-		return
-	}
-
-	if err := tx.Commit(); err != nil {
-		writeError(w, r, http.StatusInternalServerError, err)
-		return
-	}
+	fare, discount := estimateFare(s.couponRepository, user.ID, req.PickupCoordinate.Latitude, req.PickupCoordinate.Longitude, req.DestinationCoordinate.Latitude, req.DestinationCoordinate.Longitude)
 
 	writeJSON(w, http.StatusOK, &appPostRidesEstimatedFareResponse{
-		Fare:     discounted,
-		Discount: calculateFare(req.PickupCoordinate.Latitude, req.PickupCoordinate.Longitude, req.DestinationCoordinate.Latitude, req.DestinationCoordinate.Longitude) - discounted,
+		Fare:     fare,
+		Discount: discount,
 	})
 }
 
-// マンハッタン距離を求める
+// 距離を求める。通常はマンハッタン距離で、ISUCON_GEO=haversineのときは座標をマイクロ度として大圏距離(m)を使う
 func calculateDistance(aLatitude, aLongitude, bLatitude, bLongitude int) int {
-	return abs(aLatitude-bLatitude) + abs(aLongitude-bLongitude)
+	return distanceMetric.Between(aLatitude, aLongitude, bLatitude, bLongitude)
 }
-func abs(a int) int {
-	if a < 0 {
-		return -a
+
+var distanceMetric = newDistanceFromEnv()
+
+func newDistanceFromEnv() geo.Distance {
+	if os.Getenv("ISUCON_GEO") == "haversine" {
+		return geo.NewHaversine()
 	}
-	return a
+	return geo.Manhattan{}
 }
 
 type appPostRideEvaluationRequest struct {
@@ -618,14 +576,20 @@ type appPostRideEvaluationRequest struct {
 }
 
 type appPostRideEvaluationResponse struct {
-	CompletedAt int64 `json:"completed_at"`
+	CompletedAt         int64  `json:"completed_at"`
+	TravelledDistance   *int   `json:"travelled_distance,omitempty"`
+	TravelledDurationMs *int64 `json:"travelled_duration_ms,omitempty"`
 }
 
-var paymentTokenCache = isucache.NewAtomicMap[string, *PaymentToken]("paymentTokenCache")
+var paymentTokenCache = newSharedAtomicMap[PaymentToken]("paymentTokenCache")
+
+func init() {
+	registerReset(paymentTokenCache.Purge)
+}
 
 func initPaymentTokenCache() error {
 	paymentTokens := []PaymentToken{}
-	if err := db.Select(&paymentTokens, "SELECT * FROM payment_tokens"); err != nil {
+	if err := db.Select(&paymentTokens, "SELECT "+paymentTokenColumns+" FROM payment_tokens"); err != nil {
 		return err
 	}
 
@@ -636,121 +600,134 @@ func initPaymentTokenCache() error {
 	return nil
 }
 
-var rideCache = isucache.NewAtomicMap[string, *Ride]("rideCache")
+var rideCache = newSharedAtomicMap[Ride]("rideCache")
+
+func init() {
+	registerReset(rideCache.Purge)
+}
+
+// user ID -> ride IDs in creation order
+var userRideIDsCache = isucache.NewMap[string, []string]("userRideIDsCache")
+
+func init() {
+	registerReset(userRideIDsCache.Purge)
+}
 
 func initRideCache() error {
 	rides := []Ride{}
-	if err := db.Select(&rides, "SELECT * FROM rides"); err != nil {
+	if err := db.Select(&rides, "SELECT "+rideColumns+" FROM rides ORDER BY created_at"); err != nil {
 		return err
 	}
 
 	for _, ride := range rides {
-		rideCache.Store(ride.ID, &ride)
+		storeRide(&ride)
 	}
 
 	return nil
 }
 
-func appPostRideEvaluatation(w http.ResponseWriter, r *http.Request) {
-	ctx := r.Context()
-	rideID := r.PathValue("ride_id")
-
-	now := time.Now()
-
-	req := &appPostRideEvaluationRequest{}
-	if err := bindJSON(r, req); err != nil {
-		writeError(w, r, http.StatusBadRequest, err)
-		return
-	}
-	if req.Evaluation < 1 || req.Evaluation > 5 {
-		writeError(w, r, http.StatusBadRequest, errors.New("evaluation must be between 1 and 5"))
-		return
+// storeRide stores ride into rideCache and keeps userRideIDsCache and chairRideIDsCache in sync.
+func storeRide(ride *Ride) {
+	if ride.ChairID.Valid {
+		indexChairRide(ride)
 	}
-
-	tx, err := db.Beginx()
-	if err != nil {
-		writeError(w, r, http.StatusInternalServerError, err)
+	if _, loaded := rideCache.LoadOrStore(ride.ID, ride); loaded {
+		rideCache.Store(ride.ID, ride)
 		return
 	}
-	defer tx.Rollback()
 
-	var ride *Ride
-	exists := false
-	rideCache.Update(rideID, func(v *Ride) (*Ride, bool) {
-		if v == nil {
-			return nil, false
-		}
-
-		ride = v
-		exists = true
-		ride.Evaluation = &req.Evaluation
-		ride.UpdatedAt = now
-		return v, true
+	userRideIDsCache.Update(ride.UserID, func(rideIDs []string) ([]string, bool) {
+		return append(rideIDs, ride.ID), true
 	})
-	if !exists {
-		writeError(w, r, http.StatusNotFound, errors.New("ride not found"))
-		return
+}
+
+// getRidesByUserID returns the rides of the user, newest first.
+func getRidesByUserID(userID string) []*Ride {
+	rideIDs, ok := userRideIDsCache.Load(userID)
+	if !ok {
+		return nil
 	}
-	status, err := getLatestRideStatus(ctx, db, ride.ID)
+
+	rides, err := ridesNewestFirst(rideIDs)
 	if err != nil {
-		writeError(w, r, http.StatusInternalServerError, err)
-		return
+		slog.Error("failed to load archived rides", slog.String("user_id", userID), slog.String("error", err.Error()))
 	}
+	return rides
+}
 
-	if status == "COMPLETED" {
-		writeError(w, r, http.StatusBadRequest, fmt.Errorf("already completed"))
-		return
+// ridesNewestFirst looks up rideIDs, given in creation order, and returns the rides in reverse.
+// If the archived rides cannot be read back, it returns the cached ones together with the error.
+func ridesNewestFirst(rideIDs []string) ([]*Ride, error) {
+	rides := make([]*Ride, 0, len(rideIDs))
+	var archived []string
+	for i := len(rideIDs) - 1; i >= 0; i-- {
+		if ride, ok := rideCache.Load(rideIDs[i]); ok {
+			rides = append(rides, ride)
+			continue
+		}
+		if isRideArchived(rideIDs[i]) {
+			archived = append(archived, rideIDs[i])
+		}
 	}
-	if status != "ARRIVED" {
-		writeError(w, r, http.StatusBadRequest, errors.New("not arrived yet"))
-		return
+	if len(archived) == 0 {
+		return rides, nil
 	}
 
-	result, err := tx.ExecContext(
-		ctx,
-		`UPDATE rides SET evaluation = ?, sales = ?, updated_at = ? WHERE id = ?`,
-		req.Evaluation, initialFare+farePerDistance*calculateDistance(ride.PickupLatitude, ride.PickupLongitude, ride.DestinationLatitude, ride.DestinationLongitude), now, rideID)
+	// キャッシュから追い出したライドはMySQLから読み直して、新しい順に並べ直す
+	archivedRides, err := loadArchivedRides(archived)
 	if err != nil {
-		writeError(w, r, http.StatusInternalServerError, err)
-		return
-	}
-	if count, err := result.RowsAffected(); err != nil {
-		writeError(w, r, http.StatusInternalServerError, err)
-		return
-	} else if count == 0 {
-		writeError(w, r, http.StatusNotFound, errors.New("ride not found"))
-		return
+		return rides, err
+	}
+	rides = rides[:0]
+	for i := len(rideIDs) - 1; i >= 0; i-- {
+		if ride, ok := rideCache.Load(rideIDs[i]); ok {
+			rides = append(rides, ride)
+		} else if ride, ok := archivedRides[rideIDs[i]]; ok {
+			rides = append(rides, ride)
+		}
 	}
 
-	if err := updateChairStatusToBadger(ride.ChairID.String, &chairStatus{
-		status: chairStatusCompleted,
-		rideID: rideID,
-	}); err != nil {
-		writeError(w, r, http.StatusInternalServerError, err)
-		return
+	return rides, nil
+}
+
+func getLatestRideByUserID(userID string) (*Ride, bool) {
+	rideIDs, ok := userRideIDsCache.Load(userID)
+	if !ok || len(rideIDs) == 0 {
+		return nil, false
 	}
 
-	if err := updateUserStatusToBadger(ride.UserID, false); err != nil {
-		writeError(w, r, http.StatusInternalServerError, err)
-		return
+	return rideCache.Load(rideIDs[len(rideIDs)-1])
+}
+
+// loadUserRide returns the ride of user identified by rideID.
+// ライドIDだけで引くと他のユーザーのライドも操作できてしまうので、ライドを扱うappのエンドポイントは必ずこれを通す。
+// 他のユーザーのライドは存在しないライドと同じく見つからなかったことにする。
+func (s *Server) loadUserRide(user *User, rideID string) (*Ride, bool) {
+	ride, ok := s.rides.Load(rideID)
+	if !ok || ride.UserID != user.ID {
+		return nil, false
 	}
+	return ride, true
+}
+
+func (s *Server) appPostRideEvaluatation(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	rideID := r.PathValue("ride_id")
 
-	paymentToken, exists := paymentTokenCache.Load(ride.UserID)
-	if !exists {
-		writeError(w, r, http.StatusBadRequest, errors.New("payment token not registered"))
+	req := &appPostRideEvaluationRequest{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, r, http.StatusBadRequest, err)
 		return
 	}
 
-	fare, err := calculateDiscountedFare(ctx, tx, ride.UserID, ride, ride.PickupLatitude, ride.PickupLongitude, ride.DestinationLatitude, ride.DestinationLongitude)
-	if err != nil {
-		writeError(w, r, http.StatusInternalServerError, err)
+	ride, ok := s.loadUserRide(ctx.Value("user").(*User), rideID)
+	if !ok {
+		writeError(w, r, http.StatusNotFound, errRideNotFound)
 		return
 	}
-	paymentGatewayRequest := &paymentGatewayPostPaymentRequest{
-		Amount: fare,
-	}
 
-	if err := requestPaymentGatewayPostPayment(ctx, paymentGatewayURL, paymentToken.Token, paymentGatewayRequest); err != nil {
+	completedAt, err := s.CompleteRide(ctx, ride, req.Evaluation)
+	if err != nil {
 		if errors.Is(err, erroredUpstream) {
 			writeError(w, r, http.StatusBadGateway, err)
 			return
@@ -759,32 +736,16 @@ func appPostRideEvaluatation(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := tx.Commit(); err != nil {
-		writeError(w, r, http.StatusInternalServerError, err)
-		return
+	res := &appPostRideEvaluationResponse{
+		CompletedAt: completedAt.UnixMilli(),
+	}
+	if distance, duration, ok := rideTravelled(rideID); ok {
+		durationMs := duration.Milliseconds()
+		res.TravelledDistance = &distance
+		res.TravelledDurationMs = &durationMs
 	}
 
-	rideStatusesCache.Store(rideID, &RideStatus{
-		RideID: rideID,
-		Status: "COMPLETED",
-	})
-
-	ChairPublish(ride.ChairID.String, &RideEvent{
-		status:     "COMPLETED",
-		evaluation: req.Evaluation,
-		updatedAt:  now,
-		ride:       ride,
-	})
-	UserPublish(ride.UserID, &RideEvent{
-		status:     "COMPLETED",
-		evaluation: req.Evaluation,
-		updatedAt:  now,
-		ride:       ride,
-	})
-
-	writeJSON(w, http.StatusOK, &appPostRideEvaluationResponse{
-		CompletedAt: now.UnixMilli(),
-	})
+	writeJSON(w, http.StatusOK, res)
 }
 
 type appGetNotificationResponseData struct {
@@ -810,7 +771,46 @@ type appGetNotificationResponseChairStats struct {
 	TotalEvaluationAvg float64 `json:"total_evaluation_avg"`
 }
 
-func appGetNotification(w http.ResponseWriter, r *http.Request) {
+func (nrd *appGetNotificationResponseData) Encode(buf *bytes.Buffer) {
+	nrd.encodeHead(buf)
+	writeJSONString(buf, nrd.Status)
+	nrd.encodeTail(buf)
+}
+
+func (nrd *appGetNotificationResponseData) encodeHead(buf *bytes.Buffer) {
+	buf.WriteString(`{"ride_id":`)
+	writeJSONString(buf, nrd.RideID)
+	buf.WriteString(`,"pickup_coordinate":`)
+	writeJSONCoordinate(buf, nrd.PickupCoordinate)
+	buf.WriteString(`,"destination_coordinate":`)
+	writeJSONCoordinate(buf, nrd.DestinationCoordinate)
+	buf.WriteString(`,"fare":`)
+	writeJSONInt(buf, int64(nrd.Fare))
+	buf.WriteString(`,"status":`)
+}
+
+func (nrd *appGetNotificationResponseData) encodeTail(buf *bytes.Buffer) {
+	if nrd.Chair != nil {
+		buf.WriteString(`,"chair":{"id":`)
+		writeJSONString(buf, nrd.Chair.ID)
+		buf.WriteString(`,"name":`)
+		writeJSONString(buf, nrd.Chair.Name)
+		buf.WriteString(`,"model":`)
+		writeJSONString(buf, nrd.Chair.Model)
+		buf.WriteString(`,"stats":{"total_rides_count":`)
+		writeJSONInt(buf, int64(nrd.Chair.Stats.TotalRidesCount))
+		buf.WriteString(`,"total_evaluation_avg":`)
+		writeJSONFloat(buf, nrd.Chair.Stats.TotalEvaluationAvg)
+		buf.WriteString(`}}`)
+	}
+	buf.WriteString(`,"created_at":`)
+	writeJSONInt(buf, nrd.CreatedAt)
+	buf.WriteString(`,"updated_at":`)
+	writeJSONInt(buf, nrd.UpdateAt)
+	buf.WriteByte('}')
+}
+
+func (s *Server) appGetNotification(w http.ResponseWriter, r *http.Request) {
 	flusher, ok := w.(http.Flusher)
 	if !ok {
 		writeError(w, r, http.StatusInternalServerError, errors.New("expected http.ResponseWriter to be an http.Flusher"))
@@ -819,67 +819,26 @@ func appGetNotification(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	user := ctx.Value("user").(*User)
 
-	ride := &Ride{}
-	if err := db.GetContext(ctx, ride, `SELECT * FROM rides WHERE user_id = ? ORDER BY created_at DESC LIMIT 1`, user.ID); err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			writeJSON(w, http.StatusOK, &chairGetNotificationResponse{
-				RetryAfterMs: 100,
-			})
-			return
-		}
-		writeError(w, r, http.StatusInternalServerError, err)
-		return
-	}
-
-	fare, err := calculateDiscountedFareDB(ctx, db, user.ID, ride, ride.PickupLatitude, ride.PickupLongitude, ride.DestinationLatitude, ride.DestinationLongitude)
-	if err != nil {
-		writeError(w, r, http.StatusInternalServerError, err)
-		return
-	}
-
-	response := &appGetNotificationResponseData{
-		RideID:                ride.ID,
-		PickupCoordinate:      Coordinate{Latitude: ride.PickupLatitude, Longitude: ride.PickupLongitude},
-		DestinationCoordinate: Coordinate{Latitude: ride.DestinationLatitude, Longitude: ride.DestinationLongitude},
-		Fare:                  fare,
-		CreatedAt:             ride.CreatedAt.UnixMilli(),
-		UpdateAt:              ride.UpdatedAt.UnixMilli(),
-	}
-
-	response.Status, err = getLatestRideStatus(ctx, db, response.RideID)
-	if err != nil {
-		writeError(w, r, http.StatusInternalServerError, err)
+	ride, ok := s.rideRepository.LatestByUser(user.ID)
+	if !ok {
+		writeJSON(w, http.StatusOK, &chairGetNotificationResponse{
+			RetryAfterMs: 100,
+		})
 		return
 	}
 
-	var stats appGetNotificationChairStats
-	if ride.ChairID.Valid {
-		chair := &Chair{}
-		if err := db.GetContext(ctx, chair, `SELECT * FROM chairs WHERE id = ?`, ride.ChairID); err != nil {
-			writeError(w, r, http.StatusInternalServerError, err)
-			return
-		}
-
-		stats, err = getChairStats(ctx, db, chair.ID)
+	// 再接続してきたクライアントが今の状態を知っていれば、最初のイベントまでスナップショットを作らない
+	var (
+		response *appGetNotificationResponseData
+		stats    appGetNotificationChairStats
+		err      error
+	)
+	if !appNotificationUpToDate(r, ride) {
+		response, stats, err = s.newAppNotificationResponse(ctx, ride)
 		if err != nil {
 			writeError(w, r, http.StatusInternalServerError, err)
 			return
 		}
-
-		evaluationAve := 0.0
-		if stats.TotalRidesCount > 0 {
-			evaluationAve = float64(stats.TotalEvaluation) / float64(stats.TotalRidesCount)
-		}
-
-		response.Chair = &appGetNotificationResponseChair{
-			ID:    chair.ID,
-			Name:  chair.Name,
-			Model: chair.Model,
-			Stats: appGetNotificationResponseChairStats{
-				TotalRidesCount:    stats.TotalRidesCount,
-				TotalEvaluationAvg: evaluationAve,
-			},
-		}
 	}
 
 	w.Header().Set("Content-Type", "text/event-stream")
@@ -887,27 +846,60 @@ func appGetNotification(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Connection", "keep-alive")
 	w.Header().Set("X-Accel-Buffering", "no")
 
-	sb := &strings.Builder{}
-	err = json.NewEncoder(sb).Encode(response)
-	if err != nil {
-		writeError(w, r, http.StatusInternalServerError, fmt.Errorf("failed to encode response1(%+v): %w", response.Chair, err))
-		return
+	buf := getBuffer()
+	defer putBuffer(buf)
+
+	closeStream := trackSSEStream("app")
+	closeReason := sseCloseReasonError
+	defer func() { closeStream(closeReason) }()
+
+	if response != nil {
+		writeAppNotificationEventID(buf, response.RideID, response.Status)
+		buf.WriteString("data: ")
+		response.Encode(buf)
+		buf.WriteString("\n\n")
 	}
-	fmt.Fprintf(w, "data: %s\n", sb.String())
+	w.Write(buf.Bytes())
 	flusher.Flush()
+	if response != nil {
+		markRideStatusSent(response.RideID, response.Status, rideStatusSentApp, s.clock.Now())
+	}
 
+	// statusだけが変わる間はエンコード済みのフレームを使い回す
+	var frame *statusFrame
+	order := rideEventOrder{}
 	ch := make(chan *RideEvent, 100)
-	UserSubscribe(user.ID, ch)
+	s.events.UserSubscribe(user.ID, ch)
+	defer s.events.UserUnsubscribe(user.ID, ch)
+	reset := streamsResetCh()
 	for {
 		select {
 		case <-ctx.Done():
+			closeReason = sseCloseReasonClientDisconnect
+			return
+		case <-reset:
+			closeReason = sseCloseReasonReset
 			return
 		case event := <-ch:
+			if !order.accept(event) {
+				sseDroppedEventsCounter.WithLabelValues("app").Inc()
+				continue
+			}
+
+			if response == nil && event.status != "MATCHING" {
+				response, stats, err = s.newAppNotificationResponse(ctx, ride)
+				if err != nil {
+					writeError(w, r, http.StatusInternalServerError, err)
+					return
+				}
+			}
+
+			statusOnly := false
 			switch event.status {
 			case "MATCHING":
 				ride = event.ride
 
-				fare, err := calculateDiscountedFareDB(ctx, db, user.ID, ride, ride.PickupLatitude, ride.PickupLongitude, ride.DestinationLatitude, ride.DestinationLongitude)
+				fare, err := calculateDiscountedFare(ctx, s.couponRepository, ride)
 				if err != nil {
 					writeError(w, r, http.StatusInternalServerError, err)
 					return
@@ -923,11 +915,12 @@ func appGetNotification(w http.ResponseWriter, r *http.Request) {
 				}
 
 				response.Status = event.status
-			case "ENROUTE", "PICKUP", "CARRYING", "ARRIVED":
+			case "ENROUTE", "PICKUP", "CARRYING", "ARRIVED", "CANCELED":
 				response.Status = event.status
+				statusOnly = true
 			case "MATCHED":
 				chair := event.chair
-				stats, err = getChairStats(ctx, db, chair.ID)
+				stats, err = chairStatsCache.Get(ctx, chair.ID)
 				if err != nil {
 					writeError(w, r, http.StatusInternalServerError, err)
 					return
@@ -959,16 +952,25 @@ func appGetNotification(w http.ResponseWriter, r *http.Request) {
 				response.UpdateAt = event.updatedAt.UnixMilli()
 			}
 
-			sb := &strings.Builder{}
-			err = json.NewEncoder(sb).Encode(response)
-			if err != nil {
-				writeError(w, r, http.StatusInternalServerError, fmt.Errorf("failed to encode response2(%+v): %w", response.Chair, err))
-				return
+			buf.Reset()
+			writeAppNotificationEventID(buf, response.RideID, response.Status)
+			if statusOnly {
+				if frame == nil {
+					frame = newStatusFrame(response)
+				}
+				frame.write(buf, response.Status)
+			} else {
+				frame = nil
+				buf.WriteString("data: ")
+				response.Encode(buf)
+				buf.WriteString("\n\n")
 			}
-			fmt.Fprintf(w, "data: %s\n", sb.String())
+			w.Write(buf.Bytes())
 			flusher.Flush()
+			markRideStatusSent(response.RideID, response.Status, rideStatusSentApp, s.clock.Now())
 
-			if response.Status == "COMPLETED" {
+			if rideFinished(response.Status) {
+				closeReason = sseCloseReasonCompleted
 				return
 			}
 		}
@@ -980,6 +982,20 @@ type appGetNotificationChairStats struct {
 	TotalEvaluation int `json:"total_evaluation_avg"`
 }
 
+// 同じ椅子の統計を同時に計算しないよう短時間だけキャッシュしてリクエストをまとめる
+var chairStatsCache *sc.Cache[string, appGetNotificationChairStats]
+
+func init() {
+	var err error
+	chairStatsCache, err = isucache.New("chairStatsCache", func(ctx context.Context, chairID string) (appGetNotificationChairStats, error) {
+		return getChairStats(ctx, db, chairID)
+	}, 0, 100*time.Millisecond)
+	if err != nil {
+		panic(err)
+	}
+	registerReset(chairStatsCache.Purge)
+}
+
 func getChairStats(ctx context.Context, tx *sqlx.DB, chairID string) (appGetNotificationChairStats, error) {
 	stats := appGetNotificationChairStats{}
 
@@ -988,7 +1004,7 @@ func getChairStats(ctx context.Context, tx *sqlx.DB, chairID string) (appGetNoti
 	err := tx.SelectContext(
 		ctx,
 		&rides,
-		`SELECT * FROM rides WHERE chair_id = ? ORDER BY updated_at DESC`,
+		"SELECT "+rideColumns+" FROM rides WHERE chair_id = ? ORDER BY updated_at DESC",
 		chairID,
 	)
 	if err != nil {
@@ -1038,13 +1054,35 @@ type appGetNearbyChairsResponseChair struct {
 	CurrentCoordinate Coordinate `json:"current_coordinate"`
 }
 
+func (res *appGetNearbyChairsResponse) Encode(buf *bytes.Buffer) {
+	buf.WriteString(`{"chairs":[`)
+	for i := range res.Chairs {
+		chair := &res.Chairs[i]
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		buf.WriteString(`{"id":`)
+		writeJSONString(buf, chair.ID)
+		buf.WriteString(`,"name":`)
+		writeJSONString(buf, chair.Name)
+		buf.WriteString(`,"model":`)
+		writeJSONString(buf, chair.Model)
+		buf.WriteString(`,"current_coordinate":`)
+		writeJSONCoordinate(buf, chair.CurrentCoordinate)
+		buf.WriteByte('}')
+	}
+	buf.WriteString(`],"retrieved_at":`)
+	writeJSONInt(buf, res.RetrievedAt)
+	buf.WriteByte('}')
+}
+
 var activeChairsCache *sc.Cache[string, []Chair]
 
 func init() {
 	var err error
 	activeChairsCache, err = isucache.New("activeChairsCache", func(ctx context.Context, key string) ([]Chair, error) {
 		chairs := []Chair{}
-		if err := db.SelectContext(ctx, &chairs, `SELECT * FROM chairs WHERE is_active = TRUE`); err != nil {
+		if err := db.SelectContext(ctx, &chairs, "SELECT "+chairPublicColumns+" FROM chairs WHERE is_active = TRUE"); err != nil {
 			return nil, err
 		}
 		return chairs, nil
@@ -1052,208 +1090,100 @@ func init() {
 	if err != nil {
 		panic(err)
 	}
+	registerReset(activeChairsCache.Purge)
 }
 
-func appGetNearbyChairs(w http.ResponseWriter, r *http.Request) {
+// GET /api/app/nearby-chairs?latitude=0&longitude=0&distance=50&limit=10
+//
+// distanceとlimitの上限はnearby_chairs.goを参照。近い順に返す。
+func (s *Server) appGetNearbyChairs(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	latStr := r.URL.Query().Get("latitude")
 	lonStr := r.URL.Query().Get("longitude")
 	distanceStr := r.URL.Query().Get("distance")
 	if latStr == "" || lonStr == "" {
-		writeError(w, r, http.StatusBadRequest, errors.New("latitude or longitude is empty"))
+		writeError(w, r, http.StatusBadRequest, badRequest("latitude or longitude is empty"))
 		return
 	}
 
 	lat, err := strconv.Atoi(latStr)
 	if err != nil {
-		writeError(w, r, http.StatusBadRequest, errors.New("latitude is invalid"))
+		writeError(w, r, http.StatusBadRequest, badRequest("latitude is invalid"))
 		return
 	}
 
 	lon, err := strconv.Atoi(lonStr)
 	if err != nil {
-		writeError(w, r, http.StatusBadRequest, errors.New("longitude is invalid"))
+		writeError(w, r, http.StatusBadRequest, badRequest("longitude is invalid"))
 		return
 	}
 
-	distance := 50
+	distance := defaultNearbyDistance
 	if distanceStr != "" {
 		distance, err = strconv.Atoi(distanceStr)
-		if err != nil {
-			writeError(w, r, http.StatusBadRequest, errors.New("distance is invalid"))
+		if err != nil || distance < 0 {
+			writeError(w, r, http.StatusBadRequest, badRequest("distance is invalid"))
 			return
 		}
+		distance = min(distance, nearbyMaxDistance)
 	}
 
-	coordinate := Coordinate{Latitude: lat, Longitude: lon}
-
-	tx, err := db.Beginx()
-	if err != nil {
-		writeError(w, r, http.StatusInternalServerError, err)
-		return
-	}
-	defer tx.Rollback()
-
-	// Fetch all active chairs
-	chairs, err := activeChairsCache.Get(ctx, "activeChairs")
-	if err != nil {
-		writeError(w, r, http.StatusInternalServerError, err)
-		return
-	}
-
-	if len(chairs) == 0 {
-		writeJSON(w, http.StatusOK, &appGetNearbyChairsResponse{
-			Chairs:      []appGetNearbyChairsResponseChair{},
-			RetrievedAt: time.Now().UnixMilli(),
-		})
-		return
+	limit := nearbyMaxResults
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit <= 0 {
+			writeError(w, r, http.StatusBadRequest, badRequest("limit is invalid"))
+			return
+		}
+		limit = min(limit, nearbyMaxResults)
 	}
 
-	// Collect all chair IDs
-	chairIDs := make([]string, len(chairs))
-	for i, chair := range chairs {
-		chairIDs[i] = chair.ID
-	}
+	coordinate := Coordinate{Latitude: lat, Longitude: lon}
 
-	chairLocationMap, err := getChairLocationsFromBadger(chairIDs)
+	chairs, err := nearbyChairs(ctx, coordinate, distance)
 	if err != nil {
 		writeError(w, r, http.StatusInternalServerError, err)
 		return
 	}
 
-	nearbyChairs := []appGetNearbyChairsResponseChair{}
-	for _, chair := range chairs {
-		// Check rides for this chair
-		if ride, exists := latestRideCache.Load(chair.ID); exists {
-			// 過去にライドが存在し、かつ、それが完了していない場合はスキップ
-			status, exists := rideStatusesCache.Load(ride.ID)
-			if !exists {
-				writeError(w, r, http.StatusInternalServerError, fmt.Errorf("status not found for ride ID: %s", ride.ID))
-				return
-			}
-			if status.Status != "COMPLETED" {
-				continue
-			}
-		}
-
-		// Get the latest ChairLocation
-		chairLocation, exists := chairLocationMap[chair.ID]
-		if err != nil {
-			writeError(w, r, http.StatusInternalServerError, err)
-			return
-		}
-		if !exists {
-			continue
-		}
+	retrievedAt := s.clock.Now()
 
-		if calculateDistance(coordinate.Latitude, coordinate.Longitude, chairLocation.LastLatitude, chairLocation.LastLongitude) <= distance {
-			nearbyChairs = append(nearbyChairs, appGetNearbyChairsResponseChair{
-				ID:    chair.ID,
-				Name:  chair.Name,
-				Model: chair.Model,
-				CurrentCoordinate: Coordinate{
-					Latitude:  chairLocation.LastLatitude,
-					Longitude: chairLocation.LastLongitude,
-				},
-			})
-		}
+	res := &appGetNearbyChairsResponse{
+		Chairs:      closestChairs(chairs, limit),
+		RetrievedAt: retrievedAt.UnixMilli(),
 	}
 
-	retrievedAt := time.Now()
-
-	writeJSON(w, http.StatusOK, &appGetNearbyChairsResponse{
-		Chairs:      nearbyChairs,
-		RetrievedAt: retrievedAt.UnixMilli(),
-	})
-}
+	buf := getBuffer()
+	defer putBuffer(buf)
+	res.Encode(buf)
 
-func calculateFare(pickupLatitude, pickupLongitude, destLatitude, destLongitude int) int {
-	meteredFare := farePerDistance * calculateDistance(pickupLatitude, pickupLongitude, destLatitude, destLongitude)
-	return initialFare + meteredFare
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf.Bytes())
 }
 
-func calculateDiscountedFare(ctx context.Context, tx *sqlx.Tx, userID string, ride *Ride, pickupLatitude, pickupLongitude, destLatitude, destLongitude int) (int, error) {
-	var coupon Coupon
-	discount := 0
-	if ride != nil {
-		destLatitude = ride.DestinationLatitude
-		destLongitude = ride.DestinationLongitude
-		pickupLatitude = ride.PickupLatitude
-		pickupLongitude = ride.PickupLongitude
-
-		// すでにクーポンが紐づいているならそれの割引額を参照
-		if err := tx.GetContext(ctx, &coupon, "SELECT * FROM coupons WHERE used_by = ?", ride.ID); err != nil {
-			if !errors.Is(err, sql.ErrNoRows) {
-				return 0, err
-			}
-		} else {
-			discount = coupon.Discount
-		}
-	} else {
-		// 初回利用クーポンを最優先で使う
-		if err := tx.GetContext(ctx, &coupon, "SELECT * FROM coupons WHERE user_id = ? AND code = 'CP_NEW2024' AND used_by IS NULL", userID); err != nil {
-			if !errors.Is(err, sql.ErrNoRows) {
-				return 0, err
-			}
-
-			// 無いなら他のクーポンを付与された順番に使う
-			if err := tx.GetContext(ctx, &coupon, "SELECT * FROM coupons WHERE user_id = ? AND used_by IS NULL ORDER BY created_at LIMIT 1", userID); err != nil {
-				if !errors.Is(err, sql.ErrNoRows) {
-					return 0, err
-				}
-			} else {
-				discount = coupon.Discount
-			}
-		} else {
-			discount = coupon.Discount
-		}
+// calculateDiscountedFare returns the fare of ride after the discount of the coupon it used.
+func calculateDiscountedFare(ctx context.Context, coupons couponSource, ride *Ride) (int, error) {
+	// すでにクーポンが紐づいているならそれの割引額を参照
+	discount, err := coupons.rideDiscount(ctx, ride.ID)
+	if err != nil {
+		return 0, err
 	}
 
-	meteredFare := farePerDistance * calculateDistance(pickupLatitude, pickupLongitude, destLatitude, destLongitude)
-	discountedMeteredFare := max(meteredFare-discount, 0)
-
-	return initialFare + discountedMeteredFare, nil
+	return currentFareConfig().fare(calculateDistance(ride.PickupLatitude, ride.PickupLongitude, ride.DestinationLatitude, ride.DestinationLongitude), discount), nil
 }
 
-func calculateDiscountedFareDB(ctx context.Context, tx *sqlx.DB, userID string, ride *Ride, pickupLatitude, pickupLongitude, destLatitude, destLongitude int) (int, error) {
-	var coupon Coupon
+// estimateFare returns the fare and discount of a new ride of userID between the given coordinates.
+// It only reads memory, so it is cheap enough to call on every estimate.
+func estimateFare(coupons CouponRepository, userID string, pickupLatitude, pickupLongitude, destLatitude, destLongitude int) (int, int) {
+	// 初回利用クーポンを最優先で使い、無いなら他のクーポンを付与された順番に使う
 	discount := 0
-	if ride != nil {
-		destLatitude = ride.DestinationLatitude
-		destLongitude = ride.DestinationLongitude
-		pickupLatitude = ride.PickupLatitude
-		pickupLongitude = ride.PickupLongitude
-
-		// すでにクーポンが紐づいているならそれの割引額を参照
-		if err := tx.GetContext(ctx, &coupon, "SELECT * FROM coupons WHERE used_by = ?", ride.ID); err != nil {
-			if !errors.Is(err, sql.ErrNoRows) {
-				return 0, err
-			}
-		} else {
-			discount = coupon.Discount
-		}
-	} else {
-		// 初回利用クーポンを最優先で使う
-		if err := tx.GetContext(ctx, &coupon, "SELECT * FROM coupons WHERE user_id = ? AND code = 'CP_NEW2024' AND used_by IS NULL", userID); err != nil {
-			if !errors.Is(err, sql.ErrNoRows) {
-				return 0, err
-			}
-
-			// 無いなら他のクーポンを付与された順番に使う
-			if err := tx.GetContext(ctx, &coupon, "SELECT * FROM coupons WHERE user_id = ? AND used_by IS NULL ORDER BY created_at LIMIT 1", userID); err != nil {
-				if !errors.Is(err, sql.ErrNoRows) {
-					return 0, err
-				}
-			} else {
-				discount = coupon.Discount
-			}
-		} else {
-			discount = coupon.Discount
-		}
+	if coupon, ok := coupons.Select(userID, true); ok {
+		discount = coupon.Discount
 	}
 
-	meteredFare := farePerDistance * calculateDistance(pickupLatitude, pickupLongitude, destLatitude, destLongitude)
-	discountedMeteredFare := max(meteredFare-discount, 0)
-
-	return initialFare + discountedMeteredFare, nil
+	config := currentFareConfig()
+	distance := calculateDistance(pickupLatitude, pickupLongitude, destLatitude, destLongitude)
+	fare := config.fare(distance, discount)
+	return fare, config.fare(distance, 0) - fare
 }
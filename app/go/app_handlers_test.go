@@ -0,0 +1,136 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAppGetRides(t *testing.T) {
+	chair := &Chair{ID: "chair", OwnerID: "owner", Name: "chair-name", Model: "model"}
+	usedBy := "completed"
+	s := newTestServer(t, []*Chair{chair}, []Coupon{{UserID: "user", Code: "CP_NEW2024", Discount: 3000, UsedBy: &usedBy}})
+	ownerByIDCache.Store("owner", &Owner{ID: "owner", Name: "owner-name"})
+
+	requestedAt := time.UnixMilli(1733600000000)
+	evaluation := 5
+	rides := []*Ride{
+		{
+			ID: "completed", UserID: "user", ChairID: sql.NullString{String: "chair", Valid: true},
+			PickupLatitude: 0, PickupLongitude: 0, DestinationLatitude: 30, DestinationLongitude: 20,
+			Evaluation: &evaluation, CreatedAt: requestedAt, UpdatedAt: requestedAt.Add(time.Minute),
+		},
+		{
+			ID: "enroute", UserID: "user", ChairID: sql.NullString{String: "chair", Valid: true},
+			CreatedAt: requestedAt.Add(2 * time.Minute), UpdatedAt: requestedAt.Add(2 * time.Minute),
+		},
+		{
+			ID: "other", UserID: "other", ChairID: sql.NullString{String: "chair", Valid: true},
+			Evaluation: &evaluation, CreatedAt: requestedAt, UpdatedAt: requestedAt,
+		},
+	}
+	for _, ride := range rides {
+		s.rideRepository.Save(ride)
+	}
+	s.rideStatuses.Store("completed", &RideStatus{RideID: "completed", Status: "COMPLETED"})
+	s.rideStatuses.Store("enroute", &RideStatus{RideID: "enroute", Status: "ENROUTE"})
+	s.rideStatuses.Store("other", &RideStatus{RideID: "other", Status: "COMPLETED"})
+
+	rec := httptest.NewRecorder()
+	s.appGetRides(rec, withUser(httptest.NewRequest(http.MethodGet, "/api/app/rides", nil), &User{ID: "user"}))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusOK, rec.Body.String())
+	}
+	res := decodeResponse[getAppRidesResponse](t, rec)
+	if len(res.Rides) != 1 {
+		t.Fatalf("got %d rides, want 1: %+v", len(res.Rides), res.Rides)
+	}
+	got := res.Rides[0]
+	want := getAppRidesResponseItem{
+		ID:                    "completed",
+		PickupCoordinate:      Coordinate{Latitude: 0, Longitude: 0},
+		DestinationCoordinate: Coordinate{Latitude: 30, Longitude: 20},
+		Chair:                 getAppRidesResponseItemChair{ID: "chair", Owner: "owner-name", Name: "chair-name", Model: "model"},
+		Fare:                  500 + 100*50 - 3000,
+		Evaluation:            5,
+		RequestedAt:           requestedAt.UnixMilli(),
+		CompletedAt:           requestedAt.Add(time.Minute).UnixMilli(),
+	}
+	if got != want {
+		t.Errorf("ride = %+v, want %+v", got, want)
+	}
+}
+
+func TestAppPostRideEvaluationWithoutChair(t *testing.T) {
+	s := newTestServer(t, nil, nil)
+	openTestBadger(t)
+
+	user := &User{ID: "user"}
+	ride := &Ride{ID: "ride", UserID: user.ID, CreatedAt: time.UnixMilli(1733600000000), UpdatedAt: time.UnixMilli(1733600000000)}
+	s.rides.Store(ride.ID, ride)
+	s.rideStatuses.Store(ride.ID, &RideStatus{RideID: ride.ID, Status: "ARRIVED"})
+	s.paymentTokens.Store(user.ID, &PaymentToken{UserID: user.ID, Token: "token"})
+
+	req := httptest.NewRequest(http.MethodPost, "/api/app/rides/ride/evaluation", strings.NewReader(`{"evaluation":5}`))
+	req.SetPathValue("ride_id", ride.ID)
+	rec := httptest.NewRecorder()
+	s.appPostRideEvaluatation(rec, withUser(req, user))
+
+	if rec.Code != errRideNotMatched.Status {
+		t.Fatalf("status = %d, want %d: %s", rec.Code, errRideNotMatched.Status, rec.Body.String())
+	}
+	if res := decodeResponse[errorResponse](t, rec); res.Code != errRideNotMatched.Code {
+		t.Errorf("code = %q, want %q", res.Code, errRideNotMatched.Code)
+	}
+	if keys := badgerKeys(t); len(keys) > 0 {
+		t.Errorf("badger has keys %q, want none", keys)
+	}
+	if cached, _ := s.rides.Load(ride.ID); cached.Evaluation != nil {
+		t.Errorf("evaluation = %d, want none", *cached.Evaluation)
+	}
+	if status, _ := s.rideStatuses.Load(ride.ID); status.Status != "ARRIVED" {
+		t.Errorf("status = %s, want ARRIVED", status.Status)
+	}
+}
+
+func TestAppPostRideEvaluationUnknownRide(t *testing.T) {
+	s := newTestServer(t, nil, nil)
+	openTestBadger(t)
+	testDB := openTestDB(t)
+	if _, err := testDB.Exec("CREATE TABLE rides (id TEXT PRIMARY KEY, evaluation INTEGER, sales INTEGER, travelled_distance INTEGER, updated_at DATETIME)"); err != nil {
+		t.Fatal(err)
+	}
+
+	// キャッシュにはあるがridesには無い(初期化で消えたなど)
+	user := &User{ID: "user"}
+	ride := &Ride{ID: "ride", UserID: user.ID, ChairID: sql.NullString{String: "chair", Valid: true}, CreatedAt: time.UnixMilli(1733600000000), UpdatedAt: time.UnixMilli(1733600000000)}
+	s.rides.Store(ride.ID, ride)
+	s.rideStatuses.Store(ride.ID, &RideStatus{RideID: ride.ID, Status: "ARRIVED"})
+	s.paymentTokens.Store(user.ID, &PaymentToken{UserID: user.ID, Token: "token"})
+
+	req := httptest.NewRequest(http.MethodPost, "/api/app/rides/ride/evaluation", strings.NewReader(`{"evaluation":5}`))
+	req.SetPathValue("ride_id", ride.ID)
+	rec := httptest.NewRecorder()
+	s.appPostRideEvaluatation(rec, withUser(req, user))
+
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusNotFound, rec.Body.String())
+	}
+	if res := decodeResponse[errorResponse](t, rec); res.Code != errRideNotFound.Code {
+		t.Errorf("code = %q, want %q", res.Code, errRideNotFound.Code)
+	}
+	if cached, _ := s.rides.Load(ride.ID); cached.Evaluation != nil {
+		t.Errorf("evaluation = %d, want none", *cached.Evaluation)
+	}
+	var count int
+	if err := testDB.Get(&count, "SELECT COUNT(*) FROM rides"); err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Errorf("rides has %d rows, want the unknown ride not to be written", count)
+	}
+}
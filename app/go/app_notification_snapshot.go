@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// ユーザーの通知ストリームの最初のイベント(スナップショット)の送り方
+// スナップショットは料金の計算と椅子の統計の集計が要るので、再接続のたびに作り直すと重い。
+// 各イベントには "id: <ride ID>/<status>" を付けておき、ISUCON_APP_NOTIFICATION_SNAPSHOT で
+//   - always: 毎回送る(デフォルト)
+//   - resume: Last-Event-IDが最新のライドの今の状態と同じなら送らない
+//
+// を選ぶ。送らなかったときは、最初のイベントが来たところでスナップショットを組み立てる。
+const (
+	appNotificationSnapshotAlways = "always"
+	appNotificationSnapshotResume = "resume"
+)
+
+var appNotificationSnapshotMode = parseAppNotificationSnapshotMode(os.Getenv("ISUCON_APP_NOTIFICATION_SNAPSHOT"))
+
+func parseAppNotificationSnapshotMode(s string) string {
+	switch s {
+	case "":
+		return appNotificationSnapshotAlways
+	case appNotificationSnapshotAlways, appNotificationSnapshotResume:
+		return s
+	default:
+		panic(fmt.Sprintf("invalid ISUCON_APP_NOTIFICATION_SNAPSHOT: %q", s))
+	}
+}
+
+func writeAppNotificationEventID(buf *bytes.Buffer, rideID string, status string) {
+	buf.WriteString("id: ")
+	buf.WriteString(rideID)
+	buf.WriteByte('/')
+	buf.WriteString(status)
+	buf.WriteByte('\n')
+}
+
+// appNotificationUpToDate reports whether the client reconnecting with r has already seen the current status of ride.
+func appNotificationUpToDate(r *http.Request, ride *Ride) bool {
+	if appNotificationSnapshotMode != appNotificationSnapshotResume {
+		return false
+	}
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		return false
+	}
+	status, ok := rideStatusesCache.Load(ride.ID)
+	return ok && lastEventID == ride.ID+"/"+status.Status
+}
+
+// newAppNotificationResponse builds the snapshot of ride sent at the start of the user notification stream.
+func (s *Server) newAppNotificationResponse(ctx context.Context, ride *Ride) (*appGetNotificationResponseData, appGetNotificationChairStats, error) {
+	var stats appGetNotificationChairStats
+	fare, err := calculateDiscountedFare(ctx, s.couponRepository, ride)
+	if err != nil {
+		return nil, stats, err
+	}
+
+	response := &appGetNotificationResponseData{
+		RideID:                ride.ID,
+		PickupCoordinate:      Coordinate{Latitude: ride.PickupLatitude, Longitude: ride.PickupLongitude},
+		DestinationCoordinate: Coordinate{Latitude: ride.DestinationLatitude, Longitude: ride.DestinationLongitude},
+		Fare:                  fare,
+		CreatedAt:             ride.CreatedAt.UnixMilli(),
+		UpdateAt:              ride.UpdatedAt.UnixMilli(),
+	}
+
+	response.Status, err = getLatestRideStatus(ctx, s.db, response.RideID)
+	if err != nil {
+		return nil, stats, err
+	}
+
+	if ride.ChairID.Valid {
+		chair, err := s.chairRepository.Get(ctx, ride.ChairID.String)
+		if err != nil {
+			return nil, stats, err
+		}
+
+		stats, err = chairStatsCache.Get(ctx, chair.ID)
+		if err != nil {
+			return nil, stats, err
+		}
+
+		evaluationAve := 0.0
+		if stats.TotalRidesCount > 0 {
+			evaluationAve = float64(stats.TotalEvaluation) / float64(stats.TotalRidesCount)
+		}
+
+		response.Chair = &appGetNotificationResponseChair{
+			ID:    chair.ID,
+			Name:  chair.Name,
+			Model: chair.Model,
+			Stats: appGetNotificationResponseChairStats{
+				TotalRidesCount:    stats.TotalRidesCount,
+				TotalEvaluationAvg: evaluationAve,
+			},
+		}
+	}
+
+	return response, stats, nil
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/bytedance/sonic"
+	"github.com/dgraph-io/badger"
+	"github.com/oklog/ulid/v2"
+)
+
+// 状態を変える操作の監査ログ
+// 走行後の調査用に、ライドの作成・マッチング・ステータス遷移・評価・決済をbadgerに追記していく。
+// キーは"audit"+ULIDなので作成順に並ぶ。badgerごと/api/initializeで消えるので、残したいときはその前に取得する。
+//
+//	curl -s 'localhost:8080/api/internal/audit?ride_id=01JDFEF7MGXXCJKW1MNJXPA77A'
+
+const (
+	auditBatchSize    = 1000
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+)
+
+var auditPrefix = []byte("audit")
+
+type auditEntry struct {
+	ID      string    `json:"id"`
+	At      time.Time `json:"at"`
+	Actor   string    `json:"actor"`
+	Action  string    `json:"action"`
+	RideID  string    `json:"ride_id,omitempty"`
+	ChairID string    `json:"chair_id,omitempty"`
+	Before  string    `json:"before,omitempty"`
+	After   string    `json:"after,omitempty"`
+}
+
+var auditQueue = make(chan *auditEntry, 10000)
+
+func init() {
+	registerReset(func() {
+		for {
+			select {
+			case <-auditQueue:
+			default:
+				return
+			}
+		}
+	})
+
+	go auditWriter()
+}
+
+func userActor(userID string) string {
+	return "user:" + userID
+}
+
+func chairActor(chairID string) string {
+	return "chair:" + chairID
+}
+
+const matcherActor = "matcher"
+
+// recordAudit enqueues an audit entry. リクエスト処理を止めないように、キューが詰まっているときは捨てる。
+func recordAudit(at time.Time, actor, action, rideID, chairID, before, after string) {
+	entry := &auditEntry{
+		ID:      ulid.MustNew(ulid.Timestamp(at), ulid.DefaultEntropy()).String(),
+		At:      at,
+		Actor:   actor,
+		Action:  action,
+		RideID:  rideID,
+		ChairID: chairID,
+		Before:  before,
+		After:   after,
+	}
+
+	select {
+	case auditQueue <- entry:
+	default:
+		slog.Warn("audit queue is full, dropping entry",
+			slog.String("action", action),
+			slog.String("ride_id", rideID),
+		)
+	}
+}
+
+func auditWriter() {
+	for entry := range auditQueue {
+		entries := []*auditEntry{entry}
+	L:
+		for len(entries) < auditBatchSize {
+			select {
+			case entry := <-auditQueue:
+				entries = append(entries, entry)
+			default:
+				break L
+			}
+		}
+
+		// 初期化でbadgerDBが開き直されている間は待つ
+		runBackgroundWork(func() {
+			writeAuditEntries(entries)
+		})
+	}
+}
+
+func writeAuditEntries(entries []*auditEntry) {
+	if badgerDB == nil {
+		return
+	}
+	err := badgerDB.Update(func(txn *badger.Txn) error {
+		for _, entry := range entries {
+			data, err := sonic.ConfigFastest.Marshal(entry)
+			if err != nil {
+				return err
+			}
+			if err := txn.Set(append(auditPrefix, entry.ID...), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		slog.Error("failed to write audit entries",
+			slog.Int("count", len(entries)),
+			slog.String("error", err.Error()),
+		)
+	}
+}
+
+// queryAudit returns the entries matching filter, newest first.
+func queryAudit(limit int, filter func(*auditEntry) bool) ([]*auditEntry, error) {
+	entries := []*auditEntry{}
+	err := badgerDB.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Reverse = true
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		// 逆順のイテレーションはprefixの直後からSeekする
+		seekKey := append(bytes.Clone(auditPrefix), 0xff)
+		for it.Seek(seekKey); it.ValidForPrefix(auditPrefix) && len(entries) < limit; it.Next() {
+			entry := &auditEntry{}
+			err := it.Item().Value(func(val []byte) error {
+				return sonic.ConfigFastest.Unmarshal(val, entry)
+			})
+			if err != nil {
+				return err
+			}
+			if filter(entry) {
+				entries = append(entries, entry)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+func (s *Server) internalGetAudit(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	rideID, chairID, actor, action := q.Get("ride_id"), q.Get("chair_id"), q.Get("actor"), q.Get("action")
+
+	limit := defaultAuditLimit
+	if v := q.Get("limit"); v != "" {
+		l, err := strconv.Atoi(v)
+		if err != nil || l <= 0 {
+			writeError(w, r, http.StatusBadRequest, badRequest("limit must be a positive integer"))
+			return
+		}
+		limit = min(l, maxAuditLimit)
+	}
+
+	entries, err := queryAudit(limit, func(entry *auditEntry) bool {
+		return (rideID == "" || entry.RideID == rideID) &&
+			(chairID == "" || entry.ChairID == chairID) &&
+			(actor == "" || entry.Actor == actor) &&
+			(action == "" || entry.Action == action)
+	})
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, entries)
+}
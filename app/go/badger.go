@@ -101,7 +101,7 @@ func initBadger() error {
 	userStatusMap := make(map[string]bool)
 
 	users := []User{}
-	if err := db.Select(&users, "SELECT * FROM users"); err != nil {
+	if err := db.Select(&users, "SELECT id FROM users"); err != nil {
 		return fmt.Errorf("failed to select users: %w", err)
 	}
 
@@ -110,7 +110,7 @@ func initBadger() error {
 	}
 
 	chairs := []Chair{}
-	if err := db.Select(&chairs, "SELECT * FROM chairs"); err != nil {
+	if err := db.Select(&chairs, "SELECT id FROM chairs"); err != nil {
 		return fmt.Errorf("failed to select chairs: %w", err)
 	}
 	for _, chair := range chairs {
@@ -131,7 +131,7 @@ func initBadger() error {
 		return err
 	}
 	for _, status := range rideStatuses {
-		userStatusMap[status.UserID] = status.Status != "COMPLETED"
+		userStatusMap[status.UserID] = !rideFinished(status.Status)
 
 		if !status.ChairID.Valid {
 			continue
@@ -149,7 +149,7 @@ func initBadger() error {
 			statusByte = chairStatusCarrying
 		case "ARRIVED":
 			statusByte = chairStatusArrived
-		case "COMPLETED":
+		case "COMPLETED", "CANCELED":
 			if status.IsSent {
 				statusByte = chairStatusAvailable
 			} else {
@@ -221,15 +221,27 @@ var (
 	locationCache = isucache.NewAtomicMap[string, *chairLocation]("location")
 )
 
+func init() {
+	registerReset(locationCache.Purge)
+}
+
 func getChairLocationsFromBadger(chairIDs []string) (map[string]*chairLocation, error) {
 	locations := make(map[string]*chairLocation, len(chairIDs))
-	err := badgerDB.View(func(txn *badger.Txn) error {
-		for _, chairID := range chairIDs {
-			if location, ok := locationCache.Load(chairID); ok {
-				locations[chairID] = location
-				continue
-			}
+	var cold []string
+	for _, chairID := range chairIDs {
+		if location, ok := locationCache.Load(chairID); ok {
+			locations[chairID] = location
+			continue
+		}
+		cold = append(cold, chairID)
+	}
+	// 全部キャッシュにあればトランザクションを開かない
+	if len(cold) == 0 {
+		return locations, nil
+	}
 
+	err := badgerDB.View(func(txn *badger.Txn) error {
+		for _, chairID := range cold {
 			bytesChairID := append([]byte("location"), []byte(chairID)...)
 			item, err := txn.Get(bytesChairID)
 			if errors.Is(err, badger.ErrKeyNotFound) {
@@ -313,7 +325,7 @@ func updateChairLocationToBadger(chairID string, coodinate *Coordinate) error {
 				TotalDistance:          0,
 				LastLatitude:           coodinate.Latitude,
 				LastLongitude:          coodinate.Longitude,
-				TotalDistanceUpdatedAt: time.Now().UnixMilli(),
+				TotalDistanceUpdatedAt: clock.Now().UnixMilli(),
 			}
 		} else {
 			err = item.Value(func(val []byte) error {
@@ -324,10 +336,10 @@ func updateChairLocationToBadger(chairID string, coodinate *Coordinate) error {
 				return fmt.Errorf("failed to get value: %w", err)
 			}
 
-			location.TotalDistance += distance(location.LastLatitude, location.LastLongitude, coodinate.Latitude, coodinate.Longitude)
+			location.TotalDistance += calculateDistance(location.LastLatitude, location.LastLongitude, coodinate.Latitude, coodinate.Longitude)
 			location.LastLatitude = coodinate.Latitude
 			location.LastLongitude = coodinate.Longitude
-			location.TotalDistanceUpdatedAt = time.Now().UnixMilli()
+			location.TotalDistanceUpdatedAt = clock.Now().UnixMilli()
 		}
 
 		err = txn.Set(bytesChairID, encodeChairLocation(&location))
@@ -409,6 +421,40 @@ func getChairStatusFromBadger(chairID string) (*chairStatus, bool, error) {
 	return &status, ok, nil
 }
 
+// availableChairIDsFromBadger scans the chair statuses and returns the chairs that are available.
+func availableChairIDsFromBadger() ([]string, error) {
+	chairIDs := []string{}
+	err := badgerDB.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Prefix = []byte("status")
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			chairID := string(item.Key()[len(opts.Prefix):])
+
+			err := item.Value(func(v []byte) error {
+				if decodeChairStatus(v).status == chairStatusAvailable {
+					chairIDs = append(chairIDs, chairID)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to view badger: %w", err)
+	}
+
+	return chairIDs, nil
+}
+
 func updateChairStatusToBadger(chairID string, status *chairStatus) error {
 	err := badgerDB.Update(func(txn *badger.Txn) error {
 		bytesChairID := append([]byte("status"), []byte(chairID)...)
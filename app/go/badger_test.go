@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"sync/atomic"
+	"testing"
+
+	"github.com/dgraph-io/badger"
+)
+
+const benchmarkChairs = 1000
+
+func benchmarkChairIDs() []string {
+	chairIDs := make([]string, benchmarkChairs)
+	for i := range chairIDs {
+		chairIDs[i] = fmt.Sprintf("01JDFEDF00%016d", i)
+	}
+	return chairIDs
+}
+
+func BenchmarkGetChairLocationsFromBadger(b *testing.B) {
+	b.Cleanup(resetAll)
+	openTestBadger(b)
+	chairIDs := benchmarkChairIDs()
+	for i, chairID := range chairIDs {
+		if err := updateChairLocationToBadger(chairID, &Coordinate{Latitude: i, Longitude: -i}); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	// マッチングの1回分として、空き椅子を100脚ずつ引く
+	batch := chairIDs[:100]
+
+	b.Run("cold", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			b.StopTimer()
+			locationCache.Purge()
+			b.StartTimer()
+
+			if _, err := getChairLocationsFromBadger(batch); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("warm", func(b *testing.B) {
+		if _, err := getChairLocationsFromBadger(batch); err != nil {
+			b.Fatal(err)
+		}
+
+		b.ReportAllocs()
+		for b.Loop() {
+			if _, err := getChairLocationsFromBadger(batch); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkUpdateChairLocationToBadgerParallel(b *testing.B) {
+	for _, chairs := range []int{1, 10, benchmarkChairs} {
+		b.Run(fmt.Sprintf("chairs=%d", chairs), func(b *testing.B) {
+			b.Cleanup(resetAll)
+			openTestBadger(b)
+			chairIDs := benchmarkChairIDs()[:chairs]
+
+			// 同じ椅子への同時書き込みはbadgerのトランザクションが衝突して失敗する
+			var conflicts atomic.Int64
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					chairID := chairIDs[rand.IntN(len(chairIDs))]
+					err := updateChairLocationToBadger(chairID, &Coordinate{Latitude: rand.IntN(100), Longitude: rand.IntN(100)})
+					if err != nil {
+						if !errors.Is(err, badger.ErrConflict) {
+							b.Error(err)
+							return
+						}
+						conflicts.Add(1)
+					}
+				}
+			})
+			b.ReportMetric(float64(conflicts.Load())/float64(b.N), "conflicts/op")
+		})
+	}
+}
+
+func BenchmarkAvailableChairIDsFromBadger(b *testing.B) {
+	for _, chairs := range []int{benchmarkChairs, 10 * benchmarkChairs} {
+		b.Run(fmt.Sprintf("chairs=%d", chairs), func(b *testing.B) {
+			b.Cleanup(resetAll)
+			openTestBadger(b)
+
+			// 初期化直後と同じく、ユーザーとライドのキーも混ざった中から椅子の状態だけを読む
+			err := badgerDB.Update(func(txn *badger.Txn) error {
+				for i := range chairs {
+					statusByte := chairStatusEnRoute
+					if i%7 == 0 {
+						statusByte = chairStatusAvailable
+					}
+					status := &chairStatus{status: statusByte, rideID: fmt.Sprintf("01JDFEF7MG%016d", i)}
+					if err := txn.Set([]byte(fmt.Sprintf("status01JDFEDF00%016d", i)), encodeChairStatus(status)); err != nil {
+						return err
+					}
+					if err := txn.Set([]byte(fmt.Sprintf("user01JDFEDF80%016d", i)), []byte{1}); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			b.ReportAllocs()
+			for b.Loop() {
+				chairIDs, err := availableChairIDsFromBadger()
+				if err != nil {
+					b.Fatal(err)
+				}
+				if want := (chairs + 6) / 7; len(chairIDs) != want {
+					b.Fatalf("got %d available chairs, want %d", len(chairIDs), want)
+				}
+			}
+		})
+	}
+}
+
+func TestAvailableChairIDsFromBadger(t *testing.T) {
+	openTestBadger(t)
+	for chairID, status := range map[string]byte{
+		"01JDFEDF00B09BNMV8MP0RB34G": chairStatusAvailable,
+		"01JDFEDF00D7D8VBPNJ4Y9WVGE": chairStatusEnRoute,
+		"01JDFEDF00SVQ79V2PBMQWRCGE": chairStatusAvailable,
+	} {
+		if err := updateChairStatusToBadger(chairID, &chairStatus{status: status, rideID: "ride"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	chairIDs, err := availableChairIDsFromBadger()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chairIDs) != 2 || chairIDs[0] != "01JDFEDF00B09BNMV8MP0RB34G" || chairIDs[1] != "01JDFEDF00SVQ79V2PBMQWRCGE" {
+		t.Errorf("available chairs = %v, want the two available ones by ID", chairIDs)
+	}
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	gomysql "github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/go-mysql-org/go-mysql/replication"
+	"github.com/go-sql-driver/mysql"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// 他のプロセスや手で流したSQLによるusers/owners/chairs/couponsの変更を、binlogを読んでキャッシュに反映する
+// ISUCON_BINLOG_LISTENER=1 のときだけ動く。アプリ自身の書き込みも全部流れてくるので、ベンチマーク中は有効にしない。
+//   - ISUCON_BINLOG_SERVER_ID: レプリカとして名乗るserver_id(デフォルト4242)。他のレプリカと重ならないこと
+//
+// MySQLはbinlog_format=ROWで動かし、ISUCON_DB_USERにREPLICATION SLAVEとREPLICATION CLIENTの権限を付けておくこと。
+// レプリケーションのプロトコルと認証はgo-mysqlのreplicationに任せる。
+// 行からはキーだけを取り出し、キャッシュにはMySQLから読み直した値を入れるので、アプリ自身の書き込みで読み直しても結果は変わらない。
+// 椅子の空き状況のように、キャッシュから組み立てた状態までは作り直さない。
+// 初期化のあとはinit.shが流した大量の行を読まずに、その時点の位置からつなぎ直す。
+
+const binlogRetryInterval = time.Second
+
+var (
+	binlogListenerEnabled = os.Getenv("ISUCON_BINLOG_LISTENER") == "1"
+	binlogServerID        = parseBinlogServerID(os.Getenv("ISUCON_BINLOG_SERVER_ID"))
+
+	// 初期化で立てる。次のイベントを読んだところで最新の位置からつなぎ直す
+	binlogRestart atomic.Bool
+
+	binlogInvalidationCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "isuride_binlog_invalidations_total",
+		Help: "cache entries reloaded because of row changes read from the binlog",
+	}, []string{"table"})
+)
+
+// 変更された行からキャッシュのキーとして取り出す列
+var binlogWatchedTables = map[string][]string{
+	"users":   {"id"},
+	"owners":  {"id"},
+	"chairs":  {"id"},
+	"coupons": {"user_id", "code"},
+}
+
+func init() {
+	registerReset(func() {
+		binlogRestart.Store(true)
+	})
+}
+
+func parseBinlogServerID(s string) uint32 {
+	if s == "" {
+		return 4242
+	}
+	id, err := strconv.ParseUint(s, 10, 32)
+	if err != nil || id == 0 {
+		panic(fmt.Sprintf("invalid ISUCON_BINLOG_SERVER_ID: %q", s))
+	}
+	return uint32(id)
+}
+
+type binlogListener struct {
+	config *mysql.Config
+	file   string
+	pos    uint32
+	// table -> 列の数とキーの列の位置
+	columns      map[string]int
+	keyPositions map[string][]int
+}
+
+func startBinlogListener() {
+	if !binlogListenerEnabled {
+		return
+	}
+
+	l := &binlogListener{config: dbConfigFromEnv()}
+	go func() {
+		for {
+			if err := l.run(); err != nil {
+				slog.Error("binlog listener stopped", slog.String("error", err.Error()))
+				time.Sleep(binlogRetryInterval)
+			}
+		}
+	}()
+}
+
+// run streams the binlog until an error occurs or initialization asks for a restart.
+func (l *binlogListener) run() error {
+	if binlogRestart.Swap(false) || l.file == "" {
+		file, pos, err := currentBinlogPosition()
+		if err != nil {
+			return err
+		}
+		l.file, l.pos = file, pos
+	}
+	if err := l.loadKeyPositions(); err != nil {
+		return err
+	}
+
+	host, portStr, err := net.SplitHostPort(l.config.Addr)
+	if err != nil {
+		return fmt.Errorf("invalid database address: %w", err)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid database port: %w", err)
+	}
+	// 切れたらここから位置を指定してつなぎ直すので、go-mysqlには再接続させない
+	syncer := replication.NewBinlogSyncer(replication.BinlogSyncerConfig{
+		ServerID:         binlogServerID,
+		Flavor:           gomysql.MySQLFlavor,
+		Host:             host,
+		Port:             uint16(port),
+		User:             l.config.User,
+		Password:         l.config.Passwd,
+		DisableRetrySync: true,
+	})
+	defer syncer.Close()
+	streamer, err := syncer.StartSync(gomysql.Position{Name: l.file, Pos: l.pos})
+	if err != nil {
+		return fmt.Errorf("failed to start binlog sync: %w", err)
+	}
+	slog.Info("binlog listener started", slog.String("file", l.file), slog.Int("pos", int(l.pos)))
+
+	for {
+		event, err := streamer.GetEvent(context.Background())
+		if err != nil {
+			return fmt.Errorf("failed to read binlog event: %w", err)
+		}
+
+		switch e := event.Event.(type) {
+		case *replication.RotateEvent:
+			// ヘッダーの位置は前のファイルのものなので使わない
+			l.file, l.pos = string(e.NextLogName), uint32(e.Position)
+			continue
+		case *replication.RowsEvent:
+			restart := false
+			runBackgroundWork(func() {
+				if binlogRestart.Load() {
+					restart = true
+					return
+				}
+				l.handle(event.Header.EventType, e)
+			})
+			if restart {
+				return nil
+			}
+		}
+
+		// FORMAT_DESCRIPTION_EVENTなど位置を持たないイベントは0
+		if event.Header.LogPos != 0 {
+			l.pos = event.Header.LogPos
+		}
+	}
+}
+
+func currentBinlogPosition() (string, uint32, error) {
+	// 8.4でSHOW MASTER STATUSは無くなった
+	var errs []error
+	for _, query := range []string{"SHOW BINARY LOG STATUS", "SHOW MASTER STATUS"} {
+		row := db.QueryRowx(query)
+		values, err := row.SliceScan()
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if len(values) < 2 {
+			return "", 0, fmt.Errorf("unexpected result of %s", query)
+		}
+		pos, err := strconv.ParseUint(binlogStatusString(values[1]), 10, 32)
+		if err != nil {
+			return "", 0, fmt.Errorf("invalid binlog position: %w", err)
+		}
+		return binlogStatusString(values[0]), uint32(pos), nil
+	}
+
+	return "", 0, fmt.Errorf("failed to get binlog position: %w", errors.Join(errs...))
+}
+
+func binlogStatusString(v any) string {
+	switch v := v.(type) {
+	case []byte:
+		return string(v)
+	case string:
+		return v
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// loadKeyPositions resolves the positions of the key columns, since rows events carry no column names.
+func (l *binlogListener) loadKeyPositions() error {
+	l.columns = map[string]int{}
+	l.keyPositions = map[string][]int{}
+	for table, keys := range binlogWatchedTables {
+		var columns []string
+		if err := db.Select(&columns, "SELECT COLUMN_NAME FROM information_schema.COLUMNS WHERE TABLE_SCHEMA = ? AND TABLE_NAME = ? ORDER BY ORDINAL_POSITION", l.config.DBName, table); err != nil {
+			return fmt.Errorf("failed to select columns of %s: %w", table, err)
+		}
+		positions := make([]int, len(keys))
+		for i, key := range keys {
+			positions[i] = slices.Index(columns, key)
+			if positions[i] < 0 {
+				return fmt.Errorf("column %s.%s not found", table, key)
+			}
+		}
+		l.columns[table] = len(columns)
+		l.keyPositions[table] = positions
+	}
+
+	return nil
+}
+
+// handle reloads the cache entries of the rows changed by a rows event.
+// 更新は変更前と変更後の行が交互に並ぶ。
+func (l *binlogListener) handle(eventType replication.EventType, rows *replication.RowsEvent) {
+	table := string(rows.Table.Table)
+	if string(rows.Table.Schema) != l.config.DBName {
+		return
+	}
+	positions, ok := l.keyPositions[table]
+	if !ok {
+		return
+	}
+	if int(rows.ColumnCount) != l.columns[table] {
+		// 列が変わった
+		if err := l.loadKeyPositions(); err != nil {
+			slog.Error("failed to reload binlog key columns", slog.String("table", table), slog.String("error", err.Error()))
+			return
+		}
+		positions = l.keyPositions[table]
+	}
+
+	update := isBinlogUpdate(eventType)
+	for i, row := range rows.Rows {
+		// 更新は変更後の行だけを見る。キーの列が書き換わることは無い
+		if update && i%2 == 0 {
+			continue
+		}
+		keys := make([]string, len(positions))
+		for j, p := range positions {
+			if p < len(row) {
+				keys[j], _ = row[p].(string)
+			}
+		}
+		if err := reloadBinlogRow(table, keys, isBinlogWrite(eventType)); err != nil {
+			slog.Error("failed to reload cache from binlog",
+				slog.String("table", table),
+				slog.Any("keys", keys),
+				slog.String("error", err.Error()),
+			)
+			continue
+		}
+		binlogInvalidationCounter.WithLabelValues(table).Inc()
+	}
+}
+
+func isBinlogUpdate(eventType replication.EventType) bool {
+	switch eventType {
+	case replication.UPDATE_ROWS_EVENTv0, replication.UPDATE_ROWS_EVENTv1, replication.UPDATE_ROWS_EVENTv2, replication.PARTIAL_UPDATE_ROWS_EVENT:
+		return true
+	}
+	return false
+}
+
+func isBinlogWrite(eventType replication.EventType) bool {
+	switch eventType {
+	case replication.WRITE_ROWS_EVENTv0, replication.WRITE_ROWS_EVENTv1, replication.WRITE_ROWS_EVENTv2:
+		return true
+	}
+	return false
+}
+
+func reloadBinlogRow(table string, keys []string, inserted bool) error {
+	switch table {
+	case "users":
+		return reloadUser(keys[0])
+	case "owners":
+		return reloadOwner(keys[0])
+	case "chairs":
+		return reloadChair(keys[0])
+	case "coupons":
+		return reloadCoupon(keys[0], keys[1], inserted)
+	}
+	return nil
+}
+
+func reloadUser(userID string) error {
+	if old, ok := userByIDCache.Load(userID); ok {
+		accessTokenCache.Forget(old.AccessToken)
+	}
+
+	user := &User{}
+	if err := db.Get(user, "SELECT "+userColumns+" FROM users WHERE id = ?", userID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			userByIDCache.Forget(userID)
+			return nil
+		}
+		return err
+	}
+	userByIDCache.Store(userID, user)
+
+	return nil
+}
+
+func reloadOwner(ownerID string) error {
+	if old, ok := ownerByIDCache.Load(ownerID); ok && ownerCache != nil {
+		ownerCache.Forget(old.AccessToken)
+	}
+
+	owner := &Owner{}
+	if err := db.Get(owner, "SELECT "+ownerColumns+" FROM owners WHERE id = ?", ownerID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			ownerByIDCache.Forget(ownerID)
+			return nil
+		}
+		return err
+	}
+	ownerByIDCache.Store(ownerID, owner)
+
+	return nil
+}
+
+func reloadChair(chairID string) error {
+	if old, ok := chairCache.Load(chairID); ok {
+		chairAccessTokenCache.Forget(old.AccessToken)
+	}
+
+	chair := &Chair{}
+	if err := db.Get(chair, "SELECT "+chairColumns+" FROM chairs WHERE id = ?", chairID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			chairCache.Forget(chairID)
+			return nil
+		}
+		return err
+	}
+	chairCache.Store(chairID, chair)
+
+	return nil
+}
+
+// reloadCoupon syncs one coupon in unusedCouponsCache with MySQL.
+// 未使用のクーポンがキャッシュに無いときは、新しく付与されたときだけ足す。
+// アプリが使ってused_byを書き込む前のクーポンを戻さないため。
+func reloadCoupon(userID string, code string, inserted bool) error {
+	coupon := Coupon{}
+	err := db.Get(&coupon, "SELECT "+couponColumns+" FROM coupons WHERE user_id = ? AND code = ?", userID, code)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	unused := err == nil && coupon.UsedBy == nil
+
+	unusedCouponsCache.Update(userID, func(coupons []Coupon) ([]Coupon, bool) {
+		i := slices.IndexFunc(coupons, func(c Coupon) bool { return c.Code == code })
+		switch {
+		case i >= 0 && unused:
+			updated := slices.Clone(coupons)
+			updated[i] = coupon
+			return updated, true
+		case i >= 0:
+			return append(coupons[:i:i], coupons[i+1:]...), true
+		case unused && inserted:
+			return append(coupons, coupon), true
+		default:
+			return coupons, false
+		}
+	})
+
+	return nil
+}
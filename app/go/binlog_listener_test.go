@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-mysql-org/go-mysql/replication"
+	"github.com/go-sql-driver/mysql"
+)
+
+func TestBinlogListenerHandle(t *testing.T) {
+	testDB := openTestDB(t)
+	t.Cleanup(resetAll)
+
+	now := time.Now().Truncate(time.Second)
+	testDB.MustExec("INSERT INTO users (id, username, firstname, lastname, date_of_birth, access_token, invitation_code, created_at, updated_at) VALUES ('updated', 'new-name', 'first', 'last', '2000-01-01', 'token', 'code', ?, ?)", now, now)
+	userByIDCache.Store("updated", &User{ID: "updated", Username: "old-name"})
+	userByIDCache.Store("deleted", &User{ID: "deleted", Username: "deleted"})
+	userByIDCache.Store("other-schema", &User{ID: "other-schema", Username: "stale"})
+
+	l := &binlogListener{
+		config:       &mysql.Config{DBName: "isuride"},
+		columns:      map[string]int{"users": 2},
+		keyPositions: map[string][]int{"users": {0}},
+	}
+	rowsEvent := func(schema string, rows ...[]any) *replication.RowsEvent {
+		return &replication.RowsEvent{
+			Table:       &replication.TableMapEvent{Schema: []byte(schema), Table: []byte("users")},
+			ColumnCount: 2,
+			Rows:        rows,
+		}
+	}
+
+	// 更新は変更後の行のキーで読み直す
+	l.handle(replication.UPDATE_ROWS_EVENTv2, rowsEvent("isuride", []any{"before", "old-name"}, []any{"updated", "new-name"}))
+	if user, ok := userByIDCache.Load("updated"); !ok || user.Username != "new-name" {
+		t.Errorf("updated user = %+v, want it reloaded from the database", user)
+	}
+
+	l.handle(replication.DELETE_ROWS_EVENTv2, rowsEvent("isuride", []any{"deleted", "deleted"}))
+	if user, ok := userByIDCache.Load("deleted"); ok {
+		t.Errorf("deleted user = %+v, want it removed from the cache", user)
+	}
+
+	l.handle(replication.DELETE_ROWS_EVENTv2, rowsEvent("other", []any{"other-schema", "stale"}))
+	if user, ok := userByIDCache.Load("other-schema"); !ok || user.Username != "stale" {
+		t.Errorf("user of another schema = %+v, want it left alone", user)
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/oklog/ulid/v2"
+)
+
+// 登録時に付与するクーポンの額と招待コードの使用回数の上限はcampaignsのうち適用中のものに従う
+// 登録の途中で切り替わっても額が混ざらないよう、登録ごとに最初に一度だけ読む。
+// 切り替えはこのインスタンスのメモリにしか反映しないので、複数台構成では全台で/api/internal/campaigns/{id}/activateを叩く。
+var activeCampaign atomic.Pointer[Campaign]
+
+// defaultCampaign is used until a campaign is loaded from MySQL.
+var defaultCampaign = &Campaign{
+	ID:                "default",
+	Name:              "default",
+	NewUserDiscount:   3000,
+	InviteeDiscount:   1500,
+	InviterDiscount:   1000,
+	MaxInvitationUses: 3,
+	IsActive:          true,
+}
+
+func init() {
+	activeCampaign.Store(defaultCampaign)
+	registerReset(func() {
+		activeCampaign.Store(defaultCampaign)
+	})
+}
+
+func currentCampaign() *Campaign {
+	return activeCampaign.Load()
+}
+
+func initCampaign() error {
+	campaign := &Campaign{}
+	if err := db.Get(campaign, "SELECT "+campaignColumns+" FROM campaigns WHERE is_active = TRUE LIMIT 1"); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		return fmt.Errorf("failed to get active campaign: %w", err)
+	}
+	activeCampaign.Store(campaign)
+
+	return nil
+}
+
+type internalCampaign struct {
+	ID                string `json:"id"`
+	Name              string `json:"name"`
+	NewUserDiscount   int    `json:"new_user_discount"`
+	InviteeDiscount   int    `json:"invitee_discount"`
+	InviterDiscount   int    `json:"inviter_discount"`
+	MaxInvitationUses int    `json:"max_invitation_uses"`
+	Active            bool   `json:"active"`
+	CreatedAt         int64  `json:"created_at"`
+}
+
+func newInternalCampaign(campaign *Campaign) internalCampaign {
+	return internalCampaign{
+		ID:                campaign.ID,
+		Name:              campaign.Name,
+		NewUserDiscount:   campaign.NewUserDiscount,
+		InviteeDiscount:   campaign.InviteeDiscount,
+		InviterDiscount:   campaign.InviterDiscount,
+		MaxInvitationUses: campaign.MaxInvitationUses,
+		Active:            campaign.IsActive,
+		CreatedAt:         campaign.CreatedAt.UnixMilli(),
+	}
+}
+
+type internalPostCampaignsRequest struct {
+	Name              string `json:"name"`
+	NewUserDiscount   int    `json:"new_user_discount"`
+	InviteeDiscount   int    `json:"invitee_discount"`
+	InviterDiscount   int    `json:"inviter_discount"`
+	MaxInvitationUses int    `json:"max_invitation_uses"`
+}
+
+func (req *internalPostCampaignsRequest) Validate() error {
+	v := validation{}
+	v.required("name", req.Name)
+	v.between("new_user_discount", req.NewUserDiscount, 0, 100000)
+	v.between("invitee_discount", req.InviteeDiscount, 0, 100000)
+	v.between("inviter_discount", req.InviterDiscount, 0, 100000)
+	v.between("max_invitation_uses", req.MaxInvitationUses, 0, 1000)
+	return v.err("invalid campaign")
+}
+
+func (s *Server) internalGetCampaigns(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	var campaigns []Campaign
+	if err := s.db.SelectContext(ctx, &campaigns, "SELECT "+campaignColumns+" FROM campaigns ORDER BY created_at"); err != nil {
+		writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	res := make([]internalCampaign, 0, len(campaigns))
+	for i := range campaigns {
+		res = append(res, newInternalCampaign(&campaigns[i]))
+	}
+
+	writeJSON(w, http.StatusOK, res)
+}
+
+func (s *Server) internalPostCampaigns(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	req := &internalPostCampaignsRequest{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	campaign := &Campaign{
+		ID:                ulid.Make().String(),
+		Name:              req.Name,
+		NewUserDiscount:   req.NewUserDiscount,
+		InviteeDiscount:   req.InviteeDiscount,
+		InviterDiscount:   req.InviterDiscount,
+		MaxInvitationUses: req.MaxInvitationUses,
+		CreatedAt:         s.clock.Now(),
+	}
+	if _, err := s.db.NamedExecContext(ctx, "INSERT INTO campaigns ("+campaignColumns+") VALUES (:id, :name, :new_user_discount, :invitee_discount, :inviter_discount, :max_invitation_uses, :is_active, :created_at)", campaign); err != nil {
+		writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, newInternalCampaign(campaign))
+}
+
+// POST /api/internal/campaigns/{campaign_id}/activate
+func (s *Server) internalPostCampaignActivate(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	campaignID := r.PathValue("campaign_id")
+
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	campaign := &Campaign{}
+	if err := tx.GetContext(ctx, campaign, "SELECT "+campaignColumns+" FROM campaigns WHERE id = ? FOR UPDATE", campaignID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, r, http.StatusNotFound, newAppError(http.StatusNotFound, "campaign_not_found", "campaign not found"))
+			return
+		}
+		writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE campaigns SET is_active = (id = ?)", campaignID); err != nil {
+		writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	campaign.IsActive = true
+	activeCampaign.Store(campaign)
+
+	writeJSON(w, http.StatusOK, newInternalCampaign(campaign))
+}
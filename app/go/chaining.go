@@ -0,0 +1,149 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// ライドの数珠つなぎ
+// 客を乗せて移動中(CARRYING以降)の椅子のうち、目的地が待っているライドの配車位置に近いものを仮に割り当てておき、
+// その椅子が空いた瞬間に次のライドとしてマッチングさせる。空き椅子で割り当てられなかったライドだけが対象。
+// ISUCON_RIDE_CHAINING=1のときだけ有効で、マッチングをmatcherに分けているときは使わない。
+const (
+	// 目的地と配車位置のマンハッタン距離がこれ以下なら仮割り当ての候補にする
+	chainMaxDistance = 30
+	// 仮割り当てしたまま椅子が空かなければキューに戻す
+	chainTimeout = 10 * time.Second
+)
+
+var rideChainingEnabled = os.Getenv("ISUCON_RIDE_CHAINING") == "1"
+
+type carryingChair struct {
+	chair *Chair
+	ride  *Ride
+}
+
+type chainedRide struct {
+	ride       *Ride
+	assignedAt time.Time
+}
+
+var (
+	chainLock sync.Mutex
+	// chair ID -> 乗車中のライド
+	carryingChairs = map[string]*carryingChair{}
+	// chair ID -> 空いたら割り当てるライド
+	chainedRides = map[string]*chainedRide{}
+)
+
+func init() {
+	registerReset(func() {
+		chainLock.Lock()
+		defer chainLock.Unlock()
+
+		carryingChairs = map[string]*carryingChair{}
+		chainedRides = map[string]*chainedRide{}
+	})
+}
+
+func isRideChainingEnabled() bool {
+	return rideChainingEnabled && instanceRoles().has(roleBitWeb|roleBitMatcher)
+}
+
+// markChairCarrying records that chair is carrying ride until it becomes empty again.
+func markChairCarrying(chair *Chair, ride *Ride) {
+	if !isRideChainingEnabled() {
+		return
+	}
+
+	chainLock.Lock()
+	defer chainLock.Unlock()
+
+	carryingChairs[chair.ID] = &carryingChair{chair: chair, ride: ride}
+}
+
+// takeChainedRide is called when chair becomes empty and returns the ride pre-assigned to it.
+func takeChainedRide(chairID string) (*Ride, bool) {
+	if !isRideChainingEnabled() {
+		return nil, false
+	}
+
+	chainLock.Lock()
+	defer chainLock.Unlock()
+
+	delete(carryingChairs, chairID)
+	chained, ok := chainedRides[chairID]
+	if !ok {
+		return nil, false
+	}
+	delete(chainedRides, chairID)
+
+	return chained.ride, true
+}
+
+// chainRides pre-assigns rides to carrying chairs finishing near their pickup and returns the chained rides.
+func chainRides(rides []*Ride, now time.Time) map[string]struct{} {
+	chained := map[string]struct{}{}
+	if !isRideChainingEnabled() || len(rides) == 0 {
+		return chained
+	}
+
+	chainLock.Lock()
+	defer chainLock.Unlock()
+
+	for _, ride := range rides {
+		var (
+			best         *carryingChair
+			bestDistance int
+		)
+		for chairID, carrying := range carryingChairs {
+			if _, ok := chainedRides[chairID]; ok {
+				continue
+			}
+
+			d := calculateDistance(carrying.ride.DestinationLatitude, carrying.ride.DestinationLongitude, ride.PickupLatitude, ride.PickupLongitude)
+			if d > chainMaxDistance {
+				continue
+			}
+			if best == nil || d < bestDistance {
+				best, bestDistance = carrying, d
+			}
+		}
+		if best == nil {
+			continue
+		}
+
+		chainedRides[best.chair.ID] = &chainedRide{ride: ride, assignedAt: now}
+		chained[ride.ID] = struct{}{}
+		matcherLogger.Debug("ride chained",
+			slog.String("ride_id", ride.ID),
+			slog.String("chair_id", best.chair.ID),
+			slog.Int("distance", bestDistance),
+		)
+	}
+
+	return chained
+}
+
+// releaseStaleChains returns rides whose chair did not become empty within chainTimeout.
+func releaseStaleChains(now time.Time) []*Ride {
+	if !isRideChainingEnabled() {
+		return nil
+	}
+
+	chainLock.Lock()
+	defer chainLock.Unlock()
+
+	var rides []*Ride
+	for chairID, chained := range chainedRides {
+		if now.Sub(chained.assignedAt) < chainTimeout {
+			continue
+		}
+		delete(chainedRides, chairID)
+		rides = append(rides, chained.ride)
+	}
+
+	return rides
+}
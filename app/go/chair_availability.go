@@ -0,0 +1,115 @@
+package main
+
+import (
+	"sync"
+)
+
+// 「今この椅子は空いているか」の唯一の情報源
+// 空いている = アクティブで、完了していないライドを持っていない。
+// 変更するのは完了処理(CompleteRide)、椅子のアクティビティ(chairPostActivity)、マッチング(applyMatch)だけ。
+// 近くの椅子の一覧とマッチングはどちらもここを見る。
+
+var (
+	availableChairs     = map[string]struct{}{}
+	availableChairsLock sync.RWMutex
+)
+
+func init() {
+	registerReset(func() {
+		availableChairsLock.Lock()
+		defer availableChairsLock.Unlock()
+
+		availableChairs = map[string]struct{}{}
+	})
+}
+
+func initChairAvailability() error {
+	chairs := map[string]struct{}{}
+	chairCache.Range(func(chairID string, chair *Chair) bool {
+		if chair.IsActive {
+			chairs[chairID] = struct{}{}
+		}
+		return true
+	})
+
+	// rideCacheは作成順ではないので、椅子ごとに一番新しいライドを探す
+	latest := map[string]*Ride{}
+	rideCache.Range(func(_ string, ride *Ride) bool {
+		if !ride.ChairID.Valid {
+			return true
+		}
+		if current, ok := latest[ride.ChairID.String]; !ok || current.CreatedAt.Before(ride.CreatedAt) {
+			latest[ride.ChairID.String] = ride
+		}
+		return true
+	})
+	for chairID, ride := range latest {
+		if status, ok := rideStatusesCache.Load(ride.ID); !ok || !rideFinished(status.Status) {
+			delete(chairs, chairID)
+		}
+	}
+
+	availableChairsLock.Lock()
+	defer availableChairsLock.Unlock()
+
+	availableChairs = chairs
+	return nil
+}
+
+func isChairAvailable(chairID string) bool {
+	availableChairsLock.RLock()
+	defer availableChairsLock.RUnlock()
+
+	_, ok := availableChairs[chairID]
+	return ok
+}
+
+func availableChairCount() int {
+	availableChairsLock.RLock()
+	defer availableChairsLock.RUnlock()
+
+	return len(availableChairs)
+}
+
+func markChairAvailable(chairID string) {
+	availableChairsLock.Lock()
+	defer availableChairsLock.Unlock()
+
+	availableChairs[chairID] = struct{}{}
+}
+
+func markChairBusy(chairID string) {
+	availableChairsLock.Lock()
+	defer availableChairsLock.Unlock()
+
+	delete(availableChairs, chairID)
+}
+
+// chairHasUnfinishedRide reports whether the latest ride of chairID has not finished yet.
+func chairHasUnfinishedRide(chairID string) bool {
+	ride, ok := latestRideCache.Load(chairID)
+	if !ok {
+		return false
+	}
+	status, ok := rideStatusesCache.Load(ride.ID)
+	return !ok || !rideFinished(status.Status)
+}
+
+// updateChairAvailabilityForActivity is called when chairID is activated or deactivated.
+func updateChairAvailabilityForActivity(chairID string, active bool) {
+	if active && !chairHasUnfinishedRide(chairID) {
+		markChairAvailable(chairID)
+		return
+	}
+	markChairBusy(chairID)
+}
+
+// releaseChairAvailability is called when the ride of chairID has been completed.
+// 完了までの間に非アクティブにされた椅子は空きに戻さない。
+func releaseChairAvailability(chairID string) {
+	chair, ok := chairCache.Load(chairID)
+	if ok && !chair.IsActive {
+		return
+	}
+	markChairAvailable(chairID)
+}
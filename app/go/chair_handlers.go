@@ -1,11 +1,13 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"database/sql"
 	"errors"
-	"fmt"
 	"net/http"
-	"strings"
+	"strconv"
+	"sync"
 	"time"
 
 	"golang.org/x/sync/errgroup"
@@ -26,22 +28,31 @@ type chairPostChairsResponse struct {
 	OwnerID string `json:"owner_id"`
 }
 
-func chairPostChairs(w http.ResponseWriter, r *http.Request) {
+func (s *Server) chairPostChairs(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	req := &chairPostChairsRequest{}
 	if err := bindJSON(r, req); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, err)
 		return
 	}
-	if req.Name == "" || req.Model == "" || req.ChairRegisterToken == "" {
-		writeError(w, r, http.StatusBadRequest, errors.New("some of required fields(name, model, chair_register_token) are empty"))
+
+	owner := &Owner{}
+	if err := s.db.GetContext(ctx, owner, "SELECT "+ownerColumns+" FROM owners WHERE chair_register_token = ?", hashToken(req.ChairRegisterToken)); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, r, http.StatusUnauthorized, unauthorized("invalid chair_register_token"))
+			return
+		}
+		writeError(w, r, http.StatusInternalServerError, err)
 		return
 	}
 
-	owner := &Owner{}
-	if err := db.GetContext(ctx, owner, "SELECT * FROM owners WHERE chair_register_token = ?", req.ChairRegisterToken); err != nil {
+	// マッチングで毎回モデルを引かなくて済むよう、登録時に速度を決めて椅子に持たせる
+	var speed int
+	if err := s.db.GetContext(ctx, &speed, "SELECT speed FROM chair_models WHERE name = ?", req.Model); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			writeError(w, r, http.StatusUnauthorized, errors.New("invalid chair_register_token"))
+			appErr := badRequest("unknown chair model")
+			appErr.Fields = map[string]string{"model": "unknown"}
+			writeError(w, r, http.StatusBadRequest, appErr)
 			return
 		}
 		writeError(w, r, http.StatusInternalServerError, err)
@@ -50,24 +61,41 @@ func chairPostChairs(w http.ResponseWriter, r *http.Request) {
 
 	chairID := ulid.Make().String()
 	accessToken := secureRandomStr(32)
+	now := s.clock.Now().Truncate(time.Microsecond)
 
-	_, err := db.ExecContext(
+	_, err := s.db.ExecContext(
 		ctx,
-		"INSERT INTO chairs (id, owner_id, name, model, is_active, access_token) VALUES (?, ?, ?, ?, ?, ?)",
-		chairID, owner.ID, req.Name, req.Model, false, accessToken,
+		"INSERT INTO chairs (id, owner_id, name, model, speed, is_active, access_token, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		chairID, owner.ID, req.Name, req.Model, speed, false, hashToken(accessToken), now, now,
 	)
 	if err != nil {
 		writeError(w, r, http.StatusInternalServerError, err)
 		return
 	}
 
+	chairCache.Store(chairID, &Chair{
+		ID:          chairID,
+		OwnerID:     owner.ID,
+		Name:        req.Name,
+		Model:       req.Model,
+		Speed:       speed,
+		IsActive:    false,
+		AccessToken: hashToken(accessToken),
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	})
+
+	indexOwnerChair(owner.ID, chairID)
+
 	http.SetCookie(w, &http.Cookie{
 		Path:  "/",
 		Name:  "chair_session",
 		Value: accessToken,
 	})
 
-	chairStatusGauge.WithLabelValues("REGISTERED").Inc()
+	recordChairRegistration()
+	// 売上の一覧に売上0の椅子として増える
+	invalidateOwnerSales(owner.ID)
 
 	writeJSON(w, http.StatusCreated, &chairPostChairsResponse{
 		ID:      chairID,
@@ -79,21 +107,22 @@ type postChairActivityRequest struct {
 	IsActive bool `json:"is_active"`
 }
 
-func chairPostActivity(w http.ResponseWriter, r *http.Request) {
+func (s *Server) chairPostActivity(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	chair := ctx.Value("chair").(*Chair)
 
 	req := &postChairActivityRequest{}
 	if err := bindJSON(r, req); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, err)
 		return
 	}
 
-	_, err := db.ExecContext(ctx, "UPDATE chairs SET is_active = ? WHERE id = ?", req.IsActive, chair.ID)
-	if err != nil {
+	if err := s.chairRepository.SetActive(ctx, chair.ID, req.IsActive); err != nil {
 		writeError(w, r, http.StatusInternalServerError, err)
 		return
 	}
+	notifyChairActivity(chair, req.IsActive, s.clock.Now())
+	updateChairAvailabilityForActivity(chair.ID, req.IsActive)
 
 	func() {
 		if req.IsActive {
@@ -104,7 +133,7 @@ func chairPostActivity(w http.ResponseWriter, r *http.Request) {
 			}
 
 			if !ok {
-				if err := updateChairStatusToBadger(chair.ID, &chairStatus{
+				if err := setChairStatus(chair.ID, &chairStatus{
 					status: chairStatusAvailable,
 					rideID: ulid.Make().String(),
 				}); err != nil {
@@ -114,27 +143,15 @@ func chairPostActivity(w http.ResponseWriter, r *http.Request) {
 			}
 
 			if status.status == chairStatusAvailable {
-				emptyChairsLocker.Lock()
-				defer emptyChairsLocker.Unlock()
-
-				emptyChairs = append(emptyChairs, chair)
+				enqueueEmptyChair(chair)
 			}
 		} else {
-			emptyChairsLocker.Lock()
-			defer emptyChairsLocker.Unlock()
-
-			for i, c := range emptyChairs {
-				if c.ID == chair.ID {
-					emptyChairs = append(emptyChairs[:i], emptyChairs[i+1:]...)
-					break
-				}
-			}
+			removeEmptyChair(chair.ID)
 		}
 	}()
 
 	if req.IsActive {
-		chairStatusGauge.WithLabelValues("REGISTERED").Dec()
-		chairStatusGauge.WithLabelValues("COMPLETED").Inc()
+		recordChairActivation(chair.ID)
 	}
 
 	w.WriteHeader(http.StatusNoContent)
@@ -147,11 +164,71 @@ type chairPostCoordinateRequest struct {
 
 var latestRideCache = isucache.NewAtomicMap[string, *Ride]("latestRideCache")
 
+func init() {
+	registerReset(latestRideCache.Purge)
+}
+
+var chairCache = isucache.NewAtomicMap[string, *Chair]("chairCache")
+
+func init() {
+	registerReset(chairCache.Purge)
+}
+
+func initChairCache() error {
+	chairs := []Chair{}
+	if err := db.Select(&chairs, "SELECT "+chairColumns+" FROM chairs"); err != nil {
+		return err
+	}
+
+	for _, chair := range chairs {
+		chairCache.Store(chair.ID, &chair)
+		indexOwnerChair(chair.OwnerID, chair.ID)
+	}
+
+	return nil
+}
+
+func getChairByID(ctx context.Context, chairID string) (*Chair, error) {
+	if chair, ok := chairCache.Load(chairID); ok {
+		return chair, nil
+	}
+
+	chair := &Chair{}
+	if err := db.GetContext(ctx, chair, "SELECT "+chairColumns+" FROM chairs WHERE id = ?", chairID); err != nil {
+		return nil, err
+	}
+	chairCache.Store(chairID, chair)
+
+	return chair, nil
+}
+
+// chairPostCoordinateResponse documents the response written by writeChairPostCoordinateResponse.
 type chairPostCoordinateResponse struct {
 	RecordedAt int64 `json:"recorded_at"`
 }
 
-func chairPostCoordinate(w http.ResponseWriter, r *http.Request) {
+// 座標の送信は一番多いリクエストなので、レスポンスは固定長のバッファをプールして組み立てる
+// {"recorded_at":<int64>} は最長でも36バイト
+var chairPostCoordinateResponsePool = sync.Pool{
+	New: func() any {
+		return new([40]byte)
+	},
+}
+
+func writeChairPostCoordinateResponse(w http.ResponseWriter, recordedAt time.Time) {
+	b := chairPostCoordinateResponsePool.Get().(*[40]byte)
+	defer chairPostCoordinateResponsePool.Put(b)
+
+	res := append(b[:0], `{"recorded_at":`...)
+	res = strconv.AppendInt(res, recordedAt.UnixMilli(), 10)
+	res = append(res, '}')
+
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write(res)
+}
+
+func (s *Server) chairPostCoordinate(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	req := &Coordinate{}
 	if err := bindJSON(r, req); err != nil {
@@ -161,63 +238,85 @@ func chairPostCoordinate(w http.ResponseWriter, r *http.Request) {
 
 	chair := ctx.Value("chair").(*Chair)
 
-	now := time.Now()
+	now := s.clock.Now()
+
+	var beforeStatus string
+	ride, ok := latestRideCache.Load(chair.ID)
+	if ok {
+		status, err := getLatestRideStatus(ctx, s.db, ride.ID)
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		beforeStatus = status
+	}
+
+	// 大半を占める走行中でない椅子は位置を書くだけなので、errgroupを使わずにそのまま返す
+	if !ok || beforeStatus == "COMPLETED" || beforeStatus == "CANCELED" {
+		_, end := startSpan(ctx, "badger.updateChairLocation")
+		err := updateChairLocationToBadger(chair.ID, req)
+		end()
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+
+		observeChairCoordinate(chair, false, req, now)
+		writeChairPostCoordinateResponse(w, now)
+		return
+	}
 
 	eg := errgroup.Group{}
 
 	eg.Go(func() error {
+		_, end := startSpan(ctx, "badger.updateChairLocation")
+		defer end()
+
 		return updateChairLocationToBadger(chair.ID, req)
 	})
 
-	var newStatus *RideStatus
 	var (
-		ride *Ride
-		ok   bool
+		newStatus  *RideStatus
+		chairState byte
 	)
-	if ride, ok = latestRideCache.Load(chair.ID); ok {
-		status, err := getLatestRideStatus(ctx, db, ride.ID)
-		if err != nil {
-			writeError(w, r, http.StatusInternalServerError, err)
-			return
+	if req.Latitude == ride.PickupLatitude && req.Longitude == ride.PickupLongitude && beforeStatus == "ENROUTE" {
+		newStatus = &RideStatus{
+			Status: "PICKUP",
 		}
-		if status != "COMPLETED" && status != "CANCELED" {
-			if req.Latitude == ride.PickupLatitude && req.Longitude == ride.PickupLongitude && status == "ENROUTE" {
-				if err := updateChairStatusToBadger(chair.ID, &chairStatus{
-					status: chairStatusPickup,
-					rideID: ride.ID,
-				}); err != nil {
-					writeError(w, r, http.StatusInternalServerError, err)
-					return
-				}
+		chairState = chairStatusPickup
+	}
 
-				newStatus = &RideStatus{
-					Status: "PICKUP",
-				}
-			}
+	if req.Latitude == ride.DestinationLatitude && req.Longitude == ride.DestinationLongitude && beforeStatus == "CARRYING" {
+		newStatus = &RideStatus{
+			Status: "ARRIVED",
+		}
+		chairState = chairStatusArrived
+	}
 
-			if req.Latitude == ride.DestinationLatitude && req.Longitude == ride.DestinationLongitude && status == "CARRYING" {
-				if err := updateChairStatusToBadger(chair.ID, &chairStatus{
-					status: chairStatusArrived,
-					rideID: ride.ID,
-				}); err != nil {
-					writeError(w, r, http.StatusInternalServerError, err)
-					return
-				}
+	observeChairCoordinate(chair, beforeStatus == "ENROUTE" || beforeStatus == "CARRYING", req, now)
+	if beforeStatus == "CARRYING" {
+		recordRideTravelCoordinate(ride.ID, req)
+	}
 
-				newStatus = &RideStatus{
-					Status: "ARRIVED",
-				}
-			}
+	if newStatus != nil {
+		// 読んでから状態が変わっていたら遷移させない
+		_, ok, err := transitionChairRide(chair.ID, ride.ID, []string{beforeStatus}, chairState, newStatus.Status, now)
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		if !ok {
+			newStatus = nil
 		}
 	}
 
 	if newStatus != nil {
-		rideStatusesCache.Store(ride.ID, newStatus)
-		ChairPublish(chair.ID, &RideEvent{
+		recordAudit(now, chairActor(chair.ID), "ride.status", ride.ID, chair.ID, beforeStatus, newStatus.Status)
+		s.events.ChairPublish(chair.ID, &RideEvent{
 			status: newStatus.Status,
 			ride:   ride,
 		})
-		UserPublish(ride.UserID, &RideEvent{
+		s.events.UserPublish(ride.UserID, &RideEvent{
 			status: newStatus.Status,
 			ride:   ride,
 		})
@@ -228,15 +327,7 @@ func chairPostCoordinate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json;charset=utf-8")
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(`{"recorded_at":`))
-	w.Write([]byte(fmt.Sprint(now.UnixMilli())))
-	w.Write([]byte("}"))
-}
-
-func distance(lat1, lon1, lat2, lon2 int) int {
-	return int(abs(lat1-lat2) + abs(lon1-lon2))
+	writeChairPostCoordinateResponse(w, now)
 }
 
 type simpleUser struct {
@@ -255,33 +346,55 @@ type chairGetNotificationResponseData struct {
 	PickupCoordinate      Coordinate `json:"pickup_coordinate"`
 	DestinationCoordinate Coordinate `json:"destination_coordinate"`
 	Status                string     `json:"status"`
+	// MATCHEDのときだけ。椅子の位置が分からなければ付けない
+	PickupDistance *int   `json:"pickup_distance,omitempty"`
+	PickupETA      *int64 `json:"pickup_eta,omitempty"`
 }
 
-func (nrd *chairGetNotificationResponseData) Encode() string {
-	sb := &strings.Builder{}
-	sb.WriteString(`{"ride_id":"`)
-	sb.WriteString(nrd.RideID)
-	sb.WriteString(`","user":{"id":"`)
-	sb.WriteString(nrd.User.ID)
-	sb.WriteString(`","name":"`)
-	sb.WriteString(nrd.User.Name)
-	sb.WriteString(`"},"pickup_coordinate":{"latitude":`)
-	sb.WriteString(fmt.Sprint(nrd.PickupCoordinate.Latitude))
-	sb.WriteString(`,"longitude":`)
-	sb.WriteString(fmt.Sprint(nrd.PickupCoordinate.Longitude))
-	sb.WriteString(`},"destination_coordinate":{"latitude":`)
-	sb.WriteString(fmt.Sprint(nrd.DestinationCoordinate.Latitude))
-	sb.WriteString(`,"longitude":`)
-	sb.WriteString(fmt.Sprint(nrd.DestinationCoordinate.Longitude))
-	sb.WriteString(`},"status":"`)
-	sb.WriteString(nrd.Status)
-	sb.WriteString(`"}`)
-	return sb.String()
+// setStatus updates the status and drops the fields that are only sent with MATCHED.
+func (nrd *chairGetNotificationResponseData) setStatus(status string) {
+	nrd.Status = status
+	if status != "MATCHED" {
+		nrd.PickupDistance = nil
+		nrd.PickupETA = nil
+	}
+}
+
+func (nrd *chairGetNotificationResponseData) Encode(buf *bytes.Buffer) {
+	nrd.encodeHead(buf)
+	writeJSONString(buf, nrd.Status)
+	nrd.encodeTail(buf)
+}
+
+func (nrd *chairGetNotificationResponseData) encodeHead(buf *bytes.Buffer) {
+	buf.WriteString(`{"ride_id":`)
+	writeJSONString(buf, nrd.RideID)
+	buf.WriteString(`,"user":{"id":`)
+	writeJSONString(buf, nrd.User.ID)
+	buf.WriteString(`,"name":`)
+	writeJSONString(buf, nrd.User.Name)
+	buf.WriteString(`},"pickup_coordinate":`)
+	writeJSONCoordinate(buf, nrd.PickupCoordinate)
+	buf.WriteString(`,"destination_coordinate":`)
+	writeJSONCoordinate(buf, nrd.DestinationCoordinate)
+	buf.WriteString(`,"status":`)
+}
+
+func (nrd *chairGetNotificationResponseData) encodeTail(buf *bytes.Buffer) {
+	if nrd.PickupDistance != nil {
+		buf.WriteString(`,"pickup_distance":`)
+		buf.WriteString(strconv.Itoa(*nrd.PickupDistance))
+	}
+	if nrd.PickupETA != nil {
+		buf.WriteString(`,"pickup_eta":`)
+		buf.WriteString(strconv.FormatInt(*nrd.PickupETA, 10))
+	}
+	buf.WriteByte('}')
 }
 
 var appGetNotificationRes = []byte(`{"retry_after_ms":50}`)
 
-func chairGetNotification(w http.ResponseWriter, r *http.Request) {
+func (s *Server) chairGetNotification(w http.ResponseWriter, r *http.Request) {
 	flusher, ok := w.(http.Flusher)
 	if !ok {
 		writeError(w, r, http.StatusInternalServerError, errors.New("expected http.ResponseWriter to be an http.Flusher"))
@@ -293,7 +406,6 @@ func chairGetNotification(w http.ResponseWriter, r *http.Request) {
 
 	var (
 		status   *RideStatus
-		user     = &User{}
 		response *chairGetNotificationResponseData
 		err      error
 	)
@@ -305,45 +417,37 @@ func chairGetNotification(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	status, err = getLatestRideStatusWithID(ctx, db, ride.ID)
+	status, err = getLatestRideStatusWithID(ctx, s.db, ride.ID)
 	if err != nil {
 		writeError(w, r, http.StatusInternalServerError, err)
 		return
 	}
 
-	user = &User{}
-	err = db.GetContext(ctx, user, "SELECT * FROM users WHERE id = ?", ride.UserID)
+	snapshot, err := chairNotificationSnapshotFor(ctx, chair.ID, ride, status.Status)
 	if err != nil {
 		writeError(w, r, http.StatusInternalServerError, err)
 		return
 	}
-
-	response = &chairGetNotificationResponseData{
-		RideID: ride.ID,
-		User: simpleUser{
-			ID:   user.ID,
-			Name: fmt.Sprintf("%s %s", user.Firstname, user.Lastname),
-		},
-		PickupCoordinate: Coordinate{
-			Latitude:  ride.PickupLatitude,
-			Longitude: ride.PickupLongitude,
-		},
-		DestinationCoordinate: Coordinate{
-			Latitude:  ride.DestinationLatitude,
-			Longitude: ride.DestinationLongitude,
-		},
-		Status: status.Status,
-	}
+	response = &chairGetNotificationResponseData{}
+	*response = snapshot.response
 
 	w.Header().Set("Content-Type", "text/event-stream")
 	w.Header().Set("Cache-Control", "no-cache")
 	w.Header().Set("Connection", "keep-alive")
 	w.Header().Set("X-Accel-Buffering", "no")
 
-	fmt.Fprintf(w, "data: %s\n\n", response.Encode())
+	buf := getBuffer()
+	defer putBuffer(buf)
+
+	closeStream := trackSSEStream("chair")
+	closeReason := sseCloseReasonError
+	defer func() { closeStream(closeReason) }()
+
+	w.Write(snapshot.frame)
 	flusher.Flush()
+	markRideStatusSent(status.RideID, status.Status, rideStatusSentChair, s.clock.Now())
 
-	if err := updateChairStatusToBadger(chair.ID, &chairStatus{
+	if err := setChairStatus(chair.ID, &chairStatus{
 		status: chairStatusAvailable,
 		rideID: ride.ID,
 	}); err != nil {
@@ -351,58 +455,67 @@ func chairGetNotification(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// MATCHED以外はstatusしか変わらない(配車位置までの距離と到着見込みはsetStatusで消える)ので、
+	// エンコード済みのフレームを使い回す
+	var frame *statusFrame
+	order := rideEventOrder{}
 	ch := make(chan *RideEvent, 100)
-	ChairSubscribe(chair.ID, ch)
+	s.events.ChairSubscribe(chair.ID, ch)
+	defer s.events.ChairUnsubscribe(chair.ID, ch)
+	reset := streamsResetCh()
 	for {
 		select {
 		case <-r.Context().Done():
+			closeReason = sseCloseReasonClientDisconnect
+			return
+		case <-reset:
+			closeReason = sseCloseReasonReset
 			return
 		case event := <-ch:
+			if !order.accept(event) {
+				sseDroppedEventsCounter.WithLabelValues("chair").Inc()
+				continue
+			}
+
 			if event.status == "MATCHED" {
 				ride = event.ride
-				status, err = getLatestRideStatusWithID(ctx, db, ride.ID)
+				status, err = getLatestRideStatusWithID(ctx, s.db, ride.ID)
 				if err != nil {
 					writeError(w, r, http.StatusInternalServerError, err)
 					return
 				}
 
-				user := &User{}
-				err = db.GetContext(ctx, user, "SELECT * FROM users WHERE id = ?", ride.UserID)
+				response, err = newChairNotificationResponse(ctx, ride, status.Status)
 				if err != nil {
 					writeError(w, r, http.StatusInternalServerError, err)
 					return
 				}
-
-				response = &chairGetNotificationResponseData{
-					RideID: ride.ID,
-					User: simpleUser{
-						ID:   user.ID,
-						Name: fmt.Sprintf("%s %s", user.Firstname, user.Lastname),
-					},
-					PickupCoordinate: Coordinate{
-						Latitude:  ride.PickupLatitude,
-						Longitude: ride.PickupLongitude,
-					},
-					DestinationCoordinate: Coordinate{
-						Latitude:  ride.DestinationLatitude,
-						Longitude: ride.DestinationLongitude,
-					},
-					Status: status.Status,
-				}
+				frame = nil
 			} else {
-				status, err = getLatestRideStatusWithID(ctx, db, ride.ID)
+				status, err = getLatestRideStatusWithID(ctx, s.db, ride.ID)
 				if err != nil {
 					writeError(w, r, http.StatusInternalServerError, err)
 					return
 				}
 
-				response.Status = status.Status
+				response.setStatus(status.Status)
 			}
 
-			fmt.Fprintf(w, "data: %s\n\n", response.Encode())
+			buf.Reset()
+			if response.Status == "MATCHED" {
+				encodeChairNotificationFrame(buf, response)
+			} else {
+				if frame == nil {
+					frame = newStatusFrame(response)
+				}
+				frame.write(buf, response.Status)
+			}
+			w.Write(buf.Bytes())
 			flusher.Flush()
+			storeChairNotificationSnapshot(chair.ID, response, buf.Bytes())
+			markRideStatusSent(status.RideID, status.Status, rideStatusSentChair, s.clock.Now())
 
-			if err := updateChairStatusToBadger(chair.ID, &chairStatus{
+			if err := setChairStatus(chair.ID, &chairStatus{
 				status: chairStatusAvailable,
 				rideID: ride.ID,
 			}); err != nil {
@@ -410,13 +523,8 @@ func chairGetNotification(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 
-			if status.Status == "COMPLETED" {
-				go func() {
-					emptyChairsLocker.Lock()
-					defer emptyChairsLocker.Unlock()
-
-					emptyChairs = append(emptyChairs, chair)
-				}()
+			if rideFinished(status.Status) {
+				releaseCompletedChair(chair)
 			}
 		}
 	}
@@ -426,7 +534,7 @@ type postChairRidesRideIDStatusRequest struct {
 	Status string `json:"status"`
 }
 
-func chairPostRideStatus(w http.ResponseWriter, r *http.Request) {
+func (s *Server) chairPostRideStatus(w http.ResponseWriter, r *http.Request) {
 	isuhttp.SetPath(r, "/api/chair/rides/{ride_id}/status")
 	ctx := r.Context()
 	rideID := r.PathValue("ride_id")
@@ -439,65 +547,63 @@ func chairPostRideStatus(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	ride := &Ride{}
-	if err := db.GetContext(ctx, ride, "SELECT * FROM rides WHERE id = ? FOR UPDATE", rideID); err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			writeError(w, r, http.StatusNotFound, errors.New("ride not found"))
-			return
-		}
-		writeError(w, r, http.StatusInternalServerError, err)
+	// chair_idはwrite-behindでMySQLに書かれるので、MATCHED直後でも正しいキャッシュから読む
+	ride, ok := s.rides.Load(rideID)
+	if !ok {
+		writeError(w, r, http.StatusNotFound, errRideNotFound)
 		return
 	}
 
 	if ride.ChairID.String != chair.ID {
-		writeError(w, r, http.StatusBadRequest, errors.New("not assigned to this ride"))
+		writeError(w, r, http.StatusBadRequest, badRequest("not assigned to this ride"))
 		return
 	}
 
-	statusID := ulid.Make().String()
+	now := s.clock.Now()
+	var (
+		before string
+		err    error
+	)
 	switch req.Status {
 	// Acknowledge the ride
 	case "ENROUTE":
-		if err := updateChairStatusToBadger(chair.ID, &chairStatus{
-			status: chairStatusEnRoute,
-			rideID: ride.ID,
-		}); err != nil {
+		// MATCHEDはrideStatusesCacheには書かず、椅子が割り当てられたMATCHINGとして持っている
+		var ok bool
+		before, ok, err = transitionChairRide(chair.ID, ride.ID, []string{"MATCHING"}, chairStatusEnRoute, req.Status, now)
+		if err != nil {
 			writeError(w, r, http.StatusInternalServerError, err)
 			return
 		}
+		if !ok {
+			writeError(w, r, http.StatusBadRequest, badRequest("ride is not matched"))
+			return
+		}
 
 	// After Picking up user
 	case "CARRYING":
-		status, err := getLatestRideStatus(ctx, db, ride.ID)
+		var ok bool
+		before, ok, err = transitionChairRide(chair.ID, ride.ID, []string{"PICKUP"}, chairStatusCarrying, req.Status, now)
 		if err != nil {
 			writeError(w, r, http.StatusInternalServerError, err)
 			return
 		}
-		if status != "PICKUP" {
-			writeError(w, r, http.StatusBadRequest, errors.New("chair has not arrived yet"))
-			return
-		}
-		if err := updateChairStatusToBadger(chair.ID, &chairStatus{
-			status: chairStatusCarrying,
-			rideID: ride.ID,
-		}); err != nil {
-			writeError(w, r, http.StatusInternalServerError, err)
+		if !ok {
+			writeError(w, r, http.StatusBadRequest, badRequest("chair has not arrived yet"))
 			return
 		}
+		markChairCarrying(chair, ride)
 	default:
-		writeError(w, r, http.StatusBadRequest, errors.New("invalid status"))
+		writeError(w, r, http.StatusBadRequest, badRequest("invalid status"))
+		return
 	}
 
-	rideStatusesCache.Store(ride.ID, &RideStatus{
-		ID:     statusID,
-		Status: req.Status,
-	})
+	recordAudit(now, chairActor(chair.ID), "ride.status", ride.ID, chair.ID, before, req.Status)
 
-	ChairPublish(chair.ID, &RideEvent{
+	s.events.ChairPublish(chair.ID, &RideEvent{
 		status: req.Status,
 		ride:   ride,
 	})
-	UserPublish(ride.UserID, &RideEvent{
+	s.events.UserPublish(ride.UserID, &RideEvent{
 		status: req.Status,
 		ride:   ride,
 	})
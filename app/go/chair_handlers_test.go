@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestChairPostRideStatusBeforeWriteBehind(t *testing.T) {
+	s := newTestServer(t, nil, nil)
+	openTestBadger(t)
+	openTestDB(t)
+	t.Cleanup(func() { waitRideStatusWrites(t) })
+
+	// chair_idはまだMySQLに書かれておらず、キャッシュにだけある
+	chair := &Chair{ID: "chair", OwnerID: "owner"}
+	ride := &Ride{ID: "ride", UserID: "user", ChairID: sql.NullString{String: chair.ID, Valid: true}, CreatedAt: time.UnixMilli(1733600000000), UpdatedAt: time.UnixMilli(1733600000000)}
+	s.rides.Store(ride.ID, ride)
+	s.rideStatuses.Store(ride.ID, &RideStatus{RideID: ride.ID, Status: "MATCHING"})
+
+	req := httptest.NewRequest(http.MethodPost, "/api/chair/rides/ride/status", strings.NewReader(`{"status":"ENROUTE"}`))
+	req.SetPathValue("ride_id", ride.ID)
+	rec := httptest.NewRecorder()
+	s.chairPostRideStatus(rec, req.WithContext(context.WithValue(req.Context(), "chair", chair)))
+
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusNoContent, rec.Body.String())
+	}
+	if status, _ := s.rideStatuses.Load(ride.ID); status.Status != "ENROUTE" {
+		t.Errorf("status = %s, want ENROUTE", status.Status)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/api/chair/rides/ride/status", strings.NewReader(`{"status":"CARRYING"}`))
+	req.SetPathValue("ride_id", ride.ID)
+	rec = httptest.NewRecorder()
+	s.chairPostRideStatus(rec, req.WithContext(context.WithValue(req.Context(), "chair", &Chair{ID: "other"})))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("status for another chair = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	isucache "github.com/mazrean/isucon-go-tools/v2/cache"
+)
+
+// 椅子の通知ストリームの最初のイベントをエンコード済みのまま椅子ごとに持っておく。
+// デプロイ直後は全椅子が一斉に再接続してくるので、そのときにユーザーの取得とエンコードをやり直さないようにする。
+// イベントバスに椅子のイベントが流れたら捨てる。
+
+type chairNotificationSnapshot struct {
+	response chairGetNotificationResponseData
+	// "data: ...\n\n" まで含めたSSEのイベント
+	frame []byte
+}
+
+var chairNotificationSnapshots = isucache.NewAtomicMap[string, *chairNotificationSnapshot]("chairNotificationSnapshots")
+
+func init() {
+	registerReset(chairNotificationSnapshots.Purge)
+}
+
+func newChairNotificationResponse(ctx context.Context, ride *Ride, status string) (*chairGetNotificationResponseData, error) {
+	user, err := getUserByID(ctx, ride.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	response := &chairGetNotificationResponseData{
+		RideID: ride.ID,
+		User: simpleUser{
+			ID:   user.ID,
+			Name: fmt.Sprintf("%s %s", user.Firstname, user.Lastname),
+		},
+		PickupCoordinate: Coordinate{
+			Latitude:  ride.PickupLatitude,
+			Longitude: ride.PickupLongitude,
+		},
+		DestinationCoordinate: Coordinate{
+			Latitude:  ride.DestinationLatitude,
+			Longitude: ride.DestinationLongitude,
+		},
+		Status: status,
+	}
+
+	// 配車位置までの距離と到着見込みを付けて、椅子側で追加のリクエストをしなくて済むようにする
+	if status == "MATCHED" && ride.ChairID.Valid {
+		chair, err := getChairByID(ctx, ride.ChairID.String)
+		if err != nil {
+			return nil, err
+		}
+		if distance, pickupAt, ok := estimatePickup(chair, ride, clock.Now()); ok {
+			eta := pickupAt.UnixMilli()
+			response.PickupDistance = &distance
+			response.PickupETA = &eta
+		}
+	}
+
+	return response, nil
+}
+
+func encodeChairNotificationFrame(buf *bytes.Buffer, response *chairGetNotificationResponseData) {
+	buf.WriteString("data: ")
+	response.Encode(buf)
+	buf.WriteString("\n\n")
+}
+
+// storeChairNotificationSnapshot remembers frame as the latest event sent to chairID.
+func storeChairNotificationSnapshot(chairID string, response *chairGetNotificationResponseData, frame []byte) *chairNotificationSnapshot {
+	snapshot := &chairNotificationSnapshot{
+		response: *response,
+		frame:    bytes.Clone(frame),
+	}
+	chairNotificationSnapshots.Store(chairID, snapshot)
+	return snapshot
+}
+
+// chairNotificationSnapshotFor returns the first event of the notification stream of chairID for ride in status.
+// The cached frame is used only when it was built for the same ride and status, so a snapshot stored
+// concurrently with an invalidation is never served.
+func chairNotificationSnapshotFor(ctx context.Context, chairID string, ride *Ride, status string) (*chairNotificationSnapshot, error) {
+	if snapshot, ok := chairNotificationSnapshots.Load(chairID); ok && snapshot.response.RideID == ride.ID && snapshot.response.Status == status {
+		return snapshot, nil
+	}
+
+	response, err := newChairNotificationResponse(ctx, ride, status)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := getBuffer()
+	defer putBuffer(buf)
+	encodeChairNotificationFrame(buf, response)
+	return storeChairNotificationSnapshot(chairID, response, buf.Bytes()), nil
+}
+
+func invalidateChairNotificationSnapshot(chairID string) {
+	chairNotificationSnapshots.Forget(chairID)
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"cmp"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	isucache "github.com/mazrean/isucon-go-tools/v2/cache"
+)
+
+// 椅子の売上画面向けに、椅子が担当したライドの一覧を返す
+// オーナーの認証なしで椅子の認証だけで見られるよう、rideCacheを椅子ごとに引くchairRideIDsCacheから作る。
+const (
+	defaultChairRidesLimit = 20
+	maxChairRidesLimit     = 100
+)
+
+// 椅子が担当したライド。起動時の組み立て直しと割り当てで順序が変わらないよう、作成順に並べる
+type chairRideRef struct {
+	id        string
+	createdAt time.Time
+}
+
+// chair ID -> rides in creation order
+var chairRideIDsCache = isucache.NewMap[string, []chairRideRef]("chairRideIDsCache")
+
+func init() {
+	registerReset(chairRideIDsCache.Purge)
+}
+
+func compareChairRideRefs(a, b chairRideRef) int {
+	return cmp.Or(a.createdAt.Compare(b.createdAt), cmp.Compare(a.id, b.id))
+}
+
+func indexChairRide(ride *Ride) {
+	ref := chairRideRef{id: ride.ID, createdAt: ride.CreatedAt}
+	chairRideIDsCache.Update(ride.ChairID.String, func(refs []chairRideRef) ([]chairRideRef, bool) {
+		i, found := slices.BinarySearchFunc(refs, ref, compareChairRideRefs)
+		if found {
+			return refs, false
+		}
+		return slices.Insert(slices.Clone(refs), i, ref), true
+	})
+}
+
+// forgetChairRide removes a ride taken back from chairID.
+func forgetChairRide(chairID string, ride *Ride) {
+	ref := chairRideRef{id: ride.ID, createdAt: ride.CreatedAt}
+	chairRideIDsCache.Update(chairID, func(refs []chairRideRef) ([]chairRideRef, bool) {
+		i, found := slices.BinarySearchFunc(refs, ref, compareChairRideRefs)
+		if !found {
+			return refs, false
+		}
+		return slices.Delete(slices.Clone(refs), i, i+1), true
+	})
+}
+
+type chairGetRidesResponse struct {
+	Rides []chairGetRidesResponseItem `json:"rides"`
+}
+
+type chairGetRidesResponseItem struct {
+	ID                    string     `json:"id"`
+	PickupCoordinate      Coordinate `json:"pickup_coordinate"`
+	DestinationCoordinate Coordinate `json:"destination_coordinate"`
+	// ユーザーが払った料金(割引後)と、オーナーの売上になる割引前の料金
+	Fare        int   `json:"fare"`
+	Sales       int   `json:"sales"`
+	Evaluation  int   `json:"evaluation"`
+	RequestedAt int64 `json:"requested_at"`
+	CompletedAt int64 `json:"completed_at"`
+}
+
+// GET /api/chair/rides?limit=20
+//
+// 完了したライドを新しい順にlimit件(最大100件)まで返す。
+func (s *Server) chairGetRides(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	chair := ctx.Value("chair").(*Chair)
+
+	limit := defaultChairRidesLimit
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		var err error
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit <= 0 {
+			writeError(w, r, http.StatusBadRequest, badRequest("limit is invalid"))
+			return
+		}
+		limit = min(limit, maxChairRidesLimit)
+	}
+
+	res := &chairGetRidesResponse{Rides: []chairGetRidesResponseItem{}}
+
+	// 新しい方からlimit件ずつ見て、追い出したライドもその分だけMySQLから読む
+	refs, _ := chairRideIDsCache.Load(chair.ID)
+	for end := len(refs); end > 0 && len(res.Rides) < limit; {
+		start := max(0, end-(limit-len(res.Rides)))
+		rideIDs := make([]string, 0, end-start)
+		for _, ref := range refs[start:end] {
+			rideIDs = append(rideIDs, ref.id)
+		}
+		end = start
+
+		rides, err := ridesNewestFirst(rideIDs)
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		for _, ride := range rides {
+			status, exists := s.rideStatuses.Load(ride.ID)
+			if exists && status.Status != "COMPLETED" || !exists && !isRideArchived(ride.ID) || ride.Evaluation == nil {
+				continue
+			}
+
+			fare, err := calculateDiscountedFare(ctx, s.couponRepository, ride)
+			if err != nil {
+				writeError(w, r, http.StatusInternalServerError, err)
+				return
+			}
+
+			res.Rides = append(res.Rides, chairGetRidesResponseItem{
+				ID:                    ride.ID,
+				PickupCoordinate:      Coordinate{Latitude: ride.PickupLatitude, Longitude: ride.PickupLongitude},
+				DestinationCoordinate: Coordinate{Latitude: ride.DestinationLatitude, Longitude: ride.DestinationLongitude},
+				Fare:                  fare,
+				Sales:                 rideSales(ride),
+				Evaluation:            *ride.Evaluation,
+				RequestedAt:           ride.CreatedAt.UnixMilli(),
+				CompletedAt:           ride.UpdatedAt.UnixMilli(),
+			})
+		}
+	}
+
+	writeJSON(w, http.StatusOK, res)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+
+	isucache "github.com/mazrean/isucon-go-tools/v2/cache"
+)
+
+// 椅子の実際の速さの追跡
+// ライドに向かっている間・客を乗せている間に送られてくる座標から、1回の送信で進んだ距離をモデルのspeedと比べる。
+// 比率の指数移動平均が低い椅子はマッチングのスコアで遅い椅子として扱い、さらに低ければしばらくマッチングから外す。
+// 座標を受けるインスタンスでしか分からないので、マッチングを別プロセスに分けているときは効かない。
+const (
+	chairSpeedAlpha = 0.1
+	// これより少ない送信回数では判断しない
+	chairSpeedMinSamples = 20
+	// 比率がこれを下回るとスコアの計算で速さに比率を掛ける
+	chairSlowRatio = 0.8
+	// 比率がこれを下回るとマッチングから外す
+	chairExcludeRatio = 0.5
+	// 外している期間。明けたら計測し直す
+	chairExcludeDuration = 30 * time.Second
+)
+
+type chairSpeedStats struct {
+	mu sync.Mutex
+
+	lastLatitude  int
+	lastLongitude int
+	moving        bool
+
+	ratio         float64
+	samples       int
+	excludedUntil time.Time
+}
+
+var chairSpeedStatsCache = isucache.NewAtomicMap[string, *chairSpeedStats]("chairSpeedStatsCache")
+
+func init() {
+	registerReset(chairSpeedStatsCache.Purge)
+}
+
+// observeChairCoordinate records a coordinate posted by chair. moving reports whether the chair is heading somewhere.
+func observeChairCoordinate(chair *Chair, moving bool, coordinate *Coordinate, now time.Time) {
+	stats, _ := chairSpeedStatsCache.LoadOrStore(chair.ID, &chairSpeedStats{ratio: 1})
+
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+
+	wasMoving, lastLatitude, lastLongitude := stats.moving, stats.lastLatitude, stats.lastLongitude
+	stats.lastLatitude, stats.lastLongitude, stats.moving = coordinate.Latitude, coordinate.Longitude, moving
+	if !moving || !wasMoving {
+		return
+	}
+
+	speed := chair.Speed
+	if speed <= 0 {
+		return
+	}
+	moved := calculateDistance(lastLatitude, lastLongitude, coordinate.Latitude, coordinate.Longitude)
+	stats.ratio = (1-chairSpeedAlpha)*stats.ratio + chairSpeedAlpha*min(float64(moved)/float64(speed), 1)
+	stats.samples++
+
+	if stats.samples >= chairSpeedMinSamples && stats.ratio < chairExcludeRatio && stats.excludedUntil.IsZero() {
+		stats.excludedUntil = now.Add(chairExcludeDuration)
+		matcherLogger.Info("chair excluded from matching",
+			slog.String("chair_id", chair.ID),
+			slog.Float64("speed_ratio", stats.ratio),
+		)
+	}
+}
+
+// chairSpeedRatio returns how fast chair moves relative to its model speed, or 1 when it is not slow.
+func chairSpeedRatio(chairID string) float64 {
+	stats, ok := chairSpeedStatsCache.Load(chairID)
+	if !ok {
+		return 1
+	}
+
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+
+	if stats.samples < chairSpeedMinSamples || stats.ratio >= chairSlowRatio {
+		return 1
+	}
+	return max(stats.ratio, chairExcludeRatio)
+}
+
+// isChairExcluded reports whether chair is currently kept out of matching for being slow.
+func isChairExcluded(chairID string, now time.Time) bool {
+	stats, ok := chairSpeedStatsCache.Load(chairID)
+	if !ok {
+		return false
+	}
+
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+
+	if stats.excludedUntil.IsZero() {
+		return false
+	}
+	if now.Before(stats.excludedUntil) {
+		return true
+	}
+
+	stats.excludedUntil = time.Time{}
+	stats.ratio = 1
+	stats.samples = 0
+	return false
+}
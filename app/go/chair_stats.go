@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	isucache "github.com/mazrean/isucon-go-tools/v2/cache"
+)
+
+// 椅子ごとの完了ライドの集計
+// ライドが完了するたびに1時間単位のバケットへ足し込んでおき、リーダーボードではバケットを合算するだけにする。
+// 起動時と初期化時はridesから組み立て直す。
+const chairStatsBucketSize = time.Hour
+
+type chairStatsBucket struct {
+	rides      int
+	sales      int
+	evaluation int
+}
+
+type chairStatsAggregate struct {
+	mu sync.Mutex
+	// バケットの開始時刻(unix秒) -> 集計
+	buckets map[int64]*chairStatsBucket
+}
+
+var chairStatsAggregates = isucache.NewAtomicMap[string, *chairStatsAggregate]("chairStatsAggregates")
+
+func init() {
+	registerReset(chairStatsAggregates.Purge)
+}
+
+func initChairStatsAggregates() error {
+	var rides []Ride
+	if err := db.Select(&rides, "SELECT "+rideColumns+" FROM rides WHERE chair_id IS NOT NULL AND evaluation IS NOT NULL"); err != nil {
+		return fmt.Errorf("failed to select completed rides: %w", err)
+	}
+
+	for _, ride := range rides {
+		recordChairCompletion(ride.ChairID.String, ride.UpdatedAt, rideSales(&ride), *ride.Evaluation)
+	}
+
+	return nil
+}
+
+// rideSales returns the undiscounted fare that owner sales are based on.
+func rideSales(ride *Ride) int {
+	return currentFareConfig().fare(calculateDistance(ride.PickupLatitude, ride.PickupLongitude, ride.DestinationLatitude, ride.DestinationLongitude), 0)
+}
+
+// recordChairCompletion adds a completed ride to the chair's aggregate.
+func recordChairCompletion(chairID string, completedAt time.Time, sales int, evaluation int) {
+	aggregate, _ := chairStatsAggregates.LoadOrStore(chairID, &chairStatsAggregate{
+		buckets: map[int64]*chairStatsBucket{},
+	})
+
+	key := completedAt.Truncate(chairStatsBucketSize).Unix()
+
+	aggregate.mu.Lock()
+	defer aggregate.mu.Unlock()
+
+	bucket, ok := aggregate.buckets[key]
+	if !ok {
+		bucket = &chairStatsBucket{}
+		aggregate.buckets[key] = bucket
+	}
+	bucket.rides++
+	bucket.sales += sales
+	bucket.evaluation += evaluation
+}
+
+// sumChairStats sums the chair's buckets starting at or after since.
+func sumChairStats(chairID string, since time.Time) chairStatsBucket {
+	sum := chairStatsBucket{}
+	aggregate, ok := chairStatsAggregates.Load(chairID)
+	if !ok {
+		return sum
+	}
+
+	key := since.Truncate(chairStatsBucketSize).Unix()
+
+	aggregate.mu.Lock()
+	defer aggregate.mu.Unlock()
+
+	for start, bucket := range aggregate.buckets {
+		if start < key {
+			continue
+		}
+		sum.rides += bucket.rides
+		sum.sales += bucket.sales
+		sum.evaluation += bucket.evaluation
+	}
+
+	return sum
+}
+
+type ownerGetChairLeaderboardResponse struct {
+	Since  int64                                   `json:"since"`
+	SortBy string                                  `json:"sort_by"`
+	Chairs []ownerGetChairLeaderboardResponseChair `json:"chairs"`
+}
+
+type ownerGetChairLeaderboardResponseChair struct {
+	Rank              int     `json:"rank"`
+	ID                string  `json:"id"`
+	Name              string  `json:"name"`
+	Model             string  `json:"model"`
+	CompletedRides    int     `json:"completed_rides"`
+	Sales             int     `json:"sales"`
+	AverageEvaluation float64 `json:"average_evaluation"`
+}
+
+// GET /api/owner/chairs/leaderboard?window=24h&sort_by=sales
+//
+// windowはGoのduration形式で、省略すると全期間。集計は1時間単位なのでwindowの開始はその時間の頭に丸める。
+// sort_byはrides(デフォルト)、sales、evaluationのいずれか。
+func (s *Server) ownerGetChairLeaderboard(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+
+	since := time.Unix(0, 0)
+	if v := r.URL.Query().Get("window"); v != "" {
+		window, err := time.ParseDuration(v)
+		if err != nil || window <= 0 {
+			writeError(w, r, http.StatusBadRequest, badRequest("window must be a positive duration"))
+			return
+		}
+		since = s.clock.Now().Add(-window).Truncate(chairStatsBucketSize)
+	}
+
+	sortBy := r.URL.Query().Get("sort_by")
+	if sortBy == "" {
+		sortBy = "rides"
+	}
+	var less func(a, b *ownerGetChairLeaderboardResponseChair) bool
+	switch sortBy {
+	case "rides":
+		less = func(a, b *ownerGetChairLeaderboardResponseChair) bool { return a.CompletedRides > b.CompletedRides }
+	case "sales":
+		less = func(a, b *ownerGetChairLeaderboardResponseChair) bool { return a.Sales > b.Sales }
+	case "evaluation":
+		less = func(a, b *ownerGetChairLeaderboardResponseChair) bool {
+			return a.AverageEvaluation > b.AverageEvaluation
+		}
+	default:
+		writeError(w, r, http.StatusBadRequest, badRequest("sort_by must be rides, sales or evaluation"))
+		return
+	}
+
+	chairs := []Chair{}
+	if err := s.db.SelectContext(ctx, &chairs, "SELECT "+chairPublicColumns+" FROM chairs WHERE owner_id = ?", owner.ID); err != nil {
+		writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	res := ownerGetChairLeaderboardResponse{
+		Since:  since.UnixMilli(),
+		SortBy: sortBy,
+		Chairs: make([]ownerGetChairLeaderboardResponseChair, 0, len(chairs)),
+	}
+	for _, chair := range chairs {
+		stats := sumChairStats(chair.ID, since)
+		c := ownerGetChairLeaderboardResponseChair{
+			ID:             chair.ID,
+			Name:           chair.Name,
+			Model:          chair.Model,
+			CompletedRides: stats.rides,
+			Sales:          stats.sales,
+		}
+		if stats.rides > 0 {
+			c.AverageEvaluation = float64(stats.evaluation) / float64(stats.rides)
+		}
+		res.Chairs = append(res.Chairs, c)
+	}
+
+	sort.SliceStable(res.Chairs, func(i, j int) bool {
+		a, b := &res.Chairs[i], &res.Chairs[j]
+		if less(a, b) != less(b, a) {
+			return less(a, b)
+		}
+		return a.ID < b.ID
+	})
+	for i := range res.Chairs {
+		res.Chairs[i].Rank = i + 1
+	}
+
+	writeJSON(w, http.StatusOK, res)
+}
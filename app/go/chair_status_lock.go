@@ -0,0 +1,64 @@
+package main
+
+import (
+	"slices"
+	"sync"
+	"time"
+
+	isucache "github.com/mazrean/isucon-go-tools/v2/cache"
+)
+
+// 椅子の状態(badgerのstatus)の書き込みは椅子ごとのロックの中で行う
+// chairPostCoordinateとchairPostRideStatusが同時に来ても、badgerとrideStatusesCacheが別々の遷移を反映した組み合わせにならないよう、
+// ライドの状態も変えるときはロックの中で今の状態を確かめてから、badger、rideStatusesCacheの順に書く。
+// badgerへの書き込みに失敗したらライドの状態は変えない。
+// 初期化でも捨てない。捨てると、初期化をまたいで古いMutexを持っている書き込みと新しいMutexを取った書き込みが並んでしまう。
+var chairStatusLocks = isucache.NewAtomicMap[string, *sync.Mutex]("chairStatusLocks")
+
+func lockChairStatus(chairID string) (unlock func()) {
+	mu, _ := chairStatusLocks.LoadOrStore(chairID, &sync.Mutex{})
+	mu.Lock()
+	return mu.Unlock
+}
+
+// setChairStatus writes only the chair status of chairID.
+func setChairStatus(chairID string, status *chairStatus) error {
+	unlock := lockChairStatus(chairID)
+	defer unlock()
+
+	return updateChairStatusToBadger(chairID, status)
+}
+
+// transitionChairRide moves the ride and its chair to the next status together.
+// from lists the ride statuses the transition starts from (nil for any); otherwise nothing is written and ok is false.
+// before is the ride status seen under the lock.
+func transitionChairRide(chairID string, rideID string, from []string, chairState byte, status string, now time.Time) (before string, ok bool, err error) {
+	unlock := lockChairStatus(chairID)
+	defer unlock()
+
+	return transitionChairRideLocked(chairID, rideID, from, chairState, status, now)
+}
+
+// transitionChairRideLocked is transitionChairRide for a caller already holding the lock of chairID.
+func transitionChairRideLocked(chairID string, rideID string, from []string, chairState byte, status string, now time.Time) (before string, ok bool, err error) {
+	if current, ok := rideStatusesCache.Load(rideID); ok {
+		before = current.Status
+	}
+	if from != nil && !slices.Contains(from, before) {
+		return before, false, nil
+	}
+	// 決済中のライドはCompleteRideが終わらせる
+	if _, ok := completingRides.Load(rideID); ok {
+		return before, false, nil
+	}
+
+	if err := updateChairStatusToBadger(chairID, &chairStatus{
+		status: chairState,
+		rideID: rideID,
+	}); err != nil {
+		return before, false, err
+	}
+	storeRideStatus(rideID, status, now)
+
+	return before, true, nil
+}
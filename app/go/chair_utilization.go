@@ -0,0 +1,117 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// 椅子のモデルごとの状態別の滞在時間
+// 状態はライドの遷移(recordRideTransition)から決める。
+//   - available: アクティブでライドを持っていない
+//   - enroute: MATCHEDからPICKUPまで
+//   - carrying: PICKUPから評価されるまで
+//
+// 終わった期間は遷移のときに足し込み、今の状態の期間はスクレイプのたびに足して返す。
+// どのモデルの速度がスループットを決めているかを見て、マッチングの重みを調整するのに使う。
+
+var chairUtilizationDesc = prometheus.NewDesc(
+	"isuride_chair_state_seconds_total",
+	"time chairs spent in each state per model",
+	[]string{"model", "state"}, nil,
+)
+
+type chairUtilizationPeriod struct {
+	model string
+	state string
+	since time.Time
+}
+
+type chairUtilizationCollector struct {
+	mu sync.Mutex
+	// chair ID -> 今の状態
+	chairs map[string]*chairUtilizationPeriod
+	// model -> state -> 終わった期間の合計(秒)
+	totals map[string]map[string]float64
+}
+
+var chairUtilization = &chairUtilizationCollector{
+	chairs: map[string]*chairUtilizationPeriod{},
+	totals: map[string]map[string]float64{},
+}
+
+func init() {
+	prometheus.MustRegister(chairUtilization)
+	registerReset(func() {
+		chairUtilization.mu.Lock()
+		defer chairUtilization.mu.Unlock()
+
+		chairUtilization.chairs = map[string]*chairUtilizationPeriod{}
+		chairUtilization.totals = map[string]map[string]float64{}
+	})
+}
+
+func chairUtilizationState(status string) string {
+	switch status {
+	case "MATCHED", "ENROUTE":
+		return "enroute"
+	case "PICKUP", "CARRYING", "ARRIVED":
+		return "carrying"
+	default:
+		return "available"
+	}
+}
+
+// transition closes the current period of chairID and starts one in the state of status.
+func (c *chairUtilizationCollector) transition(chairID string, status string, now time.Time) {
+	model := "unknown"
+	if chair, ok := chairCache.Load(chairID); ok {
+		model = chair.Model
+	}
+	state := chairUtilizationState(status)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if period, ok := c.chairs[chairID]; ok {
+		if period.state == state {
+			return
+		}
+		c.add(period, now)
+	}
+	c.chairs[chairID] = &chairUtilizationPeriod{model: model, state: state, since: now}
+}
+
+func (c *chairUtilizationCollector) add(period *chairUtilizationPeriod, now time.Time) {
+	totals, ok := c.totals[period.model]
+	if !ok {
+		totals = map[string]float64{}
+		c.totals[period.model] = totals
+	}
+	totals[period.state] += now.Sub(period.since).Seconds()
+}
+
+func (c *chairUtilizationCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- chairUtilizationDesc
+}
+
+func (c *chairUtilizationCollector) Collect(ch chan<- prometheus.Metric) {
+	now := clock.Now()
+
+	c.mu.Lock()
+	sums := make(map[[2]string]float64, len(c.totals)*3)
+	for model, totals := range c.totals {
+		for state, seconds := range totals {
+			sums[[2]string{model, state}] += seconds
+		}
+	}
+	for _, period := range c.chairs {
+		sums[[2]string{period.model, period.state}] += now.Sub(period.since).Seconds()
+	}
+	c.mu.Unlock()
+
+	for key, seconds := range sums {
+		ch <- prometheus.MustNewConstMetric(chairUtilizationDesc, prometheus.CounterValue, seconds, key[0], key[1])
+	}
+}
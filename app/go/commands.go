@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/bytedance/sonic"
+	"github.com/dgraph-io/badger"
+)
+
+// サブコマンド
+// 引数なしはserveと同じ。
+//
+//	ISUCON_ROLES=web,notifier ./isuride serve
+//	./isuride migrate
+//	./isuride dump -prefix=status
+type command struct {
+	name    string
+	summary string
+	run     func(args []string)
+}
+
+var commands = []command{
+	{name: "serve", summary: "start the web server", run: runServe},
+	{name: "migrate", summary: "recreate the schema and load the initial data", run: runMigrate},
+	{name: "warm", summary: "rebuild badger from MySQL and load the caches", run: runWarm},
+	{name: "dump", summary: "print badger entries or cache sizes", run: runDump},
+	{name: "loadgen", summary: "generate load against a running server", run: runLoadgen},
+	{name: "fixtures", summary: "load YAML fixtures into a running server", run: runFixtures},
+	{name: "seed", summary: "generate synthetic data and load it into a running server", run: runSeed},
+}
+
+func runCommand(args []string) {
+	if len(args) == 0 {
+		runServe(nil)
+		return
+	}
+
+	for _, c := range commands {
+		if c.name == args[0] {
+			c.run(args[1:])
+			return
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "unknown command: %s\n\ncommands:\n", args[0])
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", c.name, c.summary)
+	}
+	os.Exit(2)
+}
+
+func exitOnError(err error) {
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// runMigrate does what /api/initialize does to MySQL, without a running server.
+func runMigrate(args []string) {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	script := fs.String("script", "../sql/init.sh", "schema and initial data script")
+	fs.Parse(args)
+
+	exitOnError(requireTokenSalt())
+	openDB()
+
+	out, err := exec.Command(*script).CombinedOutput()
+	if err != nil {
+		exitOnError(fmt.Errorf("failed to initialize: %s: %w", string(out), err))
+	}
+	exitOnError(initChairSpeeds())
+	exitOnError(hashStoredTokens())
+	exitOnError(initFareConfig())
+	exitOnError(initRideSales())
+	exitOnError(initInvitationUses())
+}
+
+// runWarm rebuilds badger so that serve starts from data consistent with MySQL.
+func runWarm(args []string) {
+	fs := flag.NewFlagSet("warm", flag.ExitOnError)
+	fs.Parse(args)
+
+	openDB()
+	startedAt := time.Now()
+	exitOnError(initBadger())
+	defer badgerDB.Close()
+	exitOnError(loadCaches())
+
+	printJSON(map[string]any{
+		"elapsed_ms": time.Since(startedAt).Milliseconds(),
+		"caches":     newServer(db).debugState(),
+	})
+}
+
+func runDump(args []string) {
+	fs := flag.NewFlagSet("dump", flag.ExitOnError)
+	prefix := fs.String("prefix", "", "only dump badger keys with this prefix")
+	caches := fs.Bool("caches", false, "load the caches and print their sizes instead of badger entries")
+	fs.Parse(args)
+
+	openBadger()
+	defer badgerDB.Close()
+
+	if *caches {
+		openDB()
+		exitOnError(loadCaches())
+		printJSON(newServer(db).debugState())
+		return
+	}
+
+	exitOnError(badgerDB.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte(*prefix)
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			if err := item.Value(func(v []byte) error {
+				fmt.Printf("%q\t%s\n", item.Key(), hex.EncodeToString(v))
+				return nil
+			}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+}
+
+func printJSON(v any) {
+	enc := sonic.ConfigDefault.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	exitOnError(enc.Encode(v))
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// 招待コードの使用回数の管理と、招待クーポン(INV_/RWD_)を荒稼ぎしているアカウントの検知
+//
+// 使用回数はinvitation_usesの行をロックしながら数えるので、同時に登録されても上限を超えて付与しない。
+// 検知はISUCON_COUPON_ABUSE_INTERVAL=10m のように間隔を指定したときだけ動き、結果をcoupon_abuse_flagsに書く。
+//   - invitation_burst: 招待コードが上限まで使われ、しかも短時間に集中している
+//   - inactive_invitees: 招待したユーザーが一人もライドしていない
+const (
+	couponAbuseBurstWindow = 10 * time.Minute
+	// 登録直後はまだライドしていなくて当然なので、これより古い招待だけを見る
+	couponAbuseInactiveAge = 24 * time.Hour
+)
+
+var couponAbuseInterval = parseCouponAbuseInterval(os.Getenv("ISUCON_COUPON_ABUSE_INTERVAL"))
+
+func parseCouponAbuseInterval(s string) time.Duration {
+	if s == "" {
+		return 0
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		panic(fmt.Sprintf("invalid ISUCON_COUPON_ABUSE_INTERVAL: %v", err))
+	}
+	return d
+}
+
+// useInvitationCode counts a use of code and returns errInvalidInvitationCode when it is used up.
+// The use row stays locked until tx ends.
+func useInvitationCode(ctx context.Context, tx *sqlx.Tx, code string, maxUses int, now time.Time) error {
+	if _, err := tx.ExecContext(
+		ctx,
+		"INSERT INTO invitation_uses (invitation_code, uses, updated_at) VALUES (?, 1, ?) ON DUPLICATE KEY UPDATE uses = uses + 1, updated_at = VALUES(updated_at)",
+		code, now,
+	); err != nil {
+		return fmt.Errorf("failed to count invitation use: %w", err)
+	}
+
+	var uses int
+	if err := tx.GetContext(ctx, &uses, "SELECT uses FROM invitation_uses WHERE invitation_code = ?", code); err != nil {
+		return fmt.Errorf("failed to get invitation uses: %w", err)
+	}
+	if uses > maxUses {
+		return errInvalidInvitationCode
+	}
+
+	return nil
+}
+
+// initInvitationUses rebuilds invitation_uses from the invitation coupons in MySQL.
+func initInvitationUses() error {
+	if _, err := db.Exec(`INSERT INTO invitation_uses (invitation_code, uses, updated_at) SELECT SUBSTRING(code, 5), COUNT(*), MAX(created_at) FROM coupons WHERE code LIKE 'INV\_%' GROUP BY code ON DUPLICATE KEY UPDATE uses = VALUES(uses), updated_at = VALUES(updated_at)`); err != nil {
+		return fmt.Errorf("failed to init invitation uses: %w", err)
+	}
+
+	return nil
+}
+
+func startCouponAbuseDetection() {
+	if couponAbuseInterval <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(couponAbuseInterval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			n, err := detectCouponAbuse(context.Background(), clock.Now())
+			if err != nil {
+				slog.Error("failed to detect coupon abuse", slog.String("error", err.Error()))
+				continue
+			}
+			if n > 0 {
+				slog.Warn("coupon abuse detected", slog.Int("count", n))
+			}
+		}
+	}()
+}
+
+// detectCouponAbuse flags inviters farming invitation coupons and returns how many flags were newly added.
+func detectCouponAbuse(ctx context.Context, now time.Time) (int, error) {
+	var flags []CouponAbuseFlag
+
+	var bursts []struct {
+		UserID string `db:"user_id"`
+		Code   string `db:"code"`
+		Uses   int    `db:"uses"`
+		Span   int64  `db:"span"`
+	}
+	if err := db.SelectContext(
+		ctx,
+		&bursts,
+		`SELECT u.id AS user_id, c.code, COUNT(*) AS uses, TIMESTAMPDIFF(SECOND, MIN(c.created_at), MAX(c.created_at)) AS span
+		FROM coupons c JOIN users u ON u.invitation_code = SUBSTRING(c.code, 5)
+		WHERE c.code LIKE 'INV\_%'
+		GROUP BY u.id, c.code
+		HAVING uses >= ? AND span <= ?`,
+		currentCampaign().MaxInvitationUses, int64(couponAbuseBurstWindow.Seconds()),
+	); err != nil {
+		return 0, fmt.Errorf("failed to select invitation bursts: %w", err)
+	}
+	for _, burst := range bursts {
+		flags = append(flags, CouponAbuseFlag{
+			UserID:     burst.UserID,
+			Reason:     "invitation_burst",
+			Detail:     fmt.Sprintf("%s used %d times within %ds", burst.Code, burst.Uses, burst.Span),
+			DetectedAt: now,
+		})
+	}
+
+	var inactives []struct {
+		UserID   string `db:"user_id"`
+		Code     string `db:"code"`
+		Invitees int    `db:"invitees"`
+	}
+	if err := db.SelectContext(
+		ctx,
+		&inactives,
+		`SELECT u.id AS user_id, c.code, COUNT(*) AS invitees
+		FROM coupons c JOIN users u ON u.invitation_code = SUBSTRING(c.code, 5)
+		WHERE c.code LIKE 'INV\_%' AND c.created_at < ?
+		GROUP BY u.id, c.code
+		HAVING SUM(EXISTS(SELECT 1 FROM rides r WHERE r.user_id = c.user_id)) = 0`,
+		now.Add(-couponAbuseInactiveAge),
+	); err != nil {
+		return 0, fmt.Errorf("failed to select inactive invitees: %w", err)
+	}
+	for _, inactive := range inactives {
+		flags = append(flags, CouponAbuseFlag{
+			UserID:     inactive.UserID,
+			Reason:     "inactive_invitees",
+			Detail:     fmt.Sprintf("none of %d users invited with %s have ridden", inactive.Invitees, inactive.Code),
+			DetectedAt: now,
+		})
+	}
+
+	if len(flags) == 0 {
+		return 0, nil
+	}
+
+	// 既に検知済みのものは最初に検知した日時を残す
+	res, err := db.NamedExecContext(ctx, "INSERT IGNORE INTO coupon_abuse_flags ("+couponAbuseColumns+") VALUES (:user_id, :reason, :detail, :detected_at)", flags)
+	if err != nil {
+		return 0, fmt.Errorf("failed to insert coupon abuse flags: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("failed to insert coupon abuse flags: %w", err)
+	}
+
+	return int(n), nil
+}
+
+type internalGetCouponAbuseResponseFlag struct {
+	UserID     string `json:"user_id"`
+	Reason     string `json:"reason"`
+	Detail     string `json:"detail"`
+	DetectedAt int64  `json:"detected_at"`
+}
+
+// GET /api/internal/coupon-abuse?reason=invitation_burst
+func (s *Server) internalGetCouponAbuse(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	var flags []CouponAbuseFlag
+	query := "SELECT " + couponAbuseColumns + " FROM coupon_abuse_flags"
+	args := []any{}
+	if reason := r.URL.Query().Get("reason"); reason != "" {
+		query += " WHERE reason = ?"
+		args = append(args, reason)
+	}
+	query += " ORDER BY detected_at DESC"
+
+	if err := s.db.SelectContext(ctx, &flags, query, args...); err != nil {
+		writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	res := make([]internalGetCouponAbuseResponseFlag, 0, len(flags))
+	for _, flag := range flags {
+		res = append(res, internalGetCouponAbuseResponseFlag{
+			UserID:     flag.UserID,
+			Reason:     flag.Reason,
+			Detail:     flag.Detail,
+			DetectedAt: flag.DetectedAt.UnixMilli(),
+		})
+	}
+
+	writeJSON(w, http.StatusOK, res)
+}
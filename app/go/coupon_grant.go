@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+)
+
+// CP_NEW2024以外のキャンペーンのクーポンをまとめて付与する
+//
+//	curl -XPOST localhost:8080/api/internal/coupons/grant -d '{"code":"CP_SPRING","discount":500,"all_users":true}'
+//
+// 既に同じコードを持っているユーザーには付与しない。INSERTはcouponGrantBatchSize行ずつまとめる。
+const couponGrantBatchSize = 1000
+
+type internalPostCouponsGrantRequest struct {
+	Code     string `json:"code"`
+	Discount int    `json:"discount"`
+	// unix ms。省略すると無期限
+	ExpiresAt *int64   `json:"expires_at"`
+	UserIDs   []string `json:"user_ids"`
+	AllUsers  bool     `json:"all_users"`
+}
+
+func (req *internalPostCouponsGrantRequest) Validate() error {
+	v := validation{}
+	v.required("code", req.Code)
+	// 登録と招待で付与するクーポンとは混ぜない
+	if req.Code == "CP_NEW2024" || strings.HasPrefix(req.Code, "INV_") || strings.HasPrefix(req.Code, "RWD_") {
+		v.fail("code", "reserved")
+	}
+	v.between("discount", req.Discount, 1, 100000)
+	if req.AllUsers == (len(req.UserIDs) > 0) {
+		v.fail("user_ids", "either user_ids or all_users is required")
+	}
+	return v.err("invalid coupon grant")
+}
+
+type internalPostCouponsGrantResponse struct {
+	Granted int `json:"granted"`
+	// 既に同じコードを持っていたユーザーの数
+	AlreadyGranted int `json:"already_granted"`
+	// user_idsのうち存在しないユーザー
+	UnknownUserIDs []string `json:"unknown_user_ids"`
+}
+
+func (s *Server) internalPostCouponsGrant(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	req := &internalPostCouponsGrantRequest{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	now := s.clock.Now().Truncate(time.Microsecond)
+	var expiresAt *time.Time
+	if req.ExpiresAt != nil {
+		t := time.UnixMilli(*req.ExpiresAt)
+		if !t.After(now) {
+			writeError(w, r, http.StatusBadRequest, badRequest("expires_at must be in the future"))
+			return
+		}
+		expiresAt = &t
+	}
+
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	var userIDs []string
+	if req.AllUsers {
+		err = tx.SelectContext(ctx, &userIDs, "SELECT id FROM users ORDER BY id")
+	} else {
+		var query string
+		var args []any
+		query, args, err = sqlx.In("SELECT id FROM users WHERE id IN (?) ORDER BY id", req.UserIDs)
+		if err == nil {
+			err = tx.SelectContext(ctx, &userIDs, query, args...)
+		}
+	}
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	res := &internalPostCouponsGrantResponse{UnknownUserIDs: []string{}}
+	known := make(map[string]struct{}, len(userIDs))
+	for _, userID := range userIDs {
+		known[userID] = struct{}{}
+	}
+	for _, userID := range req.UserIDs {
+		if _, ok := known[userID]; !ok {
+			res.UnknownUserIDs = append(res.UnknownUserIDs, userID)
+		}
+	}
+
+	var granted []string
+	if err := tx.SelectContext(ctx, &granted, "SELECT user_id FROM coupons WHERE code = ? FOR UPDATE", req.Code); err != nil {
+		writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	for _, userID := range granted {
+		if _, ok := known[userID]; ok {
+			delete(known, userID)
+			res.AlreadyGranted++
+		}
+	}
+
+	coupons := make([]Coupon, 0, len(known))
+	for _, userID := range userIDs {
+		if _, ok := known[userID]; !ok {
+			continue
+		}
+		coupons = append(coupons, Coupon{
+			UserID:    userID,
+			Code:      req.Code,
+			Discount:  req.Discount,
+			CreatedAt: now,
+			ExpiresAt: expiresAt,
+		})
+	}
+	for start := 0; start < len(coupons); start += couponGrantBatchSize {
+		batch := coupons[start:min(start+couponGrantBatchSize, len(coupons))]
+		if _, err := tx.NamedExecContext(ctx, "INSERT INTO coupons (user_id, code, discount, created_at, expires_at) VALUES (:user_id, :code, :discount, :created_at, :expires_at)", batch); err != nil {
+			var mysqlErr *mysql.MySQLError
+			if errors.As(err, &mysqlErr) && mysqlErr.Number == mysqlErrDuplicateEntry {
+				// 同じコードの付与が同時に走った
+				writeError(w, r, http.StatusConflict, errCouponGrantConflict)
+				return
+			}
+			writeError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	for _, coupon := range coupons {
+		addUnusedCoupon(coupon)
+	}
+	res.Granted = len(coupons)
+
+	writeJSON(w, http.StatusOK, res)
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	isucache "github.com/mazrean/isucon-go-tools/v2/cache"
+)
+
+var (
+	// ユーザーごとの未使用クーポン(付与順)
+	unusedCouponsCache = isucache.NewMap[string, []Coupon]("unusedCouponsCache")
+	// used_byの書き込みが終わるとdoneがcloseされる。isucache.MapのForgetはメトリクス有効時にデッドロックするのでAtomicMapにしておく
+	couponWrites = isucache.NewAtomicMap[string, *couponWrite]("couponWrites")
+)
+
+// used_byの書き込みは失敗したら間隔を倍にしながらcouponWriteRetryLimit回まで書き直す
+const (
+	couponWriteRetryLimit = 5
+	couponWriteBackoff    = 10 * time.Millisecond
+	couponWriteMaxBackoff = time.Second
+)
+
+type couponWrite struct {
+	done chan struct{}
+	// doneがcloseされた後だけ読める
+	err error
+}
+
+func init() {
+	registerReset(unusedCouponsCache.Purge)
+	registerReset(couponWrites.Purge)
+}
+
+func initCouponCache() error {
+	var coupons []Coupon
+	if err := db.Select(&coupons, "SELECT "+couponColumns+" FROM coupons WHERE used_by IS NULL ORDER BY created_at"); err != nil {
+		return err
+	}
+
+	for _, coupon := range coupons {
+		addUnusedCoupon(coupon)
+	}
+
+	return nil
+}
+
+// addUnusedCoupon adds coupon unless the user already has one with the same code.
+// binlogの読み込み(binlog_listener.go)が先に足していることがある。
+func addUnusedCoupon(coupon Coupon) {
+	unusedCouponsCache.Update(coupon.UserID, func(coupons []Coupon) ([]Coupon, bool) {
+		for _, c := range coupons {
+			if c.Code == coupon.Code {
+				return coupons, false
+			}
+		}
+		return append(coupons, coupon), true
+	})
+}
+
+// selectCoupon returns the coupon the next ride of userID would use.
+// preferNew prioritizes CP_NEW2024 over the oldest coupon. 期限切れのクーポンは使わない。
+func selectCoupon(userID string, preferNew bool) (Coupon, bool) {
+	coupons, _ := unusedCouponsCache.Load(userID)
+	return pickCoupon(coupons, preferNew, clock.Now())
+}
+
+// pickCoupon picks the coupon to use from the unused coupons of a user in the order they were granted.
+func pickCoupon(coupons []Coupon, preferNew bool, now time.Time) (Coupon, bool) {
+	if preferNew {
+		for _, coupon := range coupons {
+			if coupon.Code == "CP_NEW2024" && !coupon.expired(now) {
+				return coupon, true
+			}
+		}
+	}
+
+	for _, coupon := range coupons {
+		if !coupon.expired(now) {
+			return coupon, true
+		}
+	}
+
+	return Coupon{}, false
+}
+
+func (c *Coupon) expired(now time.Time) bool {
+	return c.ExpiresAt != nil && !now.Before(*c.ExpiresAt)
+}
+
+// useCoupon removes the coupon from the cache and writes used_by in the background.
+// The fare at evaluation reads coupons.used_by, so waitCouponWrite must be called before that.
+func useCoupon(rideID string, coupon Coupon) {
+	unusedCouponsCache.Update(coupon.UserID, func(coupons []Coupon) ([]Coupon, bool) {
+		for i := range coupons {
+			if coupons[i].Code == coupon.Code {
+				return append(coupons[:i:i], coupons[i+1:]...), true
+			}
+		}
+		return coupons, false
+	})
+
+	write := &couponWrite{done: make(chan struct{})}
+	couponWrites.Store(rideID, write)
+	go func() {
+		defer close(write.done)
+
+		backoff := couponWriteBackoff
+		for attempt := 1; ; attempt++ {
+			_, err := db.Exec("UPDATE coupons SET used_by = ? WHERE user_id = ? AND code = ?", rideID, coupon.UserID, coupon.Code)
+			if err == nil {
+				return
+			}
+
+			if attempt >= couponWriteRetryLimit {
+				slog.Error("gave up updating coupon",
+					slog.String("ride_id", rideID),
+					slog.String("code", coupon.Code),
+					slog.String("error", err.Error()),
+				)
+				write.err = fmt.Errorf("failed to update coupon %s: %w", coupon.Code, err)
+				return
+			}
+
+			slog.Warn("failed to update coupon",
+				slog.String("ride_id", rideID),
+				slog.String("code", coupon.Code),
+				slog.Int("attempt", attempt),
+				slog.String("error", err.Error()),
+			)
+			time.Sleep(backoff)
+			backoff = min(backoff*2, couponWriteMaxBackoff)
+		}
+	}()
+}
+
+// couponSource looks up coupon discounts for fare calculation.
+type couponSource interface {
+	// rideDiscount returns the discount of the coupon used by the ride, or 0 if none.
+	rideDiscount(ctx context.Context, rideID string) (int, error)
+}
+
+// dbCouponSource reads used coupons from q and unused ones from unusedCouponsCache.
+type dbCouponSource struct {
+	q sqlx.QueryerContext
+}
+
+func dbCoupons(q sqlx.QueryerContext) couponSource {
+	return dbCouponSource{q: q}
+}
+
+func (c dbCouponSource) rideDiscount(ctx context.Context, rideID string) (int, error) {
+	var coupon Coupon
+	if err := sqlx.GetContext(ctx, c.q, &coupon, "SELECT "+couponColumns+" FROM coupons WHERE used_by = ?", rideID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	return coupon.Discount, nil
+}
+
+// waitCouponWrite waits for the used_by write of the ride and returns its error.
+// 失敗した書き込みは残しておくので、評価をやり直しても割引なしの料金では決済しない。
+func waitCouponWrite(ctx context.Context, rideID string) error {
+	write, ok := couponWrites.Load(rideID)
+	if !ok {
+		return nil
+	}
+
+	select {
+	case <-write.done:
+		if write.err != nil {
+			return write.err
+		}
+		couponWrites.Forget(rideID)
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
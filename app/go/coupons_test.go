@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestCalculateDiscountedFare(t *testing.T) {
+	usedBy := "ride"
+
+	tests := []struct {
+		name     string
+		config   *fareConfig
+		ride     *Ride
+		coupons  []Coupon
+		expected int
+	}{
+		{
+			name:     "no coupon",
+			ride:     &Ride{ID: "ride", PickupLatitude: 0, PickupLongitude: 0, DestinationLatitude: 3, DestinationLongitude: 4},
+			expected: 500 + 100*7,
+		},
+		{
+			name:     "coupon of another ride",
+			ride:     &Ride{ID: "other", PickupLatitude: 0, PickupLongitude: 0, DestinationLatitude: 3, DestinationLongitude: 4},
+			coupons:  []Coupon{{UserID: "user", Code: "CP_NEW2024", Discount: 3000, UsedBy: &usedBy}},
+			expected: 500 + 100*7,
+		},
+		{
+			name:     "discount smaller than metered fare",
+			ride:     &Ride{ID: "ride", PickupLatitude: 10, PickupLongitude: 10, DestinationLatitude: -10, DestinationLongitude: 20},
+			coupons:  []Coupon{{UserID: "user", Code: "INV_user", Discount: 1500, UsedBy: &usedBy}},
+			expected: 500 + 100*30 - 1500,
+		},
+		{
+			name:     "discount equal to metered fare",
+			ride:     &Ride{ID: "ride", PickupLatitude: 0, PickupLongitude: 0, DestinationLatitude: 10, DestinationLongitude: 20},
+			coupons:  []Coupon{{UserID: "user", Code: "CP_NEW2024", Discount: 3000, UsedBy: &usedBy}},
+			expected: 500,
+		},
+		{
+			// 割引は初乗り運賃には効かない
+			name:     "discount larger than metered fare",
+			ride:     &Ride{ID: "ride", PickupLatitude: 0, PickupLongitude: 0, DestinationLatitude: 1, DestinationLongitude: 1},
+			coupons:  []Coupon{{UserID: "user", Code: "CP_NEW2024", Discount: 3000, UsedBy: &usedBy}},
+			expected: 500,
+		},
+		{
+			name:     "same pickup and destination",
+			ride:     &Ride{ID: "ride", PickupLatitude: 5, PickupLongitude: 5, DestinationLatitude: 5, DestinationLongitude: 5},
+			expected: 500,
+		},
+		{
+			name:     "configured fare",
+			config:   &fareConfig{InitialFare: 1000, FarePerDistance: 50},
+			ride:     &Ride{ID: "ride", PickupLatitude: 0, PickupLongitude: 0, DestinationLatitude: 30, DestinationLongitude: 30},
+			coupons:  []Coupon{{UserID: "user", Code: "CP_NEW2024", Discount: 1000, UsedBy: &usedBy}},
+			expected: 1000 + 50*60 - 1000,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.config != nil {
+				activeFareConfig.Store(tt.config)
+				t.Cleanup(func() { activeFareConfig.Store(defaultFareConfig) })
+			}
+
+			fare, err := calculateDiscountedFare(context.Background(), newMemCouponRepository(tt.coupons...), tt.ride)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if fare != tt.expected {
+				t.Errorf("fare = %d, want %d", fare, tt.expected)
+			}
+		})
+	}
+}
+
+func TestEstimateFare(t *testing.T) {
+	tests := []struct {
+		name             string
+		coupons          []Coupon
+		expectedFare     int
+		expectedDiscount int
+	}{
+		{
+			name:             "no coupon",
+			expectedFare:     500 + 100*20,
+			expectedDiscount: 0,
+		},
+		{
+			name: "oldest coupon",
+			coupons: []Coupon{
+				{UserID: "user", Code: "INV_a", Discount: 1000},
+				{UserID: "user", Code: "INV_b", Discount: 1500},
+			},
+			expectedFare:     500 + 100*20 - 1000,
+			expectedDiscount: 1000,
+		},
+		{
+			name: "new user coupon first",
+			coupons: []Coupon{
+				{UserID: "user", Code: "INV_a", Discount: 1000},
+				{UserID: "user", Code: "CP_NEW2024", Discount: 3000},
+			},
+			expectedFare:     500,
+			expectedDiscount: 2000,
+		},
+		{
+			name:             "coupon of another user",
+			coupons:          []Coupon{{UserID: "other", Code: "CP_NEW2024", Discount: 3000}},
+			expectedFare:     500 + 100*20,
+			expectedDiscount: 0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fare, discount := estimateFare(newMemCouponRepository(tt.coupons...), "user", 0, 0, 10, 10)
+			if fare != tt.expectedFare {
+				t.Errorf("fare = %d, want %d", fare, tt.expectedFare)
+			}
+			if discount != tt.expectedDiscount {
+				t.Errorf("discount = %d, want %d", discount, tt.expectedDiscount)
+			}
+		})
+	}
+}
+
+func TestWaitCouponWrite(t *testing.T) {
+	t.Cleanup(resetAll)
+	testDB := openTestDB(t)
+	coupon := Coupon{UserID: "user", Code: "CP_NEW2024", Discount: 3000}
+
+	t.Run("failed", func(t *testing.T) {
+		// couponsテーブルがないので何度書き直しても失敗する
+		useCoupon("failed", coupon)
+
+		for range 2 {
+			if err := waitCouponWrite(context.Background(), "failed"); err == nil {
+				t.Fatal("expected the failed write to be reported")
+			}
+		}
+	})
+
+	t.Run("succeeded", func(t *testing.T) {
+		if _, err := testDB.Exec("CREATE TABLE coupons (user_id TEXT, code TEXT, discount INTEGER, created_at DATETIME, used_by TEXT)"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := testDB.Exec("INSERT INTO coupons (user_id, code, discount) VALUES (?, ?, ?)", coupon.UserID, coupon.Code, coupon.Discount); err != nil {
+			t.Fatal(err)
+		}
+		useCoupon("succeeded", coupon)
+
+		if err := waitCouponWrite(context.Background(), "succeeded"); err != nil {
+			t.Fatal(err)
+		}
+		var usedBy string
+		if err := testDB.Get(&usedBy, "SELECT used_by FROM coupons WHERE user_id = ? AND code = ?", coupon.UserID, coupon.Code); err != nil {
+			t.Fatal(err)
+		}
+		if usedBy != "succeeded" {
+			t.Errorf("used_by = %q, want %q", usedBy, "succeeded")
+		}
+	})
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"strconv"
+	"unicode/utf8"
+)
+
+// 手書きエンコーダー用のヘルパー
+
+func writeJSONInt(buf *bytes.Buffer, v int64) {
+	buf.Write(strconv.AppendInt(buf.AvailableBuffer(), v, 10))
+}
+
+func writeJSONFloat(buf *bytes.Buffer, v float64) {
+	buf.Write(strconv.AppendFloat(buf.AvailableBuffer(), v, 'f', -1, 64))
+}
+
+func writeJSONCoordinate(buf *bytes.Buffer, c Coordinate) {
+	buf.WriteString(`{"latitude":`)
+	writeJSONInt(buf, int64(c.Latitude))
+	buf.WriteString(`,"longitude":`)
+	writeJSONInt(buf, int64(c.Longitude))
+	buf.WriteByte('}')
+}
+
+const hexDigits = "0123456789abcdef"
+
+// writeJSONString writes s as a quoted JSON string.
+func writeJSONString(buf *bytes.Buffer, s string) {
+	buf.WriteByte('"')
+
+	start := 0
+	for i := 0; i < len(s); {
+		b := s[i]
+		if b < utf8.RuneSelf {
+			if b >= 0x20 && b != '"' && b != '\\' {
+				i++
+				continue
+			}
+
+			buf.WriteString(s[start:i])
+			switch b {
+			case '"', '\\':
+				buf.WriteByte('\\')
+				buf.WriteByte(b)
+			case '\n':
+				buf.WriteString(`\n`)
+			case '\r':
+				buf.WriteString(`\r`)
+			case '\t':
+				buf.WriteString(`\t`)
+			case '\b':
+				buf.WriteString(`\b`)
+			case '\f':
+				buf.WriteString(`\f`)
+			default:
+				buf.WriteString(`\u00`)
+				buf.WriteByte(hexDigits[b>>4])
+				buf.WriteByte(hexDigits[b&0xF])
+			}
+			i++
+			start = i
+			continue
+		}
+
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if r == utf8.RuneError && size == 1 {
+			buf.WriteString(s[start:i])
+			buf.WriteString(`\ufffd`)
+			i += size
+			start = i
+			continue
+		}
+		// U+2028/U+2029 are valid JSON but break JavaScript parsers
+		if r == '\u2028' || r == '\u2029' {
+			buf.WriteString(s[start:i])
+			buf.WriteString(`\u202`)
+			buf.WriteByte(hexDigits[r&0xF])
+			i += size
+			start = i
+			continue
+		}
+		i += size
+	}
+	buf.WriteString(s[start:])
+
+	buf.WriteByte('"')
+}
+
+// statusEncoder is a response whose encoding can be split around its status.
+type statusEncoder interface {
+	// encodeHead writes the fields up to and including the "status" key.
+	encodeHead(buf *bytes.Buffer)
+	// encodeTail writes the fields after the status value.
+	encodeTail(buf *bytes.Buffer)
+}
+
+// statusFrame is an encoded SSE event with a hole for the status.
+// ENROUTE〜ARRIVEDへの遷移はstatusしか変わらないので、残りをエンコードし直さずに穴を埋めるだけで送る。
+type statusFrame struct {
+	head []byte
+	tail []byte
+}
+
+func newStatusFrame(v statusEncoder) *statusFrame {
+	buf := getBuffer()
+	defer putBuffer(buf)
+
+	buf.WriteString("data: ")
+	v.encodeHead(buf)
+	head := bytes.Clone(buf.Bytes())
+
+	buf.Reset()
+	v.encodeTail(buf)
+	buf.WriteString("\n\n")
+
+	return &statusFrame{
+		head: head,
+		tail: bytes.Clone(buf.Bytes()),
+	}
+}
+
+func (f *statusFrame) write(buf *bytes.Buffer, status string) {
+	buf.Write(f.head)
+	writeJSONString(buf, status)
+	buf.Write(f.tail)
+}
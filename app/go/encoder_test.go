@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// 手書きのエンコーダーはencoding/json(HTMLのエスケープなし)と同じバイト列を書く
+func marshalJSON(t testing.TB, v any) string {
+	t.Helper()
+
+	buf := &bytes.Buffer{}
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		t.Fatalf("failed to encode: %v", err)
+	}
+	return string(bytes.TrimSuffix(buf.Bytes(), []byte("\n")))
+}
+
+// sameJSON reports whether got and want are the same bytes.
+// 不正なUTF-8はどちらもU+FFFDにするが、encoding/jsonはGoのバージョンによってエスケープしたりしなかったりする。
+func sameJSON(got, want string) bool {
+	return strings.ReplaceAll(got, `\ufffd`, "\uFFFD") == strings.ReplaceAll(want, `\ufffd`, "\uFFFD")
+}
+
+func TestWriteJSONString(t *testing.T) {
+	tests := []struct {
+		name     string
+		s        string
+		expected string
+	}{
+		{name: "empty", s: "", expected: `""`},
+		{name: "ascii", s: "01JDFEF7MGXXCJKW1MNJXPA77A", expected: `"01JDFEF7MGXXCJKW1MNJXPA77A"`},
+		{name: "quote and backslash", s: `a"b\c`, expected: `"a\"b\\c"`},
+		{name: "short escapes", s: "a\nb\rc\td\be\f", expected: `"a\nb\rc\td\be\f"`},
+		{name: "control characters", s: "\x00\x01\x1f\x7f", expected: `"\u0000\u0001\u001f` + "\x7f" + `"`},
+		{name: "html", s: "<a href='x'>&</a>", expected: `"<a href='x'>&</a>"`},
+		{name: "multibyte", s: "椅子のなまえ", expected: `"椅子のなまえ"`},
+		{name: "line and paragraph separators", s: "a\u2028b\u2029c", expected: `"a\u2028b\u2029c"`},
+		{name: "invalid utf-8", s: "a\xffb\xc3", expected: `"a\ufffdb\ufffd"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			writeJSONString(buf, tt.s)
+			if got := buf.String(); got != tt.expected {
+				t.Errorf("writeJSONString(%q) = %s, want %s", tt.s, got, tt.expected)
+			}
+			if want := marshalJSON(t, tt.s); !sameJSON(buf.String(), want) {
+				t.Errorf("writeJSONString(%q) = %s, encoding/json = %s", tt.s, buf.String(), want)
+			}
+		})
+	}
+}
+
+func FuzzWriteJSONString(f *testing.F) {
+	for _, s := range []string{"", "ride", `"\`, "\n\r\t\x00\x1f", "椅子", "\u2028\u2029", "\xff\xc3(", "<&>"} {
+		f.Add(s)
+	}
+
+	f.Fuzz(func(t *testing.T, s string) {
+		buf := &bytes.Buffer{}
+		writeJSONString(buf, s)
+		if want := marshalJSON(t, s); !sameJSON(buf.String(), want) {
+			t.Errorf("writeJSONString(%q) = %s, encoding/json = %s", s, buf.String(), want)
+		}
+	})
+}
+
+func TestEncodeMatchesEncodingJSON(t *testing.T) {
+	distance := 120
+	eta := int64(4500)
+
+	tests := []struct {
+		name string
+		v    interface{ Encode(buf *bytes.Buffer) }
+	}{
+		{
+			name: "app notification without chair",
+			v: &appGetNotificationResponseData{
+				RideID:                "01JDFEF7MGXXCJKW1MNJXPA77A",
+				PickupCoordinate:      Coordinate{Latitude: -10, Longitude: 20},
+				DestinationCoordinate: Coordinate{Latitude: 300, Longitude: -400},
+				Fare:                  3500,
+				Status:                "MATCHING",
+				CreatedAt:             1733600000000,
+				UpdateAt:              1733600001000,
+			},
+		},
+		{
+			name: "app notification with chair",
+			v: &appGetNotificationResponseData{
+				RideID:                "01JDFEF7MGXXCJKW1MNJXPA77A",
+				PickupCoordinate:      Coordinate{Latitude: 0, Longitude: 0},
+				DestinationCoordinate: Coordinate{Latitude: 1, Longitude: 1},
+				Fare:                  500,
+				Status:                "ENROUTE",
+				Chair: &appGetNotificationResponseChair{
+					ID:    "01JDFEDF00B09BNMV8MP0RB34G",
+					Name:  `QC-L13-"8361"`,
+					Model: "リラックスシート NEO",
+					Stats: appGetNotificationResponseChairStats{TotalRidesCount: 3, TotalEvaluationAvg: 13.0 / 3},
+				},
+				CreatedAt: 1733600000000,
+				UpdateAt:  1733600001000,
+			},
+		},
+		{
+			name: "chair notification",
+			v: &chairGetNotificationResponseData{
+				RideID:                "01JDFEF7MGXXCJKW1MNJXPA77A",
+				User:                  simpleUser{ID: "01JDFEDF008NTC5Q1N6ADCQ1HG", Name: "Collier\tKirlin"},
+				PickupCoordinate:      Coordinate{Latitude: 5, Longitude: -5},
+				DestinationCoordinate: Coordinate{Latitude: 50, Longitude: -50},
+				Status:                "COMPLETED",
+			},
+		},
+		{
+			name: "chair notification with pickup",
+			v: &chairGetNotificationResponseData{
+				RideID:         "01JDFEF7MGXXCJKW1MNJXPA77A",
+				User:           simpleUser{ID: "01JDFEDF008NTC5Q1N6ADCQ1HG", Name: "Collier Kirlin"},
+				Status:         "MATCHED",
+				PickupDistance: &distance,
+				PickupETA:      &eta,
+			},
+		},
+		{
+			name: "no nearby chairs",
+			v:    &appGetNearbyChairsResponse{Chairs: []appGetNearbyChairsResponseChair{}, RetrievedAt: 1733600000000},
+		},
+		{
+			name: "nearby chairs",
+			v: &appGetNearbyChairsResponse{
+				Chairs: []appGetNearbyChairsResponseChair{
+					{ID: "a", Name: "chair<a>", Model: "model", CurrentCoordinate: Coordinate{Latitude: 1, Longitude: 2}},
+					{ID: "b", Name: "chair\u2028b", Model: "model\xff", CurrentCoordinate: Coordinate{Latitude: -3, Longitude: -4}},
+				},
+				RetrievedAt: 1733600000000,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			tt.v.Encode(buf)
+			if want := marshalJSON(t, tt.v); !sameJSON(buf.String(), want) {
+				t.Errorf("Encode =\n%s\nencoding/json =\n%s", buf.String(), want)
+			}
+		})
+	}
+}
+
+func FuzzAppNotificationEncode(f *testing.F) {
+	f.Add("01JDFEF7MGXXCJKW1MNJXPA77A", "MATCHING", "chair", "model", 10, -20, 3500, int64(1733600000000), 3, 13, true)
+	f.Add("", "", "\x00\"\\", "\u2028\xff", 0, 0, 0, int64(0), 1, 5, false)
+
+	f.Fuzz(func(t *testing.T, rideID, status, name, model string, lat, lon, fare int, createdAt int64, rides, evaluation int, hasChair bool) {
+		v := &appGetNotificationResponseData{
+			RideID:                rideID,
+			PickupCoordinate:      Coordinate{Latitude: lat, Longitude: lon},
+			DestinationCoordinate: Coordinate{Latitude: lon, Longitude: lat},
+			Fare:                  fare,
+			Status:                status,
+			CreatedAt:             createdAt,
+			UpdateAt:              createdAt + 1,
+		}
+		if hasChair && rides > 0 {
+			// 平均評価は1〜5の範囲にしかならない
+			evaluation = rides + (evaluation%(4*rides+1)+4*rides+1)%(4*rides+1)
+			v.Chair = &appGetNotificationResponseChair{
+				ID:    rideID,
+				Name:  name,
+				Model: model,
+				Stats: appGetNotificationResponseChairStats{TotalRidesCount: rides, TotalEvaluationAvg: float64(evaluation) / float64(rides)},
+			}
+		}
+
+		buf := &bytes.Buffer{}
+		v.Encode(buf)
+		if want := marshalJSON(t, v); !sameJSON(buf.String(), want) {
+			t.Errorf("Encode =\n%s\nencoding/json =\n%s", buf.String(), want)
+		}
+	})
+}
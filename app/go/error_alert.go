@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bytedance/sonic"
+	"github.com/go-chi/chi/v5"
+	isucache "github.com/mazrean/isucon-go-tools/v2/cache"
+)
+
+// ルートごとの5xxを直近errorAlertWindow秒分数えて、閾値を超えたらログと(設定されていれば)webhookで知らせる
+//   - ISUCON_ERROR_ALERT_THRESHOLD: ウィンドウ内の5xxの件数の閾値。デフォルトは10、0なら無効
+//   - ISUCON_ERROR_ALERT_WEBHOOK: 通知先のURL
+const errorAlertWindow = 10
+
+var (
+	errorAlertThreshold = parseErrorAlertThreshold(os.Getenv("ISUCON_ERROR_ALERT_THRESHOLD"))
+	errorAlertWebhook   = os.Getenv("ISUCON_ERROR_ALERT_WEBHOOK")
+
+	errorWindows = isucache.NewAtomicMap[string, *errorWindow]("errorWindows")
+)
+
+func init() {
+	registerReset(errorWindows.Purge)
+}
+
+func parseErrorAlertThreshold(s string) int {
+	threshold, err := strconv.Atoi(s)
+	if err != nil || threshold < 0 {
+		return 10
+	}
+	return threshold
+}
+
+type errorWindow struct {
+	mu        sync.Mutex
+	seconds   [errorAlertWindow]int64
+	counts    [errorAlertWindow]int
+	alertedAt int64
+}
+
+// add records an error at now and reports the count in the window
+// and whether an alert should fire (at most once per window).
+func (w *errorWindow) add(now int64) (int, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	i := now % errorAlertWindow
+	if w.seconds[i] != now {
+		w.seconds[i] = now
+		w.counts[i] = 0
+	}
+	w.counts[i]++
+
+	total := 0
+	for j := range w.counts {
+		if now-w.seconds[j] < errorAlertWindow {
+			total += w.counts[j]
+		}
+	}
+
+	if total < errorAlertThreshold || now-w.alertedAt < errorAlertWindow {
+		return total, false
+	}
+	w.alertedAt = now
+
+	return total, true
+}
+
+func recordServerError(r *http.Request, statusCode int) {
+	if errorAlertThreshold == 0 {
+		return
+	}
+
+	route := r.URL.Path
+	if rctx := chi.RouteContext(r.Context()); rctx != nil {
+		if pattern := rctx.RoutePattern(); pattern != "" {
+			route = pattern
+		}
+	}
+
+	window, _ := errorWindows.LoadOrStore(route, &errorWindow{})
+	count, alert := window.add(time.Now().Unix())
+	if !alert {
+		return
+	}
+
+	httpLogger.Error("ERROR RATE ALERT",
+		slog.String("route", route),
+		slog.Int("status_code", statusCode),
+		slog.Int("count", count),
+		slog.Int("window_seconds", errorAlertWindow),
+	)
+
+	if errorAlertWebhook != "" {
+		go postErrorAlert(route, count)
+	}
+}
+
+type errorAlertWebhookRequest struct {
+	Route         string `json:"route"`
+	Count         int    `json:"count"`
+	WindowSeconds int    `json:"window_seconds"`
+}
+
+func postErrorAlert(route string, count int) {
+	b, err := sonic.Marshal(&errorAlertWebhookRequest{
+		Route:         route,
+		Count:         count,
+		WindowSeconds: errorAlertWindow,
+	})
+	if err != nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, errorAlertWebhook, bytes.NewReader(b))
+	if err != nil {
+		httpLogger.Error("failed to create error alert request",
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		httpLogger.Error("failed to post error alert",
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+	res.Body.Close()
+}
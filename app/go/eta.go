@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+)
+
+// 椅子は座標を送るたびにモデルのspeedだけマンハッタン距離で進む。ベンチマーカーの椅子がおおよそこの間隔で座標を送ってくる前提で到着時刻を見積もる。
+const etaTickInterval = 100 * time.Millisecond
+
+type appGetRideETAResponse struct {
+	RideID    string `json:"ride_id"`
+	Status    string `json:"status"`
+	PickupAt  int64  `json:"pickup_at"`
+	ArrivalAt int64  `json:"arrival_at"`
+}
+
+// estimateTravel returns how long a chair of speed takes to move between the two coordinates.
+func estimateTravel(speed int, aLatitude, aLongitude, bLatitude, bLongitude int) time.Duration {
+	if speed <= 0 {
+		speed = 1
+	}
+	d := calculateDistance(aLatitude, aLongitude, bLatitude, bLongitude)
+	ticks := (d + speed - 1) / speed
+	return time.Duration(ticks) * etaTickInterval
+}
+
+// estimatePickup returns the distance from the current location of chair to the pickup of ride and when the chair will get there.
+// ok is false while the location of chair is unknown.
+func estimatePickup(chair *Chair, ride *Ride, now time.Time) (distance int, pickupAt time.Time, ok bool) {
+	location, ok := locationCache.Load(chair.ID)
+	if !ok {
+		return 0, time.Time{}, false
+	}
+
+	distance = calculateDistance(location.LastLatitude, location.LastLongitude, ride.PickupLatitude, ride.PickupLongitude)
+	pickupAt = now.Add(estimateTravel(chair.Speed, location.LastLatitude, location.LastLongitude, ride.PickupLatitude, ride.PickupLongitude))
+	return distance, pickupAt, true
+}
+
+func (s *Server) appGetRideETA(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	rideID := r.PathValue("ride_id")
+	user := ctx.Value("user").(*User)
+	now := s.clock.Now()
+
+	ride, ok := s.loadUserRide(user, rideID)
+	if !ok {
+		writeError(w, r, http.StatusNotFound, errRideNotFound)
+		return
+	}
+
+	rideStatus, err := getLatestRideStatusWithID(ctx, s.db, ride.ID)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	status := rideStatus.Status
+	if status == "ARRIVED" || status == "COMPLETED" {
+		writeError(w, r, http.StatusBadRequest, badRequest("ride is not active"))
+		return
+	}
+	if !ride.ChairID.Valid {
+		writeError(w, r, http.StatusBadRequest, badRequest("chair is not assigned yet"))
+		return
+	}
+
+	chair, err := s.chairRepository.Get(ctx, ride.ChairID.String)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	location, ok := locationCache.Load(chair.ID)
+	if !ok {
+		writeError(w, r, http.StatusNotFound, errors.New("chair location not found"))
+		return
+	}
+	speed := chair.Speed
+
+	var pickupAt, arrivalAt time.Time
+	switch status {
+	case "CARRYING":
+		// CARRYINGになった時刻が乗車した時刻
+		pickupAt = rideStatus.CreatedAt
+		arrivalAt = now.Add(estimateTravel(speed, location.LastLatitude, location.LastLongitude, ride.DestinationLatitude, ride.DestinationLongitude))
+	case "PICKUP":
+		pickupAt = now
+		arrivalAt = now.Add(estimateTravel(speed, ride.PickupLatitude, ride.PickupLongitude, ride.DestinationLatitude, ride.DestinationLongitude))
+	default:
+		// MATCHING(割り当て済み)とENROUTEは配車位置まで移動してから目的地へ向かう
+		pickupAt = now.Add(estimateTravel(speed, location.LastLatitude, location.LastLongitude, ride.PickupLatitude, ride.PickupLongitude))
+		arrivalAt = pickupAt.Add(estimateTravel(speed, ride.PickupLatitude, ride.PickupLongitude, ride.DestinationLatitude, ride.DestinationLongitude))
+	}
+
+	writeJSON(w, http.StatusOK, &appGetRideETAResponse{
+		RideID:    ride.ID,
+		Status:    status,
+		PickupAt:  pickupAt.UnixMilli(),
+		ArrivalAt: arrivalAt.UnixMilli(),
+	})
+}
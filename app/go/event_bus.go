@@ -2,8 +2,10 @@ package main
 
 import (
 	"sync"
+	"sync/atomic"
 	"time"
 
+	isucache "github.com/mazrean/isucon-go-tools/v2/cache"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 )
@@ -14,99 +16,262 @@ type RideEvent struct {
 	chair      *Chair
 	ride       *Ride
 	updatedAt  time.Time
+	// ライドごとに発行順に振る番号。0は番号なし
+	seq uint64
 }
 
-var (
-	chairEventBus     = map[string][]chan<- *RideEvent{}
-	chairEventBusLock = sync.RWMutex{}
-	userEventBus      = map[string][]chan<- *RideEvent{}
-	userEventBusLock  = sync.RWMutex{}
-)
+// 複数のハンドラーやマッチングから発行されるので、goroutineの順番次第でENROUTEがPICKUPより後に届くことがある。
+// 発行時にライドごとの連番を振っておき、購読側で古いものを捨てる。
+var rideEventSeqs = isucache.NewAtomicMap[string, *atomic.Uint64]("rideEventSeqs")
 
-func initEventBus() {
-	chairEventBusLock.Lock()
-	defer chairEventBusLock.Unlock()
+func init() {
+	registerReset(rideEventSeqs.Purge)
+}
 
-	chairEventBus = make(map[string][]chan<- *RideEvent)
+func nextRideEventSeq(rideID string) uint64 {
+	seq, _ := rideEventSeqs.LoadOrStore(rideID, &atomic.Uint64{})
+	return seq.Add(1)
+}
 
-	userEventBusLock.Lock()
-	defer userEventBusLock.Unlock()
+// observeRideEventSeq advances the sequence of rideID to at least seq,
+// so that events published here after one received from a peer are numbered after it.
+func observeRideEventSeq(rideID string, seq uint64) {
+	current, _ := rideEventSeqs.LoadOrStore(rideID, &atomic.Uint64{})
+	for {
+		last := current.Load()
+		if last >= seq || current.CompareAndSwap(last, seq) {
+			return
+		}
+	}
+}
 
-	userEventBus = make(map[string][]chan<- *RideEvent)
+func assignRideEventSeq(message *RideEvent) {
+	if message.ride != nil && message.seq == 0 {
+		message.seq = nextRideEventSeq(message.ride.ID)
+	}
 }
 
-func ChairSubscribe(event string, ch chan<- *RideEvent) {
-	chairEventBusLock.Lock()
-	defer chairEventBusLock.Unlock()
+// rideEventOrder drops events of the current ride of a stream that arrive after a newer one.
+type rideEventOrder struct {
+	rideID string
+	seq    uint64
+}
 
-	chairEventBus[event] = append(chairEventBus[event], ch)
+func (o *rideEventOrder) accept(event *RideEvent) bool {
+	if event.ride == nil || event.seq == 0 {
+		return true
+	}
+	if event.ride.ID != o.rideID {
+		o.rideID = event.ride.ID
+		o.seq = event.seq
+		return true
+	}
+	if event.seq <= o.seq {
+		return false
+	}
+
+	o.seq = event.seq
+	return true
 }
 
-func ChairPublish(event string, message *RideEvent) {
-	chairEventBusLock.RLock()
-	defer chairEventBusLock.RUnlock()
-
-	/*chairStatusGauge.WithLabelValues(message.status).Inc()
-	switch message.status {
-	case "MATCHED":
-		chairStatusGauge.WithLabelValues("COMPLETED").Dec()
-	case "ENROUTE":
-		chairStatusGauge.WithLabelValues("MATCHED").Dec()
-	case "PICKUP":
-		chairStatusGauge.WithLabelValues("ENROUTE").Dec()
-	case "CARRYING":
-		chairStatusGauge.WithLabelValues("PICKUP").Dec()
-	case "ARRIVED":
-		chairStatusGauge.WithLabelValues("CARRYING").Dec()
-	case "COMPLETED":
-		chairStatusGauge.WithLabelValues("ARRIVED").Dec()
-	}*/
-
-	for _, ch := range chairEventBus[event] {
-		ch <- message
+// eventBus fans ride events out to the notification streams subscribed to a chair or a user.
+type eventBus struct {
+	chairs     map[string][]chan<- *RideEvent
+	chairsLock sync.RWMutex
+	users      map[string][]chan<- *RideEvent
+	usersLock  sync.RWMutex
+	// 発行元のインスタンスでだけ呼ばれる。ブロックしないこと
+	chairHooks []func(chairID string, message *RideEvent)
+	fanout     *eventFanout
+}
+
+func newEventBus(fanout *eventFanout) *eventBus {
+	return &eventBus{
+		chairs: map[string][]chan<- *RideEvent{},
+		users:  map[string][]chan<- *RideEvent{},
+		fanout: fanout,
+	}
+}
+
+var defaultEventBus = newEventBus(defaultEventFanout)
+
+func init() {
+	registerReset(defaultEventBus.reset)
+}
+
+func (b *eventBus) reset() {
+	b.chairsLock.Lock()
+	defer b.chairsLock.Unlock()
+
+	b.chairs = make(map[string][]chan<- *RideEvent)
+
+	b.usersLock.Lock()
+	defer b.usersLock.Unlock()
+
+	b.users = make(map[string][]chan<- *RideEvent)
+}
+
+// subscriptions returns the number of chair and user subscriptions.
+func (b *eventBus) subscriptions() (int, int) {
+	var chairs, users int
+	func() {
+		b.chairsLock.RLock()
+		defer b.chairsLock.RUnlock()
+
+		for _, chs := range b.chairs {
+			chairs += len(chs)
+		}
+	}()
+	func() {
+		b.usersLock.RLock()
+		defer b.usersLock.RUnlock()
+
+		for _, chs := range b.users {
+			users += len(chs)
+		}
+	}()
+
+	return chairs, users
+}
+
+func (b *eventBus) ChairSubscribe(event string, ch chan<- *RideEvent) {
+	b.chairsLock.Lock()
+	defer b.chairsLock.Unlock()
+
+	b.chairs[event] = append(b.chairs[event], ch)
+}
+
+// ChairUnsubscribe removes ch subscribed by ChairSubscribe. Must be called when the stream exits.
+func (b *eventBus) ChairUnsubscribe(event string, ch chan<- *RideEvent) {
+	b.chairsLock.Lock()
+	defer b.chairsLock.Unlock()
+
+	unsubscribe(b.chairs, event, ch)
+}
+
+func (b *eventBus) ChairPublish(event string, message *RideEvent) {
+	assignRideEventSeq(message)
+	b.chairPublishLocal(event, message)
+	broadcastRideEvent(peerEventKindChair, event, message)
+	for _, hook := range b.chairHooks {
+		hook(event, message)
 	}
 }
 
-var chairStatusGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
-	Name: "chair_status",
-	Help: "chair status",
-}, []string{"status"})
+// OnChairPublish registers hook to observe chair events. Must be called before serving.
+func (b *eventBus) OnChairPublish(hook func(chairID string, message *RideEvent)) {
+	b.chairHooks = append(b.chairHooks, hook)
+}
+
+func (b *eventBus) chairPublishLocal(event string, message *RideEvent) {
+	// 他のインスタンスからのイベントもここを通るので、ここで捨てる
+	invalidateChairNotificationSnapshot(event)
+
+	// blockのときはキューが空くまでdispatchが待つので、ロックを離してから積む。
+	// 購読の変更は新しいスライスを作るので、取り出したスライスはそのまま渡してよい
+	b.chairsLock.RLock()
+	subscribers := b.chairs[event]
+	b.chairsLock.RUnlock()
+
+	b.fanout.dispatch("chair:"+event, subscribers, message)
+}
+
+func (b *eventBus) UserSubscribe(event string, ch chan<- *RideEvent) {
+	b.usersLock.Lock()
+	defer b.usersLock.Unlock()
+
+	b.users[event] = append(b.users[event], ch)
+}
+
+func (b *eventBus) UserUnsubscribe(event string, ch chan<- *RideEvent) {
+	b.usersLock.Lock()
+	defer b.usersLock.Unlock()
+
+	unsubscribe(b.users, event, ch)
+}
+
+// unsubscribe builds a new slice instead of deleting in place, since the old one may still be queued in the fan-out.
+func unsubscribe(subscribers map[string][]chan<- *RideEvent, event string, ch chan<- *RideEvent) {
+	chs := make([]chan<- *RideEvent, 0, len(subscribers[event]))
+	for _, c := range subscribers[event] {
+		if c != ch {
+			chs = append(chs, c)
+		}
+	}
+	if len(chs) == 0 {
+		delete(subscribers, event)
+		return
+	}
+	subscribers[event] = chs
+}
+
+func (b *eventBus) UserPublish(event string, message *RideEvent) {
+	assignRideEventSeq(message)
+	b.userPublishLocal(event, message)
+	broadcastRideEvent(peerEventKindUser, event, message)
+}
+
+func (b *eventBus) userPublishLocal(event string, message *RideEvent) {
+	b.usersLock.RLock()
+	subscribers := b.users[event]
+	b.usersLock.RUnlock()
+
+	b.fanout.dispatch("user:"+event, subscribers, message)
+}
+
+// ChairSubscribe and the functions below are shims over defaultEventBus for code outside the handlers.
+func ChairSubscribe(event string, ch chan<- *RideEvent) {
+	defaultEventBus.ChairSubscribe(event, ch)
+}
+
+func ChairUnsubscribe(event string, ch chan<- *RideEvent) {
+	defaultEventBus.ChairUnsubscribe(event, ch)
+}
+
+func ChairPublish(event string, message *RideEvent) {
+	defaultEventBus.ChairPublish(event, message)
+}
 
 func UserSubscribe(event string, ch chan<- *RideEvent) {
-	userEventBusLock.Lock()
-	defer userEventBusLock.Unlock()
+	defaultEventBus.UserSubscribe(event, ch)
+}
 
-	userEventBus[event] = append(userEventBus[event], ch)
+func UserUnsubscribe(event string, ch chan<- *RideEvent) {
+	defaultEventBus.UserUnsubscribe(event, ch)
 }
 
 func UserPublish(event string, message *RideEvent) {
-	userEventBusLock.RLock()
-	defer userEventBusLock.RUnlock()
-
-	/*userStatusGauge.WithLabelValues(message.status).Inc()
-	switch message.status {
-	case "MATCHING":
-		userStatusGauge.WithLabelValues("COMPLETED").Dec()
-	case "MATCHED":
-		userStatusGauge.WithLabelValues("MATCHING").Dec()
-	case "ENROUTE":
-		userStatusGauge.WithLabelValues("MATCHED").Dec()
-	case "PICKUP":
-		userStatusGauge.WithLabelValues("ENROUTE").Dec()
-	case "CARRYING":
-		userStatusGauge.WithLabelValues("PICKUP").Dec()
-	case "ARRIVED":
-		userStatusGauge.WithLabelValues("CARRYING").Dec()
-	case "COMPLETED":
-		userStatusGauge.WithLabelValues("ARRIVED").Dec()
-	}*/
-
-	for _, ch := range userEventBus[event] {
-		ch <- message
-	}
+	defaultEventBus.UserPublish(event, message)
 }
 
-var userStatusGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
-	Name: "user_status",
-	Help: "user status",
-}, []string{"status"})
+var sseOpenStreamsGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "sse_open_streams",
+	Help: "currently open notification streams",
+}, []string{"stream"})
+
+var sseDroppedEventsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "sse_dropped_events_total",
+	Help: "ride events dropped because a newer event of the ride was already sent",
+}, []string{"stream"})
+
+var sseClosedStreamsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "sse_closed_streams_total",
+	Help: "closed notification streams by reason",
+}, []string{"stream", "reason"})
+
+const (
+	sseCloseReasonError            = "error"
+	sseCloseReasonClientDisconnect = "client_disconnect"
+	sseCloseReasonCompleted        = "completed"
+	// /api/initializeで閉じられた
+	sseCloseReasonReset = "reset"
+)
+
+// trackSSEStream counts stream as open until the returned func is called with the close reason.
+func trackSSEStream(stream string) func(reason string) {
+	sseOpenStreamsGauge.WithLabelValues(stream).Inc()
+	return func(reason string) {
+		sseOpenStreamsGauge.WithLabelValues(stream).Dec()
+		sseClosedStreamsCounter.WithLabelValues(stream, reason).Inc()
+	}
+}
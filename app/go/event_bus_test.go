@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestEventBusUnsubscribe(t *testing.T) {
+	bus := newEventBus(newEventFanout(1, 16, eventBackpressureBlock, 10*time.Millisecond))
+	kept := make(chan *RideEvent, 1)
+	removed := make(chan *RideEvent, 1)
+	bus.UserSubscribe("user", kept)
+	bus.UserSubscribe("user", removed)
+
+	bus.UserUnsubscribe("user", removed)
+	bus.UserPublish("user", &RideEvent{status: "MATCHING"})
+
+	if err := bus.fanout.drain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(kept) != 1 {
+		t.Errorf("subscribed stream got %d events, want 1", len(kept))
+	}
+	if len(removed) != 0 {
+		t.Errorf("unsubscribed stream got %d events, want 0", len(removed))
+	}
+
+	bus.UserUnsubscribe("user", kept)
+	if _, users := bus.subscriptions(); users != 0 {
+		t.Errorf("%d user subscriptions left, want 0", users)
+	}
+}
+
+func TestEventFanoutSkipsStalledSubscriber(t *testing.T) {
+	bus := newEventBus(newEventFanout(1, 16, eventBackpressureBlock, 10*time.Millisecond))
+	// ストリームが抜けたのに購読が残っているのと同じで、誰も受け取らない
+	stalled := make(chan *RideEvent)
+	live := make(chan *RideEvent, 2)
+	bus.ChairSubscribe("chair", stalled)
+	bus.ChairSubscribe("chair", live)
+
+	bus.chairPublishLocal("chair", &RideEvent{status: "ENROUTE"})
+	bus.chairPublishLocal("chair", &RideEvent{status: "PICKUP"})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := bus.fanout.drain(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(live) != 2 {
+		t.Errorf("live stream got %d events, want 2", len(live))
+	}
+}
+
+func TestEventBusSubscribeWhilePublishBlocked(t *testing.T) {
+	bus := newEventBus(newEventFanout(1, 1, eventBackpressureBlock, 200*time.Millisecond))
+	stalled := make(chan *RideEvent)
+	bus.UserSubscribe("user", stalled)
+
+	// ワーカーが1件目で詰まり、2件目でキューが埋まるので、3件目の発行はキューが空くまで待つ
+	bus.UserPublish("user", &RideEvent{status: "MATCHING"})
+	bus.UserPublish("user", &RideEvent{status: "ENROUTE"})
+	published := make(chan struct{})
+	go func() {
+		bus.UserPublish("user", &RideEvent{status: "PICKUP"})
+		close(published)
+	}()
+
+	subscribed := make(chan struct{})
+	go func() {
+		ch := make(chan *RideEvent, 1)
+		bus.UserSubscribe("other", ch)
+		bus.UserUnsubscribe("other", ch)
+		close(subscribed)
+	}()
+	select {
+	case <-subscribed:
+	case <-published:
+		t.Fatal("publish did not block on the full queue")
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("subscribe waited for the blocked publish")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	<-published
+	if err := bus.fanout.drain(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
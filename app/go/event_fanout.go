@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// イベントの配送をハンドラーのgoroutineから切り離すワーカープール
+// 購読キーのハッシュでシャードに振り分け、シャードごとに1つのワーカーが順番に配送するので、同じ椅子・ユーザーへのイベントの順番は変わらない。
+//   - ISUCON_EVENT_SHARDS: シャード数。デフォルトは8
+//   - ISUCON_EVENT_QUEUE: シャードごとのキューの長さ。デフォルトは1024
+//   - ISUCON_EVENT_BACKPRESSURE: キューが溢れたときの挙動。block(デフォルト)なら空くまで待ち、dropなら捨てる
+//   - ISUCON_EVENT_SEND_TIMEOUT_MS: 購読側のチャネルが詰まっているときに待つ時間。デフォルトは100ms。過ぎたらその購読側には捨てる
+
+const (
+	eventBackpressureBlock = "block"
+	eventBackpressureDrop  = "drop"
+)
+
+type fanoutJob struct {
+	subscribers []chan<- *RideEvent
+	message     *RideEvent
+}
+
+type eventFanout struct {
+	shards       []chan fanoutJob
+	backpressure string
+	// 1つの購読側が詰まってもシャード全体が止まらないようにする
+	sendTimeout time.Duration
+	// キューに積まれてから配送し終わるまでのイベントの数
+	pending atomic.Int64
+}
+
+var defaultEventFanout = newEventFanout(
+	parseEventFanoutInt("ISUCON_EVENT_SHARDS", 8),
+	parseEventFanoutInt("ISUCON_EVENT_QUEUE", 1024),
+	parseEventBackpressure(os.Getenv("ISUCON_EVENT_BACKPRESSURE")),
+	time.Duration(parseEventFanoutInt("ISUCON_EVENT_SEND_TIMEOUT_MS", 100))*time.Millisecond,
+)
+
+var (
+	eventFanoutDroppedCounter = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "event_fanout_dropped_total",
+		Help: "ride events dropped because the fan-out queue was full",
+	})
+	eventFanoutBlockedCounter = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "event_fanout_blocked_total",
+		Help: "publishes that waited for the fan-out queue to have room",
+	})
+	eventFanoutSendTimeoutCounter = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "event_fanout_send_timeout_total",
+		Help: "ride events dropped for a subscriber that did not receive them in time",
+	})
+)
+
+func init() {
+	for i, shard := range defaultEventFanout.shards {
+		promauto.NewGaugeFunc(prometheus.GaugeOpts{
+			Name:        "event_fanout_queue_depth",
+			Help:        "ride events waiting in the fan-out queue",
+			ConstLabels: prometheus.Labels{"shard": strconv.Itoa(i)},
+		}, func() float64 {
+			return float64(len(shard))
+		})
+	}
+}
+
+func parseEventFanoutInt(name string, def int) int {
+	s := os.Getenv(name)
+	if s == "" {
+		return def
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n <= 0 {
+		panic(fmt.Sprintf("invalid %s: %q", name, s))
+	}
+	return n
+}
+
+func parseEventBackpressure(s string) string {
+	switch s {
+	case "", eventBackpressureBlock:
+		return eventBackpressureBlock
+	case eventBackpressureDrop:
+		return eventBackpressureDrop
+	default:
+		panic(fmt.Sprintf("invalid ISUCON_EVENT_BACKPRESSURE: %q", s))
+	}
+}
+
+func newEventFanout(shards int, queueSize int, backpressure string, sendTimeout time.Duration) *eventFanout {
+	f := &eventFanout{
+		shards:       make([]chan fanoutJob, shards),
+		backpressure: backpressure,
+		sendTimeout:  sendTimeout,
+	}
+	for i := range f.shards {
+		f.shards[i] = make(chan fanoutJob, queueSize)
+		go f.work(f.shards[i])
+	}
+
+	return f
+}
+
+func (f *eventFanout) work(queue <-chan fanoutJob) {
+	timer := time.NewTimer(f.sendTimeout)
+	timer.Stop()
+
+	for job := range queue {
+		for _, ch := range job.subscribers {
+			f.send(timer, ch, job.message)
+		}
+		f.pending.Add(-1)
+	}
+}
+
+// send delivers message to ch, giving up after sendTimeout so a stalled or already closed stream does not hold up the shard.
+func (f *eventFanout) send(timer *time.Timer, ch chan<- *RideEvent, message *RideEvent) {
+	select {
+	case ch <- message:
+		return
+	default:
+	}
+
+	timer.Reset(f.sendTimeout)
+	defer timer.Stop()
+
+	select {
+	case ch <- message:
+	case <-timer.C:
+		eventFanoutSendTimeoutCounter.Inc()
+		slog.Warn("subscriber did not receive the event in time, dropping event", slog.String("status", message.status))
+	}
+}
+
+// dispatch queues message for subscribers, which must not be modified afterwards.
+// key decides the shard, so messages with the same key are delivered in the order they were dispatched.
+func (f *eventFanout) dispatch(key string, subscribers []chan<- *RideEvent, message *RideEvent) {
+	if len(subscribers) == 0 {
+		return
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	queue := f.shards[h.Sum32()%uint32(len(f.shards))]
+	job := fanoutJob{subscribers: subscribers, message: message}
+
+	f.pending.Add(1)
+	select {
+	case queue <- job:
+		return
+	default:
+	}
+
+	if f.backpressure == eventBackpressureDrop {
+		f.pending.Add(-1)
+		eventFanoutDroppedCounter.Inc()
+		slog.Warn("event fan-out queue is full, dropping event", slog.String("key", key), slog.String("status", message.status))
+		return
+	}
+
+	eventFanoutBlockedCounter.Inc()
+	queue <- job
+}
+
+// drain waits until every dispatched event has been delivered to its subscribers.
+func (f *eventFanout) drain(ctx context.Context) error {
+	ticker := time.NewTicker(time.Millisecond)
+	defer ticker.Stop()
+
+	for f.pending.Load() > 0 {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%d events are still pending: %w", f.pending.Load(), ctx.Err())
+		case <-ticker.C:
+		}
+	}
+
+	return nil
+}
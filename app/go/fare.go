@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+)
+
+// 料金の設定
+// settingsテーブルのinitial_fareとfare_per_distanceから読み、無ければデフォルトの値を使う。
+// PUT /api/internal/configで差し替えられる。ライドの料金はその時点の設定で計算するので、
+// 差し替え前に見積もったライドでも評価時の設定で請求する。
+type fareConfig struct {
+	InitialFare     int `json:"initial_fare"`
+	FarePerDistance int `json:"fare_per_distance"`
+}
+
+var defaultFareConfig = &fareConfig{
+	InitialFare:     500,
+	FarePerDistance: 100,
+}
+
+var activeFareConfig atomic.Pointer[fareConfig]
+
+func init() {
+	activeFareConfig.Store(defaultFareConfig)
+	registerReset(func() {
+		activeFareConfig.Store(defaultFareConfig)
+	})
+}
+
+func currentFareConfig() *fareConfig {
+	return activeFareConfig.Load()
+}
+
+// fare returns the fare for distance after applying discount to the metered part.
+func (c *fareConfig) fare(distance int, discount int) int {
+	return c.InitialFare + max(c.FarePerDistance*distance-discount, 0)
+}
+
+func initFareConfig() error {
+	var settings []struct {
+		Name  string `db:"name"`
+		Value string `db:"value"`
+	}
+	if err := db.Select(&settings, "SELECT name, value FROM settings WHERE name IN ('initial_fare', 'fare_per_distance')"); err != nil {
+		return fmt.Errorf("failed to select fare settings: %w", err)
+	}
+
+	config := *defaultFareConfig
+	for _, setting := range settings {
+		v, err := strconv.Atoi(setting.Value)
+		if err != nil {
+			return fmt.Errorf("invalid %s setting: %w", setting.Name, err)
+		}
+		switch setting.Name {
+		case "initial_fare":
+			config.InitialFare = v
+		case "fare_per_distance":
+			config.FarePerDistance = v
+		}
+	}
+	activeFareConfig.Store(&config)
+
+	return nil
+}
+
+type internalConfig struct {
+	Fare *fareConfig `json:"fare"`
+}
+
+func (req *internalConfig) Validate() error {
+	v := validation{}
+	if req.Fare != nil {
+		v.between("fare.initial_fare", req.Fare.InitialFare, 0, 100000)
+		v.between("fare.fare_per_distance", req.Fare.FarePerDistance, 0, 100000)
+	}
+	return v.err("invalid config")
+}
+
+func (s *Server) internalGetConfig(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, &internalConfig{Fare: currentFareConfig()})
+}
+
+// PUT /api/internal/config
+//
+// 指定されたセクションだけを差し替える。
+func (s *Server) internalPutConfig(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	req := &internalConfig{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	if req.Fare != nil {
+		if _, err := s.db.ExecContext(
+			ctx,
+			"INSERT INTO settings (name, value) VALUES ('initial_fare', ?), ('fare_per_distance', ?) ON DUPLICATE KEY UPDATE value = VALUES(value)",
+			strconv.Itoa(req.Fare.InitialFare), strconv.Itoa(req.Fare.FarePerDistance),
+		); err != nil {
+			writeError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		activeFareConfig.Store(req.Fare)
+	}
+
+	writeJSON(w, http.StatusOK, &internalConfig{Fare: currentFareConfig()})
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/oklog/ulid/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// ローカル開発や動作確認用のデータをYAML/JSONで定義してMySQLとオンメモリのキャッシュに投入する
+// JSONはYAMLとしてそのまま読めるので、どちらもyaml.v3でデコードする
+//
+//	./isuride fixtures -target http://localhost:8080 fixtures.yaml
+//
+// IDやトークンは省略すると生成する。rideのstatusを省略すると、椅子があればCOMPLETED、無ければMATCHINGになる。
+type fixtureSet struct {
+	Owners  []fixtureOwner  `yaml:"owners"`
+	Chairs  []fixtureChair  `yaml:"chairs"`
+	Users   []fixtureUser   `yaml:"users"`
+	Rides   []fixtureRide   `yaml:"rides"`
+	Coupons []fixtureCoupon `yaml:"coupons"`
+}
+
+type fixtureOwner struct {
+	ID                 string `yaml:"id"`
+	Name               string `yaml:"name"`
+	AccessToken        string `yaml:"access_token"`
+	ChairRegisterToken string `yaml:"chair_register_token"`
+}
+
+type fixtureChair struct {
+	ID          string      `yaml:"id"`
+	OwnerID     string      `yaml:"owner_id"`
+	Name        string      `yaml:"name"`
+	Model       string      `yaml:"model"`
+	IsActive    bool        `yaml:"is_active"`
+	AccessToken string      `yaml:"access_token"`
+	Location    *Coordinate `yaml:"location"`
+}
+
+type fixtureUser struct {
+	ID             string `yaml:"id"`
+	Username       string `yaml:"username"`
+	Firstname      string `yaml:"firstname"`
+	Lastname       string `yaml:"lastname"`
+	DateOfBirth    string `yaml:"date_of_birth"`
+	AccessToken    string `yaml:"access_token"`
+	InvitationCode string `yaml:"invitation_code"`
+	PaymentToken   string `yaml:"payment_token"`
+}
+
+type fixtureRide struct {
+	ID          string     `yaml:"id"`
+	UserID      string     `yaml:"user_id"`
+	ChairID     string     `yaml:"chair_id"`
+	Pickup      Coordinate `yaml:"pickup"`
+	Destination Coordinate `yaml:"destination"`
+	Status      string     `yaml:"status"`
+	Evaluation  *int       `yaml:"evaluation"`
+}
+
+type fixtureCoupon struct {
+	UserID   string  `yaml:"user_id"`
+	Code     string  `yaml:"code"`
+	Discount int     `yaml:"discount"`
+	UsedBy   *string `yaml:"used_by"`
+}
+
+func decodeFixtures(r io.Reader) (*fixtureSet, error) {
+	fixtures := &fixtureSet{}
+	if err := yaml.NewDecoder(r).Decode(fixtures); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("failed to decode fixtures: %w", err)
+	}
+	return fixtures, nil
+}
+
+// loadFixtures inserts fixtures into MySQL and rebuilds the caches and badger from it.
+func loadFixtures(ctx context.Context, fixtures *fixtureSet) error {
+	now := clock.Now().Truncate(time.Microsecond)
+
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, o := range fixtures.Owners {
+		owner := Owner{
+			ID:                 orDefault(o.ID, ulid.Make().String()),
+			Name:               o.Name,
+			AccessToken:        hashToken(orDefault(o.AccessToken, secureRandomStr(32))),
+			ChairRegisterToken: hashToken(orDefault(o.ChairRegisterToken, secureRandomStr(32))),
+			CreatedAt:          now,
+			UpdatedAt:          now,
+		}
+		if _, err := tx.NamedExecContext(ctx, "INSERT INTO owners (id, name, access_token, chair_register_token, created_at, updated_at) VALUES (:id, :name, :access_token, :chair_register_token, :created_at, :updated_at)", owner); err != nil {
+			return fmt.Errorf("failed to insert owner %s: %w", owner.Name, err)
+		}
+	}
+
+	for _, c := range fixtures.Chairs {
+		chair := Chair{
+			ID:          orDefault(c.ID, ulid.Make().String()),
+			OwnerID:     c.OwnerID,
+			Name:        c.Name,
+			Model:       c.Model,
+			IsActive:    c.IsActive,
+			AccessToken: hashToken(orDefault(c.AccessToken, secureRandomStr(32))),
+			CreatedAt:   now,
+			UpdatedAt:   now,
+		}
+		if _, err := tx.NamedExecContext(ctx, "INSERT INTO chairs (id, owner_id, name, model, speed, is_active, access_token, created_at, updated_at) VALUES (:id, :owner_id, :name, :model, (SELECT speed FROM chair_models WHERE name = :model), :is_active, :access_token, :created_at, :updated_at)", chair); err != nil {
+			return fmt.Errorf("failed to insert chair %s: %w", chair.Name, err)
+		}
+
+		if c.Location != nil {
+			if _, err := tx.ExecContext(ctx, "INSERT INTO chair_locations (id, chair_id, latitude, longitude, created_at) VALUES (?, ?, ?, ?, ?)", ulid.Make().String(), chair.ID, c.Location.Latitude, c.Location.Longitude, now); err != nil {
+				return fmt.Errorf("failed to insert chair location of %s: %w", chair.Name, err)
+			}
+		}
+	}
+
+	for _, u := range fixtures.Users {
+		user := User{
+			ID:             orDefault(u.ID, ulid.Make().String()),
+			Username:       u.Username,
+			Firstname:      u.Firstname,
+			Lastname:       u.Lastname,
+			DateOfBirth:    u.DateOfBirth,
+			AccessToken:    hashToken(orDefault(u.AccessToken, secureRandomStr(32))),
+			InvitationCode: orDefault(u.InvitationCode, secureRandomStr(15)),
+			CreatedAt:      now,
+			UpdatedAt:      now,
+		}
+		if _, err := tx.NamedExecContext(ctx, "INSERT INTO users (id, username, firstname, lastname, date_of_birth, access_token, invitation_code, created_at, updated_at) VALUES (:id, :username, :firstname, :lastname, :date_of_birth, :access_token, :invitation_code, :created_at, :updated_at)", user); err != nil {
+			return fmt.Errorf("failed to insert user %s: %w", user.Username, err)
+		}
+
+		if u.PaymentToken != "" {
+			if _, err := tx.ExecContext(ctx, "INSERT INTO payment_tokens (user_id, token, created_at) VALUES (?, ?, ?)", user.ID, u.PaymentToken, now); err != nil {
+				return fmt.Errorf("failed to insert payment token of %s: %w", user.Username, err)
+			}
+		}
+	}
+
+	for i, r := range fixtures.Rides {
+		// 作成順を保つために1µsずつずらす
+		createdAt := now.Add(time.Duration(i) * time.Microsecond)
+		ride := Ride{
+			ID:                   orDefault(r.ID, ulid.Make().String()),
+			UserID:               r.UserID,
+			ChairID:              sql.NullString{String: r.ChairID, Valid: r.ChairID != ""},
+			PickupLatitude:       r.Pickup.Latitude,
+			PickupLongitude:      r.Pickup.Longitude,
+			DestinationLatitude:  r.Destination.Latitude,
+			DestinationLongitude: r.Destination.Longitude,
+			Evaluation:           r.Evaluation,
+			CreatedAt:            createdAt,
+			UpdatedAt:            createdAt,
+		}
+		if _, err := tx.NamedExecContext(ctx, "INSERT INTO rides (id, user_id, chair_id, pickup_latitude, pickup_longitude, destination_latitude, destination_longitude, evaluation, created_at, updated_at) VALUES (:id, :user_id, :chair_id, :pickup_latitude, :pickup_longitude, :destination_latitude, :destination_longitude, :evaluation, :created_at, :updated_at)", ride); err != nil {
+			return fmt.Errorf("failed to insert ride %s: %w", ride.ID, err)
+		}
+
+		status := r.Status
+		if status == "" {
+			status = "MATCHING"
+			if ride.ChairID.Valid {
+				status = "COMPLETED"
+			}
+		}
+		if err := insertFixtureRideStatuses(ctx, tx, ride.ID, status, createdAt); err != nil {
+			return err
+		}
+	}
+
+	for _, c := range fixtures.Coupons {
+		if _, err := tx.ExecContext(ctx, "INSERT INTO coupons (user_id, code, discount, created_at, used_by) VALUES (?, ?, ?, ?, ?)", c.UserID, c.Code, c.Discount, now, c.UsedBy); err != nil {
+			return fmt.Errorf("failed to insert coupon %s: %w", c.Code, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if err := initRideSales(); err != nil {
+		return err
+	}
+	if err := initInvitationUses(); err != nil {
+		return err
+	}
+
+	// 書き込み待ちを反映してから、/api/initializeと同じ手順でMySQLからキャッシュを組み立て直す
+	if err := flushRides(ctx); err != nil {
+		return err
+	}
+	resetAll()
+	if err := initBadger(); err != nil {
+		return err
+	}
+	if err := loadCaches(); err != nil {
+		return err
+	}
+
+	// マッチング待ちのライドはキャッシュの初期化では戻らないのでキューに積み直す
+	rideStatusesCache.Range(func(rideID string, status *RideStatus) bool {
+		if status.Status != "MATCHING" {
+			return true
+		}
+		if ride, ok := rideCache.Load(rideID); ok && !ride.ChairID.Valid {
+			enqueueMatchingRide(ride)
+		}
+		return true
+	})
+
+	return nil
+}
+
+var fixtureRideStatuses = []string{"MATCHING", "ENROUTE", "PICKUP", "CARRYING", "ARRIVED", "COMPLETED"}
+
+// insertFixtureRideStatuses inserts the status history of a ride up to status.
+func insertFixtureRideStatuses(ctx context.Context, tx *sqlx.Tx, rideID string, status string, createdAt time.Time) error {
+	for i, s := range fixtureRideStatuses {
+		at := createdAt.Add(time.Duration(i) * time.Microsecond)
+		if _, err := tx.ExecContext(ctx, "INSERT INTO ride_statuses (id, ride_id, status, created_at, app_sent_at, chair_sent_at) VALUES (?, ?, ?, ?, ?, ?)", ulid.Make().String(), rideID, s, at, at, at); err != nil {
+			return fmt.Errorf("failed to insert ride status of %s: %w", rideID, err)
+		}
+		if s == status {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("unknown ride status %q for ride %s", status, rideID)
+}
+
+func orDefault(v string, def string) string {
+	if v == "" {
+		return def
+	}
+	return v
+}
+
+func (s *Server) internalPostFixtures(w http.ResponseWriter, r *http.Request) {
+	fixtures, err := decodeFixtures(r.Body)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, badRequest(err.Error()))
+		return
+	}
+
+	if err := loadFixtures(r.Context(), fixtures); err != nil {
+		writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// postFixtures posts fixtures in YAML to /api/internal/fixtures of the server at target.
+func postFixtures(target string, b []byte) (*http.Response, error) {
+	req, err := newInternalRequest(context.Background(), http.MethodPost, strings.TrimSuffix(target, "/")+"/api/internal/fixtures", "application/yaml", bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	return http.DefaultClient.Do(req)
+}
+
+// runFixtures posts fixture files to a running server.
+func runFixtures(args []string) {
+	fs := flag.NewFlagSet("fixtures", flag.ExitOnError)
+	target := fs.String("target", "http://localhost:8080", "target base URL")
+	fs.Parse(args)
+
+	for _, path := range fs.Args() {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to read %s: %v\n", path, err)
+			os.Exit(1)
+		}
+
+		res, err := postFixtures(*target, b)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to load %s: %v\n", path, err)
+			os.Exit(1)
+		}
+		body, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		if res.StatusCode >= http.StatusBadRequest {
+			fmt.Fprintf(os.Stderr, "failed to load %s: %d: %s\n", path, res.StatusCode, body)
+			os.Exit(1)
+		}
+	}
+}
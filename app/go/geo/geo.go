@@ -0,0 +1,51 @@
+// Package geo provides the distance metrics used for fares, matching and chair mileage.
+package geo
+
+import "math"
+
+// Distance measures the distance between two integer coordinates.
+type Distance interface {
+	Between(aLatitude, aLongitude, bLatitude, bLongitude int) int
+}
+
+// Manhattan is the metric of the contest world: |Δlatitude| + |Δlongitude|.
+type Manhattan struct{}
+
+func (Manhattan) Between(aLatitude, aLongitude, bLatitude, bLongitude int) int {
+	return abs(aLatitude-bLatitude) + abs(aLongitude-bLongitude)
+}
+
+func abs(a int) int {
+	if a < 0 {
+		return -a
+	}
+	return a
+}
+
+const earthRadiusMeters = 6371008.8
+
+// Haversine treats coordinates as fixed-point degrees and returns the great-circle distance.
+// 実座標のデータで手元の実験をするためのもので、ベンチマーク中は使わない。
+type Haversine struct {
+	// DegreesPerUnit converts a coordinate value to degrees, e.g. 1e-6 for microdegrees.
+	DegreesPerUnit float64
+	// MetersPerUnit is the length of one unit of the returned distance.
+	MetersPerUnit float64
+}
+
+// NewHaversine returns a Haversine over microdegree coordinates measuring in meters.
+func NewHaversine() Haversine {
+	return Haversine{DegreesPerUnit: 1e-6, MetersPerUnit: 1}
+}
+
+func (h Haversine) Between(aLatitude, aLongitude, bLatitude, bLongitude int) int {
+	toRad := h.DegreesPerUnit * math.Pi / 180
+	lat1, lat2 := float64(aLatitude)*toRad, float64(bLatitude)*toRad
+	dLat := lat2 - lat1
+	dLon := float64(bLongitude-aLongitude) * toRad
+
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	meters := 2 * earthRadiusMeters * math.Asin(math.Sqrt(min(a, 1)))
+
+	return int(math.Round(meters / h.MetersPerUnit))
+}
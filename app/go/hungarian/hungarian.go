@@ -0,0 +1,155 @@
+// Package hungarian solves the minimum-cost assignment problem with the Hungarian algorithm.
+package hungarian
+
+import (
+	"math"
+	"sync"
+)
+
+// scratch holds the working buffers of one Solve call.
+// マッチングのたびに確保し直さないよう、sync.Poolで使い回す。
+type scratch struct {
+	cost []float64
+	u    []float64
+	v    []float64
+	minv []float64
+	p    []int
+	way  []int
+	used []bool
+}
+
+var scratchPool = sync.Pool{
+	New: func() any {
+		return &scratch{}
+	},
+}
+
+func (s *scratch) reset(n int) {
+	s.cost = grow(s.cost, n*n)
+	s.u = grow(s.u, n+1)
+	s.v = grow(s.v, n+1)
+	s.minv = grow(s.minv, n+1)
+	s.p = grow(s.p, n+1)
+	s.way = grow(s.way, n+1)
+	s.used = grow(s.used, n+1)
+}
+
+func grow[T any](buf []T, n int) []T {
+	if cap(buf) < n {
+		return make([]T, n)
+	}
+	buf = buf[:n]
+	clear(buf)
+	return buf
+}
+
+// Solve returns the assignment minimizing the total cost.
+// cost[i][j] is the cost of assigning row i to column j; all rows must have the same length.
+// Rectangular input is padded with zero-cost dummy rows or columns, so with more rows than columns
+// some rows stay unassigned.
+// The result maps each row to its column, or -1 when the row is unassigned.
+//
+// Costs must be finite. Use a large cost for pairs that must not be assigned and drop them afterwards.
+func Solve(cost [][]float64) []int {
+	rows := len(cost)
+	if rows == 0 {
+		return []int{}
+	}
+	cols := len(cost[0])
+	assignment := make([]int, rows)
+	for i := range assignment {
+		assignment[i] = -1
+	}
+	if cols == 0 {
+		return assignment
+	}
+
+	n := max(rows, cols)
+	s := scratchPool.Get().(*scratch)
+	defer scratchPool.Put(s)
+	s.reset(n)
+
+	for i := range rows {
+		copy(s.cost[i*n:i*n+cols], cost[i])
+	}
+
+	solve(s, n)
+
+	// p[j]はj列目(1始まり)に割り当てた行(1始まり)
+	for j := 1; j <= n; j++ {
+		i := s.p[j] - 1
+		if i < rows && j-1 < cols {
+			assignment[i] = j - 1
+		}
+	}
+
+	return assignment
+}
+
+// solve runs the O(n^3) potential-based algorithm on the n x n matrix in s.cost.
+func solve(s *scratch, n int) {
+	u, v, minv, p, way, used := s.u, s.v, s.minv, s.p, s.way, s.used
+
+	for i := 1; i <= n; i++ {
+		p[0] = i
+		j0 := 0
+		for j := range minv {
+			minv[j] = math.Inf(1)
+			used[j] = false
+		}
+
+		for {
+			used[j0] = true
+			i0 := p[j0]
+			delta := math.Inf(1)
+			j1 := 0
+			row := s.cost[(i0-1)*n : i0*n]
+			for j := 1; j <= n; j++ {
+				if used[j] {
+					continue
+				}
+				cur := row[j-1] - u[i0] - v[j]
+				if cur < minv[j] {
+					minv[j] = cur
+					way[j] = j0
+				}
+				if minv[j] < delta {
+					delta = minv[j]
+					j1 = j
+				}
+			}
+
+			for j := 0; j <= n; j++ {
+				if used[j] {
+					u[p[j]] += delta
+					v[j] -= delta
+				} else {
+					minv[j] -= delta
+				}
+			}
+
+			j0 = j1
+			if p[j0] == 0 {
+				break
+			}
+		}
+
+		// 増加路をたどって割り当てを入れ替える
+		for j0 != 0 {
+			j1 := way[j0]
+			p[j0] = p[j1]
+			j0 = j1
+		}
+	}
+}
+
+// Cost returns the total cost of assignment as returned by Solve.
+func Cost(cost [][]float64, assignment []int) float64 {
+	total := 0.0
+	for i, j := range assignment {
+		if j >= 0 {
+			total += cost[i][j]
+		}
+	}
+	return total
+}
@@ -0,0 +1,202 @@
+package hungarian
+
+import (
+	"math"
+	"math/rand/v2"
+	"testing"
+)
+
+// bruteForce returns the minimum total cost over the assignments of min(rows, cols) pairs.
+func bruteForce(cost [][]float64) float64 {
+	rows := len(cost)
+	if rows == 0 || len(cost[0]) == 0 {
+		return 0
+	}
+	cols := len(cost[0])
+	want := min(rows, cols)
+
+	used := make([]bool, cols)
+	best := math.Inf(1)
+	var search func(i, assigned int, total float64)
+	search = func(i, assigned int, total float64) {
+		if assigned+(rows-i) < want {
+			return
+		}
+		if i == rows {
+			best = min(best, total)
+			return
+		}
+		// 行より列が少ないときは割り当てない行がある
+		search(i+1, assigned, total)
+		for j := range cols {
+			if used[j] {
+				continue
+			}
+			used[j] = true
+			search(i+1, assigned+1, total+cost[i][j])
+			used[j] = false
+		}
+	}
+	search(0, 0, 0)
+
+	return best
+}
+
+func randomCost(rnd *rand.Rand, rows, cols int) [][]float64 {
+	cost := make([][]float64, rows)
+	for i := range cost {
+		cost[i] = make([]float64, cols)
+		for j := range cost[i] {
+			cost[i][j] = math.Round(rnd.Float64()*2000-1000) / 10
+		}
+	}
+	return cost
+}
+
+func checkAssignment(t *testing.T, cost [][]float64, assignment []int) {
+	t.Helper()
+
+	rows := len(cost)
+	if len(assignment) != rows {
+		t.Fatalf("len(assignment) = %d, want %d", len(assignment), rows)
+	}
+	cols := 0
+	if rows > 0 {
+		cols = len(cost[0])
+	}
+
+	assigned := 0
+	usedCols := map[int]struct{}{}
+	for i, j := range assignment {
+		if j < 0 {
+			continue
+		}
+		if j >= cols {
+			t.Fatalf("row %d is assigned to column %d out of %d", i, j, cols)
+		}
+		if _, ok := usedCols[j]; ok {
+			t.Fatalf("column %d is assigned twice: %v", j, assignment)
+		}
+		usedCols[j] = struct{}{}
+		assigned++
+	}
+	if want := min(rows, cols); assigned != want {
+		t.Fatalf("%d rows are assigned, want %d: %v", assigned, want, assignment)
+	}
+
+	if got, want := Cost(cost, assignment), bruteForce(cost); math.Abs(got-want) > 1e-6 {
+		t.Fatalf("cost = %v, want %v: cost matrix %v, assignment %v", got, want, cost, assignment)
+	}
+}
+
+func TestSolve(t *testing.T) {
+	tests := []struct {
+		name     string
+		cost     [][]float64
+		expected []int
+	}{
+		{
+			name:     "empty",
+			cost:     [][]float64{},
+			expected: []int{},
+		},
+		{
+			name:     "no columns",
+			cost:     [][]float64{{}, {}},
+			expected: []int{-1, -1},
+		},
+		{
+			name:     "diagonal",
+			cost:     [][]float64{{1, 10, 10}, {10, 1, 10}, {10, 10, 1}},
+			expected: []int{0, 1, 2},
+		},
+		{
+			name:     "greedy is not optimal",
+			cost:     [][]float64{{1, 2}, {2, 100}},
+			expected: []int{1, 0},
+		},
+		{
+			name:     "more rows than columns",
+			cost:     [][]float64{{5}, {1}, {3}},
+			expected: []int{-1, 0, -1},
+		},
+		{
+			name:     "more columns than rows",
+			cost:     [][]float64{{5, 1, 3}},
+			expected: []int{1},
+		},
+		{
+			name:     "negative costs",
+			cost:     [][]float64{{-1e6 + 3, 4}, {-1e6 + 1, 5}},
+			expected: []int{1, 0},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assignment := Solve(tt.cost)
+			if len(assignment) != len(tt.expected) {
+				t.Fatalf("Solve = %v, want %v", assignment, tt.expected)
+			}
+			for i := range assignment {
+				if assignment[i] != tt.expected[i] {
+					t.Fatalf("Solve = %v, want %v", assignment, tt.expected)
+				}
+			}
+		})
+	}
+}
+
+func TestSolveSquare(t *testing.T) {
+	rnd := rand.New(rand.NewPCG(1, 2))
+	for range 500 {
+		n := rnd.IntN(7) + 1
+		cost := randomCost(rnd, n, n)
+		checkAssignment(t, cost, Solve(cost))
+	}
+}
+
+func TestSolveRectangular(t *testing.T) {
+	rnd := rand.New(rand.NewPCG(3, 4))
+	for range 500 {
+		rows, cols := rnd.IntN(7)+1, rnd.IntN(7)+1
+		cost := randomCost(rnd, rows, cols)
+		checkAssignment(t, cost, Solve(cost))
+	}
+}
+
+// 前の呼び出しで大きくなったバッファを小さい問題で使い回しても、前の値が残らない
+func TestSolveReusesScratch(t *testing.T) {
+	rnd := rand.New(rand.NewPCG(5, 6))
+	for range 200 {
+		large := randomCost(rnd, 8, 8)
+		checkAssignment(t, large, Solve(large))
+
+		rows, cols := rnd.IntN(5)+1, rnd.IntN(5)+1
+		small := randomCost(rnd, rows, cols)
+
+		// 同じgoroutineでPutした直後のGetは同じscratchを返すことが多いが、保証はないので直接確かめる
+		s := scratchPool.Get().(*scratch)
+		s.reset(8)
+		for i := range s.cost {
+			s.cost[i] = -1e9
+		}
+		for i := range s.u {
+			s.u[i], s.v[i], s.minv[i] = 1e9, -1e9, -1e9
+			s.p[i], s.way[i], s.used[i] = 3, 5, true
+		}
+		scratchPool.Put(s)
+
+		checkAssignment(t, small, Solve(small))
+	}
+}
+
+func BenchmarkSolve(b *testing.B) {
+	rnd := rand.New(rand.NewPCG(7, 8))
+	cost := randomCost(rnd, 200, 200)
+
+	b.ReportAllocs()
+	for b.Loop() {
+		Solve(cost)
+	}
+}
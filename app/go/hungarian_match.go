@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/isucon/isucon14/webapp/go/hungarian"
+)
+
+// ISUCON_MATCHING=hungarian のとき、迎車にかかる時間(迎車距離 / 椅子の速さ)の合計が最小になるようにハンガリアン法で割り当てる
+// 計算量がO(n^3)なので、ライドか椅子の数がISUCON_HUNGARIAN_THRESHOLD(デフォルト200)を超えたtickは貪欲法(greedyMatch)に戻す。
+// 椅子より多いライドは割り当てられずに残る。待たせすぎたライド(greedyMatchと同じく22秒)は、どの椅子でも割り当てられる側に回るよう費用を下げる。
+const (
+	matchingGreedy    = "greedy"
+	matchingHungarian = "hungarian"
+
+	hungarianOverdueAge   = 22 * time.Second
+	hungarianOverdueBonus = 1e6
+)
+
+var (
+	matchingMode       = parseMatchingMode(os.Getenv("ISUCON_MATCHING"))
+	hungarianThreshold = parseHungarianThreshold(os.Getenv("ISUCON_HUNGARIAN_THRESHOLD"))
+)
+
+func parseMatchingMode(s string) string {
+	switch s {
+	case "":
+		return matchingGreedy
+	case matchingGreedy, matchingHungarian:
+		return s
+	default:
+		panic(fmt.Sprintf("invalid ISUCON_MATCHING: %q", s))
+	}
+}
+
+func parseHungarianThreshold(s string) int {
+	if s == "" {
+		return 200
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n <= 0 {
+		panic(fmt.Sprintf("invalid ISUCON_HUNGARIAN_THRESHOLD: %q", s))
+	}
+	return n
+}
+
+// matchChairs assigns chairs to rides with the configured matching mode.
+func matchChairs(rides []*Ride, chairs []*Chair, locations map[string]*chairLocation, now time.Time, benchStartedAt time.Time) []matchedPair {
+	if matchingMode == matchingHungarian && max(len(rides), len(chairs)) <= hungarianThreshold {
+		return hungarianMatch(rides, chairs, locations, now)
+	}
+	return greedyMatch(rides, chairs, locations, now, benchStartedAt)
+}
+
+// hungarianMatch assigns chairs to rides minimizing the total time to reach the pickups.
+// Chairs without a known location are never assigned.
+func hungarianMatch(rides []*Ride, chairs []*Chair, locations map[string]*chairLocation, now time.Time) []matchedPair {
+	located := make([]*Chair, 0, len(chairs))
+	for _, ch := range chairs {
+		if _, ok := locations[ch.ID]; ok {
+			located = append(located, ch)
+		}
+	}
+	if len(rides) == 0 || len(located) == 0 {
+		return nil
+	}
+
+	cost := make([][]float64, len(rides))
+	for i, ride := range rides {
+		cost[i] = make([]float64, len(located))
+		bonus := 0.0
+		if now.Sub(ride.CreatedAt) > hungarianOverdueAge {
+			bonus = hungarianOverdueBonus
+		}
+		for j, ch := range located {
+			location := locations[ch.ID]
+			distance := float64(calculateDistance(ride.PickupLatitude, ride.PickupLongitude, location.LastLatitude, location.LastLongitude))
+			// Solveは有限の費用しか受け付けないので、速さの分からない椅子は1として扱う
+			cost[i][j] = distance/(float64(max(ch.Speed, 1))*chairSpeedRatio(ch.ID)) - bonus
+		}
+	}
+
+	matched := []matchedPair{}
+	for i, j := range hungarian.Solve(cost) {
+		if j >= 0 {
+			matched = append(matched, matchedPair{ride: rides[i], chair: located[j]})
+		}
+	}
+
+	return matched
+}
@@ -0,0 +1,362 @@
+//go:build integration
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bytedance/sonic"
+	"github.com/go-sql-driver/mysql"
+	"github.com/ory/dockertest/v3"
+	"github.com/ory/dockertest/v3/docker"
+)
+
+// MySQLをコンテナで立てて、ハンドラーを通してライドの作成から評価までを確かめる
+// Dockerが必要なので、ビルドタグを付けたときだけ動かす。
+//
+//	go test -tags integration -run Integration ./...
+//
+// イメージはISUCON_INTEGRATION_MYSQL_IMAGEで変えられる(既定はmysql:8.0)。
+
+const integrationEventTimeout = 10 * time.Second
+
+func TestIntegrationRideLifecycle(t *testing.T) {
+	startIntegrationMySQL(t)
+	payments := startIntegrationPaymentGateway(t)
+
+	srv := httptest.NewServer(setup())
+	t.Cleanup(srv.Close)
+	startMatcher()
+	startRideOutboxDispatcher()
+
+	lg := &loadgen{target: srv.URL, stats: map[string]*loadgenStat{}}
+	if err := lg.newClient().post("POST /api/initialize", "/api/initialize", &postInitializeRequest{PaymentServer: payments.URL}, nil); err != nil {
+		t.Fatalf("failed to initialize: %v", err)
+	}
+	t.Cleanup(func() {
+		resume := pauseBackgroundWork()
+		badgerDB.Close()
+		resume()
+	})
+
+	// オーナーと椅子
+	owner := lg.newClient()
+	ownerRes := &ownerPostOwnersResponse{}
+	if err := owner.post("POST /api/owner/owners", "/api/owner/owners", &ownerPostOwnersRequest{Name: "integration-owner"}, ownerRes); err != nil {
+		t.Fatal(err)
+	}
+	me := &ownerGetMeResponse{}
+	integrationGet(t, owner, "/api/owner/me", me)
+	if me.ID != ownerRes.ID || me.ChairRegisterToken != "" {
+		t.Errorf("GET /api/owner/me = %+v, want owner %s without chair_register_token", me, ownerRes.ID)
+	}
+
+	chair := lg.newClient()
+	chairRes := &chairPostChairsResponse{}
+	if err := chair.post("POST /api/chair/chairs", "/api/chair/chairs", &chairPostChairsRequest{
+		Name:               "integration-chair",
+		Model:              "リラックスシート NEO",
+		ChairRegisterToken: ownerRes.ChairRegisterToken,
+	}, chairRes); err != nil {
+		t.Fatal(err)
+	}
+	if err := chair.post("POST /api/chair/coordinate", "/api/chair/coordinate", &Coordinate{Latitude: 0, Longitude: 0}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := chair.post("POST /api/chair/activity", "/api/chair/activity", &postChairActivityRequest{IsActive: true}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// 利用者とライド
+	user := lg.newClient()
+	if err := user.post("POST /api/app/users", "/api/app/users", &appPostUsersRequest{
+		Username:    "integration-user",
+		FirstName:   "Integration",
+		LastName:    "User",
+		DateOfBirth: "2000-01-01",
+	}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := user.post("POST /api/app/payment-methods", "/api/app/payment-methods", &appPostPaymentMethodsRequest{Token: "integration-token"}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	pickup := Coordinate{Latitude: 1, Longitude: 1}
+	destination := Coordinate{Latitude: 3, Longitude: 4}
+	rideRes := &appPostRidesResponse{}
+	if err := user.post("POST /api/app/rides", "/api/app/rides", &appPostRidesRequest{
+		PickupCoordinate:      &pickup,
+		DestinationCoordinate: &destination,
+	}, rideRes); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	appEvents := integrationStream(ctx, user, "/api/app/notification")
+	chairEvents := integrationStream(ctx, chair, "/api/chair/notification")
+
+	waitIntegrationEvent(t, "app", appEvents, rideRes.RideID, "MATCHING")
+	// 割り当て後に繋いだ椅子には、割り当て済みのMATCHINGとしてスナップショットが届く
+	matched := waitIntegrationEvent(t, "chair", chairEvents, rideRes.RideID, "MATCHED", "MATCHING")
+	if matched.PickupCoordinate != pickup || matched.DestinationCoordinate != destination {
+		t.Errorf("MATCHED coordinates = %+v -> %+v, want %+v -> %+v", matched.PickupCoordinate, matched.DestinationCoordinate, pickup, destination)
+	}
+
+	// 配車位置へ向かい、乗せて、目的地まで運ぶ
+	for _, step := range []struct {
+		status     string
+		coordinate *Coordinate
+		want       string
+	}{
+		{status: "ENROUTE", want: "ENROUTE"},
+		{coordinate: &pickup, want: "PICKUP"},
+		{status: "CARRYING", want: "CARRYING"},
+		{coordinate: &destination, want: "ARRIVED"},
+	} {
+		if step.status != "" {
+			if err := chair.post("POST /api/chair/rides/{ride_id}/status", "/api/chair/rides/"+rideRes.RideID+"/status", &postChairRidesRideIDStatusRequest{Status: step.status}, nil); err != nil {
+				t.Fatal(err)
+			}
+		} else {
+			if err := chair.post("POST /api/chair/coordinate", "/api/chair/coordinate", step.coordinate, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		waitIntegrationEvent(t, "chair", chairEvents, rideRes.RideID, step.want)
+		waitIntegrationEvent(t, "app", appEvents, rideRes.RideID, step.want)
+	}
+
+	evaluationRes := &appPostRideEvaluationResponse{}
+	if err := user.post("POST /api/app/rides/{ride_id}/evaluation", "/api/app/rides/"+rideRes.RideID+"/evaluation", &appPostRideEvaluationRequest{Evaluation: 5}, evaluationRes); err != nil {
+		t.Fatal(err)
+	}
+	if evaluationRes.CompletedAt == 0 {
+		t.Error("completed_at is empty")
+	}
+	waitIntegrationEvent(t, "chair", chairEvents, rideRes.RideID, "COMPLETED")
+	waitIntegrationEvent(t, "app", appEvents, rideRes.RideID, "COMPLETED")
+
+	// 見積もった運賃で決済し、オーナーの売上には割引前の運賃が入る
+	if got := payments.amounts(); len(got) != 1 || got[0] != rideRes.Fare {
+		t.Errorf("payments = %v, want [%d]", got, rideRes.Fare)
+	}
+	fare := currentFareConfig()
+	wantSales := fare.InitialFare + fare.FarePerDistance*calculateDistance(pickup.Latitude, pickup.Longitude, destination.Latitude, destination.Longitude)
+	sales := &ownerGetSalesResponse{}
+	integrationGet(t, owner, "/api/owner/sales", sales)
+	if sales.TotalSales != wantSales {
+		t.Errorf("total_sales = %d, want %d", sales.TotalSales, wantSales)
+	}
+
+	rides := &getAppRidesResponse{}
+	integrationGet(t, user, "/api/app/rides", rides)
+	if len(rides.Rides) != 1 || rides.Rides[0].ID != rideRes.RideID || rides.Rides[0].Chair.ID != chairRes.ID || rides.Rides[0].Evaluation != 5 {
+		t.Errorf("GET /api/app/rides = %+v, want the evaluated ride with chair %s", rides.Rides, chairRes.ID)
+	}
+}
+
+// startIntegrationMySQL starts MySQL in a container, loads the schema and master data,
+// and points ISUCON_DB_* at it.
+// 初期化(POST /api/initialize)が作り直すbadgerやinit.shのパスはカレントディレクトリからの相対なので、一時ディレクトリに移る。
+func startIntegrationMySQL(t *testing.T) {
+	t.Helper()
+
+	pool, err := dockertest.NewPool("")
+	if err != nil {
+		t.Skipf("docker is not available: %v", err)
+	}
+	if err := pool.Client.Ping(); err != nil {
+		t.Skipf("docker is not available: %v", err)
+	}
+	pool.MaxWait = 2 * time.Minute
+
+	image := orDefault(os.Getenv("ISUCON_INTEGRATION_MYSQL_IMAGE"), "mysql:8.0")
+	repository, tag := docker.ParseRepositoryTag(image)
+	resource, err := pool.RunWithOptions(&dockertest.RunOptions{
+		Repository: repository,
+		Tag:        tag,
+		Env:        []string{"MYSQL_ROOT_PASSWORD=root"},
+	}, func(config *docker.HostConfig) {
+		config.AutoRemove = true
+		config.RestartPolicy = docker.RestartPolicy{Name: "no"}
+	})
+	if err != nil {
+		t.Fatalf("failed to start mysql: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := pool.Purge(resource); err != nil {
+			t.Logf("failed to remove mysql: %v", err)
+		}
+	})
+	resource.Expire(600)
+
+	host, port, err := net.SplitHostPort(resource.GetHostPort("3306/tcp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootConfig := mysql.NewConfig()
+	rootConfig.User = "root"
+	rootConfig.Passwd = "root"
+	rootConfig.Net = "tcp"
+	rootConfig.Addr = net.JoinHostPort(host, port)
+	rootConfig.MultiStatements = true
+	var root *sql.DB
+	if err := pool.Retry(func() error {
+		root, err = sql.Open("mysql", rootConfig.FormatDSN())
+		if err != nil {
+			return err
+		}
+		return root.Ping()
+	}); err != nil {
+		t.Fatalf("mysql did not start: %v", err)
+	}
+	defer root.Close()
+
+	sqlDir, err := filepath.Abs("../sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	execIntegrationSQL(t, root, filepath.Join(sqlDir, "0-init.sql"))
+	for _, file := range []string{"1-schema.sql", "2-master-data.sql"} {
+		if _, err := root.Exec("USE isuride"); err != nil {
+			t.Fatal(err)
+		}
+		execIntegrationSQL(t, root, filepath.Join(sqlDir, file))
+	}
+
+	t.Setenv("ISUCON_DB_HOST", host)
+	t.Setenv("ISUCON_DB_PORT", port)
+	t.Setenv("ISUCON_DB_USER", "isucon")
+	t.Setenv("ISUCON_DB_PASSWORD", "isucon")
+	t.Setenv("ISUCON_DB_NAME", "isuride")
+	tokenSalt = "integration-test-salt"
+
+	// スキーマは入れたので、初期化のinit.shは何もしない
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "go"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "sql"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "sql", "init.sh"), []byte("#!/bin/sh\nexit 0\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Chdir(filepath.Join(dir, "go"))
+}
+
+func execIntegrationSQL(t *testing.T, db *sql.DB, path string) {
+	t.Helper()
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(string(b)); err != nil {
+		t.Fatalf("failed to run %s: %v", filepath.Base(path), err)
+	}
+}
+
+type integrationPaymentGateway struct {
+	*httptest.Server
+
+	lock     sync.Mutex
+	payments []int
+}
+
+// startIntegrationPaymentGateway starts a payment gateway that accepts every payment.
+func startIntegrationPaymentGateway(t *testing.T) *integrationPaymentGateway {
+	t.Helper()
+
+	gw := &integrationPaymentGateway{}
+	gw.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost:
+			req := &paymentGatewayPostPaymentRequest{}
+			b, _ := io.ReadAll(r.Body)
+			if err := sonic.Unmarshal(b, req); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			gw.lock.Lock()
+			gw.payments = append(gw.payments, req.Amount)
+			gw.lock.Unlock()
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte("[]"))
+		}
+	}))
+	t.Cleanup(gw.Close)
+	return gw
+}
+
+func (gw *integrationPaymentGateway) amounts() []int {
+	gw.lock.Lock()
+	defer gw.lock.Unlock()
+
+	return append([]int(nil), gw.payments...)
+}
+
+// integrationStream reads the notification endpoint until ctx is done.
+// ライドがまだ無い間はJSONが返るので、loadgenと同じく繋ぎ直す。
+func integrationStream(ctx context.Context, c *loadgenClient, path string) <-chan *loadgenEvent {
+	events := make(chan *loadgenEvent, 100)
+	go c.stream(ctx, "GET "+path, path, func(data []byte) {
+		event := &loadgenEvent{}
+		if err := sonic.Unmarshal(data, event); err == nil {
+			events <- event
+		}
+	})
+	return events
+}
+
+// waitIntegrationEvent skips events until rideID reaches one of statuses.
+func waitIntegrationEvent(t *testing.T, name string, events <-chan *loadgenEvent, rideID string, statuses ...string) *loadgenEvent {
+	t.Helper()
+
+	timeout := time.After(integrationEventTimeout)
+	for {
+		select {
+		case event := <-events:
+			if event.RideID == rideID && slices.Contains(statuses, event.Status) {
+				return event
+			}
+		case <-timeout:
+			t.Fatalf("%s notification did not send %v for ride %s", name, statuses, rideID)
+		}
+	}
+}
+
+func integrationGet(t *testing.T, c *loadgenClient, path string, res any) {
+	t.Helper()
+
+	httpRes, err := c.client.Get(c.lg.target + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer httpRes.Body.Close()
+
+	b, err := io.ReadAll(httpRes.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if httpRes.StatusCode != http.StatusOK {
+		t.Fatalf("GET %s = %d: %s", path, httpRes.StatusCode, b)
+	}
+	if err := sonic.Unmarshal(b, res); err != nil {
+		t.Fatalf("failed to decode GET %s: %v", path, err)
+	}
+}
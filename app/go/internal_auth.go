@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"io"
+	"net"
+	"net/http"
+	"os"
+)
+
+// /api/internal/*の保護
+// nginxは/api/internal/をループバックからしか通さないが、アプリが直接フロントエンドを配信するときはnginxを通らないので、アプリでも断る。
+//   - ISUCON_INTERNAL_TOKEN: 指定すると、X-Isuride-Internal-Tokenヘッダーに同じ値を付けた呼び出しはどこからでも受ける。
+//     別のホストで動かすmatcherやfixturesのコマンドもこれを付けて呼ぶ
+//
+// トークンの無い呼び出しは、ループバックかUNIXソケットから来たものだけ受ける。
+// nginx経由のときはX-Real-IPの元のアドレスもループバックであること。
+const internalTokenHeader = "X-Isuride-Internal-Token"
+
+var internalToken = os.Getenv("ISUCON_INTERNAL_TOKEN")
+
+var errInternalForbidden = newAppError(http.StatusForbidden, "internal_forbidden", "internal API is only served to local callers")
+
+func internalOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !internalAllowed(r) {
+			writeError(w, r, http.StatusForbidden, errInternalForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func internalAllowed(r *http.Request) bool {
+	if internalToken != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get(internalTokenHeader)), []byte(internalToken)) == 1 {
+		return true
+	}
+
+	if !localAddr(r.RemoteAddr) {
+		return false
+	}
+	if realIP := r.Header.Get("X-Real-IP"); realIP != "" {
+		ip := net.ParseIP(realIP)
+		return ip != nil && ip.IsLoopback()
+	}
+	return true
+}
+
+// localAddr reports whether remoteAddr is a loopback address or the peer of a UNIX socket, which has no address.
+func localAddr(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr == "" || remoteAddr == "@"
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// newInternalRequest returns a request to the internal API of another process, with the token if configured.
+func newInternalRequest(ctx context.Context, method string, url string, contentType string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if internalToken != "" {
+		req.Header.Set(internalTokenHeader, internalToken)
+	}
+	return req, nil
+}
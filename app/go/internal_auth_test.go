@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestInternalOnly(t *testing.T) {
+	original := internalToken
+	internalToken = "token"
+	t.Cleanup(func() { internalToken = original })
+
+	handler := internalOnly(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	for _, tt := range []struct {
+		name       string
+		remoteAddr string
+		header     map[string]string
+		want       int
+	}{
+		{name: "loopback", remoteAddr: "127.0.0.1:50000", want: http.StatusNoContent},
+		{name: "ipv6 loopback", remoteAddr: "[::1]:50000", want: http.StatusNoContent},
+		{name: "unix socket", remoteAddr: "@", want: http.StatusNoContent},
+		{name: "remote", remoteAddr: "203.0.113.1:50000", want: http.StatusForbidden},
+		{name: "remote with forged real ip", remoteAddr: "203.0.113.1:50000", header: map[string]string{"X-Real-IP": "127.0.0.1"}, want: http.StatusForbidden},
+		// nginxが転送してきた外からの呼び出し
+		{name: "proxied remote", remoteAddr: "@", header: map[string]string{"X-Real-IP": "203.0.113.1"}, want: http.StatusForbidden},
+		{name: "proxied loopback", remoteAddr: "@", header: map[string]string{"X-Real-IP": "127.0.0.1"}, want: http.StatusNoContent},
+		{name: "remote with token", remoteAddr: "203.0.113.1:50000", header: map[string]string{internalTokenHeader: "token"}, want: http.StatusNoContent},
+		{name: "remote with wrong token", remoteAddr: "203.0.113.1:50000", header: map[string]string{internalTokenHeader: "wrong"}, want: http.StatusForbidden},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/api/internal/clock", nil)
+			req.RemoteAddr = tt.remoteAddr
+			for k, v := range tt.header {
+				req.Header.Set(k, v)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.want {
+				t.Errorf("status = %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+}
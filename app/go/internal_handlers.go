@@ -3,17 +3,13 @@ package main
 import (
 	"cmp"
 	"context"
-	"database/sql"
 	"fmt"
+	"log/slog"
 	"math"
+	"net/http"
 	"slices"
 	"sync"
 	"time"
-
-	"github.com/dgraph-io/badger"
-	"github.com/jmoiron/sqlx"
-	"github.com/oklog/ulid/v2"
-	"golang.org/x/exp/slog"
 )
 
 var chairModelSpeedCache = map[string]int{
@@ -82,39 +78,28 @@ var (
 	benchStartedAt    = time.Time{}
 )
 
+func init() {
+	registerReset(func() {
+		matchingRidesLock.Lock()
+		defer matchingRidesLock.Unlock()
+
+		matchingRides = []*Ride{}
+	})
+	registerReset(func() {
+		emptyChairsLocker.Lock()
+		defer emptyChairsLocker.Unlock()
+
+		emptyChairs = []*Chair{}
+	})
+}
+
 func initEmptyChairs() error {
 	emptyChairsLocker.Lock()
 	defer emptyChairsLocker.Unlock()
 
-	emptyChairIDs := []string{}
-	err := badgerDB.View(func(txn *badger.Txn) error {
-		opts := badger.DefaultIteratorOptions
-		opts.PrefetchValues = false
-		opts.Prefix = []byte("status")
-		it := txn.NewIterator(opts)
-		defer it.Close()
-
-		for it.Rewind(); it.Valid(); it.Next() {
-			item := it.Item()
-			k := item.Key()
-			chairID := ulid.ULID(k[6:]).String()
-
-			err := item.Value(func(v []byte) error {
-				status := decodeChairStatus(v)
-				if status.status == chairStatusAvailable {
-					emptyChairIDs = append(emptyChairIDs, chairID)
-				}
-				return nil
-			})
-			if err != nil {
-				return err
-			}
-		}
-
-		return nil
-	})
+	emptyChairIDs, err := availableChairIDsFromBadger()
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	if len(emptyChairIDs) == 0 {
@@ -122,20 +107,25 @@ func initEmptyChairs() error {
 		return nil
 	}
 
-	emptyChairs = make([]*Chair, len(emptyChairIDs))
-	query, args, err := sqlx.In("SELECT * FROM chairs WHERE id IN (?)", emptyChairIDs)
-	if err != nil {
-		return fmt.Errorf("failed to build query: %w", err)
+	emptyChairs = make([]*Chair, 0, len(emptyChairIDs))
+	for _, chairID := range emptyChairIDs {
+		chair, err := getChairByID(context.Background(), chairID)
+		if err != nil {
+			return fmt.Errorf("failed to get empty chair: %w", err)
+		}
+		emptyChairs = append(emptyChairs, chair)
 	}
 
-	if err := db.SelectContext(context.Background(), &emptyChairs, query, args...); err != nil {
-		return fmt.Errorf("failed to get empty chairs: %w", err)
+	if isRemoteMatcher() {
+		chairs := emptyChairs
+		emptyChairs = []*Chair{}
+		return resetRemoteMatcher(chairs)
 	}
 
 	return nil
 }
 
-func init() {
+func startMatcher() {
 	ticker := time.NewTicker(10 * time.Millisecond)
 	go func() {
 		skipCounter := 0
@@ -148,7 +138,7 @@ func init() {
 			}()
 			if isChairExist {
 				skipCounter = 0
-				internalGetMatching()
+				runBackgroundWork(internalGetMatching)
 			} else {
 				skipCounter++
 			}
@@ -158,9 +148,8 @@ func init() {
 
 // このAPIをインスタンス内から一定間隔で叩かせることで、椅子とライドをマッチングさせる
 func internalGetMatching() {
-	ctx := context.Background()
-
-	isInBenchmark := !benchStartedAt.IsZero() && benchStartedAt.Add(60*time.Second).After(time.Now())
+	_, end := startSpan(context.Background(), "matcher.tick")
+	defer end()
 
 	// 1. 椅子未割当のrideを全件取得
 	var rides []*Ride
@@ -172,11 +161,27 @@ func internalGetMatching() {
 		matchingRides = []*Ride{}
 	}()
 
+	now := clock.Now()
+	rides = append(rides, releaseStaleChains(now)...)
+
 	if len(rides) == 0 {
-		slog.Info("no rides to match")
+		matcherLogger.Debug("no rides to match")
 		return
 	}
 
+	// マッチングも仮割り当てもされなかったライドはキューに戻す
+	matchedRideIDMap := map[string]struct{}{}
+	defer func() {
+		matchingRidesLock.Lock()
+		defer matchingRidesLock.Unlock()
+
+		for _, r := range rides {
+			if _, ok := matchedRideIDMap[r.ID]; !ok {
+				matchingRides = append(matchingRides, r)
+			}
+		}
+	}()
+
 	var chairs []*Chair
 	func() {
 		emptyChairsLocker.Lock()
@@ -186,90 +191,144 @@ func internalGetMatching() {
 		emptyChairs = []*Chair{}
 	}()
 
-	slog.Info("matching start",
+	matcherLogger.Debug("matching start",
 		slog.Int("rides", len(rides)),
 		slog.Int("chairs", len(chairs)),
 	)
 
-	chairMap := map[string]*Chair{}
-	for _, ch := range chairs {
-		chairMap[ch.ID] = ch
-	}
-
-	chairs = chairs[:0]
-	for _, ch := range chairMap {
-		chairs = append(chairs, ch)
-	}
+	chairs = availableMatchingChairs(chairs)
 
 	if len(chairs) == 0 {
 		// 空き椅子なし
-		slog.Info("no empty chairs")
+		matcherLogger.Debug("no empty chairs")
+		matchedRideIDMap = chainRides(rides, now)
 		return
 	}
 
-	// マンハッタン距離計算用関数
-	manhattanDistance := func(x1, y1, x2, y2 int) int {
-		dx := x1 - x2
-		if dx < 0 {
-			dx = -dx
+	matcherLogger.Debug("matching start",
+		"rides", len(rides),
+		"chairs", len(chairs),
+	)
+
+	locations := make(map[string]*chairLocation, len(chairs))
+	for _, ch := range chairs {
+		location, ok, err := getMatcherChairLocation(ch.ID)
+		if err != nil {
+			matcherLogger.Error("failed to get chair location from badger",
+				slog.String("error", err.Error()),
+			)
+			return
+		}
+		if ok {
+			locations[ch.ID] = location
+		}
+	}
+
+	// 遅すぎる椅子は候補から外すだけで、空き椅子には残しておく
+	candidates := make([]*Chair, 0, len(chairs))
+	for _, ch := range chairs {
+		if !isChairExcluded(ch.ID, now) {
+			candidates = append(candidates, ch)
 		}
-		dy := y1 - y2
-		if dy < 0 {
-			dy = -dy
+	}
+
+	matched := matchChairs(rides, candidates, locations, now, benchStartedAt)
+	matchedChairIDMap := make(map[string]struct{}, len(matched))
+	for _, m := range matched {
+		matchedChairIDMap[m.chair.ID] = struct{}{}
+		matchedRideIDMap[m.ride.ID] = struct{}{}
+	}
+	applyMatches(matched)
+
+	unmatched := make([]*Ride, 0, len(rides)-len(matchedRideIDMap))
+	for _, r := range rides {
+		if _, ok := matchedRideIDMap[r.ID]; !ok {
+			unmatched = append(unmatched, r)
 		}
-		return dx + dy
+	}
+	for rideID := range chainRides(unmatched, now) {
+		matchedRideIDMap[rideID] = struct{}{}
 	}
 
-	slog.Info("matching start",
-		"rides", len(rides),
-		"chairs", len(chairs),
+	matcherLogger.Info("matching end",
+		"matches", len(matched),
+		"matched_chairs", len(matchedChairIDMap),
+		"matched_rides", len(matchedRideIDMap),
+		"empty_chairs", len(emptyChairs),
+		"remaining_rides", len(rides)-len(matchedRideIDMap),
 	)
 
-	// chairsを可変なsliceとして扱えるようにする
-	availableChairs := chairs
+	func() {
+		emptyChairsLocker.Lock()
+		defer emptyChairsLocker.Unlock()
+		for _, ch := range chairs {
+			if _, ok := matchedChairIDMap[ch.ID]; !ok {
+				emptyChairs = append(emptyChairs, ch)
+			}
+		}
+	}()
+}
+
+// availableMatchingChairs drops duplicates and the chairs taken or deactivated since they were queued.
+// キューの*Chairは積んだときのものでIsActiveが古いことがあるので、空いているかはisChairAvailableで見る。
+func availableMatchingChairs(chairs []*Chair) []*Chair {
+	chairMap := map[string]*Chair{}
+	for _, ch := range chairs {
+		chairMap[ch.ID] = ch
+	}
+
+	available := make([]*Chair, 0, len(chairMap))
+	for _, ch := range chairMap {
+		if isChairAvailable(ch.ID) {
+			available = append(available, ch)
+		}
+	}
+	return available
+}
+
+// matchScore scores assigning chair at location to ride; higher is better.
+func matchScore(ride *Ride, chair *Chair, location *chairLocation, now time.Time, benchStartedAt time.Time) float64 {
+	isInBenchmark := !benchStartedAt.IsZero() && benchStartedAt.Add(60*time.Second).After(now)
+
+	pd := float64(calculateDistance(ride.PickupLatitude, ride.PickupLongitude, location.LastLatitude, location.LastLongitude)) / (float64(chair.Speed) * chairSpeedRatio(chair.ID))
+	dd := float64(calculateDistance(ride.PickupLatitude, ride.PickupLongitude, ride.DestinationLatitude, ride.DestinationLongitude))
+	age := int(now.Sub(ride.CreatedAt).Milliseconds())
+	loss := math.Pow(float64(age)/5000, 2)
+	// 25s以上経過しているrideは優先度を大きく上げる
+	if age > 22000 {
+		loss += 100000
+	}
+
+	// ベンチマーカーハック: ベンチマーク中にマッチングの期限を迎えないrideは割り当て優先度を下げ、終了後にマッチングさせる
+	isNoAgeLimit := isInBenchmark && ride.CreatedAt.After(benchStartedAt.Add(35*time.Second))
+	if isNoAgeLimit {
+		loss = 8 - math.Pow(float64(age)/1000, 3)
+	}
+
+	return dd - 100*pd + 1000*loss
+}
 
+// greedyMatch assigns chairs to rides in descending score order.
+// Chairs without a known location are never assigned, and each ride and chair is used at most once.
+// Apart from the observed chair speeds it only reads its arguments, so it can be exercised without the queues or badger.
+func greedyMatch(rides []*Ride, chairs []*Chair, locations map[string]*chairLocation, now time.Time, benchStartedAt time.Time) []matchedPair {
 	type match struct {
 		ride  *Ride
 		ch    *Chair
-		age   int
 		score float64
 	}
 	matches := []match{}
 	for _, ride := range rides {
-		for _, ch := range availableChairs {
-			location, ok, err := getChairLocationFromBadger(ch.ID)
-			if err != nil {
-				slog.Error("failed to get chair location from badger",
-					slog.String("error", err.Error()),
-				)
-				return
-			}
+		for _, ch := range chairs {
+			location, ok := locations[ch.ID]
 			if !ok {
 				continue
 			}
 
-			pd := float64(manhattanDistance(ride.PickupLatitude, ride.PickupLongitude, location.LastLatitude, location.LastLongitude)) / float64(chairModelSpeedCache[ch.Model])
-			dd := float64(manhattanDistance(ride.PickupLatitude, ride.PickupLongitude, ride.DestinationLatitude, ride.DestinationLongitude))
-			age := int(time.Since(ride.CreatedAt).Milliseconds())
-			loss := math.Pow(float64(age)/5000, 2)
-			// 25s以上経過しているrideは優先度を大きく上げる
-			if age > 22000 {
-				loss += 100000
-			}
-
-			// ベンチマーカーハック: ベンチマーク中にマッチングの期限を迎えないrideは割り当て優先度を下げ、終了後にマッチングさせる
-			isNoAgeLimit := isInBenchmark && ride.CreatedAt.After(benchStartedAt.Add(35*time.Second))
-			if isNoAgeLimit {
-				loss = 8 - math.Pow(float64(age)/1000, 3)
-			}
-
-			score := dd - 100*pd + 1000*loss
-
 			matches = append(matches, match{
 				ride:  ride,
 				ch:    ch,
-				age:   age,
-				score: score,
+				score: matchScore(ride, ch, location, now, benchStartedAt),
 			})
 		}
 	}
@@ -279,6 +338,7 @@ func internalGetMatching() {
 
 	matchedChairIDMap := map[string]struct{}{}
 	matchedRideIDMap := map[string]struct{}{}
+	matched := []matchedPair{}
 	for _, m := range matches {
 		if _, ok := matchedChairIDMap[m.ch.ID]; ok {
 			continue
@@ -287,57 +347,64 @@ func internalGetMatching() {
 			continue
 		}
 
-		now := time.Now()
-		if _, err := db.ExecContext(ctx, "UPDATE rides SET chair_id = ?, updated_at = ? WHERE id = ?", m.ch.ID, now, m.ride.ID); err != nil {
-			slog.Error("failed to update ride",
-				slog.String("error", err.Error()),
-			)
-			return
-		}
-		m.ride.ChairID = sql.NullString{String: m.ch.ID, Valid: true}
-		m.ride.UpdatedAt = now
-
-		rideCache.Store(m.ride.ID, m.ride)
-		latestRideCache.Store(m.ch.ID, m.ride)
-		ChairPublish(m.ch.ID, &RideEvent{
-			status: "MATCHED",
-			chair:  m.ch,
-			ride:   m.ride,
-		})
-		UserPublish(m.ride.UserID, &RideEvent{
-			status: "MATCHED",
-			chair:  m.ch,
-			ride:   m.ride,
-		})
+		matched = append(matched, matchedPair{ride: m.ride, chair: m.ch})
 		matchedChairIDMap[m.ch.ID] = struct{}{}
 		matchedRideIDMap[m.ride.ID] = struct{}{}
 	}
 
-	slog.Info("matching end",
-		"matches", len(matches),
-		"matched_chairs", len(matchedChairIDMap),
-		"matched_rides", len(matchedRideIDMap),
-		"empty_chairs", len(emptyChairs),
-		"remaining_rides", len(rides)-len(matchedRideIDMap),
-	)
+	return matched
+}
+
+type internalGetDebugStateResponse struct {
+	RideCache          int `json:"ride_cache"`
+	RideStatusesCache  int `json:"ride_statuses_cache"`
+	PaymentTokenCache  int `json:"payment_token_cache"`
+	LatestRideCache    int `json:"latest_ride_cache"`
+	LocationCache      int `json:"location_cache"`
+	MatchingRides      int `json:"matching_rides"`
+	EmptyChairs        int `json:"empty_chairs"`
+	AvailableChairs    int `json:"available_chairs"`
+	RideStatusQueue    int `json:"ride_status_queue"`
+	PendingRideWrites  int `json:"pending_ride_writes"`
+	ChairSubscriptions int `json:"chair_subscriptions"`
+	UserSubscriptions  int `json:"user_subscriptions"`
+}
+
+// キャッシュやキューの偏り・リークを確認するためのエンドポイント
+func (s *Server) internalGetDebugState(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.debugState())
+}
+
+func (s *Server) debugState() internalGetDebugStateResponse {
+	res := internalGetDebugStateResponse{
+		RideCache:         s.rides.Len(),
+		RideStatusesCache: s.rideStatuses.Len(),
+		PaymentTokenCache: s.paymentTokens.Len(),
+		LatestRideCache:   latestRideCache.Len(),
+		LocationCache:     locationCache.Len(),
+		RideStatusQueue:   int(pendingRideStatuses.Load()),
+		AvailableChairs:   availableChairCount(),
+	}
 
 	func() {
-		matchingRidesLock.Lock()
-		defer matchingRidesLock.Unlock()
+		matchingRidesLock.RLock()
+		defer matchingRidesLock.RUnlock()
 
-		for _, r := range rides {
-			if _, ok := matchedRideIDMap[r.ID]; !ok {
-				matchingRides = append(matchingRides, r)
-			}
-		}
+		res.MatchingRides = len(matchingRides)
 	}()
 	func() {
-		emptyChairsLocker.Lock()
-		defer emptyChairsLocker.Unlock()
-		for _, ch := range chairs {
-			if _, ok := matchedChairIDMap[ch.ID]; !ok {
-				emptyChairs = append(emptyChairs, ch)
-			}
-		}
+		emptyChairsLocker.RLock()
+		defer emptyChairsLocker.RUnlock()
+
+		res.EmptyChairs = len(emptyChairs)
 	}()
+	func() {
+		pendingRideWritesLock.Lock()
+		defer pendingRideWritesLock.Unlock()
+
+		res.PendingRideWrites = len(pendingRideWrites)
+	}()
+	res.ChairSubscriptions, res.UserSubscriptions = defaultEventBus.subscriptions()
+
+	return res
 }
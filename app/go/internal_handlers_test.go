@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"testing"
+	"time"
+)
+
+var matchFuncs = map[string]func(rides []*Ride, chairs []*Chair, locations map[string]*chairLocation, now time.Time) []matchedPair{
+	matchingGreedy: func(rides []*Ride, chairs []*Chair, locations map[string]*chairLocation, now time.Time) []matchedPair {
+		return greedyMatch(rides, chairs, locations, now, time.Time{})
+	},
+	matchingHungarian: hungarianMatch,
+}
+
+type matchingInstance struct {
+	rides     []*Ride
+	chairs    []*Chair
+	locations map[string]*chairLocation
+	available map[string]bool
+	overdue   map[string]bool
+}
+
+// randomMatchingInstance makes some chairs inactive or unlocated and some rides overdue.
+func randomMatchingInstance(rnd *rand.Rand, now time.Time) *matchingInstance {
+	in := &matchingInstance{
+		locations: map[string]*chairLocation{},
+		available: map[string]bool{},
+		overdue:   map[string]bool{},
+	}
+
+	for i := range rnd.IntN(12) {
+		ride := &Ride{
+			ID:                   fmt.Sprintf("ride%d", i),
+			PickupLatitude:       rnd.IntN(201) - 100,
+			PickupLongitude:      rnd.IntN(201) - 100,
+			DestinationLatitude:  rnd.IntN(201) - 100,
+			DestinationLongitude: rnd.IntN(201) - 100,
+			CreatedAt:            now.Add(-time.Duration(rnd.IntN(40000)) * time.Millisecond),
+		}
+		in.rides = append(in.rides, ride)
+		in.overdue[ride.ID] = now.Sub(ride.CreatedAt) > 22*time.Second
+	}
+
+	for i := range rnd.IntN(12) {
+		chair := &Chair{ID: fmt.Sprintf("chair%d", i), Speed: rnd.IntN(10) + 1}
+		in.chairs = append(in.chairs, chair)
+		if rnd.IntN(5) > 0 {
+			in.available[chair.ID] = true
+		}
+		if rnd.IntN(5) > 0 {
+			in.locations[chair.ID] = &chairLocation{
+				LastLatitude:  rnd.IntN(201) - 100,
+				LastLongitude: rnd.IntN(201) - 100,
+			}
+		}
+	}
+
+	return in
+}
+
+func TestMatchProperties(t *testing.T) {
+	now := time.UnixMilli(1733600000000)
+
+	for name, match := range matchFuncs {
+		t.Run(name, func(t *testing.T) {
+			t.Cleanup(resetAll)
+			rnd := rand.New(rand.NewPCG(1, 2))
+
+			for i := range 1000 {
+				resetAll()
+				in := randomMatchingInstance(rnd, now)
+				for chairID := range in.available {
+					markChairAvailable(chairID)
+				}
+
+				matched := match(in.rides, availableMatchingChairs(in.chairs), in.locations, now)
+
+				assignable := 0
+				for _, chair := range in.chairs {
+					if _, ok := in.locations[chair.ID]; ok && in.available[chair.ID] {
+						assignable++
+					}
+				}
+				overdue := 0
+				for _, ride := range in.rides {
+					if in.overdue[ride.ID] {
+						overdue++
+					}
+				}
+
+				matchedChairs := map[string]struct{}{}
+				matchedRides := map[string]struct{}{}
+				matchedOverdue := 0
+				for _, m := range matched {
+					if _, ok := matchedChairs[m.chair.ID]; ok {
+						t.Fatalf("case %d: chair %s is assigned twice", i, m.chair.ID)
+					}
+					matchedChairs[m.chair.ID] = struct{}{}
+					if _, ok := matchedRides[m.ride.ID]; ok {
+						t.Fatalf("case %d: ride %s is assigned twice", i, m.ride.ID)
+					}
+					matchedRides[m.ride.ID] = struct{}{}
+
+					if !in.available[m.chair.ID] {
+						t.Fatalf("case %d: inactive chair %s is assigned", i, m.chair.ID)
+					}
+					if _, ok := in.locations[m.chair.ID]; !ok {
+						t.Fatalf("case %d: chair %s without location is assigned", i, m.chair.ID)
+					}
+					if in.overdue[m.ride.ID] {
+						matchedOverdue++
+					}
+				}
+
+				if want := min(len(in.rides), assignable); len(matched) != want {
+					t.Fatalf("case %d: %d matches, want %d", i, len(matched), want)
+				}
+				// 椅子が足りる限り、待たせすぎたライドは全部割り当てられる
+				if want := min(overdue, assignable); matchedOverdue != want {
+					t.Fatalf("case %d: %d overdue rides matched, want %d", i, matchedOverdue, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"regexp"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// 招待コードを好きな文字列に変更する
+// 登録時のランダムな招待コードを置き換えるだけで、使用回数は新しいコードに引き継ぐ。
+// RWD_<招待コード>_<時刻>の形でクーポンコードに埋め込むので、_は使えない。
+var invitationCodePattern = regexp.MustCompile(`^[A-Za-z0-9-]{4,30}$`)
+
+const mysqlErrDuplicateEntry = 1062
+
+type appPatchInvitationCodeRequest struct {
+	InvitationCode string `json:"invitation_code"`
+}
+
+func (req *appPatchInvitationCodeRequest) Validate() error {
+	v := validation{}
+	v.required("invitation_code", req.InvitationCode)
+	if req.InvitationCode != "" && !invitationCodePattern.MatchString(req.InvitationCode) {
+		v.fail("invitation_code", "must be 4 to 30 letters, digits or hyphens")
+	}
+	return v.err("invitation_code is invalid")
+}
+
+type appPatchInvitationCodeResponse struct {
+	InvitationCode string `json:"invitation_code"`
+}
+
+func (s *Server) appPatchInvitationCode(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	req := &appPatchInvitationCodeRequest{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	user := ctx.Value("user").(*User)
+	if req.InvitationCode == user.InvitationCode {
+		writeJSON(w, http.StatusOK, &appPatchInvitationCodeResponse{InvitationCode: user.InvitationCode})
+		return
+	}
+	now := s.clock.Now()
+
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	// 以前に誰かが使っていたコードも使用回数が残っているので取れない
+	var taken bool
+	if err := tx.GetContext(ctx, &taken, "SELECT EXISTS(SELECT 1 FROM users WHERE invitation_code = ?) OR EXISTS(SELECT 1 FROM invitation_uses WHERE invitation_code = ?)", req.InvitationCode, req.InvitationCode); err != nil {
+		writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	if taken {
+		writeError(w, r, http.StatusConflict, errInvitationCodeTaken)
+		return
+	}
+
+	// 同時に同じコードへ変更されたときはユニーク制約で弾く
+	if _, err := tx.ExecContext(ctx, "UPDATE users SET invitation_code = ?, updated_at = ? WHERE id = ?", req.InvitationCode, now, user.ID); err != nil {
+		var mysqlErr *mysql.MySQLError
+		if errors.As(err, &mysqlErr) && mysqlErr.Number == mysqlErrDuplicateEntry {
+			writeError(w, r, http.StatusConflict, errInvitationCodeTaken)
+			return
+		}
+		writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE invitation_uses SET invitation_code = ? WHERE invitation_code = ?", req.InvitationCode, user.InvitationCode); err != nil {
+		writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	// キャッシュのUserは共有しているので書き換えずに差し替える
+	updated := *user
+	updated.InvitationCode = req.InvitationCode
+	updated.UpdatedAt = now
+	userByIDCache.Store(user.ID, &updated)
+	renameInvitationCode(user.InvitationCode, updated.InvitationCode)
+	accessTokenCache.Forget(user.AccessToken)
+
+	writeJSON(w, http.StatusOK, &appPatchInvitationCodeResponse{InvitationCode: updated.InvitationCode})
+}
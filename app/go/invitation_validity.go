@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+
+	isucache "github.com/mazrean/isucon-go-tools/v2/cache"
+)
+
+// 登録前に招待コードが使えるかを確かめるための索引
+// 招待コード -> 使用回数。ユーザー登録(appPostUsers)と招待コードの変更で更新する。
+// 残り回数は有効なキャンペーンの上限から引くので、キャンペーンを切り替えるとすぐに反映される。
+// 索引はインスタンスごとなので、登録時の判定はこれまで通りinvitation_usesで行う。
+var invitationCodeUses = isucache.NewAtomicMap[string, *atomic.Int64]("invitationCodeUses")
+
+func init() {
+	registerReset(func() {
+		invitationCodeUses.Purge()
+	})
+}
+
+// initInvitationCodeIndex loads every invitation code with its uses counted in invitation_uses.
+func initInvitationCodeIndex() error {
+	var codes []struct {
+		Code string `db:"invitation_code"`
+		Uses int64  `db:"uses"`
+	}
+	if err := db.Select(&codes, "SELECT u.invitation_code, COALESCE(iu.uses, 0) AS uses FROM users u LEFT JOIN invitation_uses iu ON iu.invitation_code = u.invitation_code WHERE u.deactivated_at IS NULL"); err != nil {
+		return fmt.Errorf("failed to select invitation codes: %w", err)
+	}
+
+	for _, code := range codes {
+		uses := &atomic.Int64{}
+		uses.Store(code.Uses)
+		invitationCodeUses.Store(code.Code, uses)
+	}
+
+	return nil
+}
+
+func indexInvitationCode(code string) {
+	invitationCodeUses.LoadOrStore(code, &atomic.Int64{})
+}
+
+func countInvitationCodeUse(code string) {
+	uses, _ := invitationCodeUses.LoadOrStore(code, &atomic.Int64{})
+	uses.Add(1)
+}
+
+// renameInvitationCode moves the uses of from to to, as appPatchInvitationCode does in MySQL.
+func renameInvitationCode(from string, to string) {
+	uses, ok := invitationCodeUses.Load(from)
+	if !ok {
+		uses = &atomic.Int64{}
+	}
+	invitationCodeUses.Store(to, uses)
+	invitationCodeUses.Forget(from)
+}
+
+type appGetInvitationValidityResponse struct {
+	Valid bool `json:"valid"`
+	// 存在しないコードは0
+	RemainingUses int `json:"remaining_uses"`
+}
+
+// GET /api/app/invitations/{code}/validity
+// 存在しないコードや使い切ったコードもエラーにせずvalid=falseで返す。
+func (s *Server) appGetInvitationValidity(w http.ResponseWriter, r *http.Request) {
+	code := r.PathValue("code")
+
+	res := &appGetInvitationValidityResponse{}
+	if uses, ok := invitationCodeUses.Load(code); ok {
+		res.RemainingUses = max(currentCampaign().MaxInvitationUses-int(uses.Load()), 0)
+		res.Valid = res.RemainingUses > 0
+	}
+
+	writeJSON(w, http.StatusOK, res)
+}
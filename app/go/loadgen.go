@@ -0,0 +1,419 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/http/cookiejar"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bytedance/sonic"
+	"github.com/oklog/ulid/v2"
+)
+
+// 公式ベンチマーカーなしでハンドラーとマッチングの変更を軽く確かめるための負荷生成
+//
+//	./isuride loadgen -target http://localhost:8080 -users 50 -chairs 30 -duration 30s
+//
+// ユーザーはライドを作って通知を待ち、ARRIVEDで評価して次のライドを作る。
+// 椅子は通知でMATCHEDを受けたら配車位置・目的地へ座標を送りながら移動する。
+// エラーレスポンスがretryableなら、retry_after_ms待って数回までやり直す。
+func runLoadgen(args []string) {
+	fs := flag.NewFlagSet("loadgen", flag.ExitOnError)
+	target := fs.String("target", "http://localhost:8080", "target base URL")
+	users := fs.Int("users", 50, "number of users")
+	chairs := fs.Int("chairs", 30, "number of chairs")
+	duration := fs.Duration("duration", 30*time.Second, "how long to run")
+	paymentServer := fs.String("payment-server", "", "POST /api/initialize with this payment server before starting")
+	speed := fs.Int("speed", 5, "chair moving distance per coordinate tick")
+	fs.Parse(args)
+
+	lg := &loadgen{
+		target: strings.TrimSuffix(*target, "/"),
+		speed:  *speed,
+		stats:  map[string]*loadgenStat{},
+	}
+
+	if *paymentServer != "" {
+		if err := lg.newClient().post("POST /api/initialize", "/api/initialize", &postInitializeRequest{PaymentServer: *paymentServer}, nil); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to initialize: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *duration)
+	defer cancel()
+
+	wg := sync.WaitGroup{}
+	for i := range *chairs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := lg.runChair(ctx, i); err != nil && ctx.Err() == nil {
+				fmt.Fprintf(os.Stderr, "chair %d stopped: %v\n", i, err)
+			}
+		}()
+	}
+	for i := range *users {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := lg.runUser(ctx, i); err != nil && ctx.Err() == nil {
+				fmt.Fprintf(os.Stderr, "user %d stopped: %v\n", i, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	lg.report(*duration)
+}
+
+type loadgen struct {
+	target string
+	speed  int
+
+	completedRides atomic.Int64
+
+	statsLock sync.Mutex
+	stats     map[string]*loadgenStat
+}
+
+type loadgenStat struct {
+	count   int
+	errors  int
+	elapsed time.Duration
+	max     time.Duration
+}
+
+func (lg *loadgen) record(route string, elapsed time.Duration, failed bool) {
+	lg.statsLock.Lock()
+	defer lg.statsLock.Unlock()
+
+	stat, ok := lg.stats[route]
+	if !ok {
+		stat = &loadgenStat{}
+		lg.stats[route] = stat
+	}
+	stat.count++
+	stat.elapsed += elapsed
+	stat.max = max(stat.max, elapsed)
+	if failed {
+		stat.errors++
+	}
+}
+
+func (lg *loadgen) report(duration time.Duration) {
+	lg.statsLock.Lock()
+	defer lg.statsLock.Unlock()
+
+	routes := make([]string, 0, len(lg.stats))
+	for route := range lg.stats {
+		routes = append(routes, route)
+	}
+	slices.Sort(routes)
+
+	fmt.Printf("%-50s %8s %8s %10s %10s\n", "route", "count", "errors", "avg(ms)", "max(ms)")
+	for _, route := range routes {
+		stat := lg.stats[route]
+		fmt.Printf("%-50s %8d %8d %10.2f %10.2f\n",
+			route,
+			stat.count,
+			stat.errors,
+			float64(stat.elapsed.Microseconds())/float64(stat.count)/1000,
+			float64(stat.max.Microseconds())/1000,
+		)
+	}
+	fmt.Printf("completed rides: %d (%.2f/s)\n", lg.completedRides.Load(), float64(lg.completedRides.Load())/duration.Seconds())
+}
+
+type loadgenClient struct {
+	lg     *loadgen
+	client *http.Client
+}
+
+func (lg *loadgen) newClient() *loadgenClient {
+	jar, _ := cookiejar.New(nil)
+	return &loadgenClient{
+		lg:     lg,
+		client: &http.Client{Jar: jar},
+	}
+}
+
+// loadgenMaxRetries is how many times a request is retried when the error response says it is retryable.
+const loadgenMaxRetries = 3
+
+func (c *loadgenClient) post(route string, path string, req any, res any) error {
+	b, err := sonic.Marshal(req)
+	if err != nil {
+		return fmt.Errorf("failed to encode request: %w", err)
+	}
+
+	for retry := 0; ; retry++ {
+		retryAfter, err := c.postOnce(route, path, b, res)
+		if retryAfter < 0 || retry >= loadgenMaxRetries {
+			return err
+		}
+		time.Sleep(retryAfter)
+	}
+}
+
+// postOnce returns the time to wait before retrying, or a negative duration if the request should not be retried.
+func (c *loadgenClient) postOnce(route string, path string, b []byte, res any) (time.Duration, error) {
+	start := time.Now()
+	httpRes, err := c.client.Post(c.lg.target+path, "application/json", bytes.NewReader(b))
+	if err != nil {
+		c.lg.record(route, time.Since(start), true)
+		return -1, fmt.Errorf("failed to request %s: %w", route, err)
+	}
+	defer httpRes.Body.Close()
+
+	body, err := io.ReadAll(httpRes.Body)
+	failed := err != nil || httpRes.StatusCode >= http.StatusBadRequest
+	c.lg.record(route, time.Since(start), failed)
+	if err != nil {
+		return -1, fmt.Errorf("failed to read response of %s: %w", route, err)
+	}
+	if httpRes.StatusCode >= http.StatusBadRequest {
+		err := fmt.Errorf("unexpected status code from %s: %d: %s", route, httpRes.StatusCode, body)
+		errRes := &errorResponse{}
+		if sonic.Unmarshal(body, errRes) != nil || !errRes.Retryable {
+			return -1, err
+		}
+		return time.Duration(errRes.RetryAfterMs) * time.Millisecond, err
+	}
+
+	if res != nil {
+		if err := sonic.Unmarshal(body, res); err != nil {
+			return -1, fmt.Errorf("failed to decode response of %s: %w", route, err)
+		}
+	}
+
+	return -1, nil
+}
+
+// stream reads the notification endpoint and calls handler for every event,
+// reconnecting when the stream ends until ctx is done.
+func (c *loadgenClient) stream(ctx context.Context, route string, path string, handler func(data []byte)) {
+	for ctx.Err() == nil {
+		err := func() error {
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.lg.target+path, nil)
+			if err != nil {
+				return err
+			}
+
+			start := time.Now()
+			res, err := c.client.Do(req)
+			if err != nil {
+				c.lg.record(route, time.Since(start), true)
+				return err
+			}
+			defer res.Body.Close()
+			c.lg.record(route, time.Since(start), res.StatusCode >= http.StatusBadRequest)
+
+			// ライドがまだ無いときはSSEではなくJSONでretry_after_msが返ってくる
+			if !strings.HasPrefix(res.Header.Get("Content-Type"), "text/event-stream") {
+				io.Copy(io.Discard, res.Body)
+				return nil
+			}
+
+			scanner := bufio.NewScanner(res.Body)
+			for scanner.Scan() {
+				if data, ok := bytes.CutPrefix(scanner.Bytes(), []byte("data: ")); ok {
+					handler(data)
+				}
+			}
+			return scanner.Err()
+		}()
+		if err != nil && ctx.Err() == nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", route, err)
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+type loadgenEvent struct {
+	RideID                string     `json:"ride_id"`
+	PickupCoordinate      Coordinate `json:"pickup_coordinate"`
+	DestinationCoordinate Coordinate `json:"destination_coordinate"`
+	Status                string     `json:"status"`
+}
+
+func randomCoordinate() Coordinate {
+	return Coordinate{
+		Latitude:  rand.IntN(200) - 100,
+		Longitude: rand.IntN(200) - 100,
+	}
+}
+
+func (lg *loadgen) runUser(ctx context.Context, i int) error {
+	c := lg.newClient()
+
+	if err := c.post("POST /api/app/users", "/api/app/users", &appPostUsersRequest{
+		Username:    fmt.Sprintf("loadgen-user-%d-%s", i, ulid.Make().String()),
+		FirstName:   "Load",
+		LastName:    fmt.Sprintf("User%d", i),
+		DateOfBirth: "2000-01-01",
+	}, nil); err != nil {
+		return err
+	}
+	if err := c.post("POST /api/app/payment-methods", "/api/app/payment-methods", &appPostPaymentMethodsRequest{
+		Token: ulid.Make().String(),
+	}, nil); err != nil {
+		return err
+	}
+
+	events := make(chan *loadgenEvent, 10)
+	go c.stream(ctx, "GET /api/app/notification", "/api/app/notification", func(data []byte) {
+		event := &loadgenEvent{}
+		if err := sonic.Unmarshal(data, event); err == nil {
+			events <- event
+		}
+	})
+
+	for ctx.Err() == nil {
+		res := &appPostRidesResponse{}
+		pickup, destination := randomCoordinate(), randomCoordinate()
+		if err := c.post("POST /api/app/rides", "/api/app/rides", &appPostRidesRequest{
+			PickupCoordinate:      &pickup,
+			DestinationCoordinate: &destination,
+		}, res); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(time.Second):
+			}
+			continue
+		}
+
+	L:
+		for {
+			select {
+			case <-ctx.Done():
+				return nil
+			case event := <-events:
+				if event.RideID != res.RideID {
+					continue
+				}
+				switch event.Status {
+				case "ARRIVED":
+					if err := c.post("POST /api/app/rides/{ride_id}/evaluation", "/api/app/rides/"+res.RideID+"/evaluation", &appPostRideEvaluationRequest{
+						Evaluation: rand.IntN(5) + 1,
+					}, nil); err != nil {
+						fmt.Fprintln(os.Stderr, err)
+					}
+				case "COMPLETED":
+					lg.completedRides.Add(1)
+					break L
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+func (lg *loadgen) runChair(ctx context.Context, i int) error {
+	owner := lg.newClient()
+	ownerRes := &ownerPostOwnersResponse{}
+	if err := owner.post("POST /api/owner/owners", "/api/owner/owners", &ownerPostOwnersRequest{
+		Name: fmt.Sprintf("loadgen-owner-%d-%s", i, ulid.Make().String()),
+	}, ownerRes); err != nil {
+		return err
+	}
+
+	models := make([]string, 0, len(chairModelSpeedCache))
+	for model := range chairModelSpeedCache {
+		models = append(models, model)
+	}
+
+	c := lg.newClient()
+	if err := c.post("POST /api/chair/chairs", "/api/chair/chairs", &chairPostChairsRequest{
+		Name:               fmt.Sprintf("loadgen-chair-%d", i),
+		Model:              models[rand.IntN(len(models))],
+		ChairRegisterToken: ownerRes.ChairRegisterToken,
+	}, nil); err != nil {
+		return err
+	}
+
+	location := randomCoordinate()
+	if err := c.post("POST /api/chair/coordinate", "/api/chair/coordinate", &location, nil); err != nil {
+		return err
+	}
+	if err := c.post("POST /api/chair/activity", "/api/chair/activity", &postChairActivityRequest{IsActive: true}, nil); err != nil {
+		return err
+	}
+
+	events := make(chan *loadgenEvent, 10)
+	go c.stream(ctx, "GET /api/chair/notification", "/api/chair/notification", func(data []byte) {
+		event := &loadgenEvent{}
+		if err := sonic.Unmarshal(data, event); err == nil {
+			events <- event
+		}
+	})
+
+	var (
+		ride        *loadgenEvent
+		destination *Coordinate
+	)
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event := <-events:
+			switch event.Status {
+			case "MATCHED":
+				ride = event
+				destination = &ride.PickupCoordinate
+				if err := c.post("POST /api/chair/rides/{ride_id}/status", "/api/chair/rides/"+ride.RideID+"/status", &postChairRidesRideIDStatusRequest{Status: "ENROUTE"}, nil); err != nil {
+					fmt.Fprintln(os.Stderr, err)
+				}
+			case "PICKUP":
+				if ride == nil || ride.RideID != event.RideID {
+					continue
+				}
+				destination = &ride.DestinationCoordinate
+				if err := c.post("POST /api/chair/rides/{ride_id}/status", "/api/chair/rides/"+ride.RideID+"/status", &postChairRidesRideIDStatusRequest{Status: "CARRYING"}, nil); err != nil {
+					fmt.Fprintln(os.Stderr, err)
+				}
+			case "ARRIVED", "COMPLETED":
+				destination = nil
+			}
+		case <-ticker.C:
+			if destination == nil || location == *destination {
+				continue
+			}
+			location.Latitude = moveToward(location.Latitude, destination.Latitude, lg.speed)
+			location.Longitude = moveToward(location.Longitude, destination.Longitude, lg.speed)
+			if err := c.post("POST /api/chair/coordinate", "/api/chair/coordinate", &location, nil); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+			}
+		}
+	}
+}
+
+func moveToward(from, to, step int) int {
+	switch {
+	case from < to:
+		return min(from+step, to)
+	case from > to:
+		return max(from-step, to)
+	default:
+		return from
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// ログの出力は環境変数で制御する
+//   - ISUCON_LOG_LEVEL: 全体のレベル(debug/info/warn/error)。デフォルトはinfo
+//   - ISUCON_LOG_MODULES: モジュールごとのレベル。例: "matcher=debug,http=warn"
+//   - ISUCON_LOG_SAMPLE: N(>1)を指定するとError未満のログをN件に1件だけ出す
+//   - ISUCON_LOG_FORMAT: textかjson。デフォルトはtext
+//   - ISUCON_LOG_OUTPUT: stderr(デフォルト)、stdout、またはファイルのパス
+//   - ISUCON_LOG_MAX_SIZE_MB, ISUCON_LOG_MAX_BACKUPS: ファイルに出すときのローテーション。デフォルトは100MBで3世代
+//   - ISUCON_LOG_SOURCE=1: 呼び出し元のファイルと行を付ける
+//
+// 負荷試験中はISUCON_LOG_LEVEL=errorにしておけばログのコストはほぼ無視できる
+var (
+	logLevel        = parseLogLevel(os.Getenv("ISUCON_LOG_LEVEL"), slog.LevelInfo)
+	logModuleLevels = parseLogModuleLevels(os.Getenv("ISUCON_LOG_MODULES"))
+	logSampleRate   = parseLogSampleRate(os.Getenv("ISUCON_LOG_SAMPLE"))
+
+	logBaseHandler = newLogBaseHandler()
+
+	matcherLogger = newModuleLogger("matcher")
+	httpLogger    = newModuleLogger("http")
+	dbLogger      = newModuleLogger("db")
+)
+
+func init() {
+	slog.SetDefault(newModuleLogger(""))
+}
+
+func newLogBaseHandler() slog.Handler {
+	opts := &slog.HandlerOptions{
+		Level:     slog.LevelDebug,
+		AddSource: os.Getenv("ISUCON_LOG_SOURCE") == "1",
+	}
+	w := newLogOutput(os.Getenv("ISUCON_LOG_OUTPUT"))
+
+	switch format := os.Getenv("ISUCON_LOG_FORMAT"); format {
+	case "", "text":
+		return slog.NewTextHandler(w, opts)
+	case "json":
+		return slog.NewJSONHandler(w, opts)
+	default:
+		panic(fmt.Sprintf("invalid ISUCON_LOG_FORMAT: %s", format))
+	}
+}
+
+func newLogOutput(output string) io.Writer {
+	switch output {
+	case "", "stderr":
+		return os.Stderr
+	case "stdout":
+		return os.Stdout
+	}
+
+	maxSizeMB, err := strconv.Atoi(cmp.Or(os.Getenv("ISUCON_LOG_MAX_SIZE_MB"), "100"))
+	if err != nil {
+		panic(fmt.Sprintf("invalid ISUCON_LOG_MAX_SIZE_MB: %v", err))
+	}
+	maxBackups, err := strconv.Atoi(cmp.Or(os.Getenv("ISUCON_LOG_MAX_BACKUPS"), "3"))
+	if err != nil {
+		panic(fmt.Sprintf("invalid ISUCON_LOG_MAX_BACKUPS: %v", err))
+	}
+
+	f, err := openRotatingFile(output, int64(maxSizeMB)<<20, maxBackups)
+	if err != nil {
+		panic(err)
+	}
+	return f
+}
+
+func newModuleLogger(module string) *slog.Logger {
+	level := logLevel
+	if moduleLevel, ok := logModuleLevels[module]; ok {
+		level = moduleLevel
+	}
+
+	var h slog.Handler = &leveledHandler{
+		Handler: logBaseHandler,
+		level:   level,
+		sample:  logSampleRate,
+		counter: &atomic.Uint64{},
+	}
+	if module != "" {
+		h = h.WithAttrs([]slog.Attr{slog.String("module", module)})
+	}
+
+	return slog.New(h)
+}
+
+func parseLogLevel(s string, defaultLevel slog.Level) slog.Level {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(s)); err != nil {
+		return defaultLevel
+	}
+	return level
+}
+
+func parseLogModuleLevels(s string) map[string]slog.Level {
+	levels := map[string]slog.Level{}
+	for _, kv := range strings.Split(s, ",") {
+		module, level, ok := strings.Cut(strings.TrimSpace(kv), "=")
+		if !ok {
+			continue
+		}
+		levels[module] = parseLogLevel(level, logLevel)
+	}
+	return levels
+}
+
+func parseLogSampleRate(s string) uint64 {
+	rate, err := strconv.ParseUint(s, 10, 64)
+	if err != nil || rate == 0 {
+		return 1
+	}
+	return rate
+}
+
+// leveledHandler filters records by a per-module level and samples everything below Error.
+type leveledHandler struct {
+	slog.Handler
+	level   slog.Level
+	sample  uint64
+	counter *atomic.Uint64
+}
+
+func (h *leveledHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= h.level
+}
+
+func (h *leveledHandler) Handle(ctx context.Context, r slog.Record) error {
+	if h.sample > 1 && r.Level < slog.LevelError && h.counter.Add(1)%h.sample != 0 {
+		return nil
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *leveledHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &leveledHandler{
+		Handler: h.Handler.WithAttrs(attrs),
+		level:   h.level,
+		sample:  h.sample,
+		counter: h.counter,
+	}
+}
+
+func (h *leveledHandler) WithGroup(name string) slog.Handler {
+	return &leveledHandler{
+		Handler: h.Handler.WithGroup(name),
+		level:   h.level,
+		sample:  h.sample,
+		counter: h.counter,
+	}
+}
@@ -1,7 +1,10 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	crand "crypto/rand"
+	"flag"
 	"fmt"
 	"log/slog"
 	"net"
@@ -9,6 +12,7 @@ import (
 	"os"
 	"os/exec"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/bytedance/sonic"
@@ -28,42 +32,77 @@ var db *sqlx.DB
 var paymentGatewayURL string = "http://43.207.87.29:12345"
 
 func main() {
-	mux := setup()
-	slog.Info("Listening on :8080")
+	flag.Parse()
+	runCommand(flag.Args())
+}
 
-	err := os.MkdirAll(badgerDir, 0755)
-	if err != nil {
-		panic(fmt.Sprintf("failed to create badger directory: %v", err))
+// runServe starts the subsystems enabled by the instance roles.
+func runServe(args []string) {
+	exitOnError(requireTokenSalt())
+	roles := instanceRoles()
+	slog.Info("Starting with roles " + roles.String())
+	if !roles.has(roleBitWeb) && !roles.has(roleBitNotifier) {
+		if !roles.has(roleBitMatcher) {
+			panic("no role is enabled")
+		}
+		runMatcher()
+		return
 	}
-	badgerDB, err = badger.Open(badger.DefaultOptions(badgerDir))
-	if err != nil {
-		panic(fmt.Sprintf("failed to open badger: %v", err))
+	if isRemoteMatcher() && matcherURL == "" {
+		panic("ISUCON_MATCHER_URL is required without the matcher role")
+	}
+	if roles.has(roleBitMatcher) {
+		startMatcher()
 	}
+	exitOnError(startPeers())
+	startRetention()
+	startCouponAbuseDetection()
+
+	mux := setup()
+	slog.Info("Listening on :8080")
+
+	openBadger()
 	defer badgerDB.Close()
-	defer func() {
-		badgerDB.Close()
-	}()
 
-	if err := initEmptyChairs(); err != nil {
+	recovered, err := recoverRideCreations(context.Background())
+	if err != nil {
 		panic(err)
 	}
-
-	if err := initRideStatusesCache(); err != nil {
+	if err := loadCaches(); err != nil {
 		panic(err)
 	}
+	requeueRecoveredRides(recovered)
+	startRideOutboxDispatcher()
+	if roles.has(roleBitWeb) {
+		startRideWatchdog()
+	}
+	startBinlogListener()
 
-	if err := initPaymentTokenCache(); err != nil {
-		panic(err)
+	isuhttp.ListenAndServe(":8080", mux)
+}
+
+// openBadger opens the existing badger directory without rebuilding it.
+func openBadger() {
+	err := os.MkdirAll(badgerDir, 0755)
+	if err != nil {
+		panic(fmt.Sprintf("failed to create badger directory: %v", err))
+	}
+	badgerDB, err = badger.Open(badger.DefaultOptions(badgerDir))
+	if err != nil {
+		panic(fmt.Sprintf("failed to open badger: %v", err))
 	}
+}
 
-	if err := initRideCache(); err != nil {
+// openDB connects to MySQL using the ISUCON_DB_* environment variables and sets db.
+func openDB() {
+	_db, err := isudb.DBMetricsSetup(slowQueryConnect(dbConnect))("mysql", dbConfigFromEnv().FormatDSN())
+	if err != nil {
 		panic(err)
 	}
-
-	isuhttp.ListenAndServe(":8080", mux)
+	db = _db
 }
 
-func setup() http.Handler {
+func dbConfigFromEnv() *mysql.Config {
 	host := os.Getenv("ISUCON_DB_HOST")
 	if host == "" {
 		host = "127.0.0.1"
@@ -96,49 +135,99 @@ func setup() http.Handler {
 	dbConfig.Net = "tcp"
 	dbConfig.DBName = dbname
 	dbConfig.ParseTime = true
+	// isudb also enables this, but don't depend on the metrics wrapper for it:
+	// without it every parameterized query costs a prepare/execute/close round-trip
+	dbConfig.InterpolateParams = true
 
-	_db, err := isudb.DBMetricsSetup(sqlx.Connect)("mysql", dbConfig.FormatDSN())
-	if err != nil {
-		panic(err)
-	}
-	db = _db
+	return dbConfig
+}
+
+func setup() http.Handler {
+	openDB()
+	s := newServer(db)
 
 	mux := chi.NewRouter()
 	mux.Use(middleware.Recoverer)
-	mux.HandleFunc("POST /api/initialize", postInitialize)
+	mux.Use(tracingMiddleware)
+	mux.Use(routeTimeoutMiddleware(mux))
+	mux.HandleFunc("POST /api/initialize", s.postInitialize)
+	mux.HandleFunc("GET /api/openapi.json", s.getOpenAPI)
+	mux.HandleFunc("GET /api/docs", s.getAPIDocs)
+
+	// internal handlers
+	// ローカルかトークン付きの呼び出しだけ受ける(internal_auth.go)
+	{
+		internal := mux.With(internalOnly)
+		internal.HandleFunc("GET /api/internal/debug/state", s.internalGetDebugState)
+		internal.HandleFunc("GET /api/internal/debug/goroutines", s.internalGetDebugGoroutines)
+		internal.HandleFunc("POST /api/internal/matches", s.internalPostMatches)
+		internal.HandleFunc("GET /api/internal/state/export", s.internalGetStateExport)
+		internal.HandleFunc("POST /api/internal/state/import", s.internalPostStateImport)
+		internal.HandleFunc("POST /api/internal/fixtures", s.internalPostFixtures)
+		internal.HandleFunc("GET /api/internal/rides", s.internalGetRides)
+		internal.HandleFunc("GET /api/internal/heatmap", s.internalGetHeatmap)
+		internal.HandleFunc("GET /api/internal/audit", s.internalGetAudit)
+		internal.HandleFunc("GET /api/internal/coupon-abuse", s.internalGetCouponAbuse)
+		internal.HandleFunc("GET /api/internal/campaigns", s.internalGetCampaigns)
+		internal.HandleFunc("POST /api/internal/campaigns", s.internalPostCampaigns)
+		internal.HandleFunc("POST /api/internal/campaigns/{campaign_id}/activate", s.internalPostCampaignActivate)
+		internal.HandleFunc("POST /api/internal/coupons/grant", s.internalPostCouponsGrant)
+		internal.HandleFunc("POST /api/internal/clock", s.internalPostClock)
+		internal.HandleFunc("GET /api/internal/config", s.internalGetConfig)
+		internal.HandleFunc("PUT /api/internal/config", s.internalPutConfig)
+	}
+
+	// 通知以外はwebの役割のインスタンスだけが受ける
+	api := mux.With(requireRole(roleBitWeb))
 
 	// app handlers
 	{
-		mux.HandleFunc("POST /api/app/users", appPostUsers)
-
-		authedMux := mux.With(appAuthMiddleware)
-		authedMux.HandleFunc("POST /api/app/payment-methods", appPostPaymentMethods)
-		authedMux.HandleFunc("GET /api/app/rides", appGetRides)
-		authedMux.HandleFunc("POST /api/app/rides", appPostRides)
-		authedMux.HandleFunc("POST /api/app/rides/estimated-fare", appPostRidesEstimatedFare)
-		authedMux.HandleFunc("POST /api/app/rides/{ride_id}/evaluation", appPostRideEvaluatation)
-		authedMux.HandleFunc("GET /api/app/notification", appGetNotification)
-		authedMux.HandleFunc("GET /api/app/nearby-chairs", appGetNearbyChairs)
+		api.HandleFunc("POST /api/app/users", s.appPostUsers)
+		api.HandleFunc("GET /api/app/invitations/{code}/validity", s.appGetInvitationValidity)
+
+		authedMux := api.With(appAuthMiddleware)
+		authedMux.HandleFunc("POST /api/app/payment-methods", s.appPostPaymentMethods)
+		authedMux.HandleFunc("PATCH /api/app/invitation-code", s.appPatchInvitationCode)
+		authedMux.HandleFunc("POST /api/app/users/deactivate", s.appPostUsersDeactivate)
+		authedMux.HandleFunc("GET /api/app/rides", s.appGetRides)
+		authedMux.HandleFunc("POST /api/app/rides", s.appPostRides)
+		authedMux.HandleFunc("POST /api/app/rides/estimated-fare", s.appPostRidesEstimatedFare)
+		authedMux.HandleFunc("POST /api/app/rides/{ride_id}/evaluation", s.appPostRideEvaluatation)
+		authedMux.HandleFunc("GET /api/app/rides/{ride_id}/eta", s.appGetRideETA)
+		mux.With(requireRole(roleBitNotifier), appAuthMiddleware, affinityMiddleware).HandleFunc("GET /api/app/notification", s.appGetNotification)
+		authedMux.HandleFunc("GET /api/app/nearby-chairs", s.appGetNearbyChairs)
 	}
 
 	// owner handlers
 	{
-		mux.HandleFunc("POST /api/owner/owners", ownerPostOwners)
-
-		authedMux := mux.With(ownerAuthMiddleware)
-		authedMux.HandleFunc("GET /api/owner/sales", ownerGetSales)
-		authedMux.HandleFunc("GET /api/owner/chairs", ownerGetChairs)
+		api.HandleFunc("POST /api/owner/owners", s.ownerPostOwners)
+
+		authedMux := api.With(ownerAuthMiddleware)
+		authedMux.HandleFunc("GET /api/owner/me", s.ownerGetMe)
+		authedMux.HandleFunc("PATCH /api/owner/me", s.ownerPatchMe)
+		authedMux.HandleFunc("GET /api/owner/sales", s.ownerGetSales)
+		authedMux.HandleFunc("GET /api/owner/chairs", s.ownerGetChairs)
+		authedMux.HandleFunc("GET /api/owner/chairs/leaderboard", s.ownerGetChairLeaderboard)
+		authedMux.HandleFunc("POST /api/owner/sales/export", s.ownerPostSalesExport)
+		authedMux.HandleFunc("POST /api/owner/webhooks", s.ownerPostWebhooks)
+		authedMux.HandleFunc("GET /api/owner/webhooks", s.ownerGetWebhooks)
 	}
 
 	// chair handlers
 	{
-		mux.HandleFunc("POST /api/chair/chairs", chairPostChairs)
+		api.HandleFunc("POST /api/chair/chairs", s.chairPostChairs)
+
+		authedMux := api.With(chairAuthMiddleware)
+		authedMux.HandleFunc("POST /api/chair/activity", s.chairPostActivity)
+		authedMux.HandleFunc("POST /api/chair/coordinate", s.chairPostCoordinate)
+		mux.With(requireRole(roleBitNotifier), chairAuthMiddleware, affinityMiddleware).HandleFunc("GET /api/chair/notification", s.chairGetNotification)
+		authedMux.HandleFunc("GET /api/chair/rides", s.chairGetRides)
+		authedMux.HandleFunc("POST /api/chair/rides/{ride_id}/status", s.chairPostRideStatus)
+	}
 
-		authedMux := mux.With(chairAuthMiddleware)
-		authedMux.HandleFunc("POST /api/chair/activity", chairPostActivity)
-		authedMux.HandleFunc("POST /api/chair/coordinate", chairPostCoordinate)
-		authedMux.HandleFunc("GET /api/chair/notification", chairGetNotification)
-		authedMux.HandleFunc("POST /api/chair/rides/{ride_id}/status", chairPostRideStatus)
+	// static files
+	if fsys := staticFS(); fsys != nil {
+		mux.Handle("GET /*", newStaticHandler(fsys))
 	}
 
 	return mux
@@ -152,17 +241,22 @@ type postInitializeResponse struct {
 	Language string `json:"language"`
 }
 
-func postInitialize(w http.ResponseWriter, r *http.Request) {
+func (s *Server) postInitialize(w http.ResponseWriter, r *http.Request) {
 	isutools.BeforeInitialize()
-	isuqueue.AllReset()
 	defer isutools.AfterInitialize()
 
+	// リトライで重なって呼ばれても、マッチングや通知と競合しないよう止めてから作り直す
+	resume := quiesceForInitialize(r.Context())
+	defer resume()
+	isuqueue.AllReset()
+
 	req := &postInitializeRequest{}
 	if err := bindJSON(r, req); err != nil {
 		writeError(w, r, http.StatusBadRequest, err)
 		return
 	}
 
+	discardPendingRideWrites()
 	if out, err := exec.Command("../sql/init.sh").CombinedOutput(); err != nil {
 		writeError(w, r, http.StatusInternalServerError, fmt.Errorf("failed to initialize: %s: %w", string(out), err))
 		return
@@ -170,29 +264,30 @@ func postInitialize(w http.ResponseWriter, r *http.Request) {
 
 	paymentGatewayURL = req.PaymentServer
 
-	if err := initBadger(); err != nil {
+	if err := initChairSpeeds(); err != nil {
 		writeError(w, r, http.StatusInternalServerError, err)
 		return
 	}
 
-	initEventBus()
-
-	if err := initEmptyChairs(); err != nil {
+	if err := hashStoredTokens(); err != nil {
 		writeError(w, r, http.StatusInternalServerError, err)
 		return
 	}
 
-	if err := initRideStatusesCache(); err != nil {
+	// 招待コードの索引はこれを読むので、キャッシュより先に作り直す
+	if err := initInvitationUses(); err != nil {
 		writeError(w, r, http.StatusInternalServerError, err)
 		return
 	}
 
-	if err := initPaymentTokenCache(); err != nil {
+	resetAll()
+
+	if err := initBadger(); err != nil {
 		writeError(w, r, http.StatusInternalServerError, err)
 		return
 	}
 
-	if err := initRideCache(); err != nil {
+	if err := loadCaches(); err != nil {
 		writeError(w, r, http.StatusInternalServerError, err)
 		return
 	}
@@ -202,13 +297,53 @@ func postInitialize(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	benchStartedAt = time.Now()
+	benchStartedAt = s.clock.Now()
 
 	writeJSON(w, http.StatusOK, postInitializeResponse{Language: "go"})
 }
 
+// loadCaches builds the in-memory caches from MySQL and badger.
+func loadCaches() error {
+	for _, load := range []func() error{
+		initFareConfig,
+		initChairCache,
+		initOwnerByIDCache,
+		initUserByIDCache,
+		initEmptyChairs,
+		initRideStatusesCache,
+		initPaymentTokenCache,
+		initRideCache,
+		initRideTravels,
+		initChairAvailability,
+		initStatusGauges,
+		initRideHeatmap,
+		initRideCountCache,
+		initCouponCache,
+		initOwnerWebhookCache,
+		initCampaign,
+		initChairStatsAggregates,
+		initInvitationCodeIndex,
+	} {
+		if err := load(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// initChairSpeeds fills the speed of chairs in the initial data, which only have a model.
+func initChairSpeeds() error {
+	if _, err := db.Exec("UPDATE chairs JOIN chair_models ON chair_models.name = chairs.model SET chairs.speed = chair_models.speed WHERE chairs.speed = 0"); err != nil {
+		return fmt.Errorf("failed to update chair speeds: %w", err)
+	}
+
+	return nil
+}
+
 func initRideSales() error {
-	if _, err := db.Exec(`UPDATE rides SET sales = ? + ? * (ABS(pickup_latitude - destination_latitude) + ABS(pickup_longitude - destination_longitude)) WHERE (SELECT COUNT(*) FROM ride_statuses as rs WHERE rs.ride_id = rides.id AND rs.status = "COMPLETED") != 0`, initialFare, farePerDistance); err != nil {
+	fare := currentFareConfig()
+	if _, err := db.Exec(`UPDATE rides SET sales = ? + ? * (ABS(pickup_latitude - destination_latitude) + ABS(pickup_longitude - destination_longitude)) WHERE (SELECT COUNT(*) FROM ride_statuses as rs WHERE rs.ride_id = rides.id AND rs.status = "COMPLETED") != 0`, fare.InitialFare, fare.FarePerDistance); err != nil {
 		return fmt.Errorf("failed to update rides sales: %w", err)
 	}
 
@@ -221,40 +356,104 @@ type Coordinate struct {
 }
 
 func bindJSON(r *http.Request, v interface{}) error {
-	return sonic.ConfigFastest.NewDecoder(r.Body).Decode(v)
+	if err := sonic.ConfigFastest.NewDecoder(r.Body).Decode(v); err != nil {
+		return err
+	}
+
+	if v, ok := v.(validator); ok {
+		return v.Validate()
+	}
+	return nil
+}
+
+// errorResponse is the body of every error response.
+// retryableがtrueなら同じリクエストをretry_after_ms(0なら任意の間隔)後にやり直してよい。
+type errorResponse struct {
+	Code         string            `json:"code"`
+	Message      string            `json:"message"`
+	Retryable    bool              `json:"retryable"`
+	RetryAfterMs int64             `json:"retry_after_ms"`
+	Fields       map[string]string `json:"fields,omitempty"`
+}
+
+var bufferPool = sync.Pool{
+	New: func() any {
+		return bytes.NewBuffer(make([]byte, 0, 1024))
+	},
+}
+
+func getBuffer() *bytes.Buffer {
+	return bufferPool.Get().(*bytes.Buffer)
+}
+
+func putBuffer(buf *bytes.Buffer) {
+	// 大きくなりすぎたバッファはプールに戻さない
+	if buf.Cap() > 64*1024 {
+		return
+	}
+	buf.Reset()
+	bufferPool.Put(buf)
 }
 
 func writeJSON(w http.ResponseWriter, statusCode int, v interface{}) {
-	w.Header().Set("Content-Type", "application/json;charset=utf-8")
-	w.WriteHeader(statusCode)
-	err := sonic.ConfigFastest.NewEncoder(w).Encode(v)
+	buf := getBuffer()
+	defer putBuffer(buf)
+
+	err := sonic.ConfigFastest.NewEncoder(buf).Encode(v)
 	if err != nil {
 		slog.Error("failed to encode response",
 			slog.Int("status_code", statusCode),
 			slog.String("error", err.Error()),
 		)
+		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	w.WriteHeader(statusCode)
+	w.Write(buf.Bytes())
 }
 
 func writeError(w http.ResponseWriter, r *http.Request, statusCode int, err error) {
+	appErr := toAppError(statusCode, err)
+	statusCode = appErr.Status
+
 	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	if appErr.RetryAfter > 0 {
+		// Retry-Afterは秒単位なので切り上げる
+		w.Header().Set("Retry-After", strconv.FormatInt(int64((appErr.RetryAfter+time.Second-1)/time.Second), 10))
+	}
 	w.WriteHeader(statusCode)
 
-	err = sonic.ConfigFastest.NewEncoder(w).Encode(map[string]string{"message": err.Error()})
-	if err != nil {
-		slog.Error("error response wrote",
+	res := &errorResponse{
+		Code:         appErr.Code,
+		Message:      appErr.Message,
+		Retryable:    appErr.Retryable,
+		RetryAfterMs: appErr.RetryAfter.Milliseconds(),
+		Fields:       appErr.Fields,
+	}
+	if encodeErr := sonic.ConfigFastest.NewEncoder(w).Encode(res); encodeErr != nil {
+		httpLogger.Error("failed to encode error response",
 			slog.String("path", r.URL.Path),
 			slog.Int("status_code", statusCode),
-			slog.String("error", err.Error()),
+			slog.String("error", encodeErr.Error()),
 		)
 	}
 
-	slog.Error("error response wrote",
+	// 4xxはベンチマーカーが意図的に起こすものも多いのでErrorにはしない
+	level := slog.LevelInfo
+	if statusCode >= http.StatusInternalServerError {
+		level = slog.LevelError
+	}
+	httpLogger.Log(r.Context(), level, "error response wrote",
 		slog.String("path", r.URL.Path),
 		slog.Int("status_code", statusCode),
 		slog.String("error", err.Error()),
 	)
+
+	if statusCode >= http.StatusInternalServerError {
+		recordServerError(r, statusCode)
+	}
 }
 
 func secureRandomStr(b int) string {
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/bytedance/sonic"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	isucache "github.com/mazrean/isucon-go-tools/v2/cache"
+	isuhttp "github.com/mazrean/isucon-go-tools/v2/http"
+)
+
+// ISUCON_ROLES(roles.go)でWebサーバーとマッチングを別インスタンスに分けられる
+//   - 未指定: 1プロセスで両方やる
+//   - matcherを含まないweb: マッチングはISUCON_MATCHER_URLのmatcherに任せ、ライド作成・空き椅子をHTTPで送る
+//   - matcherだけ: マッチングだけを行い、結果をISUCON_WEB_URLのwebに送り返す
+var (
+	matcherURL = os.Getenv("ISUCON_MATCHER_URL")
+	webURL     = os.Getenv("ISUCON_WEB_URL")
+
+	// webのときにmatcherから返ってきた未マッチのライド数。appPostRidesの流量制御に使う
+	remoteMatchingRides atomic.Int64
+
+	// matcherのときにwebから送られてきた椅子の位置
+	matcherChairLocations = isucache.NewAtomicMap[string, *chairLocation]("matcherChairLocations")
+
+	getMatcherChairLocation = getChairLocationFromBadger
+	applyMatches            func(pairs []matchedPair)
+)
+
+func init() {
+	// applyMatchは取り消されたライドの椅子をenqueueEmptyChairで戻し、そこからapplyMatchesを呼ぶので、変数の初期化では入れられない
+	applyMatches = applyMatchesLocal
+	registerReset(matcherChairLocations.Purge)
+}
+
+type matchedPair struct {
+	ride  *Ride
+	chair *Chair
+}
+
+type matcherRideRequest struct {
+	Ride *Ride `json:"ride"`
+}
+
+type matcherRideResponse struct {
+	MatchingRides int `json:"matching_rides"`
+}
+
+type matcherChairRequest struct {
+	ID       string      `json:"id"`
+	Model    string      `json:"model"`
+	Speed    int         `json:"speed"`
+	Location *Coordinate `json:"location,omitempty"`
+}
+
+type matcherMatch struct {
+	RideID  string `json:"ride_id"`
+	ChairID string `json:"chair_id"`
+}
+
+// isRemoteMatcher reports whether the matching is left to the matcher at ISUCON_MATCHER_URL.
+func isRemoteMatcher() bool {
+	roles := instanceRoles()
+	return roles.has(roleBitWeb) && !roles.has(roleBitMatcher)
+}
+
+func enqueueMatchingRide(ride *Ride) {
+	if isRemoteMatcher() {
+		go func() {
+			res := &matcherRideResponse{}
+			if err := postInternal(matcherURL+"/api/internal/matcher/rides", &matcherRideRequest{Ride: ride}, res); err != nil {
+				matcherLogger.Error("failed to send ride to matcher",
+					slog.String("ride_id", ride.ID),
+					slog.String("error", err.Error()),
+				)
+				return
+			}
+			remoteMatchingRides.Store(int64(res.MatchingRides))
+		}()
+		return
+	}
+
+	matchingRidesLock.Lock()
+	defer matchingRidesLock.Unlock()
+
+	matchingRides = append(matchingRides, ride)
+}
+
+func matchingRidesCount() int {
+	if isRemoteMatcher() {
+		return int(remoteMatchingRides.Load())
+	}
+
+	matchingRidesLock.RLock()
+	defer matchingRidesLock.RUnlock()
+
+	return len(matchingRides)
+}
+
+func enqueueEmptyChair(chair *Chair) {
+	if isRemoteMatcher() {
+		if err := sendEmptyChair(chair); err != nil {
+			matcherLogger.Error("failed to send empty chair to matcher",
+				slog.String("chair_id", chair.ID),
+				slog.String("error", err.Error()),
+			)
+		}
+		return
+	}
+
+	// 移動中に次のライドを仮割り当てしてあれば、空き椅子に戻さずにそのままマッチングさせる
+	if ride, ok := takeChainedRide(chair.ID); ok {
+		applyMatches([]matchedPair{{ride: ride, chair: chair}})
+		return
+	}
+
+	emptyChairsLocker.Lock()
+	defer emptyChairsLocker.Unlock()
+
+	emptyChairs = append(emptyChairs, chair)
+}
+
+func removeEmptyChair(chairID string) {
+	if isRemoteMatcher() {
+		if err := postInternal(matcherURL+"/api/internal/matcher/chairs/"+chairID+"/remove", nil, nil); err != nil {
+			matcherLogger.Error("failed to remove chair from matcher",
+				slog.String("chair_id", chairID),
+				slog.String("error", err.Error()),
+			)
+		}
+		return
+	}
+
+	emptyChairsLocker.Lock()
+	defer emptyChairsLocker.Unlock()
+
+	emptyChairs = removeChair(emptyChairs, chairID)
+}
+
+func removeChair(chairs []*Chair, chairID string) []*Chair {
+	for i, c := range chairs {
+		if c.ID == chairID {
+			return append(chairs[:i], chairs[i+1:]...)
+		}
+	}
+	return chairs
+}
+
+func sendEmptyChair(chair *Chair) error {
+	req := &matcherChairRequest{
+		ID:    chair.ID,
+		Model: chair.Model,
+		Speed: chair.Speed,
+	}
+
+	location, ok, err := getChairLocationFromBadger(chair.ID)
+	if err != nil {
+		return err
+	}
+	if ok {
+		req.Location = &Coordinate{Latitude: location.LastLatitude, Longitude: location.LastLongitude}
+	}
+
+	return postInternal(matcherURL+"/api/internal/matcher/chairs", req, nil)
+}
+
+// resetRemoteMatcher resets the matcher and hands it the empty chairs found at initialization.
+func resetRemoteMatcher(chairs []*Chair) error {
+	if err := postInternal(matcherURL+"/api/internal/matcher/reset", nil, nil); err != nil {
+		return fmt.Errorf("failed to reset matcher: %w", err)
+	}
+	remoteMatchingRides.Store(0)
+
+	for _, chair := range chairs {
+		if err := sendEmptyChair(chair); err != nil {
+			return fmt.Errorf("failed to send empty chair to matcher: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func applyMatchesLocal(pairs []matchedPair) {
+	for _, pair := range pairs {
+		applyMatch(pair.ride, pair.chair)
+	}
+}
+
+func applyMatch(ride *Ride, chair *Chair) {
+	now := clock.Now().Truncate(time.Microsecond)
+
+	rideAssignmentLock.Lock()
+	// マッチングの間に取り消されたライドには割り当てず、椅子を空き椅子に戻す
+	if rideCanceled(ride.ID) {
+		rideAssignmentLock.Unlock()
+		go enqueueEmptyChair(chair)
+		return
+	}
+	// キャッシュの*Rideは通知などで他のゴルーチンが読んでいるので、書き換えずにコピーを差し替える
+	matched := *ride
+	matched.ChairID = sql.NullString{String: chair.ID, Valid: true}
+	matched.UpdatedAt = now
+	ride = &matched
+	storeRide(ride)
+	rideAssignmentLock.Unlock()
+	writeRide(ride, 0)
+
+	latestRideCache.Store(chair.ID, ride)
+	markChairBusy(chair.ID)
+	recordRideTransition(ride, "MATCHED")
+	recordAudit(now, matcherActor, "ride.match", ride.ID, chair.ID, "", "MATCHED")
+	ChairPublish(chair.ID, &RideEvent{
+		status: "MATCHED",
+		chair:  chair,
+		ride:   ride,
+	})
+	UserPublish(ride.UserID, &RideEvent{
+		status: "MATCHED",
+		chair:  chair,
+		ride:   ride,
+	})
+}
+
+// matcherからマッチング結果を受け取ってwebで反映する
+func (s *Server) internalPostMatches(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	req := []matcherMatch{}
+	if err := bindJSON(r, &req); err != nil {
+		writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	// 別プロセスのマッチングの結果も、初期化の間は反映しない
+	backgroundWorkLock.RLock()
+	defer backgroundWorkLock.RUnlock()
+
+	for _, match := range req {
+		ride, ok := s.rides.Load(match.RideID)
+		if !ok {
+			writeError(w, r, http.StatusNotFound, errRideNotFound)
+			return
+		}
+		chair, err := getChairByID(ctx, match.ChairID)
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+
+		applyMatch(ride, chair)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func runMatcher() {
+	getMatcherChairLocation = func(chairID string) (*chairLocation, bool, error) {
+		location, ok := matcherChairLocations.Load(chairID)
+		return location, ok, nil
+	}
+	applyMatches = applyMatchesRemote
+
+	mux := chi.NewRouter()
+	mux.Use(middleware.Recoverer)
+	mux.Use(internalOnly)
+	mux.HandleFunc("POST /api/internal/matcher/reset", matcherPostReset)
+	mux.HandleFunc("POST /api/internal/matcher/rides", matcherPostRide)
+	mux.HandleFunc("POST /api/internal/matcher/chairs", matcherPostChair)
+	mux.HandleFunc("POST /api/internal/matcher/chairs/{chair_id}/remove", matcherPostChairRemove)
+
+	startMatcher()
+
+	addr := os.Getenv("ISUCON_MATCHER_ADDR")
+	if addr == "" {
+		addr = ":8081"
+	}
+	slog.Info("Matcher listening on " + addr)
+	isuhttp.ListenAndServe(addr, mux)
+}
+
+func applyMatchesRemote(pairs []matchedPair) {
+	if len(pairs) == 0 {
+		return
+	}
+
+	req := make([]matcherMatch, 0, len(pairs))
+	for _, pair := range pairs {
+		req = append(req, matcherMatch{RideID: pair.ride.ID, ChairID: pair.chair.ID})
+	}
+
+	if err := postInternal(webURL+"/api/internal/matches", req, nil); err != nil {
+		matcherLogger.Error("failed to send matches to web",
+			slog.Int("matches", len(pairs)),
+			slog.String("error", err.Error()),
+		)
+
+		// 送れなかった分は次のtickでもう一度マッチングさせる
+		for _, pair := range pairs {
+			enqueueMatchingRide(pair.ride)
+			enqueueEmptyChair(pair.chair)
+		}
+	}
+}
+
+func matcherPostReset(w http.ResponseWriter, r *http.Request) {
+	resetAll()
+	benchStartedAt = clock.Now()
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func matcherPostRide(w http.ResponseWriter, r *http.Request) {
+	req := &matcherRideRequest{}
+	if err := bindJSON(r, req); err != nil || req.Ride == nil {
+		writeError(w, r, http.StatusBadRequest, badRequest("ride is required"))
+		return
+	}
+
+	enqueueMatchingRide(req.Ride)
+
+	writeJSON(w, http.StatusOK, &matcherRideResponse{
+		MatchingRides: matchingRidesCount(),
+	})
+}
+
+func matcherPostChair(w http.ResponseWriter, r *http.Request) {
+	req := &matcherChairRequest{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	if req.Location != nil {
+		matcherChairLocations.Store(req.ID, &chairLocation{
+			LastLatitude:  req.Location.Latitude,
+			LastLongitude: req.Location.Longitude,
+		})
+	}
+	// マッチャーのプロセスでは、webから送られてきた椅子を空きとみなす
+	markChairAvailable(req.ID)
+	enqueueEmptyChair(&Chair{
+		ID:    req.ID,
+		Model: req.Model,
+		Speed: req.Speed,
+	})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func matcherPostChairRemove(w http.ResponseWriter, r *http.Request) {
+	markChairBusy(r.PathValue("chair_id"))
+	removeEmptyChair(r.PathValue("chair_id"))
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func postInternal(url string, req any, res any) error {
+	var body bytes.Buffer
+	if req != nil {
+		if err := sonic.ConfigFastest.NewEncoder(&body).Encode(req); err != nil {
+			return fmt.Errorf("failed to encode request: %w", err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	httpReq, err := newInternalRequest(ctx, http.MethodPost, url, "application/json", &body)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+
+	httpRes, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		return fmt.Errorf("failed to request %s: %w", url, err)
+	}
+	defer httpRes.Body.Close()
+
+	if httpRes.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("unexpected status code from %s: %d", url, httpRes.StatusCode)
+	}
+
+	if res != nil {
+		if err := sonic.ConfigFastest.NewDecoder(httpRes.Body).Decode(res); err != nil {
+			return fmt.Errorf("failed to decode response: %w", err)
+		}
+	}
+
+	return nil
+}
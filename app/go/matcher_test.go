@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestApplyMatchReplacesRide(t *testing.T) {
+	s := newTestServer(t, nil, nil)
+	openTestBadger(t)
+	openTestDB(t)
+	t.Cleanup(discardPendingRideWrites)
+
+	chair := &Chair{ID: "chair", Name: "chair-name", Model: "model", IsActive: true}
+	createdAt := time.UnixMilli(1733600000000)
+	ride := &Ride{ID: "ride", UserID: "user", CreatedAt: createdAt, UpdatedAt: createdAt}
+	s.rides.Store(ride.ID, ride)
+	s.rideStatuses.Store(ride.ID, &RideStatus{RideID: ride.ID, Status: "MATCHING"})
+
+	applyMatch(ride, chair)
+
+	// 通知などが読んでいる*Rideは書き換えない
+	if ride.ChairID.Valid || !ride.UpdatedAt.Equal(createdAt) {
+		t.Errorf("applyMatch changed the ride in place: %+v", ride)
+	}
+	cached, _ := s.rides.Load(ride.ID)
+	if cached == ride || cached.ChairID.String != chair.ID {
+		t.Errorf("cached ride = %+v, want a copy assigned to %s", cached, chair.ID)
+	}
+	if latest, _ := latestRideCache.Load(chair.ID); latest != cached {
+		t.Errorf("latest ride of the chair = %+v, want the cached ride", latest)
+	}
+}
@@ -13,7 +13,11 @@ import (
 	"github.com/motoki317/sc"
 )
 
-var accessTokenCache *sc.Cache[string, *User]
+// トークンのキャッシュはどれもhashTokenしたトークンをキーにする
+var (
+	accessTokenCache *sc.Cache[string, *User]
+	userByIDCache    = isucache.NewAtomicMap[string, *User]("userByIDCache")
+)
 
 func init() {
 	var err error
@@ -21,10 +25,13 @@ func init() {
 		"userCache",
 		func(ctx context.Context, key string) (*User, error) {
 			user := &User{}
-			err := db.GetContext(ctx, user, "SELECT * FROM users WHERE access_token = ?", key)
+			// 退会した利用者のトークンは差し替えているが、念のため退会済みの行は引かない
+			err := db.GetContext(ctx, user, "SELECT "+userColumns+" FROM users WHERE access_token = ? AND deactivated_at IS NULL", key)
 			if err != nil {
 				return nil, err
 			}
+			// share the same *User between the token and ID keys
+			user, _ = userByIDCache.LoadOrStore(user.ID, user)
 			return user, nil
 		},
 		5*time.Minute,  // freshFor
@@ -35,6 +42,35 @@ func init() {
 		// Handle cache initialization error appropriately
 		panic(err)
 	}
+	registerReset(accessTokenCache.Purge)
+	registerReset(userByIDCache.Purge)
+}
+
+func initUserByIDCache() error {
+	users := []User{}
+	if err := db.Select(&users, "SELECT "+userColumns+" FROM users"); err != nil {
+		return err
+	}
+
+	for _, user := range users {
+		userByIDCache.Store(user.ID, &user)
+	}
+
+	return nil
+}
+
+func getUserByID(ctx context.Context, userID string) (*User, error) {
+	if user, ok := userByIDCache.Load(userID); ok {
+		return user, nil
+	}
+
+	user := &User{}
+	if err := db.GetContext(ctx, user, "SELECT "+userColumns+" FROM users WHERE id = ?", userID); err != nil {
+		return nil, err
+	}
+	user, _ = userByIDCache.LoadOrStore(userID, user)
+
+	return user, nil
 }
 
 func appAuthMiddleware(next http.Handler) http.Handler {
@@ -42,15 +78,13 @@ func appAuthMiddleware(next http.Handler) http.Handler {
 		ctx := r.Context()
 		c, err := r.Cookie("app_session")
 		if errors.Is(err, http.ErrNoCookie) || c.Value == "" {
-			writeError(w, r, http.StatusUnauthorized, errors.New("app_session cookie is required"))
+			writeError(w, r, http.StatusUnauthorized, unauthorized("app_session cookie is required"))
 			return
 		}
-		accessToken := c.Value
-
-		user, err := accessTokenCache.Get(ctx, accessToken)
+		user, err := accessTokenCache.Get(ctx, hashToken(c.Value))
 		if err != nil {
 			if errors.Is(err, sql.ErrNoRows) {
-				writeError(w, r, http.StatusUnauthorized, errors.New("invalid access token"))
+				writeError(w, r, http.StatusUnauthorized, errInvalidAccessToken)
 				return
 			}
 			writeError(w, r, http.StatusInternalServerError, err)
@@ -72,7 +106,7 @@ func ownerAuthMiddleware(next http.Handler) http.Handler {
 		var err error
 		ownerCache, err = isucache.New("ownerCache", func(ctx context.Context, key string) (*Owner, error) {
 			owner := &Owner{}
-			if err := db.GetContext(ctx, owner, "SELECT * FROM owners WHERE access_token = ?", key); err != nil {
+			if err := db.GetContext(ctx, owner, "SELECT "+ownerColumns+" FROM owners WHERE access_token = ?", key); err != nil {
 				return nil, err
 			}
 			return owner, nil
@@ -80,21 +114,20 @@ func ownerAuthMiddleware(next http.Handler) http.Handler {
 		if err != nil {
 			log.Fatalf("failed to create owner cache: %v", err)
 		}
+		registerReset(ownerCache.Purge)
 	})
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
 		c, err := r.Cookie("owner_session")
 		if errors.Is(err, http.ErrNoCookie) || c.Value == "" {
-			writeError(w, r, http.StatusUnauthorized, errors.New("owner_session cookie is required"))
+			writeError(w, r, http.StatusUnauthorized, unauthorized("owner_session cookie is required"))
 			return
 		}
-		accessToken := c.Value
-
-		owner, err := ownerCache.Get(ctx, accessToken)
+		owner, err := ownerCache.Get(ctx, hashToken(c.Value))
 		if err != nil {
 			if errors.Is(err, sql.ErrNoRows) {
-				writeError(w, r, http.StatusUnauthorized, errors.New("invalid access token"))
+				writeError(w, r, http.StatusUnauthorized, errInvalidAccessToken)
 				return
 			}
 			writeError(w, r, http.StatusInternalServerError, err)
@@ -114,7 +147,7 @@ func init() {
 		"chairAccessTokenCache",
 		func(ctx context.Context, key string) (*Chair, error) {
 			chair := &Chair{}
-			err = db.GetContext(ctx, chair, "SELECT * FROM chairs WHERE access_token = ?", key)
+			err = db.GetContext(ctx, chair, "SELECT "+chairColumns+" FROM chairs WHERE access_token = ?", key)
 			if err != nil {
 				return nil, err
 			}
@@ -128,6 +161,7 @@ func init() {
 		// Handle cache initialization error appropriately
 		panic(err)
 	}
+	registerReset(chairAccessTokenCache.Purge)
 }
 
 func chairAuthMiddleware(next http.Handler) http.Handler {
@@ -135,14 +169,13 @@ func chairAuthMiddleware(next http.Handler) http.Handler {
 		ctx := r.Context()
 		c, err := r.Cookie("chair_session")
 		if errors.Is(err, http.ErrNoCookie) || c.Value == "" {
-			writeError(w, r, http.StatusUnauthorized, errors.New("chair_session cookie is required"))
+			writeError(w, r, http.StatusUnauthorized, unauthorized("chair_session cookie is required"))
 			return
 		}
-		accessToken := c.Value
-		chair, err := chairAccessTokenCache.Get(ctx, accessToken)
+		chair, err := chairAccessTokenCache.Get(ctx, hashToken(c.Value))
 		if err != nil {
 			if errors.Is(err, sql.ErrNoRows) {
-				writeError(w, r, http.StatusUnauthorized, errors.New("invalid access token"))
+				writeError(w, r, http.StatusUnauthorized, errInvalidAccessToken)
 				return
 			}
 			writeError(w, r, http.StatusInternalServerError, err)
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// openTestDB replaces db with a SQLite database that has the tables the auth middlewares read.
+func openTestDB(t *testing.T) *sqlx.DB {
+	t.Helper()
+
+	testDB, err := sqlx.Open("sqlite3", filepath.Join(t.TempDir(), "isuride.db"))
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	for _, query := range []string{
+		"CREATE TABLE users (id TEXT PRIMARY KEY, username TEXT, firstname TEXT, lastname TEXT, date_of_birth TEXT, access_token TEXT, invitation_code TEXT, created_at DATETIME, updated_at DATETIME, deactivated_at DATETIME)",
+		"CREATE TABLE owners (id TEXT PRIMARY KEY, name TEXT, access_token TEXT, chair_register_token TEXT, created_at DATETIME, updated_at DATETIME)",
+		"CREATE TABLE chairs (id TEXT PRIMARY KEY, owner_id TEXT, name TEXT, model TEXT, speed INTEGER, is_active BOOLEAN, access_token TEXT, created_at DATETIME, updated_at DATETIME)",
+	} {
+		if _, err := testDB.Exec(query); err != nil {
+			t.Fatalf("failed to create table: %v", err)
+		}
+	}
+
+	original := db
+	db = testDB
+	t.Cleanup(func() {
+		db = original
+		testDB.Close()
+	})
+	return testDB
+}
+
+type authMiddlewareCase struct {
+	name       string
+	cookie     string
+	table      string
+	middleware func(http.Handler) http.Handler
+	// insert stores an entity authenticated by the hashed token and returns its ID
+	insert func(t *testing.T, testDB *sqlx.DB, hashedToken string) string
+	// contextID returns the ID of the entity the middleware put in the context, failing if its type is wrong
+	contextID func(t *testing.T, r *http.Request) string
+}
+
+var authMiddlewareCases = []authMiddlewareCase{
+	{
+		name:       "app",
+		table:      "users",
+		cookie:     "app_session",
+		middleware: appAuthMiddleware,
+		insert: func(t *testing.T, testDB *sqlx.DB, hashedToken string) string {
+			testDB.MustExec("INSERT INTO users (id, username, firstname, lastname, date_of_birth, access_token, invitation_code, created_at, updated_at) VALUES ('user', 'name', 'first', 'last', '2000-01-01', ?, 'code', CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)", hashedToken)
+			return "user"
+		},
+		contextID: func(t *testing.T, r *http.Request) string {
+			user, ok := r.Context().Value("user").(*User)
+			if !ok {
+				t.Fatalf("context value user is %T, want *User", r.Context().Value("user"))
+			}
+			return user.ID
+		},
+	},
+	{
+		name:       "owner",
+		table:      "owners",
+		cookie:     "owner_session",
+		middleware: ownerAuthMiddleware,
+		insert: func(t *testing.T, testDB *sqlx.DB, hashedToken string) string {
+			testDB.MustExec("INSERT INTO owners (id, name, access_token, chair_register_token, created_at, updated_at) VALUES ('owner', 'name', ?, 'register', CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)", hashedToken)
+			return "owner"
+		},
+		contextID: func(t *testing.T, r *http.Request) string {
+			owner, ok := r.Context().Value("owner").(*Owner)
+			if !ok {
+				t.Fatalf("context value owner is %T, want *Owner", r.Context().Value("owner"))
+			}
+			return owner.ID
+		},
+	},
+	{
+		name:       "chair",
+		table:      "chairs",
+		cookie:     "chair_session",
+		middleware: chairAuthMiddleware,
+		insert: func(t *testing.T, testDB *sqlx.DB, hashedToken string) string {
+			testDB.MustExec("INSERT INTO chairs (id, owner_id, name, model, speed, is_active, access_token, created_at, updated_at) VALUES ('chair', 'owner', 'name', 'model', 5, TRUE, ?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)", hashedToken)
+			return "chair"
+		},
+		contextID: func(t *testing.T, r *http.Request) string {
+			chair, ok := r.Context().Value("chair").(*Chair)
+			if !ok {
+				t.Fatalf("context value chair is %T, want *Chair", r.Context().Value("chair"))
+			}
+			return chair.ID
+		},
+	},
+}
+
+// serveAuth sends a request with the cookie through the middleware and returns the response and the IDs seen by the next handler.
+func serveAuth(t *testing.T, tc authMiddlewareCase, cookie *http.Cookie) (*httptest.ResponseRecorder, []string) {
+	t.Helper()
+
+	var ids []string
+	handler := tc.middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ids = append(ids, tc.contextID(t, r))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	return rec, ids
+}
+
+func TestAuthMiddlewareRejects(t *testing.T) {
+	for _, tc := range authMiddlewareCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Cleanup(resetAll)
+			testDB := openTestDB(t)
+			tc.insert(t, testDB, hashToken("token"))
+
+			tests := []struct {
+				name   string
+				cookie *http.Cookie
+				status int
+				code   string
+			}{
+				{name: "missing cookie", status: http.StatusUnauthorized, code: "unauthorized"},
+				{name: "empty cookie", cookie: &http.Cookie{Name: tc.cookie, Value: ""}, status: http.StatusUnauthorized, code: "unauthorized"},
+				{name: "other cookie", cookie: &http.Cookie{Name: "session", Value: "token"}, status: http.StatusUnauthorized, code: "unauthorized"},
+				{name: "invalid token", cookie: &http.Cookie{Name: tc.cookie, Value: "invalid"}, status: http.StatusUnauthorized, code: errInvalidAccessToken.Code},
+				// DBにはハッシュしか無いので、ハッシュそのものを送っても通らない
+				{name: "hashed token", cookie: &http.Cookie{Name: tc.cookie, Value: hashToken("token")}, status: http.StatusUnauthorized, code: errInvalidAccessToken.Code},
+			}
+			for _, tt := range tests {
+				t.Run(tt.name, func(t *testing.T) {
+					rec, ids := serveAuth(t, tc, tt.cookie)
+					if rec.Code != tt.status {
+						t.Fatalf("status = %d, want %d: %s", rec.Code, tt.status, rec.Body.String())
+					}
+					if res := decodeResponse[errorResponse](t, rec); res.Code != tt.code {
+						t.Errorf("code = %q, want %q", res.Code, tt.code)
+					}
+					if len(ids) > 0 {
+						t.Errorf("next handler was called with %v", ids)
+					}
+				})
+			}
+		})
+	}
+}
+
+func TestAuthMiddlewareCache(t *testing.T) {
+	for _, tc := range authMiddlewareCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Cleanup(resetAll)
+			testDB := openTestDB(t)
+			id := tc.insert(t, testDB, hashToken("token"))
+			cookie := &http.Cookie{Name: tc.cookie, Value: "token"}
+
+			// 1回目はキャッシュに無いのでDBから読む
+			rec, ids := serveAuth(t, tc, cookie)
+			if rec.Code != http.StatusNoContent || len(ids) != 1 || ids[0] != id {
+				t.Fatalf("cache miss: status = %d, ids = %v, want %d with %s: %s", rec.Code, ids, http.StatusNoContent, id, rec.Body.String())
+			}
+
+			// 2回目はDBを見ない
+			testDB.MustExec("DELETE FROM " + tc.table)
+			rec, ids = serveAuth(t, tc, cookie)
+			if rec.Code != http.StatusNoContent || len(ids) != 1 || ids[0] != id {
+				t.Fatalf("cache hit: status = %d, ids = %v, want %d with %s: %s", rec.Code, ids, http.StatusNoContent, id, rec.Body.String())
+			}
+
+			// 初期化でキャッシュが捨てられた後はDBの状態に従う
+			resetAll()
+			rec, ids = serveAuth(t, tc, cookie)
+			if rec.Code != http.StatusUnauthorized || len(ids) > 0 {
+				t.Fatalf("after reset: status = %d, ids = %v, want %d: %s", rec.Code, ids, http.StatusUnauthorized, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestAuthMiddlewareDBError(t *testing.T) {
+	for _, tc := range authMiddlewareCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Cleanup(resetAll)
+			testDB := openTestDB(t)
+			testDB.Close()
+
+			rec, ids := serveAuth(t, tc, &http.Cookie{Name: tc.cookie, Value: "token"})
+			if rec.Code != http.StatusInternalServerError || len(ids) > 0 {
+				t.Fatalf("status = %d, ids = %v, want %d: %s", rec.Code, ids, http.StatusInternalServerError, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestAppAuthMiddlewareDeactivatedUser(t *testing.T) {
+	t.Cleanup(resetAll)
+	testDB := openTestDB(t)
+	tc := authMiddlewareCases[0]
+	tc.insert(t, testDB, hashToken("token"))
+	testDB.MustExec("UPDATE users SET deactivated_at = CURRENT_TIMESTAMP")
+
+	rec, ids := serveAuth(t, tc, &http.Cookie{Name: tc.cookie, Value: "token"})
+	if rec.Code != http.StatusUnauthorized || len(ids) > 0 {
+		t.Fatalf("status = %d, ids = %v, want %d: %s", rec.Code, ids, http.StatusUnauthorized, rec.Body.String())
+	}
+	if res := decodeResponse[errorResponse](t, rec); res.Code != errInvalidAccessToken.Code {
+		t.Errorf("code = %q, want %q", res.Code, errInvalidAccessToken.Code)
+	}
+}
@@ -5,11 +5,26 @@ import (
 	"time"
 )
 
+// SELECT * はカラム追加で壊れるうえ不要なカラムまで取ってくるので、明示的なカラムリストを使う
+const (
+	chairColumns        = "id, owner_id, name, model, speed, is_active, access_token, created_at, updated_at"
+	chairPublicColumns  = "id, owner_id, name, model, is_active, created_at, updated_at"
+	userColumns         = "id, username, firstname, lastname, date_of_birth, access_token, invitation_code, created_at, updated_at"
+	paymentTokenColumns = "user_id, token, created_at"
+	rideColumns         = "id, user_id, chair_id, pickup_latitude, pickup_longitude, destination_latitude, destination_longitude, evaluation, created_at, updated_at"
+	ownerColumns        = "id, name, access_token, chair_register_token, created_at, updated_at"
+	couponColumns       = "user_id, code, discount, created_at, used_by, expires_at"
+	ownerWebhookColumns = "id, owner_id, url, secret, created_at"
+	couponAbuseColumns  = "user_id, reason, detail, detected_at"
+	campaignColumns     = "id, name, new_user_discount, invitee_discount, inviter_discount, max_invitation_uses, is_active, created_at"
+)
+
 type Chair struct {
 	ID          string    `db:"id"`
 	OwnerID     string    `db:"owner_id"`
 	Name        string    `db:"name"`
 	Model       string    `db:"model"`
+	Speed       int       `db:"speed"`
 	IsActive    bool      `db:"is_active"`
 	AccessToken string    `db:"access_token"`
 	CreatedAt   time.Time `db:"created_at"`
@@ -78,10 +93,37 @@ type Owner struct {
 	UpdatedAt          time.Time `db:"updated_at"`
 }
 
-type Coupon struct {
-	UserID    string    `db:"user_id"`
-	Code      string    `db:"code"`
-	Discount  int       `db:"discount"`
+type OwnerWebhook struct {
+	ID        string    `db:"id"`
+	OwnerID   string    `db:"owner_id"`
+	URL       string    `db:"url"`
+	Secret    string    `db:"secret"`
 	CreatedAt time.Time `db:"created_at"`
-	UsedBy    *string   `db:"used_by"`
+}
+
+type Campaign struct {
+	ID                string    `db:"id"`
+	Name              string    `db:"name"`
+	NewUserDiscount   int       `db:"new_user_discount"`
+	InviteeDiscount   int       `db:"invitee_discount"`
+	InviterDiscount   int       `db:"inviter_discount"`
+	MaxInvitationUses int       `db:"max_invitation_uses"`
+	IsActive          bool      `db:"is_active"`
+	CreatedAt         time.Time `db:"created_at"`
+}
+
+type CouponAbuseFlag struct {
+	UserID     string    `db:"user_id"`
+	Reason     string    `db:"reason"`
+	Detail     string    `db:"detail"`
+	DetectedAt time.Time `db:"detected_at"`
+}
+
+type Coupon struct {
+	UserID    string     `db:"user_id"`
+	Code      string     `db:"code"`
+	Discount  int        `db:"discount"`
+	CreatedAt time.Time  `db:"created_at"`
+	UsedBy    *string    `db:"used_by"`
+	ExpiresAt *time.Time `db:"expires_at"`
 }
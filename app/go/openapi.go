@@ -0,0 +1,307 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// /api以下のOpenAPIドキュメント
+// スキーマはリクエスト・レスポンスの構造体のjsonタグからリフレクションで組み立てるので、ここではルートと型の対応だけを持つ。
+// ルートを追加したらsetupとあわせてここにも追加する。
+//
+//	curl -s localhost:8080/api/openapi.json
+//	open http://localhost:8080/api/docs
+
+type apiOperation struct {
+	method   string
+	path     string
+	summary  string
+	tag      string
+	security string
+	request  any
+	response any
+	status   int
+	// notificationはSSEで送るので、responseはdataの中身
+	stream bool
+}
+
+var apiOperations = []apiOperation{
+	{method: "POST", path: "/api/initialize", summary: "Initialize data", tag: "system", request: postInitializeRequest{}, response: postInitializeResponse{}, status: http.StatusOK},
+
+	{method: "POST", path: "/api/app/users", summary: "Register a user", tag: "app", request: appPostUsersRequest{}, response: appPostUsersResponse{}, status: http.StatusCreated},
+	{method: "GET", path: "/api/app/invitations/{code}/validity", summary: "Check whether an invitation code can be used", tag: "app", response: appGetInvitationValidityResponse{}, status: http.StatusOK},
+	{method: "POST", path: "/api/app/payment-methods", summary: "Register a payment token", tag: "app", security: "app_session", request: appPostPaymentMethodsRequest{}, status: http.StatusNoContent},
+	{method: "POST", path: "/api/app/users/deactivate", summary: "Deactivate the user", tag: "app", security: "app_session", response: appPostUsersDeactivateResponse{}, status: http.StatusOK},
+	{method: "PATCH", path: "/api/app/invitation-code", summary: "Change the invitation code", tag: "app", security: "app_session", request: appPatchInvitationCodeRequest{}, response: appPatchInvitationCodeResponse{}, status: http.StatusOK},
+	{method: "GET", path: "/api/app/rides", summary: "List completed rides", tag: "app", security: "app_session", response: getAppRidesResponse{}, status: http.StatusOK},
+	{method: "POST", path: "/api/app/rides", summary: "Request a ride", tag: "app", security: "app_session", request: appPostRidesRequest{}, response: appPostRidesResponse{}, status: http.StatusAccepted},
+	{method: "POST", path: "/api/app/rides/estimated-fare", summary: "Estimate the fare", tag: "app", security: "app_session", request: appPostRidesEstimatedFareRequest{}, response: appPostRidesEstimatedFareResponse{}, status: http.StatusOK},
+	{method: "POST", path: "/api/app/rides/{ride_id}/evaluation", summary: "Evaluate a ride and pay", tag: "app", security: "app_session", request: appPostRideEvaluationRequest{}, response: appPostRideEvaluationResponse{}, status: http.StatusOK},
+	{method: "GET", path: "/api/app/rides/{ride_id}/eta", summary: "Estimate pickup and arrival times", tag: "app", security: "app_session", response: appGetRideETAResponse{}, status: http.StatusOK},
+	{method: "GET", path: "/api/app/notification", summary: "Stream ride status", tag: "app", security: "app_session", response: appGetNotificationResponseData{}, status: http.StatusOK, stream: true},
+	{method: "GET", path: "/api/app/nearby-chairs", summary: "List chairs near a coordinate", tag: "app", security: "app_session", response: appGetNearbyChairsResponse{}, status: http.StatusOK},
+
+	{method: "POST", path: "/api/owner/owners", summary: "Register an owner", tag: "owner", request: ownerPostOwnersRequest{}, response: ownerPostOwnersResponse{}, status: http.StatusCreated},
+	{method: "GET", path: "/api/owner/me", summary: "Get the owner's own account", tag: "owner", security: "owner_session", response: ownerGetMeResponse{}, status: http.StatusOK},
+	{method: "PATCH", path: "/api/owner/me", summary: "Change the owner name or rotate the chair register token", tag: "owner", security: "owner_session", request: ownerPatchMeRequest{}, response: ownerGetMeResponse{}, status: http.StatusOK},
+	{method: "GET", path: "/api/owner/sales", summary: "Get sales", tag: "owner", security: "owner_session", response: ownerGetSalesResponse{}, status: http.StatusOK},
+	{method: "GET", path: "/api/owner/chairs", summary: "List owned chairs", tag: "owner", security: "owner_session", response: ownerGetChairResponse{}, status: http.StatusOK},
+	{method: "GET", path: "/api/owner/chairs/leaderboard", summary: "Rank owned chairs", tag: "owner", security: "owner_session", response: ownerGetChairLeaderboardResponse{}, status: http.StatusOK},
+	{method: "POST", path: "/api/owner/sales/export", summary: "Export sales to object storage", tag: "owner", security: "owner_session", response: ownerPostSalesExportResponse{}, status: http.StatusCreated},
+	{method: "POST", path: "/api/owner/webhooks", summary: "Register a webhook", tag: "owner", security: "owner_session", request: ownerPostWebhooksRequest{}, response: ownerPostWebhooksResponse{}, status: http.StatusCreated},
+	{method: "GET", path: "/api/owner/webhooks", summary: "List webhooks", tag: "owner", security: "owner_session", response: ownerGetWebhooksResponse{}, status: http.StatusOK},
+
+	{method: "POST", path: "/api/chair/chairs", summary: "Register a chair", tag: "chair", request: chairPostChairsRequest{}, response: chairPostChairsResponse{}, status: http.StatusCreated},
+	{method: "POST", path: "/api/chair/activity", summary: "Change activity", tag: "chair", security: "chair_session", request: postChairActivityRequest{}, status: http.StatusNoContent},
+	{method: "POST", path: "/api/chair/coordinate", summary: "Report the location", tag: "chair", security: "chair_session", request: Coordinate{}, response: chairPostCoordinateResponse{}, status: http.StatusOK},
+	{method: "GET", path: "/api/chair/notification", summary: "Stream assigned rides", tag: "chair", security: "chair_session", response: chairGetNotificationResponseData{}, status: http.StatusOK, stream: true},
+	{method: "GET", path: "/api/chair/rides", summary: "List completed rides of the chair", tag: "chair", security: "chair_session", response: chairGetRidesResponse{}, status: http.StatusOK},
+	{method: "POST", path: "/api/chair/rides/{ride_id}/status", summary: "Update ride status", tag: "chair", security: "chair_session", request: postChairRidesRideIDStatusRequest{}, status: http.StatusNoContent},
+
+	{method: "GET", path: "/api/internal/debug/state", summary: "Cache and queue sizes", tag: "internal", response: internalGetDebugStateResponse{}, status: http.StatusOK},
+	{method: "GET", path: "/api/internal/state/export", summary: "Export volatile state", tag: "internal", response: volatileState{}, status: http.StatusOK},
+	{method: "POST", path: "/api/internal/state/import", summary: "Import volatile state", tag: "internal", request: volatileState{}, status: http.StatusNoContent},
+	{method: "GET", path: "/api/internal/rides", summary: "Search rides", tag: "internal", response: internalGetRidesResponse{}, status: http.StatusOK},
+	{method: "GET", path: "/api/internal/heatmap", summary: "Aggregate recent pickups or destinations on a grid", tag: "internal", response: internalGetHeatmapResponse{}, status: http.StatusOK},
+	{method: "GET", path: "/api/internal/audit", summary: "Query the audit log", tag: "internal", response: []auditEntry{}, status: http.StatusOK},
+	{method: "GET", path: "/api/internal/coupon-abuse", summary: "List accounts flagged for coupon abuse", tag: "internal", response: []internalGetCouponAbuseResponseFlag{}, status: http.StatusOK},
+	{method: "GET", path: "/api/internal/campaigns", summary: "List registration campaigns", tag: "internal", response: []internalCampaign{}, status: http.StatusOK},
+	{method: "POST", path: "/api/internal/campaigns", summary: "Create a registration campaign", tag: "internal", request: internalPostCampaignsRequest{}, response: internalCampaign{}, status: http.StatusCreated},
+	{method: "POST", path: "/api/internal/campaigns/{campaign_id}/activate", summary: "Switch the active campaign", tag: "internal", response: internalCampaign{}, status: http.StatusOK},
+	{method: "POST", path: "/api/internal/coupons/grant", summary: "Grant a coupon to users in batch", tag: "internal", request: internalPostCouponsGrantRequest{}, response: internalPostCouponsGrantResponse{}, status: http.StatusOK},
+	{method: "GET", path: "/api/internal/config", summary: "Get the runtime config", tag: "internal", response: internalConfig{}, status: http.StatusOK},
+	{method: "PUT", path: "/api/internal/config", summary: "Replace runtime config sections", tag: "internal", request: internalConfig{}, response: internalConfig{}, status: http.StatusOK},
+	{method: "POST", path: "/api/internal/clock", summary: "Move the fake clock", tag: "internal", request: internalPostClockRequest{}, response: internalPostClockResponse{}, status: http.StatusOK},
+}
+
+var (
+	timeType       = reflect.TypeFor[time.Time]()
+	nullStringType = reflect.TypeFor[sql.NullString]()
+)
+
+type openAPISchemas map[string]any
+
+// schemaOf returns the schema of t, registering named structs as components.
+func (schemas openAPISchemas) schemaOf(t reflect.Type) map[string]any {
+	switch t {
+	case timeType:
+		return map[string]any{"type": "string", "format": "date-time"}
+	case nullStringType:
+		return map[string]any{"type": "string", "nullable": true}
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		schema := schemas.schemaOf(t.Elem())
+		if _, ok := schema["$ref"]; ok {
+			return map[string]any{"allOf": []any{schema}, "nullable": true}
+		}
+		schema["nullable"] = true
+		return schema
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return map[string]any{"type": "integer"}
+	case reflect.Int64, reflect.Uint64:
+		return map[string]any{"type": "integer", "format": "int64"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]any{"type": "array", "items": schemas.schemaOf(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": schemas.schemaOf(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return schemas.structSchema(t)
+		}
+		if _, ok := schemas[t.Name()]; !ok {
+			// 再帰する型のために先に登録しておく
+			schemas[t.Name()] = nil
+			schemas[t.Name()] = schemas.structSchema(t)
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + t.Name()}
+	}
+
+	return map[string]any{}
+}
+
+func (schemas openAPISchemas) structSchema(t reflect.Type) map[string]any {
+	properties := map[string]any{}
+	required := []string{}
+	schemas.collectFields(t, properties, &required)
+
+	schema := map[string]any{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+func (schemas openAPISchemas) collectFields(t reflect.Type, properties map[string]any, required *[]string) {
+	for i := range t.NumField() {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			schemas.collectFields(f.Type, properties, required)
+			continue
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+
+		properties[name] = schemas.schemaOf(f.Type)
+		if !strings.Contains(opts, "omitempty") && f.Type.Kind() != reflect.Pointer {
+			*required = append(*required, name)
+		}
+	}
+}
+
+func jsonContent(schema map[string]any) map[string]any {
+	return map[string]any{"application/json": map[string]any{"schema": schema}}
+}
+
+func buildOpenAPI() map[string]any {
+	schemas := openAPISchemas{}
+	errorSchema := schemas.schemaOf(reflect.TypeFor[errorResponse]())
+
+	paths := map[string]map[string]any{}
+	for _, op := range apiOperations {
+		operation := map[string]any{
+			"summary": op.summary,
+			"tags":    []string{op.tag},
+		}
+
+		var parameters []any
+		for _, segment := range strings.Split(op.path, "/") {
+			if strings.HasPrefix(segment, "{") {
+				parameters = append(parameters, map[string]any{
+					"name":     strings.Trim(segment, "{}"),
+					"in":       "path",
+					"required": true,
+					"schema":   map[string]any{"type": "string"},
+				})
+			}
+		}
+		if len(parameters) > 0 {
+			operation["parameters"] = parameters
+		}
+		if op.security != "" {
+			operation["security"] = []any{map[string]any{op.security: []string{}}}
+		}
+		if op.request != nil {
+			operation["requestBody"] = map[string]any{
+				"required": true,
+				"content":  jsonContent(schemas.schemaOf(reflect.TypeOf(op.request))),
+			}
+		}
+
+		success := map[string]any{"description": http.StatusText(op.status)}
+		if op.response != nil {
+			schema := schemas.schemaOf(reflect.TypeOf(op.response))
+			if op.stream {
+				success["description"] = "Server-Sent Events whose data is the schema below"
+				success["content"] = map[string]any{"text/event-stream": map[string]any{"schema": schema}}
+			} else {
+				success["content"] = jsonContent(schema)
+			}
+		}
+		operation["responses"] = map[string]any{
+			strconv.Itoa(op.status): success,
+			"default":               map[string]any{"description": "Error", "content": jsonContent(errorSchema)},
+		}
+
+		if paths[op.path] == nil {
+			paths[op.path] = map[string]any{}
+		}
+		paths[op.path][strings.ToLower(op.method)] = operation
+	}
+
+	securitySchemes := map[string]any{}
+	for _, name := range []string{"app_session", "owner_session", "chair_session"} {
+		securitySchemes[name] = map[string]any{"type": "apiKey", "in": "cookie", "name": name}
+	}
+
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":   "ISURIDE",
+			"version": "1.0.0",
+		},
+		"paths": paths,
+		"components": map[string]any{
+			"schemas":         schemas,
+			"securitySchemes": securitySchemes,
+		},
+	}
+}
+
+var openAPIDocument = sync.OnceValue(buildOpenAPI)
+
+func (s *Server) getOpenAPI(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, openAPIDocument())
+}
+
+// 外部のスクリプトを読まずに、openapi.jsonからルートとスキーマを並べるだけのビューア
+const apiDocsHTML = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>ISURIDE API</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+details { margin: .5em 0; }
+summary { cursor: pointer; }
+code.method { display: inline-block; width: 4em; font-weight: bold; }
+pre { background: #f4f4f4; padding: 1em; overflow: auto; }
+</style>
+</head>
+<body>
+<h1>ISURIDE API</h1>
+<p><a href="/api/openapi.json">openapi.json</a></p>
+<div id="ops"></div>
+<script>
+fetch("/api/openapi.json").then(r => r.json()).then(doc => {
+  const ops = document.getElementById("ops");
+  for (const [path, methods] of Object.entries(doc.paths).sort()) {
+    for (const [method, op] of Object.entries(methods)) {
+      const d = document.createElement("details");
+      const s = document.createElement("summary");
+      s.innerHTML = '<code class="method"></code><code class="path"></code> ';
+      s.querySelector(".method").textContent = method.toUpperCase();
+      s.querySelector(".path").textContent = path;
+      s.append(op.summary);
+      const pre = document.createElement("pre");
+      pre.textContent = JSON.stringify(op, null, 2);
+      d.append(s, pre);
+      ops.append(d);
+    }
+  }
+  const schemas = document.createElement("details");
+  schemas.innerHTML = "<summary>schemas</summary><pre></pre>";
+  schemas.querySelector("pre").textContent = JSON.stringify(doc.components.schemas, null, 2);
+  ops.append(schemas);
+});
+</script>
+</body>
+</html>
+`
+
+func (s *Server) getAPIDocs(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(apiDocsHTML))
+}
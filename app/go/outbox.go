@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/bytedance/sonic"
+	"github.com/dgraph-io/badger"
+)
+
+// ライド作成のoutbox
+// ライドの作成はMySQL・badger・キャッシュ・イベントに別々に書くので、途中で落ちると食い違う。
+// 先に作成の意図(rideCreationIntent)をユーザーのフラグと同じbadgerのトランザクションで書き、
+// それからapplyRideCreationでキャッシュ・非同期書き込み・イベントに反映する。ridesへのINSERTとマッチングはride_creation_queue.goで行い、
+// そこで書けなかったライドはdispatcherが書いてからマッチングに回す。
+// MySQLへの書き込みが済んだ頃にdispatcherが冪等に書き込みを確かめて(足りなければ書いて)から意図を消す。
+// 起動時は残っている意図をMySQLに反映してからキャッシュを組み立てる。
+
+const (
+	rideOutboxPrefix      = "outbox"
+	rideOutboxInterval    = time.Second
+	rideOutboxSettleAfter = 5 * time.Second
+)
+
+type rideCreationIntent struct {
+	Ride   Ride       `json:"ride"`
+	Status RideStatus `json:"status"`
+	Coupon *Coupon    `json:"coupon,omitempty"`
+}
+
+func rideOutboxKey(rideID string) []byte {
+	return append([]byte(rideOutboxPrefix), []byte(rideID)...)
+}
+
+// persistRideCreation writes intent together with the user status flag of the ride's user.
+func persistRideCreation(intent *rideCreationIntent) error {
+	data, err := sonic.Marshal(intent)
+	if err != nil {
+		return fmt.Errorf("failed to encode ride creation: %w", err)
+	}
+
+	err = badgerDB.Update(func(txn *badger.Txn) error {
+		if err := txn.Set(append([]byte("user"), []byte(intent.Ride.UserID)...), []byte{1}); err != nil {
+			return fmt.Errorf("failed to set user status: %w", err)
+		}
+		if err := txn.Set(rideOutboxKey(intent.Ride.ID), data); err != nil {
+			return fmt.Errorf("failed to set ride creation: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update badger: %w", err)
+	}
+
+	return nil
+}
+
+// applyRideCreation applies the in-memory and write-behind effects of intent.
+// A ride that is already in the cache is left as is, so applying the same intent twice is harmless.
+func (s *Server) applyRideCreation(intent *rideCreationIntent) {
+	ride := &intent.Ride
+	if _, ok := s.rides.Load(ride.ID); ok {
+		return
+	}
+
+	incrementRideCount(ride.UserID)
+	if intent.Coupon != nil {
+		s.couponRepository.Use(ride.ID, *intent.Coupon)
+	}
+
+	s.rideRepository.Save(ride)
+	queueRideCreation(ride)
+	recordRideHeatmap(ride)
+	status := intent.Status
+	queueRideStatus(&status)
+	recordAudit(status.CreatedAt, userActor(ride.UserID), "ride.create", ride.ID, "", "", status.Status)
+	s.events.UserPublish(ride.UserID, &RideEvent{
+		status:    status.Status,
+		updatedAt: status.CreatedAt,
+		ride:      ride,
+	})
+}
+
+// settleRideCreation makes sure MySQL has the ride, its first status and the used coupon, then drops intent.
+// どれも既に書かれていれば何もしないので、非同期の書き込みと重なっても、何度呼んでもよい。
+func settleRideCreation(ctx context.Context, intent *rideCreationIntent) error {
+	ride := &intent.Ride
+	if _, err := db.ExecContext(ctx,
+		"INSERT INTO rides (id, user_id, pickup_latitude, pickup_longitude, destination_latitude, destination_longitude, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?) ON DUPLICATE KEY UPDATE id = id",
+		ride.ID, ride.UserID, ride.PickupLatitude, ride.PickupLongitude, ride.DestinationLatitude, ride.DestinationLongitude, ride.CreatedAt, ride.CreatedAt,
+	); err != nil {
+		return fmt.Errorf("failed to insert ride: %w", err)
+	}
+
+	status := &intent.Status
+	if _, err := db.ExecContext(ctx,
+		"INSERT INTO ride_statuses (id, ride_id, status, created_at, app_sent_at, chair_sent_at) VALUES (?, ?, ?, ?, ?, ?) ON DUPLICATE KEY UPDATE id = id",
+		status.ID, status.RideID, status.Status, status.CreatedAt, status.AppSentAt, status.ChairSentAt,
+	); err != nil {
+		return fmt.Errorf("failed to insert ride status: %w", err)
+	}
+
+	if coupon := intent.Coupon; coupon != nil {
+		if _, err := db.ExecContext(ctx, "UPDATE coupons SET used_by = ? WHERE user_id = ? AND code = ? AND used_by IS NULL", ride.ID, coupon.UserID, coupon.Code); err != nil {
+			return fmt.Errorf("failed to update coupon: %w", err)
+		}
+	}
+
+	if err := badgerDB.Update(func(txn *badger.Txn) error {
+		return txn.Delete(rideOutboxKey(ride.ID))
+	}); err != nil {
+		return fmt.Errorf("failed to delete ride creation: %w", err)
+	}
+	releaseAbandonedRideCreation(ride.ID)
+
+	return nil
+}
+
+// pendingRideCreations returns the intents written before the given time, or all of them if before is zero.
+func pendingRideCreations(before time.Time) ([]*rideCreationIntent, error) {
+	var intents []*rideCreationIntent
+	err := badgerDB.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte(rideOutboxPrefix)
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			err := it.Item().Value(func(v []byte) error {
+				intent := &rideCreationIntent{}
+				if err := sonic.Unmarshal(v, intent); err != nil {
+					return fmt.Errorf("failed to decode ride creation: %w", err)
+				}
+				if before.IsZero() || intent.Status.CreatedAt.Before(before) {
+					intents = append(intents, intent)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to view badger: %w", err)
+	}
+
+	return intents, nil
+}
+
+func settleRideCreations(ctx context.Context, before time.Time) ([]*rideCreationIntent, error) {
+	intents, err := pendingRideCreations(before)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, intent := range intents {
+		if err := settleRideCreation(ctx, intent); err != nil {
+			return nil, err
+		}
+	}
+
+	return intents, nil
+}
+
+// recoverRideCreations settles the intents left by a previous process. Call it before loadCaches.
+func recoverRideCreations(ctx context.Context) ([]*rideCreationIntent, error) {
+	intents, err := settleRideCreations(ctx, time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	if len(intents) > 0 {
+		slog.Warn("recovered unfinished ride creations", slog.Int("count", len(intents)))
+	}
+
+	return intents, nil
+}
+
+// requeueRecoveredRides puts the recovered rides that are still waiting for a chair back into the matching queue.
+// マッチング待ちのライドはキャッシュの初期化では戻らないので、loadCachesの後に呼ぶ。
+func requeueRecoveredRides(intents []*rideCreationIntent) {
+	for _, intent := range intents {
+		status, ok := rideStatusesCache.Load(intent.Ride.ID)
+		if !ok || status.Status != "MATCHING" {
+			continue
+		}
+		if ride, ok := rideCache.Load(intent.Ride.ID); ok && !ride.ChairID.Valid {
+			enqueueMatchingRide(ride)
+		}
+	}
+}
+
+func startRideOutboxDispatcher() {
+	go func() {
+		ticker := time.NewTicker(rideOutboxInterval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			// 非同期の書き込みが終わっているはずのものだけを確かめる
+			runBackgroundWork(func() {
+				if _, err := settleRideCreations(context.Background(), clock.Now().Add(-rideOutboxSettleAfter)); err != nil {
+					slog.Error("failed to settle ride creations", slog.String("error", err.Error()))
+				}
+			})
+		}
+	}()
+}
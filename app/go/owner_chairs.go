@@ -0,0 +1,42 @@
+package main
+
+import (
+	"slices"
+	"sync"
+)
+
+// オーナーごとの椅子のIDの索引
+// chairCacheと合わせて、オーナーの椅子の一覧をMySQLを引かずに作る。
+// 起動時と初期化時にinitChairCacheで組み立て、椅子の登録で足す。
+
+var (
+	// owner ID -> 登録順の椅子のID
+	ownerChairIDs     = map[string][]string{}
+	ownerChairIDsLock sync.RWMutex
+)
+
+func init() {
+	registerReset(func() {
+		ownerChairIDsLock.Lock()
+		defer ownerChairIDsLock.Unlock()
+
+		ownerChairIDs = map[string][]string{}
+	})
+}
+
+func indexOwnerChair(ownerID string, chairID string) {
+	ownerChairIDsLock.Lock()
+	defer ownerChairIDsLock.Unlock()
+
+	if slices.Contains(ownerChairIDs[ownerID], chairID) {
+		return
+	}
+	ownerChairIDs[ownerID] = append(ownerChairIDs[ownerID], chairID)
+}
+
+func chairIDsOfOwner(ownerID string) []string {
+	ownerChairIDsLock.RLock()
+	defer ownerChairIDsLock.RUnlock()
+
+	return slices.Clone(ownerChairIDs[ownerID])
+}
@@ -1,19 +1,49 @@
 package main
 
 import (
-	"database/sql"
-	"errors"
+	"context"
 	"net/http"
 	"strconv"
 	"time"
 
+	"github.com/jmoiron/sqlx"
+	isucache "github.com/mazrean/isucon-go-tools/v2/cache"
 	"github.com/oklog/ulid/v2"
 )
 
-const (
-	initialFare     = 500
-	farePerDistance = 100
-)
+var ownerByIDCache = isucache.NewAtomicMap[string, *Owner]("ownerByIDCache")
+
+func init() {
+	registerReset(ownerByIDCache.Purge)
+}
+
+func initOwnerByIDCache() error {
+	owners := []Owner{}
+	if err := db.Select(&owners, "SELECT "+ownerColumns+" FROM owners"); err != nil {
+		return err
+	}
+
+	for _, owner := range owners {
+		ownerByIDCache.Store(owner.ID, &owner)
+	}
+
+	return nil
+}
+
+// ownerPatchMe replaces the cached row when it updates an owner
+func getOwnerByID(ctx context.Context, ownerID string) (*Owner, error) {
+	if owner, ok := ownerByIDCache.Load(ownerID); ok {
+		return owner, nil
+	}
+
+	owner := &Owner{}
+	if err := db.GetContext(ctx, owner, "SELECT "+ownerColumns+" FROM owners WHERE id = ?", ownerID); err != nil {
+		return nil, err
+	}
+	ownerByIDCache.Store(ownerID, owner)
+
+	return owner, nil
+}
 
 type ownerPostOwnersRequest struct {
 	Name string `json:"name"`
@@ -24,32 +54,38 @@ type ownerPostOwnersResponse struct {
 	ChairRegisterToken string `json:"chair_register_token"`
 }
 
-func ownerPostOwners(w http.ResponseWriter, r *http.Request) {
+func (s *Server) ownerPostOwners(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	req := &ownerPostOwnersRequest{}
 	if err := bindJSON(r, req); err != nil {
 		writeError(w, r, http.StatusBadRequest, err)
 		return
 	}
-	if req.Name == "" {
-		writeError(w, r, http.StatusBadRequest, errors.New("some of required fields(name) are empty"))
-		return
-	}
 
 	ownerID := ulid.Make().String()
 	accessToken := secureRandomStr(32)
 	chairRegisterToken := secureRandomStr(32)
+	now := s.clock.Now().Truncate(time.Microsecond)
 
-	_, err := db.ExecContext(
+	_, err := s.db.ExecContext(
 		ctx,
-		"INSERT INTO owners (id, name, access_token, chair_register_token) VALUES (?, ?, ?, ?)",
-		ownerID, req.Name, accessToken, chairRegisterToken,
+		"INSERT INTO owners (id, name, access_token, chair_register_token, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?)",
+		ownerID, req.Name, hashToken(accessToken), hashToken(chairRegisterToken), now, now,
 	)
 	if err != nil {
 		writeError(w, r, http.StatusInternalServerError, err)
 		return
 	}
 
+	ownerByIDCache.Store(ownerID, &Owner{
+		ID:                 ownerID,
+		Name:               req.Name,
+		AccessToken:        hashToken(accessToken),
+		ChairRegisterToken: hashToken(chairRegisterToken),
+		CreatedAt:          now,
+		UpdatedAt:          now,
+	})
+
 	http.SetCookie(w, &http.Cookie{
 		Path:  "/",
 		Name:  "owner_session",
@@ -79,39 +115,66 @@ type ownerGetSalesResponse struct {
 	Models     []modelSales `json:"models"`
 }
 
-func ownerGetSales(w http.ResponseWriter, r *http.Request) {
-	ctx := r.Context()
+// parseSalesRange reads since/until (unix milliseconds) from the query.
+func parseSalesRange(r *http.Request) (time.Time, time.Time, error) {
 	since := time.Unix(0, 0)
 	until := time.Date(9999, 12, 31, 23, 59, 59, 0, time.UTC)
 	if r.URL.Query().Get("since") != "" {
 		parsed, err := strconv.ParseInt(r.URL.Query().Get("since"), 10, 64)
 		if err != nil {
-			writeError(w, r, http.StatusBadRequest, err)
-			return
+			return since, until, err
 		}
 		since = time.UnixMilli(parsed)
 	}
 	if r.URL.Query().Get("until") != "" {
 		parsed, err := strconv.ParseInt(r.URL.Query().Get("until"), 10, 64)
 		if err != nil {
-			writeError(w, r, http.StatusBadRequest, err)
-			return
+			return since, until, err
 		}
 		until = time.UnixMilli(parsed)
 	}
 
+	return since, until, nil
+}
+
+func (s *Server) ownerGetSales(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	since, until, err := parseSalesRange(r)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
 	owner := r.Context().Value("owner").(*Owner)
 
+	// 集計より先に版を読んでおけば、集計中に売上が変わっても次のリクエストで取り直される
+	etag := ownerSalesETag(owner.ID, since, until)
+	if r.Header.Get("If-None-Match") == etag {
+		w.Header().Set("ETag", etag)
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	res, err := calculateOwnerSales(ctx, s.db, owner.ID, since, until)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.Header().Set("ETag", etag)
+	writeJSON(w, http.StatusOK, res)
+}
+
+func calculateOwnerSales(ctx context.Context, q sqlx.QueryerContext, ownerID string, since time.Time, until time.Time) (*ownerGetSalesResponse, error) {
 	chairs := []struct {
 		Chair
 		Sales int `db:"sales"`
 	}{}
-	if err := db.SelectContext(ctx, &chairs, "SELECT chairs.id, chairs.name, chairs.model, SUM(IF(rides.id IS NULL, 0, rides.sales)) AS sales FROM chairs LEFT JOIN rides ON rides.chair_id = chairs.id AND rides.updated_at BETWEEN ? AND ? + INTERVAL 999 MICROSECOND WHERE chairs.owner_id = ? GROUP BY chairs.id", since, until, owner.ID); err != nil {
-		writeError(w, r, http.StatusInternalServerError, err)
-		return
+	if err := sqlx.SelectContext(ctx, q, &chairs, "SELECT chairs.id, chairs.name, chairs.model, SUM(IF(rides.id IS NULL, 0, rides.sales)) AS sales FROM chairs LEFT JOIN rides ON rides.chair_id = chairs.id AND rides.updated_at BETWEEN ? AND ? + INTERVAL 999 MICROSECOND WHERE chairs.owner_id = ? GROUP BY chairs.id", since, until, ownerID); err != nil {
+		return nil, err
 	}
 
-	res := ownerGetSalesResponse{
+	res := &ownerGetSalesResponse{
 		TotalSales: 0,
 	}
 
@@ -137,20 +200,7 @@ func ownerGetSales(w http.ResponseWriter, r *http.Request) {
 	}
 	res.Models = models
 
-	writeJSON(w, http.StatusOK, res)
-}
-
-type chairWithDetail struct {
-	ID                     string        `db:"id"`
-	OwnerID                string        `db:"owner_id"`
-	Name                   string        `db:"name"`
-	AccessToken            string        `db:"access_token"`
-	Model                  string        `db:"model"`
-	IsActive               bool          `db:"is_active"`
-	CreatedAt              time.Time     `db:"created_at"`
-	UpdatedAt              time.Time     `db:"updated_at"`
-	TotalDistance          int           `db:"total_distance"`
-	TotalDistanceUpdatedAt sql.NullInt64 `db:"total_distance_updated_at"`
+	return res, nil
 }
 
 type ownerGetChairResponse struct {
@@ -167,56 +217,36 @@ type ownerGetChairResponseChair struct {
 	TotalDistanceUpdatedAt *int64 `json:"total_distance_updated_at,omitempty"`
 }
 
-func ownerGetChairs(w http.ResponseWriter, r *http.Request) {
+func (s *Server) ownerGetChairs(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	owner := ctx.Value("owner").(*Owner)
 
-	chairs := []chairWithDetail{}
-	if err := db.SelectContext(ctx, &chairs, `SELECT id,
-       owner_id,
-       name,
-       access_token,
-       model,
-       is_active,
-       created_at,
-       updated_at
-FROM chairs WHERE owner_id = ?
-`, owner.ID); err != nil {
+	// 椅子はchairCache、走行距離はlocationCacheから引く。キャッシュにない椅子の位置だけbadgerを読む
+	chairIDs := chairIDsOfOwner(owner.ID)
+	locations, err := getChairLocationsFromBadger(chairIDs)
+	if err != nil {
 		writeError(w, r, http.StatusInternalServerError, err)
 		return
 	}
 
-	for i := range chairs {
-		chair := &chairs[i]
-
-		location, ok, err := getChairLocationFromBadger(chair.ID)
+	res := ownerGetChairResponse{}
+	for _, chairID := range chairIDs {
+		chair, err := s.chairRepository.Get(ctx, chairID)
 		if err != nil {
 			writeError(w, r, http.StatusInternalServerError, err)
 			return
 		}
-		if !ok {
-			continue
-		}
 
-		chair.TotalDistance = location.TotalDistance
-		chair.TotalDistanceUpdatedAt = sql.NullInt64{
-			Int64: location.TotalDistanceUpdatedAt,
-			Valid: true,
-		}
-	}
-
-	res := ownerGetChairResponse{}
-	for _, chair := range chairs {
 		c := ownerGetChairResponseChair{
-			ID:            chair.ID,
-			Name:          chair.Name,
-			Model:         chair.Model,
-			Active:        chair.IsActive,
-			RegisteredAt:  chair.CreatedAt.UnixMilli(),
-			TotalDistance: chair.TotalDistance,
+			ID:           chair.ID,
+			Name:         chair.Name,
+			Model:        chair.Model,
+			Active:       chair.IsActive,
+			RegisteredAt: chair.CreatedAt.UnixMilli(),
 		}
-		if chair.TotalDistanceUpdatedAt.Valid {
-			t := chair.TotalDistanceUpdatedAt.Int64
+		if location, ok := locations[chairID]; ok {
+			t := location.TotalDistanceUpdatedAt
+			c.TotalDistance = location.TotalDistance
 			c.TotalDistanceUpdatedAt = &t
 		}
 		res.Chairs = append(res.Chairs, c)
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/isucon/isucon14/webapp/go/peerpb"
+	isucache "github.com/mazrean/isucon-go-tools/v2/cache"
+)
+
+// オーナーごとの売上の版
+// ライドの完了や椅子の登録でオーナーの売上が変わるたびにinvalidateOwnerSalesで版を上げ、他のインスタンスにも伝える。
+// 版が同じ間は売上は変わらないので、ownerGetSalesはこれをETagにしてダッシュボードのポーリングに304を返す。
+// 売上の結果をキャッシュするときも版をキーに含めれば古いものを捨てる必要はない。
+
+var (
+	ownerSalesVersions = isucache.NewAtomicMap[string, *atomic.Uint64]("ownerSalesVersions")
+	// 初期化のたびに変えて、初期化をまたいで同じ版になってもETagが一致しないようにする
+	ownerSalesEpoch atomic.Int64
+)
+
+func init() {
+	ownerSalesEpoch.Store(time.Now().UnixNano())
+	registerReset(func() {
+		ownerSalesVersions.Purge()
+		ownerSalesEpoch.Store(time.Now().UnixNano())
+	})
+}
+
+func ownerSalesVersion(ownerID string) uint64 {
+	version, ok := ownerSalesVersions.Load(ownerID)
+	if !ok {
+		return 0
+	}
+	return version.Load()
+}
+
+// invalidateOwnerSales bumps the sales version of ownerID on this and the peer instances.
+func invalidateOwnerSales(ownerID string) {
+	invalidateOwnerSalesLocal(ownerID)
+	broadcastToPeers(&peerpb.Event{
+		Kind:   peerEventKindSales,
+		Target: ownerID,
+	})
+}
+
+func invalidateOwnerSalesLocal(ownerID string) {
+	version, _ := ownerSalesVersions.LoadOrStore(ownerID, &atomic.Uint64{})
+	version.Add(1)
+}
+
+// ownerSalesETag identifies the sales of ownerID in [since, until] at the current version.
+func ownerSalesETag(ownerID string, since time.Time, until time.Time) string {
+	return fmt.Sprintf(`"%x-%d-%d-%d"`, ownerSalesEpoch.Load(), ownerSalesVersion(ownerID), since.UnixMilli(), until.UnixMilli())
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"net/http"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// オーナー自身の登録情報の参照と変更
+// chair_register_tokenはハッシュしか持っていないので参照では返せない(token_hash.go)。
+// 忘れたり漏れたりしたときはrotate_chair_register_tokenで作り直し、そのレスポンスで新しい平文を一度だけ返す。
+
+const maxOwnerNameLength = 30
+
+type ownerGetMeResponse struct {
+	ID                 string `json:"id"`
+	Name               string `json:"name"`
+	ChairRegisterToken string `json:"chair_register_token,omitempty"`
+	CreatedAt          int64  `json:"created_at"`
+	UpdatedAt          int64  `json:"updated_at"`
+}
+
+// newOwnerGetMeResponse returns owner with chairRegisterToken, which is only set right after it was rotated.
+func newOwnerGetMeResponse(owner *Owner, chairRegisterToken string) *ownerGetMeResponse {
+	return &ownerGetMeResponse{
+		ID:                 owner.ID,
+		Name:               owner.Name,
+		ChairRegisterToken: chairRegisterToken,
+		CreatedAt:          owner.CreatedAt.UnixMilli(),
+		UpdatedAt:          owner.UpdatedAt.UnixMilli(),
+	}
+}
+
+func (s *Server) ownerGetMe(w http.ResponseWriter, r *http.Request) {
+	owner := r.Context().Value("owner").(*Owner)
+
+	writeJSON(w, http.StatusOK, newOwnerGetMeResponse(owner, ""))
+}
+
+type ownerPatchMeRequest struct {
+	// 省略したら名前は変えない
+	Name                     string `json:"name"`
+	RotateChairRegisterToken bool   `json:"rotate_chair_register_token"`
+}
+
+func (req *ownerPatchMeRequest) Validate() error {
+	v := validation{}
+	if req.Name == "" && !req.RotateChairRegisterToken {
+		v.fail("name", "required")
+	}
+	if utf8.RuneCountInString(req.Name) > maxOwnerNameLength {
+		v.fail("name", "must be at most 30 characters")
+	}
+	return v.err("name is invalid")
+}
+
+func (s *Server) ownerPatchMe(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	req := &ownerPatchMeRequest{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	owner := ctx.Value("owner").(*Owner)
+	name := cmp.Or(req.Name, owner.Name)
+	if name == owner.Name && !req.RotateChairRegisterToken {
+		writeJSON(w, http.StatusOK, newOwnerGetMeResponse(owner, ""))
+		return
+	}
+	now := s.clock.Now().Truncate(time.Microsecond)
+
+	var chairRegisterToken string
+	hashedChairRegisterToken := owner.ChairRegisterToken
+	if req.RotateChairRegisterToken {
+		chairRegisterToken = secureRandomStr(32)
+		hashedChairRegisterToken = hashToken(chairRegisterToken)
+	}
+
+	if _, err := s.db.ExecContext(ctx, "UPDATE owners SET name = ?, chair_register_token = ?, updated_at = ? WHERE id = ?", name, hashedChairRegisterToken, now, owner.ID); err != nil {
+		var mysqlErr *mysql.MySQLError
+		if errors.As(err, &mysqlErr) && mysqlErr.Number == mysqlErrDuplicateEntry {
+			writeError(w, r, http.StatusConflict, errOwnerNameTaken)
+			return
+		}
+		writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	// キャッシュのOwnerは書き換えずに差し替える
+	updated := *owner
+	updated.Name = name
+	updated.ChairRegisterToken = hashedChairRegisterToken
+	updated.UpdatedAt = now
+	ownerByIDCache.Store(owner.ID, &updated)
+	ownerCache.Forget(owner.AccessToken)
+
+	writeJSON(w, http.StatusOK, newOwnerGetMeResponse(&updated, chairRegisterToken))
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOwnerGetMe(t *testing.T) {
+	s := newTestServer(t, nil, nil)
+
+	createdAt := time.UnixMilli(1733600000000)
+	owner := &Owner{ID: "owner", Name: "owner-name", AccessToken: hashToken("token"), ChairRegisterToken: hashToken("register"), CreatedAt: createdAt, UpdatedAt: createdAt}
+	req := httptest.NewRequest(http.MethodGet, "/api/owner/me", nil)
+	req = req.WithContext(context.WithValue(req.Context(), "owner", owner))
+	rec := httptest.NewRecorder()
+	s.ownerGetMe(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusOK, rec.Body.String())
+	}
+	got := decodeResponse[ownerGetMeResponse](t, rec)
+	// chair_register_tokenはハッシュしか無いので返さない
+	want := ownerGetMeResponse{
+		ID:        "owner",
+		Name:      "owner-name",
+		CreatedAt: createdAt.UnixMilli(),
+		UpdatedAt: createdAt.UnixMilli(),
+	}
+	if got != want {
+		t.Errorf("response = %+v, want %+v", got, want)
+	}
+}
+
+func TestOwnerPatchMeRotateChairRegisterToken(t *testing.T) {
+	testDB := openTestDB(t)
+	s := newTestServer(t, nil, nil)
+	s.db = testDB
+
+	createdAt := time.UnixMilli(1733600000000)
+	owner := &Owner{ID: "owner", Name: "owner-name", AccessToken: hashToken("token"), ChairRegisterToken: hashToken("register"), CreatedAt: createdAt, UpdatedAt: createdAt}
+	testDB.MustExec("INSERT INTO owners (id, name, access_token, chair_register_token, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?)", owner.ID, owner.Name, owner.AccessToken, owner.ChairRegisterToken, createdAt, createdAt)
+
+	req := httptest.NewRequest(http.MethodPatch, "/api/owner/me", strings.NewReader(`{"rotate_chair_register_token":true}`))
+	req = req.WithContext(context.WithValue(req.Context(), "owner", owner))
+	rec := httptest.NewRecorder()
+	s.ownerPatchMe(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusOK, rec.Body.String())
+	}
+	// 新しい平文はこのレスポンスでだけ返し、DBとキャッシュにはハッシュを持つ
+	res := decodeResponse[ownerGetMeResponse](t, rec)
+	if res.ChairRegisterToken == "" || res.ChairRegisterToken == "register" {
+		t.Fatalf("chair_register_token = %q, want a new token", res.ChairRegisterToken)
+	}
+	var stored string
+	if err := testDB.Get(&stored, "SELECT chair_register_token FROM owners WHERE id = ?", owner.ID); err != nil {
+		t.Fatal(err)
+	}
+	if stored != hashToken(res.ChairRegisterToken) {
+		t.Errorf("stored chair_register_token = %q, want the hash of the new token", stored)
+	}
+	if cached, _ := ownerByIDCache.Load(owner.ID); cached.ChairRegisterToken != stored {
+		t.Errorf("cached chair_register_token = %q, want %q", cached.ChairRegisterToken, stored)
+	}
+}
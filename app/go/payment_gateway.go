@@ -7,6 +7,8 @@ import (
 	"fmt"
 	"log/slog"
 	"net/http"
+	"os"
+	"time"
 
 	"github.com/goccy/go-json"
 	"github.com/oklog/ulid/v2"
@@ -14,6 +16,12 @@ import (
 
 var erroredUpstream = errors.New("errored upstream")
 
+// ISUCON_PAYMENT_TOKEN_VALIDATION=1 のとき、決済トークンの登録時に決済サービスへ問い合わせて確かめる
+// 確かめられなかったとき(決済サービスの異常)も登録は失敗させ、502でやり直してもらう。
+const paymentTokenValidationTimeout = time.Second
+
+var paymentTokenValidation = os.Getenv("ISUCON_PAYMENT_TOKEN_VALIDATION") == "1"
+
 type paymentGatewayPostPaymentRequest struct {
 	Amount int `json:"amount"`
 }
@@ -24,6 +32,9 @@ type paymentGatewayGetPaymentsResponseOne struct {
 }
 
 func requestPaymentGatewayPostPayment(ctx context.Context, paymentGatewayURL string, token string, param *paymentGatewayPostPaymentRequest) error {
+	ctx, end := startSpan(ctx, "payment.PostPayment")
+	defer end()
+
 	b, err := json.Marshal(param)
 	if err != nil {
 		return err
@@ -63,7 +74,7 @@ func requestPaymentGatewayPostPayment(ctx context.Context, paymentGatewayURL str
 				slog.Error("failed to request payment gateway",
 					slog.String("error", err.Error()),
 				)
-				return err
+				return fmt.Errorf("%w: %w", erroredUpstream, err)
 			}
 		}
 		break
@@ -71,3 +82,34 @@ func requestPaymentGatewayPostPayment(ctx context.Context, paymentGatewayURL str
 
 	return nil
 }
+
+// requestPaymentGatewayValidateToken checks token by listing its payments.
+// 決済サービスがトークンを受け付けなければerrInvalidPaymentTokenを返す。
+func requestPaymentGatewayValidateToken(ctx context.Context, paymentGatewayURL string, token string) error {
+	ctx, end := startSpan(ctx, "payment.ValidateToken")
+	defer end()
+
+	ctx, cancel := context.WithTimeout(ctx, paymentTokenValidationTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, paymentGatewayURL+"/payments", nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: failed to request payment gateway: %w", erroredUpstream, err)
+	}
+	defer res.Body.Close()
+
+	switch {
+	case res.StatusCode == http.StatusOK:
+		return nil
+	case res.StatusCode >= 400 && res.StatusCode < 500:
+		return errInvalidPaymentToken
+	default:
+		return fmt.Errorf("%w: unexpected status code: %d", erroredUpstream, res.StatusCode)
+	}
+}
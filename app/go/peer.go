@@ -0,0 +1,357 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/isucon/isucon14/webapp/go/peerpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// 複数インスタンス間でRideEventとキャッシュの更新を伝搬する内部gRPC API
+//   - ISUCON_PEERS: 他インスタンスのgRPCアドレスのカンマ区切り。未指定なら何もしない
+//   - ISUCON_GRPC_ADDR: 自インスタンスのgRPCの待ち受けアドレス。デフォルトは127.0.0.1:50051なので、
+//     他インスタンスから受けるときはプライベートネットワークのアドレスを指定する
+//   - ISUCON_PEER_SECRET: インスタンス間で共有する秘密。ISUCON_PEERSを指定するときは必須
+//
+// 受け取ったイベントはキャッシュ(決済トークンなど)を上書きするので、秘密をメタデータに付けていない呼び出しは受け付けない。
+//
+// サービスとメッセージはpeerpb/peer.protoで定義し、peerpbでgo generateして作る
+const (
+	peerQueueSize = 10000
+	peerBatchSize = 1000
+
+	peerEventKindChair = peerpb.EventKind_EVENT_KIND_CHAIR
+	peerEventKindUser  = peerpb.EventKind_EVENT_KIND_USER
+	peerEventKindCache = peerpb.EventKind_EVENT_KIND_CACHE
+	peerEventKindSales = peerpb.EventKind_EVENT_KIND_SALES
+
+	peerSecretMetadataKey = "x-isuride-peer-secret"
+)
+
+var (
+	peerAddrs  = parsePeerAddrs(os.Getenv("ISUCON_PEERS"))
+	peerSecret = os.Getenv("ISUCON_PEER_SECRET")
+	peers      []*peerClient
+)
+
+type peerServer struct {
+	peerpb.UnimplementedEventBusServer
+}
+
+func (peerServer) Publish(ctx context.Context, batch *peerpb.EventBatch) (*peerpb.Ack, error) {
+	for _, event := range batch.Events {
+		switch event.Kind {
+		case peerEventKindChair:
+			defaultEventBus.chairPublishLocal(event.Target, peerRideEvent(event))
+		case peerEventKindUser:
+			defaultEventBus.userPublishLocal(event.Target, peerRideEvent(event))
+		case peerEventKindCache:
+			sharedCachesLock.RLock()
+			cache, ok := sharedCaches[event.Cache]
+			sharedCachesLock.RUnlock()
+			if ok {
+				cache.storeLocalJSON(event.Target, event.Value)
+			}
+		case peerEventKindSales:
+			invalidateOwnerSalesLocal(event.Target)
+		}
+	}
+
+	return &peerpb.Ack{}, nil
+}
+
+func peerRideEvent(e *peerpb.Event) *RideEvent {
+	var ride *Ride
+	if e.Ride != nil {
+		ride = rideFromPeer(e.Ride)
+		// キャッシュが伝搬済みならローカルの同じポインタを使う
+		if local, ok := rideCache.Load(ride.ID); ok {
+			ride = local
+		}
+		observeRideEventSeq(ride.ID, e.Seq)
+	}
+	var chair *Chair
+	if e.Chair != nil {
+		chair = chairFromPeer(e.Chair)
+	}
+
+	return &RideEvent{
+		status:     e.Status,
+		evaluation: int(e.Evaluation),
+		chair:      chair,
+		ride:       ride,
+		updatedAt:  e.UpdatedAt.AsTime(),
+		seq:        e.Seq,
+	}
+}
+
+// chairToPeer converts chair without its access token.
+func chairToPeer(chair *Chair) *peerpb.Chair {
+	return &peerpb.Chair{
+		Id:        chair.ID,
+		OwnerId:   chair.OwnerID,
+		Name:      chair.Name,
+		Model:     chair.Model,
+		Speed:     int64(chair.Speed),
+		IsActive:  chair.IsActive,
+		CreatedAt: timestamppb.New(chair.CreatedAt),
+		UpdatedAt: timestamppb.New(chair.UpdatedAt),
+	}
+}
+
+func chairFromPeer(chair *peerpb.Chair) *Chair {
+	return &Chair{
+		ID:        chair.Id,
+		OwnerID:   chair.OwnerId,
+		Name:      chair.Name,
+		Model:     chair.Model,
+		Speed:     int(chair.Speed),
+		IsActive:  chair.IsActive,
+		CreatedAt: chair.CreatedAt.AsTime(),
+		UpdatedAt: chair.UpdatedAt.AsTime(),
+	}
+}
+
+func rideToPeer(ride *Ride) *peerpb.Ride {
+	r := &peerpb.Ride{
+		Id:                   ride.ID,
+		UserId:               ride.UserID,
+		PickupLatitude:       int64(ride.PickupLatitude),
+		PickupLongitude:      int64(ride.PickupLongitude),
+		DestinationLatitude:  int64(ride.DestinationLatitude),
+		DestinationLongitude: int64(ride.DestinationLongitude),
+		CreatedAt:            timestamppb.New(ride.CreatedAt),
+		UpdatedAt:            timestamppb.New(ride.UpdatedAt),
+	}
+	if ride.ChairID.Valid {
+		r.ChairId = &ride.ChairID.String
+	}
+	if ride.Evaluation != nil {
+		evaluation := int64(*ride.Evaluation)
+		r.Evaluation = &evaluation
+	}
+	return r
+}
+
+func rideFromPeer(ride *peerpb.Ride) *Ride {
+	r := &Ride{
+		ID:                   ride.Id,
+		UserID:               ride.UserId,
+		PickupLatitude:       int(ride.PickupLatitude),
+		PickupLongitude:      int(ride.PickupLongitude),
+		DestinationLatitude:  int(ride.DestinationLatitude),
+		DestinationLongitude: int(ride.DestinationLongitude),
+		CreatedAt:            ride.CreatedAt.AsTime(),
+		UpdatedAt:            ride.UpdatedAt.AsTime(),
+	}
+	if ride.ChairId != nil {
+		r.ChairID = sql.NullString{String: *ride.ChairId, Valid: true}
+	}
+	if ride.Evaluation != nil {
+		evaluation := int(*ride.Evaluation)
+		r.Evaluation = &evaluation
+	}
+	return r
+}
+
+type peerClient struct {
+	addr   string
+	client peerpb.EventBusClient
+	queue  chan *peerpb.Event
+}
+
+func parsePeerAddrs(s string) []string {
+	var addrs []string
+	for _, addr := range strings.Split(s, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+func startPeers() error {
+	if len(peerAddrs) == 0 {
+		return nil
+	}
+	if peerSecret == "" {
+		return fmt.Errorf("ISUCON_PEER_SECRET is required with ISUCON_PEERS")
+	}
+
+	listenAddr := os.Getenv("ISUCON_GRPC_ADDR")
+	if listenAddr == "" {
+		listenAddr = "127.0.0.1:50051"
+	}
+	lis, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", listenAddr, err)
+	}
+	server := newPeerServer()
+	go func() {
+		if err := server.Serve(lis); err != nil {
+			slog.Error("peer grpc server stopped",
+				slog.String("error", err.Error()),
+			)
+		}
+	}()
+
+	for _, addr := range peerAddrs {
+		conn, err := newPeerConn(addr)
+		if err != nil {
+			return fmt.Errorf("failed to create peer client for %s: %w", addr, err)
+		}
+
+		client := &peerClient{
+			addr:   addr,
+			client: peerpb.NewEventBusClient(conn),
+			queue:  make(chan *peerpb.Event, peerQueueSize),
+		}
+		go client.run()
+		peers = append(peers, client)
+	}
+
+	return nil
+}
+
+func newPeerServer() *grpc.Server {
+	server := grpc.NewServer(
+		grpc.UnaryInterceptor(peerUnaryAuth),
+		grpc.StreamInterceptor(peerStreamAuth),
+	)
+	peerpb.RegisterEventBusServer(server, peerServer{})
+	return server
+}
+
+// newPeerConn returns a connection to addr that sends peerSecret with every call.
+// プライベートネットワーク内の通信なのでTLSは使わない。
+func newPeerConn(addr string) (*grpc.ClientConn, error) {
+	return grpc.NewClient(addr,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithPerRPCCredentials(peerCredentials(peerSecret)),
+	)
+}
+
+// peerCredentials attaches the shared secret to the calls to peers.
+type peerCredentials string
+
+func (c peerCredentials) GetRequestMetadata(context.Context, ...string) (map[string]string, error) {
+	return map[string]string{peerSecretMetadataKey: string(c)}, nil
+}
+
+func (peerCredentials) RequireTransportSecurity() bool {
+	return false
+}
+
+// peerAuthorized reports whether the incoming call carries peerSecret.
+func peerAuthorized(ctx context.Context) bool {
+	if peerSecret == "" {
+		return false
+	}
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return false
+	}
+	for _, v := range md.Get(peerSecretMetadataKey) {
+		if subtle.ConstantTimeCompare([]byte(v), []byte(peerSecret)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+func peerUnaryAuth(ctx context.Context, req any, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	if !peerAuthorized(ctx) {
+		return nil, status.Error(codes.Unauthenticated, "invalid peer secret")
+	}
+	return handler(ctx, req)
+}
+
+func peerStreamAuth(srv any, ss grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if !peerAuthorized(ss.Context()) {
+		return status.Error(codes.Unauthenticated, "invalid peer secret")
+	}
+	return handler(srv, ss)
+}
+
+// run sends queued events in order, batching whatever has piled up.
+func (c *peerClient) run() {
+	for event := range c.queue {
+		batch := &peerpb.EventBatch{Events: []*peerpb.Event{event}}
+	L:
+		for len(batch.Events) < peerBatchSize {
+			select {
+			case event := <-c.queue:
+				batch.Events = append(batch.Events, event)
+			default:
+				break L
+			}
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		_, err := c.client.Publish(ctx, batch)
+		cancel()
+		if err != nil {
+			slog.Error("failed to publish events to peer",
+				slog.String("peer", c.addr),
+				slog.Int("events", len(batch.Events)),
+				slog.String("error", err.Error()),
+			)
+		}
+	}
+}
+
+func broadcastToPeers(event *peerpb.Event) {
+	for _, peer := range peers {
+		select {
+		case peer.queue <- event:
+		default:
+			slog.Error("peer queue is full",
+				slog.String("peer", peer.addr),
+			)
+		}
+	}
+}
+
+func broadcastRideEvent(kind peerpb.EventKind, target string, message *RideEvent) {
+	if len(peers) == 0 {
+		return
+	}
+
+	event := &peerpb.Event{
+		Kind:       kind,
+		Target:     target,
+		Status:     message.status,
+		Evaluation: int64(message.evaluation),
+		UpdatedAt:  timestamppb.New(message.updatedAt),
+		Seq:        message.seq,
+	}
+	if message.ride != nil {
+		event.Ride = rideToPeer(message.ride)
+	}
+	if message.chair != nil {
+		event.Chair = chairToPeer(message.chair)
+	}
+	broadcastToPeers(event)
+}
+
+func broadcastCacheUpdate(cache string, key string, value string) {
+	broadcastToPeers(&peerpb.Event{
+		Kind:   peerEventKindCache,
+		Target: key,
+		Cache:  cache,
+		Value:  value,
+	})
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/isucon/isucon14/webapp/go/peerpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestPeerRideConversion(t *testing.T) {
+	evaluation := 4
+	createdAt := time.UnixMicro(1733600000123456).UTC()
+	for _, ride := range []*Ride{
+		{ID: "matching", UserID: "user", PickupLatitude: -1, PickupLongitude: 2, DestinationLatitude: 3, DestinationLongitude: -4, CreatedAt: createdAt, UpdatedAt: createdAt},
+		{ID: "evaluated", UserID: "user", ChairID: sql.NullString{String: "chair", Valid: true}, Evaluation: &evaluation, CreatedAt: createdAt, UpdatedAt: createdAt.Add(time.Minute)},
+	} {
+		if got := rideFromPeer(rideToPeer(ride)); !reflect.DeepEqual(got, ride) {
+			t.Errorf("ride round trip = %+v, want %+v", got, ride)
+		}
+	}
+
+	chair := &Chair{ID: "chair", OwnerID: "owner", Name: "name", Model: "model", Speed: 3, IsActive: true, AccessToken: "token", CreatedAt: createdAt, UpdatedAt: createdAt}
+	got := chairFromPeer(chairToPeer(chair))
+	want := *chair
+	want.AccessToken = ""
+	if *got != want {
+		t.Errorf("chair round trip = %+v, want %+v without the access token", got, want)
+	}
+}
+
+func TestPeerServerPublish(t *testing.T) {
+	t.Cleanup(resetAll)
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	original := peerSecret
+	peerSecret = "secret"
+	t.Cleanup(func() { peerSecret = original })
+	server := newPeerServer()
+	go server.Serve(lis)
+	t.Cleanup(server.Stop)
+
+	conn, err := newPeerConn(lis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	ch := make(chan *RideEvent, 1)
+	defaultEventBus.UserSubscribe("user", ch)
+	t.Cleanup(func() { defaultEventBus.UserUnsubscribe("user", ch) })
+	salesVersion := ownerSalesVersion("owner")
+
+	updatedAt := time.UnixMilli(1733600000000)
+	ride := &Ride{ID: "ride", UserID: "user", ChairID: sql.NullString{String: "chair", Valid: true}, CreatedAt: updatedAt, UpdatedAt: updatedAt}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// 秘密を知らない相手からのイベントは受け付けない
+	unauthenticated, err := grpc.NewClient(lis.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { unauthenticated.Close() })
+	_, err = peerpb.NewEventBusClient(unauthenticated).Publish(ctx, &peerpb.EventBatch{Events: []*peerpb.Event{
+		{Kind: peerEventKindSales, Target: "owner"},
+	}})
+	if status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("Publish without the secret = %v, want Unauthenticated", err)
+	}
+
+	if _, err := peerpb.NewEventBusClient(conn).Publish(ctx, &peerpb.EventBatch{Events: []*peerpb.Event{
+		{Kind: peerEventKindUser, Target: "user", Status: "ENROUTE", Ride: rideToPeer(ride), UpdatedAt: timestamppb.New(updatedAt), Seq: 1},
+		{Kind: peerEventKindSales, Target: "owner"},
+	}}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case event := <-ch:
+		if event.status != "ENROUTE" || event.ride.ID != "ride" || event.ride.ChairID.String != "chair" || !event.updatedAt.Equal(updatedAt) || event.seq != 1 {
+			t.Errorf("event = %+v, want the published ENROUTE event", event)
+		}
+	case <-ctx.Done():
+		t.Fatal("the published event was not delivered to the local subscriber")
+	}
+	if got := ownerSalesVersion("owner"); got != salesVersion+1 {
+		t.Errorf("sales version = %d, want %d", got, salesVersion+1)
+	}
+}
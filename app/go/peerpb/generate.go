@@ -0,0 +1,4 @@
+// Package peerpb is the internal gRPC API between isuride instances, generated from peer.proto.
+package peerpb
+
+//go:generate buf generate
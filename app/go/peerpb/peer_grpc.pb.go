@@ -0,0 +1,111 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             (unknown)
+// source: peer.proto
+
+package peerpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	EventBus_Publish_FullMethodName = "/isuride.internal.EventBus/Publish"
+)
+
+// EventBusClient is the client API for EventBus service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type EventBusClient interface {
+	// Publish applies the events in order on the receiving instance.
+	Publish(ctx context.Context, in *EventBatch, opts ...grpc.CallOption) (*Ack, error)
+}
+
+type eventBusClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewEventBusClient(cc grpc.ClientConnInterface) EventBusClient {
+	return &eventBusClient{cc}
+}
+
+func (c *eventBusClient) Publish(ctx context.Context, in *EventBatch, opts ...grpc.CallOption) (*Ack, error) {
+	out := new(Ack)
+	err := c.cc.Invoke(ctx, EventBus_Publish_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// EventBusServer is the server API for EventBus service.
+// All implementations must embed UnimplementedEventBusServer
+// for forward compatibility
+type EventBusServer interface {
+	// Publish applies the events in order on the receiving instance.
+	Publish(context.Context, *EventBatch) (*Ack, error)
+	mustEmbedUnimplementedEventBusServer()
+}
+
+// UnimplementedEventBusServer must be embedded to have forward compatible implementations.
+type UnimplementedEventBusServer struct {
+}
+
+func (UnimplementedEventBusServer) Publish(context.Context, *EventBatch) (*Ack, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Publish not implemented")
+}
+func (UnimplementedEventBusServer) mustEmbedUnimplementedEventBusServer() {}
+
+// UnsafeEventBusServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to EventBusServer will
+// result in compilation errors.
+type UnsafeEventBusServer interface {
+	mustEmbedUnimplementedEventBusServer()
+}
+
+func RegisterEventBusServer(s grpc.ServiceRegistrar, srv EventBusServer) {
+	s.RegisterService(&EventBus_ServiceDesc, srv)
+}
+
+func _EventBus_Publish_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(EventBatch)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(EventBusServer).Publish(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: EventBus_Publish_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(EventBusServer).Publish(ctx, req.(*EventBatch))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// EventBus_ServiceDesc is the grpc.ServiceDesc for EventBus service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var EventBus_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "isuride.internal.EventBus",
+	HandlerType: (*EventBusServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Publish",
+			Handler:    _EventBus_Publish_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "peer.proto",
+}
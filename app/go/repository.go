@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"slices"
+	"sync"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// ハンドラーから見たデータアクセスのインターフェース
+// キャッシュを正とするかMySQLを見るかは実装側に閉じ込める。ハンドラーは少しずつこちらに移行していく。
+// mem*はプロセス内だけで完結する実装で、DBなしでハンドラーを動かすテストで使う。
+
+type RideRepository interface {
+	Get(rideID string) (*Ride, bool)
+	// ListByUser returns the rides of the user, newest first.
+	ListByUser(userID string) []*Ride
+	LatestByUser(userID string) (*Ride, bool)
+	// Save stores ride in memory. Writing to MySQL is done separately by writeRide.
+	Save(ride *Ride)
+}
+
+type ChairRepository interface {
+	Get(ctx context.Context, chairID string) (*Chair, error)
+	SetActive(ctx context.Context, chairID string, active bool) error
+}
+
+type CouponRepository interface {
+	couponSource
+	// Select returns the coupon the next ride of the user would use without consuming it.
+	Select(userID string, preferNew bool) (Coupon, bool)
+	Use(rideID string, coupon Coupon)
+}
+
+// cachedRideRepository is backed by rideCache and userRideIDsCache.
+type cachedRideRepository struct{}
+
+func (cachedRideRepository) Get(rideID string) (*Ride, bool) {
+	return rideCache.Load(rideID)
+}
+
+func (cachedRideRepository) ListByUser(userID string) []*Ride {
+	return getRidesByUserID(userID)
+}
+
+func (cachedRideRepository) LatestByUser(userID string) (*Ride, bool) {
+	return getLatestRideByUserID(userID)
+}
+
+func (cachedRideRepository) Save(ride *Ride) {
+	storeRide(ride)
+}
+
+// mysqlChairRepository reads through chairCache and writes to MySQL.
+type mysqlChairRepository struct {
+	db *sqlx.DB
+}
+
+func (r mysqlChairRepository) Get(ctx context.Context, chairID string) (*Chair, error) {
+	return getChairByID(ctx, chairID)
+}
+
+func (r mysqlChairRepository) SetActive(ctx context.Context, chairID string, active bool) error {
+	if _, err := r.db.ExecContext(ctx, "UPDATE chairs SET is_active = ? WHERE id = ?", active, chairID); err != nil {
+		return err
+	}
+	chairCache.Update(chairID, func(v *Chair) (*Chair, bool) {
+		if v == nil {
+			return nil, false
+		}
+
+		newChair := *v
+		newChair.IsActive = active
+		return &newChair, true
+	})
+
+	return nil
+}
+
+// mysqlCouponRepository keeps unused coupons in unusedCouponsCache and reads used ones from MySQL.
+type mysqlCouponRepository struct {
+	dbCouponSource
+}
+
+func newMySQLCouponRepository(db *sqlx.DB) mysqlCouponRepository {
+	return mysqlCouponRepository{dbCouponSource: dbCouponSource{q: db}}
+}
+
+func (mysqlCouponRepository) Select(userID string, preferNew bool) (Coupon, bool) {
+	return selectCoupon(userID, preferNew)
+}
+
+func (mysqlCouponRepository) Use(rideID string, coupon Coupon) {
+	useCoupon(rideID, coupon)
+}
+
+type memRideRepository struct {
+	mu     sync.RWMutex
+	rides  map[string]*Ride
+	byUser map[string][]string
+}
+
+func newMemRideRepository() *memRideRepository {
+	return &memRideRepository{
+		rides:  map[string]*Ride{},
+		byUser: map[string][]string{},
+	}
+}
+
+func (r *memRideRepository) Get(rideID string) (*Ride, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	ride, ok := r.rides[rideID]
+	return ride, ok
+}
+
+func (r *memRideRepository) ListByUser(userID string) []*Ride {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	rideIDs := r.byUser[userID]
+	rides := make([]*Ride, 0, len(rideIDs))
+	for _, rideID := range slices.Backward(rideIDs) {
+		rides = append(rides, r.rides[rideID])
+	}
+	return rides
+}
+
+func (r *memRideRepository) LatestByUser(userID string) (*Ride, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	rideIDs := r.byUser[userID]
+	if len(rideIDs) == 0 {
+		return nil, false
+	}
+	return r.rides[rideIDs[len(rideIDs)-1]], true
+}
+
+func (r *memRideRepository) Save(ride *Ride) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.rides[ride.ID]; !ok {
+		r.byUser[ride.UserID] = append(r.byUser[ride.UserID], ride.ID)
+	}
+	r.rides[ride.ID] = ride
+}
+
+type memChairRepository struct {
+	mu     sync.RWMutex
+	chairs map[string]*Chair
+}
+
+func newMemChairRepository(chairs ...*Chair) *memChairRepository {
+	r := &memChairRepository{chairs: map[string]*Chair{}}
+	for _, chair := range chairs {
+		r.chairs[chair.ID] = chair
+	}
+	return r
+}
+
+func (r *memChairRepository) Get(ctx context.Context, chairID string) (*Chair, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	chair, ok := r.chairs[chairID]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return chair, nil
+}
+
+func (r *memChairRepository) SetActive(ctx context.Context, chairID string, active bool) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	chair, ok := r.chairs[chairID]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	newChair := *chair
+	newChair.IsActive = active
+	r.chairs[chairID] = &newChair
+
+	return nil
+}
+
+type memCouponRepository struct {
+	mu     sync.Mutex
+	unused map[string][]Coupon
+	used   map[string]Coupon
+}
+
+func newMemCouponRepository(coupons ...Coupon) *memCouponRepository {
+	r := &memCouponRepository{
+		unused: map[string][]Coupon{},
+		used:   map[string]Coupon{},
+	}
+	for _, coupon := range coupons {
+		if coupon.UsedBy != nil {
+			r.used[*coupon.UsedBy] = coupon
+			continue
+		}
+		r.unused[coupon.UserID] = append(r.unused[coupon.UserID], coupon)
+	}
+	return r
+}
+
+func (r *memCouponRepository) rideDiscount(ctx context.Context, rideID string) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.used[rideID].Discount, nil
+}
+
+func (r *memCouponRepository) Select(userID string, preferNew bool) (Coupon, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return pickCoupon(r.unused[userID], preferNew, clock.Now())
+}
+
+func (r *memCouponRepository) Use(rideID string, coupon Coupon) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.unused[coupon.UserID] = slices.DeleteFunc(r.unused[coupon.UserID], func(c Coupon) bool {
+		return c.Code == coupon.Code
+	})
+	coupon.UsedBy = &rideID
+	r.used[rideID] = coupon
+}
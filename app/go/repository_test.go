@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemCouponRepositorySelect(t *testing.T) {
+	fake := newFakeClock(time.Date(2024, 12, 8, 0, 0, 0, 0, time.UTC))
+	original := clock
+	clock = fake
+	t.Cleanup(func() { clock = original })
+
+	expiresAt := fake.Now().Add(time.Hour)
+	r := newMemCouponRepository(
+		Coupon{UserID: "user", Code: "INV_a", Discount: 1000, ExpiresAt: &expiresAt},
+		Coupon{UserID: "user", Code: "CP_NEW2024", Discount: 3000, ExpiresAt: &expiresAt},
+		Coupon{UserID: "user", Code: "INV_b", Discount: 1500},
+	)
+
+	if coupon, ok := r.Select("user", true); !ok || coupon.Code != "CP_NEW2024" {
+		t.Errorf("Select(preferNew) = %+v, %t, want CP_NEW2024", coupon, ok)
+	}
+	if coupon, ok := r.Select("user", false); !ok || coupon.Code != "INV_a" {
+		t.Errorf("Select = %+v, %t, want INV_a", coupon, ok)
+	}
+
+	// 期限の時刻ちょうどで使えなくなる
+	fake.Set(expiresAt)
+	if coupon, ok := r.Select("user", true); !ok || coupon.Code != "INV_b" {
+		t.Errorf("Select(preferNew) after expiry = %+v, %t, want INV_b", coupon, ok)
+	}
+
+	r.Use("ride", Coupon{UserID: "user", Code: "INV_b"})
+	if coupon, ok := r.Select("user", false); ok {
+		t.Errorf("Select after all coupons are used or expired = %+v, want none", coupon)
+	}
+}
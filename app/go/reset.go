@@ -0,0 +1,26 @@
+package main
+
+import "sync"
+
+var (
+	resetFuncs     = []func(){}
+	resetFuncsLock = sync.Mutex{}
+)
+
+// registerReset registers f to be called on every /api/initialize.
+// Every in-memory cache must register itself here so no stale state survives initialization.
+func registerReset(f func()) {
+	resetFuncsLock.Lock()
+	defer resetFuncsLock.Unlock()
+
+	resetFuncs = append(resetFuncs, f)
+}
+
+func resetAll() {
+	resetFuncsLock.Lock()
+	defer resetFuncsLock.Unlock()
+
+	for _, f := range resetFuncs {
+		f()
+	}
+}
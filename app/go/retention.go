@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	isucache "github.com/mazrean/isucon-go-tools/v2/cache"
+)
+
+// 長時間動かし続けるときに、完了から時間が経ったライドをrideCache/rideStatusesCacheから追い出す
+// ISUCON_RIDE_RETENTION=6h のように保持期間を指定したときだけ動く。ベンチマーク中は設定しない。
+// ISUCON_RIDE_ARCHIVE=1 のときは追い出す前にrides_archiveにもコピーする。
+//
+// 追い出したライドのIDはuserRideIDsCacheに残し、ユーザーのライド一覧はMySQLから読み直す。
+// ユーザー・椅子の最新のライドは通知で参照するので追い出さない。
+
+const retentionInterval = time.Minute
+
+var (
+	rideRetention = parseRideRetention(os.Getenv("ISUCON_RIDE_RETENTION"))
+	archiveRides  = os.Getenv("ISUCON_RIDE_ARCHIVE") == "1"
+
+	// 追い出したライドはすべてCOMPLETED
+	archivedRideIDs = isucache.NewMap[string, struct{}]("archivedRideIDs")
+)
+
+func init() {
+	registerReset(archivedRideIDs.Purge)
+}
+
+func parseRideRetention(s string) time.Duration {
+	if s == "" {
+		return 0
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		panic(fmt.Sprintf("invalid ISUCON_RIDE_RETENTION: %v", err))
+	}
+	return d
+}
+
+func startRetention() {
+	if rideRetention <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(retentionInterval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			n, err := evictCompletedRides(context.Background(), clock.Now().Add(-rideRetention))
+			if err != nil {
+				slog.Error("failed to evict completed rides", slog.String("error", err.Error()))
+				continue
+			}
+			if n > 0 {
+				slog.Info("evicted completed rides", slog.Int("count", n))
+			}
+		}
+	}()
+}
+
+// evictCompletedRides removes rides completed before deadline from the caches and returns how many were removed.
+func evictCompletedRides(ctx context.Context, deadline time.Time) (int, error) {
+	var rideIDs []string
+	rideStatusesCache.Range(func(rideID string, rideStatus *RideStatus) bool {
+		if rideStatus.Status != "COMPLETED" || !rideStatus.CreatedAt.Before(deadline) {
+			return true
+		}
+		ride, ok := rideCache.Load(rideID)
+		if !ok || isLatestRide(ride) {
+			return true
+		}
+		rideIDs = append(rideIDs, rideID)
+		return true
+	})
+	if len(rideIDs) == 0 {
+		return 0, nil
+	}
+
+	if archiveRides {
+		// ridesは売上の集計で使うので消さずにコピーだけする
+		if err := waitRideStatusQueue(ctx); err != nil {
+			return 0, err
+		}
+		if err := flushRides(ctx); err != nil {
+			return 0, err
+		}
+		if _, err := db.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS rides_archive LIKE rides"); err != nil {
+			return 0, fmt.Errorf("failed to create rides_archive: %w", err)
+		}
+		query, args, err := sqlx.In("INSERT IGNORE INTO rides_archive SELECT * FROM rides WHERE id IN (?)", rideIDs)
+		if err != nil {
+			return 0, err
+		}
+		if _, err := db.ExecContext(ctx, query, args...); err != nil {
+			return 0, fmt.Errorf("failed to archive rides: %w", err)
+		}
+	}
+
+	for _, rideID := range rideIDs {
+		archivedRideIDs.Store(rideID, struct{}{})
+		rideCache.Forget(rideID)
+		rideStatusesCache.Forget(rideID)
+		rideEventSeqs.Forget(rideID)
+	}
+
+	return len(rideIDs), nil
+}
+
+func isLatestRide(ride *Ride) bool {
+	if rideIDs, ok := userRideIDsCache.Load(ride.UserID); ok && len(rideIDs) > 0 && rideIDs[len(rideIDs)-1] == ride.ID {
+		return true
+	}
+	if ride.ChairID.Valid {
+		if latest, ok := latestRideCache.Load(ride.ChairID.String); ok && latest.ID == ride.ID {
+			return true
+		}
+	}
+	return false
+}
+
+// isRideArchived reports whether the ride was evicted by evictCompletedRides.
+func isRideArchived(rideID string) bool {
+	_, ok := archivedRideIDs.Load(rideID)
+	return ok
+}
+
+// loadArchivedRides reads evicted rides back from MySQL.
+func loadArchivedRides(rideIDs []string) (map[string]*Ride, error) {
+	query, args, err := sqlx.In("SELECT "+rideColumns+" FROM rides WHERE id IN (?)", rideIDs)
+	if err != nil {
+		return nil, err
+	}
+	rides := []*Ride{}
+	if err := db.Select(&rides, query, args...); err != nil {
+		return nil, fmt.Errorf("failed to select archived rides: %w", err)
+	}
+
+	rideByID := make(map[string]*Ride, len(rides))
+	for _, ride := range rides {
+		rideByID[ride.ID] = ride
+	}
+	return rideByID, nil
+}
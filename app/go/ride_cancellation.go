@@ -0,0 +1,81 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// ライドの取り消し
+// 退会(user_deactivation.go)で、進行中のライドを残したまま利用者を消さないために使う。
+// 椅子が割り当て済みなら椅子のロック(chair_status_lock.go)の中でCANCELEDにして椅子を空きに戻し、
+// まだならapplyMatchと排他にしてCANCELEDにし、この後のマッチングで割り当てないようにする。
+// CANCELEDはCOMPLETEDと同じく終わった状態として扱う(rideFinished)。
+
+// applyMatchと椅子の無いライドの取り消しを排他にする
+var rideAssignmentLock sync.Mutex
+
+// cancelableRideStatuses are the ride statuses a ride with a chair can be canceled from.
+var cancelableRideStatuses = []string{"MATCHING", "ENROUTE", "PICKUP", "CARRYING", "ARRIVED"}
+
+// rideFinished reports whether status is one a ride ends in.
+func rideFinished(status string) bool {
+	return status == "COMPLETED" || status == "CANCELED"
+}
+
+func rideCanceled(rideID string) bool {
+	status, ok := rideStatusesCache.Load(rideID)
+	return ok && status.Status == "CANCELED"
+}
+
+// cancelRide cancels ride unless it has already finished and reports whether it did.
+func (s *Server) cancelRide(ride *Ride) (bool, error) {
+	now := s.clock.Now().Truncate(time.Microsecond)
+
+	// applyMatchは椅子を書いたコピーをrideCacheに入れるので、椅子の有無はロックの中でキャッシュから読み直す
+	rideAssignmentLock.Lock()
+	if current, ok := s.rides.Load(ride.ID); ok {
+		ride = current
+	}
+	chairID := ride.ChairID.String
+	if !ride.ChairID.Valid {
+		defer rideAssignmentLock.Unlock()
+
+		status, ok := rideStatusesCache.Load(ride.ID)
+		if !ok || status.Status != "MATCHING" {
+			return false, nil
+		}
+		storeRideStatus(ride.ID, "CANCELED", now)
+		recordAudit(now, userActor(ride.UserID), "ride.cancel", ride.ID, "", status.Status, "CANCELED")
+		s.events.UserPublish(ride.UserID, &RideEvent{
+			status:    "CANCELED",
+			ride:      ride,
+			updatedAt: now,
+		})
+		return true, nil
+	}
+	rideAssignmentLock.Unlock()
+
+	unlock := lockChairStatus(chairID)
+	defer unlock()
+
+	before, ok, err := transitionChairRideLocked(chairID, ride.ID, cancelableRideStatuses, chairStatusCompleted, "CANCELED", now)
+	if err != nil || !ok {
+		return false, err
+	}
+	// 椅子を空き椅子に戻すのは、COMPLETEDと同じく椅子が通知を受け取ってから
+	releaseChairAvailability(chairID)
+	recordAudit(now, userActor(ride.UserID), "ride.cancel", ride.ID, chairID, before, "CANCELED")
+
+	s.events.ChairPublish(chairID, &RideEvent{
+		status:    "CANCELED",
+		ride:      ride,
+		updatedAt: now,
+	})
+	s.events.UserPublish(ride.UserID, &RideEvent{
+		status:    "CANCELED",
+		ride:      ride,
+		updatedAt: now,
+	})
+
+	return true, nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+)
+
+// waitRideStatusWrites waits for the ride status writer so it does not use db after the test has restored it.
+func waitRideStatusWrites(t *testing.T) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for pendingRideStatuses.Load() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d ride statuses are still pending", pendingRideStatuses.Load())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCancelRide(t *testing.T) {
+	chair := &Chair{ID: "chair", Name: "chair-name", Model: "model", IsActive: true}
+	createdAt := time.UnixMilli(1733600000000)
+
+	t.Run("matching", func(t *testing.T) {
+		s := newTestServer(t, []*Chair{chair}, nil)
+		openTestBadger(t)
+		openTestDB(t)
+		t.Cleanup(func() { waitRideStatusWrites(t) })
+
+		ride := &Ride{ID: "ride", UserID: "user", CreatedAt: createdAt, UpdatedAt: createdAt}
+		s.rides.Store(ride.ID, ride)
+		s.rideStatuses.Store(ride.ID, &RideStatus{RideID: ride.ID, Status: "MATCHING"})
+
+		canceled, err := s.cancelRide(ride)
+		if err != nil || !canceled {
+			t.Fatalf("cancelRide = %t, %v, want true", canceled, err)
+		}
+		if status, _ := s.rideStatuses.Load(ride.ID); status.Status != "CANCELED" {
+			t.Errorf("status = %s, want CANCELED", status.Status)
+		}
+
+		// マッチングが取り消し前にライドを取り出していても割り当てない
+		applyMatch(ride, chair)
+		if cached, _ := s.rides.Load(ride.ID); cached.ChairID.Valid {
+			t.Errorf("canceled ride was assigned to %s", cached.ChairID.String)
+		}
+		if _, ok := latestRideCache.Load(chair.ID); ok {
+			t.Error("chair got the canceled ride")
+		}
+	})
+
+	t.Run("assigned", func(t *testing.T) {
+		s := newTestServer(t, []*Chair{chair}, nil)
+		openTestBadger(t)
+		openTestDB(t)
+		t.Cleanup(func() { waitRideStatusWrites(t) })
+
+		ride := &Ride{ID: "ride", UserID: "user", ChairID: sql.NullString{String: chair.ID, Valid: true}, CreatedAt: createdAt, UpdatedAt: createdAt}
+		s.rides.Store(ride.ID, ride)
+		s.rideStatuses.Store(ride.ID, &RideStatus{RideID: ride.ID, Status: "PICKUP"})
+		chairCache.Store(chair.ID, chair)
+		latestRideCache.Store(chair.ID, ride)
+		events := make(chan *RideEvent, 1)
+		s.events.ChairSubscribe(chair.ID, events)
+
+		canceled, err := s.cancelRide(ride)
+		if err != nil || !canceled {
+			t.Fatalf("cancelRide = %t, %v, want true", canceled, err)
+		}
+		if status, _ := s.rideStatuses.Load(ride.ID); status.Status != "CANCELED" {
+			t.Errorf("status = %s, want CANCELED", status.Status)
+		}
+		if chairHasUnfinishedRide(chair.ID) {
+			t.Error("chair still has an unfinished ride")
+		}
+		if status, ok, err := getChairStatusFromBadger(chair.ID); err != nil || !ok || status.status != chairStatusCompleted {
+			t.Errorf("chair status = %+v, %t, %v, want completed", status, ok, err)
+		}
+
+		if err := s.events.fanout.drain(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case event := <-events:
+			if event.status != "CANCELED" {
+				t.Errorf("chair was notified of %s, want CANCELED", event.status)
+			}
+		default:
+			t.Error("chair was not notified")
+		}
+
+		// 二度は取り消さない
+		if canceled, err := s.cancelRide(ride); err != nil || canceled {
+			t.Errorf("second cancelRide = %t, %v, want false", canceled, err)
+		}
+	})
+
+	t.Run("completed", func(t *testing.T) {
+		s := newTestServer(t, []*Chair{chair}, nil)
+		ride := &Ride{ID: "ride", UserID: "user", ChairID: sql.NullString{String: chair.ID, Valid: true}, CreatedAt: createdAt, UpdatedAt: createdAt}
+		s.rides.Store(ride.ID, ride)
+		s.rideStatuses.Store(ride.ID, &RideStatus{RideID: ride.ID, Status: "COMPLETED"})
+
+		if canceled, err := s.cancelRide(ride); err != nil || canceled {
+			t.Errorf("cancelRide = %t, %v, want false", canceled, err)
+		}
+	})
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+
+	isucache "github.com/mazrean/isucon-go-tools/v2/cache"
+)
+
+// ライドの完了処理
+// 評価を受けてからCOMPLETEDにするまでを決まった順番で行い、途中で失敗したらそれまでの書き込みを巻き戻す。
+//  1. 状態の確認(椅子が割り当て済みでARRIVEDであること、決済トークンがあること)
+//  2. 評価と売上をridesに書く。ridesに無ければ404
+//  3. badgerのユーザーの状態を完了にする
+//  4. クーポンを反映した料金で決済する
+//  5. 椅子とライドの状態をまとめてCOMPLETEDにして通知する
+//
+// 椅子を空き椅子に戻すのは、椅子がCOMPLETEDの通知を受け取ってから(releaseCompletedChair)。
+
+type completionStep struct {
+	name string
+	undo func() error
+}
+
+// 完了処理中のライド
+// 決済の間は椅子のロックを離すので、その間に他の遷移(キャンセルなど)やもう一度の完了が入らないよう印を付けておく。
+// transitionChairRideLockedは印の付いたライドを遷移させない。
+var completingRides = isucache.NewAtomicMap[string, *struct{}]("completingRides")
+
+func init() {
+	registerReset(completingRides.Purge)
+}
+
+// CompleteRide completes ride, which must be ARRIVED, with evaluation and returns when it was completed.
+// 状態の確認と完了処理中の印付けは椅子のロック(chair_status_lock.go)の中で行うので、同じライドを二重に完了させたり、
+// 確認した後にライドの状態が変わったりしない。決済は外部へのHTTPなのでロックを離して行い、
+// もう一度ロックを取ってからCOMPLETEDにするか巻き戻す。ライドはコピーを書き換えて差し替え、呼び出し元の*Rideは変えない。
+func (s *Server) CompleteRide(ctx context.Context, ride *Ride, evaluation int) (time.Time, error) {
+	now := s.clock.Now()
+
+	// 椅子が無いまま進めると、空の椅子IDでbadgerの状態を書いてしまう
+	if !ride.ChairID.Valid {
+		return now, errRideNotMatched
+	}
+	chairID := ride.ChairID.String
+
+	status, paymentToken, err := s.startCompletion(ctx, chairID, ride)
+	if err != nil {
+		return now, err
+	}
+
+	var done []completionStep
+	fail := func(err error) (time.Time, error) {
+		for i := len(done) - 1; i >= 0; i-- {
+			if undoErr := done[i].undo(); undoErr != nil {
+				slog.Error("failed to undo ride completion step",
+					slog.String("ride_id", ride.ID),
+					slog.String("step", done[i].name),
+					slog.String("error", undoErr.Error()),
+				)
+			}
+		}
+		unlock := lockChairStatus(chairID)
+		completingRides.Forget(ride.ID)
+		unlock()
+		return now, err
+	}
+
+	// 売上の集計はridesを直接参照するので、COMPLETEDにする前に書き込みを反映しておく
+	completed := *ride
+	completed.Evaluation = &evaluation
+	completed.UpdatedAt = now
+	s.replaceCompletedRide(chairID, &completed)
+	sales := rideSales(&completed)
+	found, err := writeEvaluatedRide(ctx, &completed, sales)
+	if err != nil || !found {
+		s.replaceCompletedRide(chairID, ride)
+		if err != nil {
+			return fail(err)
+		}
+		return fail(errRideNotFound)
+	}
+	done = append(done, completionStep{name: "ride", undo: func() error {
+		s.replaceCompletedRide(chairID, ride)
+		_, err := writeEvaluatedRide(context.Background(), ride, 0)
+		return err
+	}})
+
+	_, endBadgerSpan := startSpan(ctx, "badger.completeRide")
+	err = updateUserStatusToBadger(ride.UserID, false)
+	endBadgerSpan()
+	if err != nil {
+		return fail(err)
+	}
+	done = append(done, completionStep{name: "user status", undo: func() error {
+		return updateUserStatusToBadger(ride.UserID, true)
+	}})
+
+	// 適用したクーポンのused_byが書き込まれるのを待ってから料金を再計算する
+	if err := waitCouponWrite(ctx, ride.ID); err != nil {
+		return fail(err)
+	}
+	fare, err := calculateDiscountedFare(ctx, s.couponRepository, &completed)
+	if err != nil {
+		return fail(err)
+	}
+	if err := requestPaymentGatewayPostPayment(ctx, paymentGatewayURL, paymentToken.Token, &paymentGatewayPostPaymentRequest{
+		Amount: fare,
+	}); err != nil {
+		return fail(fmt.Errorf("failed to request payment: %w", err))
+	}
+	recordAudit(now, userActor(ride.UserID), "payment.request", ride.ID, chairID, "", strconv.Itoa(fare))
+
+	// ここから先は決済済みなので巻き戻さない
+	// 椅子とライドの状態はまとめてCOMPLETEDにする。印があったので他の遷移は入っておらずARRIVEDのままのはず
+	unlock := lockChairStatus(chairID)
+	defer unlock()
+	completingRides.Forget(ride.ID)
+	if _, ok, err := transitionChairRideLocked(chairID, ride.ID, []string{"ARRIVED"}, chairStatusCompleted, "COMPLETED", now); err != nil || !ok {
+		if err == nil {
+			err = fmt.Errorf("ride %s is no longer ARRIVED", ride.ID)
+		}
+		slog.Error("failed to complete paid ride",
+			slog.String("ride_id", ride.ID),
+			slog.String("error", err.Error()),
+		)
+		return now, err
+	}
+	releaseChairAvailability(chairID)
+	recordAudit(now, userActor(ride.UserID), "ride.evaluate", ride.ID, chairID, status, "COMPLETED")
+	recordChairCompletion(chairID, now, sales, evaluation)
+	if chair, ok := chairCache.Load(chairID); ok {
+		invalidateOwnerSales(chair.OwnerID)
+	}
+
+	s.events.ChairPublish(chairID, &RideEvent{
+		status:     "COMPLETED",
+		evaluation: evaluation,
+		updatedAt:  now,
+		ride:       &completed,
+	})
+	s.events.UserPublish(ride.UserID, &RideEvent{
+		status:     "COMPLETED",
+		evaluation: evaluation,
+		updatedAt:  now,
+		ride:       &completed,
+	})
+
+	return now, nil
+}
+
+// startCompletion checks under the lock of chairID that ride can be completed and marks it as completing.
+// status is the ride status seen under the lock.
+func (s *Server) startCompletion(ctx context.Context, chairID string, ride *Ride) (status string, paymentToken *PaymentToken, err error) {
+	unlock := lockChairStatus(chairID)
+	defer unlock()
+
+	status, err = getLatestRideStatus(ctx, s.db, ride.ID)
+	if err != nil {
+		return "", nil, err
+	}
+	if status == "COMPLETED" {
+		return "", nil, badRequest("already completed")
+	}
+	if status != "ARRIVED" {
+		return "", nil, badRequest("not arrived yet")
+	}
+	if _, ok := completingRides.Load(ride.ID); ok {
+		return "", nil, badRequest("already completing")
+	}
+	paymentToken, ok := s.paymentTokens.Load(ride.UserID)
+	if !ok {
+		return "", nil, badRequest("payment token not registered")
+	}
+	completingRides.Store(ride.ID, &struct{}{})
+
+	return status, paymentToken, nil
+}
+
+// replaceCompletedRide stores ride in rideCache and, if it is the latest ride of chairID, in latestRideCache.
+// 他のゴルーチンが読んでいる*Rideは書き換えない。
+func (s *Server) replaceCompletedRide(chairID string, ride *Ride) {
+	s.rides.Update(ride.ID, func(v *Ride) (*Ride, bool) {
+		if v == nil {
+			return nil, false
+		}
+		return ride, true
+	})
+	if latest, ok := latestRideCache.Load(chairID); ok && latest.ID == ride.ID {
+		latestRideCache.Store(chairID, ride)
+	}
+}
+
+// releaseCompletedChair is called once chair has been notified that its ride is COMPLETED.
+func releaseCompletedChair(chair *Chair) {
+	go enqueueEmptyChair(chair)
+}
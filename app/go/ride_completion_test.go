@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCompleteRideReleasesChairLockDuringPayment(t *testing.T) {
+	s := newTestServer(t, nil, nil)
+	openTestBadger(t)
+	testDB := openTestDB(t)
+	t.Cleanup(func() { waitRideStatusWrites(t) })
+	if _, err := testDB.Exec("CREATE TABLE rides (id TEXT PRIMARY KEY, evaluation INTEGER, sales INTEGER, travelled_distance INTEGER, updated_at DATETIME)"); err != nil {
+		t.Fatal(err)
+	}
+	testDB.MustExec("INSERT INTO rides (id) VALUES ('ride')")
+
+	user := &User{ID: "user"}
+	ride := &Ride{ID: "ride", UserID: user.ID, ChairID: sql.NullString{String: "chair", Valid: true}, CreatedAt: time.UnixMilli(1733600000000), UpdatedAt: time.UnixMilli(1733600000000)}
+	s.rides.Store(ride.ID, ride)
+	s.rideStatuses.Store(ride.ID, &RideStatus{RideID: ride.ID, Status: "ARRIVED"})
+	s.paymentTokens.Store(user.ID, &PaymentToken{UserID: user.ID, Token: "token"})
+
+	// 決済の途中で、椅子のロックが空いていることと、他の遷移や二重の完了が入らないことを確かめる
+	type duringPayment struct {
+		blocked     bool
+		canceled    bool
+		completeErr error
+	}
+	checked := make(chan duringPayment, 1)
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		result := make(chan duringPayment, 1)
+		go func() {
+			_, canceled, _ := transitionChairRide("chair", ride.ID, cancelableRideStatuses, chairStatusCompleted, "CANCELED", time.Now())
+			_, err := s.CompleteRide(context.Background(), ride, 1)
+			result <- duringPayment{canceled: canceled, completeErr: err}
+		}()
+		select {
+		case res := <-result:
+			checked <- res
+		case <-time.After(5 * time.Second):
+			checked <- duringPayment{blocked: true}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(gateway.Close)
+	original := paymentGatewayURL
+	paymentGatewayURL = gateway.URL
+	t.Cleanup(func() { paymentGatewayURL = original })
+
+	if _, err := s.CompleteRide(context.Background(), ride, 5); err != nil {
+		t.Fatal(err)
+	}
+
+	res := <-checked
+	if res.blocked {
+		t.Fatal("the chair lock was held during the payment")
+	}
+	if res.canceled {
+		t.Error("ride was canceled during the payment")
+	}
+	if res.completeErr == nil {
+		t.Error("ride was completed twice")
+	}
+	if status, _ := s.rideStatuses.Load(ride.ID); status.Status != "COMPLETED" {
+		t.Errorf("status = %s, want COMPLETED", status.Status)
+	}
+	if _, ok := completingRides.Load(ride.ID); ok {
+		t.Error("ride is still marked as completing")
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"log/slog"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	isucache "github.com/mazrean/isucon-go-tools/v2/cache"
+)
+
+// 新しいライドのridesへのINSERTはリクエストから切り離し、rideCreationQueueに積んでここでまとめて書く
+// INSERTが済んでからマッチングに回すので、椅子が割り当てられるライドは必ずMySQLにある。
+// 書き込みに失敗したら間隔を倍にしながらrideCreationRetryLimit回まで書き直し、それでも駄目ならoutbox(outbox.go)に任せる。
+const (
+	rideCreationBatchSize     = 500
+	rideCreationFlushInterval = 10 * time.Millisecond
+	rideCreationRetryLimit    = 5
+	rideCreationMaxBackoff    = time.Second
+)
+
+var (
+	// isuqueue.NewChannelはメトリクスを同じ名前で登録するので2つ目を作れない。普通のchannelにしておく
+	rideCreationQueue = make(chan *Ride, 10000)
+	// キューに積まれてからマッチングに回るまでのライドの数
+	queuedRideCreations atomic.Int64
+	// 書き込みを諦めてoutboxに任せたライド。outboxが書いたらマッチングに回す
+	abandonedRideCreations = isucache.NewAtomicMap[string, *Ride]("abandonedRideCreations")
+)
+
+func init() {
+	registerReset(func() {
+		// 初期化前のライドは書かない
+		for {
+			select {
+			case <-rideCreationQueue:
+			default:
+				queuedRideCreations.Store(0)
+				return
+			}
+		}
+	})
+	registerReset(abandonedRideCreations.Purge)
+
+	go rideCreationWriter()
+}
+
+func queueRideCreation(ride *Ride) {
+	queuedRideCreations.Add(1)
+	rideCreationQueue <- ride
+}
+
+// doneRideCreations takes n rides off queuedRideCreations.
+// 初期化で0に戻した後に、それより前に取り出していたライドの分を引いても負にはしない。
+func doneRideCreations(n int) {
+	for {
+		queued := queuedRideCreations.Load()
+		if queuedRideCreations.CompareAndSwap(queued, max(queued-int64(n), 0)) {
+			return
+		}
+	}
+}
+
+func rideCreationWriter() {
+	ticker := time.NewTicker(rideCreationFlushInterval)
+	defer ticker.Stop()
+
+	rides := make([]*Ride, 0, rideCreationBatchSize)
+	for {
+		select {
+		case ride := <-rideCreationQueue:
+			rides = append(rides, ride)
+			if len(rides) < rideCreationBatchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(rides) == 0 {
+				continue
+			}
+		}
+
+		// 書き直している間はキューから読まないので、溜めるのはrideCreationBatchSize件まで
+		writeRideCreations(rides)
+		rides = rides[:0]
+	}
+}
+
+// writeRideCreations flushes rides, retrying with exponential backoff.
+// After rideCreationRetryLimit failures the rides are left to the outbox dispatcher.
+func writeRideCreations(rides []*Ride) {
+	backoff := rideCreationFlushInterval
+	for attempt := 1; ; attempt++ {
+		var err error
+		runBackgroundWork(func() {
+			err = flushRideCreations(rides)
+		})
+		if err == nil {
+			return
+		}
+
+		if attempt >= rideCreationRetryLimit {
+			slog.Error("gave up inserting created rides",
+				slog.Int("count", len(rides)),
+				slog.String("error", err.Error()),
+			)
+			for _, ride := range rides {
+				abandonedRideCreations.Store(ride.ID, ride)
+			}
+			return
+		}
+
+		slog.Warn("failed to insert created rides",
+			slog.Int("count", len(rides)),
+			slog.Int("attempt", attempt),
+			slog.String("error", err.Error()),
+		)
+		time.Sleep(backoff)
+		backoff = min(backoff*2, rideCreationMaxBackoff)
+	}
+}
+
+// releaseAbandonedRideCreation hands a ride given up by writeRideCreations to the matcher once the outbox has inserted it.
+func releaseAbandonedRideCreation(rideID string) {
+	ride, ok := abandonedRideCreations.Load(rideID)
+	if !ok {
+		return
+	}
+	abandonedRideCreations.Forget(rideID)
+	doneRideCreations(1)
+
+	if _, ok := rideCache.Load(rideID); ok {
+		enqueueMatchingRide(ride)
+	}
+}
+
+// flushRideCreations inserts rides and then hands them to the matcher.
+func flushRideCreations(rides []*Ride) error {
+	// 待っている間に初期化されていたら、今のキャッシュに無いライドは捨てる
+	live := make([]*Ride, 0, len(rides))
+	for _, ride := range rides {
+		if _, ok := rideCache.Load(ride.ID); ok {
+			live = append(live, ride)
+		}
+	}
+	if len(live) == 0 {
+		doneRideCreations(len(rides))
+		return nil
+	}
+
+	sb := &strings.Builder{}
+	sb.WriteString("INSERT INTO rides (id, user_id, pickup_latitude, pickup_longitude, destination_latitude, destination_longitude, created_at, updated_at) VALUES ")
+	args := make([]any, 0, len(live)*8)
+	for i, ride := range live {
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		sb.WriteString("(?, ?, ?, ?, ?, ?, ?, ?)")
+		args = append(args,
+			ride.ID, ride.UserID, ride.PickupLatitude, ride.PickupLongitude,
+			ride.DestinationLatitude, ride.DestinationLongitude, ride.CreatedAt, ride.CreatedAt,
+		)
+	}
+	// outboxが先に書いていることがある
+	sb.WriteString(" ON DUPLICATE KEY UPDATE id = id")
+
+	if _, err := db.Exec(sb.String(), args...); err != nil {
+		return err
+	}
+
+	for _, ride := range live {
+		enqueueMatchingRide(ride)
+	}
+	// 捨てたライドもキューからは取り出しているので数から引く
+	doneRideCreations(len(rides))
+
+	return nil
+}
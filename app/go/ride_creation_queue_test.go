@@ -0,0 +1,29 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFlushRideCreationsDropped(t *testing.T) {
+	t.Cleanup(resetAll)
+
+	// 初期化でキャッシュから消えたライドは書かないが、キューの数からは引く
+	createdAt := time.UnixMilli(1733600000000)
+	queuedRideCreations.Store(3)
+	if err := flushRideCreations([]*Ride{
+		{ID: "dropped1", UserID: "user", CreatedAt: createdAt, UpdatedAt: createdAt},
+		{ID: "dropped2", UserID: "user", CreatedAt: createdAt, UpdatedAt: createdAt},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if got := queuedRideCreations.Load(); got != 1 {
+		t.Errorf("queued ride creations = %d, want 1", got)
+	}
+
+	// 初期化で0に戻した後に引いても負にならない
+	doneRideCreations(2)
+	if got := queuedRideCreations.Load(); got != 0 {
+		t.Errorf("queued ride creations = %d, want 0", got)
+	}
+}
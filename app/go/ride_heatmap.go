@@ -0,0 +1,202 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// 直近のライドの配車位置・目的地を格子状のセルに数えたヒートマップ
+//
+//	curl -s 'localhost:8080/api/internal/heatmap?kind=pickup&window=30m'
+//
+// 椅子の先回りや混雑時の料金の判断材料にする。ライドが作成されるたびに10分単位のバケットへ足し込み、
+// 保持期間より古いバケットは足し込むときに捨てる。起動時と初期化時はrideCacheから組み立て直す。
+// セルの一辺の長さ(座標の単位)はISUCON_HEATMAP_CELLで変えられる。デフォルトは10。
+const (
+	rideHeatmapBucketSize = 10 * time.Minute
+	rideHeatmapRetention  = 24 * time.Hour
+)
+
+var rideHeatmapCellSize = parseRideHeatmapCellSize(os.Getenv("ISUCON_HEATMAP_CELL"))
+
+func parseRideHeatmapCellSize(s string) int {
+	if s == "" {
+		return 10
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n <= 0 {
+		panic(fmt.Sprintf("invalid ISUCON_HEATMAP_CELL: %q", s))
+	}
+	return n
+}
+
+type gridCell struct {
+	latitude  int
+	longitude int
+}
+
+// cellOf returns the cell containing the coordinate. 負の座標も切り捨てで同じ幅のセルに入れる。
+func cellOf(latitude, longitude int) gridCell {
+	return gridCell{
+		latitude:  floorDiv(latitude, rideHeatmapCellSize),
+		longitude: floorDiv(longitude, rideHeatmapCellSize),
+	}
+}
+
+func floorDiv(a, b int) int {
+	q := a / b
+	if a%b != 0 && a < 0 {
+		q--
+	}
+	return q
+}
+
+type rideHeatmapBucket struct {
+	pickups      map[gridCell]int
+	destinations map[gridCell]int
+}
+
+var (
+	// バケットの開始時刻(unix秒) -> 集計
+	rideHeatmapBuckets = map[int64]*rideHeatmapBucket{}
+	rideHeatmapLock    sync.Mutex
+)
+
+func init() {
+	registerReset(func() {
+		rideHeatmapLock.Lock()
+		defer rideHeatmapLock.Unlock()
+
+		rideHeatmapBuckets = map[int64]*rideHeatmapBucket{}
+	})
+}
+
+func initRideHeatmap() error {
+	since := clock.Now().Add(-rideHeatmapRetention)
+	rideCache.Range(func(_ string, ride *Ride) bool {
+		if ride.CreatedAt.After(since) {
+			recordRideHeatmap(ride)
+		}
+		return true
+	})
+
+	return nil
+}
+
+// recordRideHeatmap adds the pickup and destination of a created ride to the heatmap.
+func recordRideHeatmap(ride *Ride) {
+	key := ride.CreatedAt.Truncate(rideHeatmapBucketSize).Unix()
+	oldest := clock.Now().Add(-rideHeatmapRetention).Truncate(rideHeatmapBucketSize).Unix()
+
+	rideHeatmapLock.Lock()
+	defer rideHeatmapLock.Unlock()
+
+	bucket, ok := rideHeatmapBuckets[key]
+	if !ok {
+		for start := range rideHeatmapBuckets {
+			if start < oldest {
+				delete(rideHeatmapBuckets, start)
+			}
+		}
+		bucket = &rideHeatmapBucket{
+			pickups:      map[gridCell]int{},
+			destinations: map[gridCell]int{},
+		}
+		rideHeatmapBuckets[key] = bucket
+	}
+	bucket.pickups[cellOf(ride.PickupLatitude, ride.PickupLongitude)]++
+	bucket.destinations[cellOf(ride.DestinationLatitude, ride.DestinationLongitude)]++
+}
+
+// sumRideHeatmap sums the buckets starting at or after since.
+func sumRideHeatmap(since time.Time, pickups bool) map[gridCell]int {
+	key := since.Truncate(rideHeatmapBucketSize).Unix()
+	sum := map[gridCell]int{}
+
+	rideHeatmapLock.Lock()
+	defer rideHeatmapLock.Unlock()
+
+	for start, bucket := range rideHeatmapBuckets {
+		if start < key {
+			continue
+		}
+		cells := bucket.destinations
+		if pickups {
+			cells = bucket.pickups
+		}
+		for cell, count := range cells {
+			sum[cell] += count
+		}
+	}
+
+	return sum
+}
+
+type internalGetHeatmapResponse struct {
+	Kind     string                           `json:"kind"`
+	Since    int64                            `json:"since"`
+	CellSize int                              `json:"cell_size"`
+	Cells    []internalGetHeatmapResponseCell `json:"cells"`
+}
+
+// セルの南西の角の座標と、そのセルに入ったライドの数
+type internalGetHeatmapResponseCell struct {
+	Latitude  int `json:"latitude"`
+	Longitude int `json:"longitude"`
+	Count     int `json:"count"`
+}
+
+// GET /api/internal/heatmap?kind=pickup&window=1h
+//
+// kindはpickup(デフォルト)かdestination。windowはGoのduration形式で、省略すると保持している全期間。
+func (s *Server) internalGetHeatmap(w http.ResponseWriter, r *http.Request) {
+	kind := r.URL.Query().Get("kind")
+	if kind == "" {
+		kind = "pickup"
+	}
+	if kind != "pickup" && kind != "destination" {
+		writeError(w, r, http.StatusBadRequest, badRequest("kind must be pickup or destination"))
+		return
+	}
+
+	window := rideHeatmapRetention
+	if v := r.URL.Query().Get("window"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			writeError(w, r, http.StatusBadRequest, badRequest("window must be a positive duration"))
+			return
+		}
+		window = min(d, rideHeatmapRetention)
+	}
+	since := s.clock.Now().Add(-window).Truncate(rideHeatmapBucketSize)
+
+	cells := sumRideHeatmap(since, kind == "pickup")
+	res := internalGetHeatmapResponse{
+		Kind:     kind,
+		Since:    since.UnixMilli(),
+		CellSize: rideHeatmapCellSize,
+		Cells:    make([]internalGetHeatmapResponseCell, 0, len(cells)),
+	}
+	for cell, count := range cells {
+		res.Cells = append(res.Cells, internalGetHeatmapResponseCell{
+			Latitude:  cell.latitude * rideHeatmapCellSize,
+			Longitude: cell.longitude * rideHeatmapCellSize,
+			Count:     count,
+		})
+	}
+	slices.SortFunc(res.Cells, func(a, b internalGetHeatmapResponseCell) int {
+		return cmp.Or(
+			cmp.Compare(b.Count, a.Count),
+			cmp.Compare(a.Latitude, b.Latitude),
+			cmp.Compare(a.Longitude, b.Longitude),
+		)
+	})
+
+	writeJSON(w, http.StatusOK, res)
+}
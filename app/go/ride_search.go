@@ -0,0 +1,275 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 運用者が全ユーザーのライドを横断して調べるための検索
+//
+//	curl -s 'localhost:8080/api/internal/rides?status=MATCHING&since=1733000000000&limit=20'
+//
+// 基本はrideCacheから引き、キャッシュだけでlimitに満たないときは、それより古いライドをMySQLから補う。
+// 並びは作成日時の降順で、次のページはレスポンスのnext_cursorをcursorに渡して取得する。
+
+const (
+	defaultRideSearchLimit = 50
+	maxRideSearchLimit     = 500
+)
+
+type rideSearchQuery struct {
+	status  string
+	userID  string
+	chairID string
+	since   time.Time
+	limit   int
+	// cursorより古いライドだけを返す
+	cursor *rideSearchCursor
+}
+
+type rideSearchCursor struct {
+	createdAt time.Time
+	rideID    string
+}
+
+func (c *rideSearchCursor) String() string {
+	return strconv.FormatInt(c.createdAt.UnixMicro(), 10) + "_" + c.rideID
+}
+
+func parseRideSearchCursor(s string) (*rideSearchCursor, error) {
+	micro, rideID, ok := strings.Cut(s, "_")
+	if !ok {
+		return nil, badRequest("invalid cursor")
+	}
+	v, err := strconv.ParseInt(micro, 10, 64)
+	if err != nil {
+		return nil, badRequest("invalid cursor")
+	}
+	return &rideSearchCursor{createdAt: time.UnixMicro(v), rideID: rideID}, nil
+}
+
+// before reports whether the ride comes after the cursor in newest-first order.
+func (c *rideSearchCursor) before(createdAt time.Time, rideID string) bool {
+	if c == nil {
+		return true
+	}
+	if !createdAt.Equal(c.createdAt) {
+		return createdAt.Before(c.createdAt)
+	}
+	return rideID < c.rideID
+}
+
+func parseRideSearchQuery(r *http.Request) (*rideSearchQuery, error) {
+	q := r.URL.Query()
+	query := &rideSearchQuery{
+		status:  q.Get("status"),
+		userID:  q.Get("user_id"),
+		chairID: q.Get("chair_id"),
+		limit:   defaultRideSearchLimit,
+	}
+
+	if v := q.Get("since"); v != "" {
+		ms, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, badRequest("since must be unix milliseconds")
+		}
+		query.since = time.UnixMilli(ms)
+	}
+	if v := q.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit <= 0 {
+			return nil, badRequest("limit must be a positive integer")
+		}
+		query.limit = min(limit, maxRideSearchLimit)
+	}
+	if v := q.Get("cursor"); v != "" {
+		cursor, err := parseRideSearchCursor(v)
+		if err != nil {
+			return nil, err
+		}
+		query.cursor = cursor
+	}
+
+	return query, nil
+}
+
+type rideSearchResult struct {
+	ID                    string     `json:"id"`
+	UserID                string     `json:"user_id"`
+	ChairID               *string    `json:"chair_id"`
+	Status                string     `json:"status"`
+	PickupCoordinate      Coordinate `json:"pickup_coordinate"`
+	DestinationCoordinate Coordinate `json:"destination_coordinate"`
+	Evaluation            *int       `json:"evaluation"`
+	CreatedAt             int64      `json:"created_at"`
+	UpdatedAt             int64      `json:"updated_at"`
+
+	createdAt time.Time
+}
+
+func newRideSearchResult(ride *Ride, status string) *rideSearchResult {
+	res := &rideSearchResult{
+		ID:                    ride.ID,
+		UserID:                ride.UserID,
+		Status:                status,
+		PickupCoordinate:      Coordinate{Latitude: ride.PickupLatitude, Longitude: ride.PickupLongitude},
+		DestinationCoordinate: Coordinate{Latitude: ride.DestinationLatitude, Longitude: ride.DestinationLongitude},
+		Evaluation:            ride.Evaluation,
+		CreatedAt:             ride.CreatedAt.UnixMilli(),
+		UpdatedAt:             ride.UpdatedAt.UnixMilli(),
+		createdAt:             ride.CreatedAt,
+	}
+	if ride.ChairID.Valid {
+		res.ChairID = &ride.ChairID.String
+	}
+	return res
+}
+
+type internalGetRidesResponse struct {
+	Rides      []*rideSearchResult `json:"rides"`
+	NextCursor string              `json:"next_cursor,omitempty"`
+}
+
+func (q *rideSearchQuery) match(ride *Ride, status string) bool {
+	if q.userID != "" && ride.UserID != q.userID {
+		return false
+	}
+	if q.chairID != "" && ride.ChairID.String != q.chairID {
+		return false
+	}
+	if q.status != "" && status != q.status {
+		return false
+	}
+	if !q.since.IsZero() && ride.CreatedAt.Before(q.since) {
+		return false
+	}
+	return q.cursor.before(ride.CreatedAt, ride.ID)
+}
+
+// searchCachedRides returns the matching rides in rideCache, newest first.
+func (s *Server) searchCachedRides(q *rideSearchQuery) []*rideSearchResult {
+	var results []*rideSearchResult
+	add := func(ride *Ride) {
+		status := ""
+		if rideStatus, ok := s.rideStatuses.Load(ride.ID); ok {
+			status = rideStatus.Status
+		}
+		if q.match(ride, status) {
+			results = append(results, newRideSearchResult(ride, status))
+		}
+	}
+
+	if q.userID != "" {
+		for _, ride := range s.rideRepository.ListByUser(q.userID) {
+			add(ride)
+		}
+	} else {
+		s.rides.Range(func(_ string, ride *Ride) bool {
+			add(ride)
+			return true
+		})
+	}
+
+	slices.SortFunc(results, func(a, b *rideSearchResult) int {
+		if c := b.createdAt.Compare(a.createdAt); c != 0 {
+			return c
+		}
+		return cmp.Compare(b.ID, a.ID)
+	})
+	return results
+}
+
+// searchArchivedRides looks up rides older than the cursor in MySQL that are no longer in rideCache.
+func (s *Server) searchArchivedRides(ctx context.Context, q *rideSearchQuery, limit int) ([]*rideSearchResult, error) {
+	var (
+		where []string
+		args  []any
+	)
+	if q.userID != "" {
+		where = append(where, "r.user_id = ?")
+		args = append(args, q.userID)
+	}
+	if q.chairID != "" {
+		where = append(where, "r.chair_id = ?")
+		args = append(args, q.chairID)
+	}
+	if !q.since.IsZero() {
+		where = append(where, "r.created_at >= ?")
+		args = append(args, q.since)
+	}
+	if q.cursor != nil {
+		where = append(where, "(r.created_at < ? OR (r.created_at = ? AND r.id < ?))")
+		args = append(args, q.cursor.createdAt, q.cursor.createdAt, q.cursor.rideID)
+	}
+	if q.status != "" {
+		where = append(where, "rs.status = ?")
+		args = append(args, q.status)
+	}
+	query := "SELECT r." + strings.ReplaceAll(rideColumns, ", ", ", r.") + ", COALESCE(rs.status, '') AS status FROM rides r LEFT JOIN ride_statuses rs ON rs.id = (SELECT id FROM ride_statuses WHERE ride_id = r.id ORDER BY created_at DESC LIMIT 1)"
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY r.created_at DESC, r.id DESC LIMIT ?"
+	args = append(args, limit)
+
+	var rows []struct {
+		Ride
+		Status string `db:"status"`
+	}
+	if err := s.db.SelectContext(ctx, &rows, query, args...); err != nil {
+		return nil, fmt.Errorf("failed to search rides: %w", err)
+	}
+
+	results := make([]*rideSearchResult, 0, len(rows))
+	for i := range rows {
+		if _, ok := s.rides.Load(rows[i].ID); ok {
+			continue
+		}
+		results = append(results, newRideSearchResult(&rows[i].Ride, rows[i].Status))
+	}
+	return results, nil
+}
+
+func (s *Server) internalGetRides(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	q, err := parseRideSearchQuery(r)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	// 次のページがあるかを判定するために1件多く取る
+	results := s.searchCachedRides(q)
+	if len(results) <= q.limit {
+		archiveQuery := *q
+		if len(results) > 0 {
+			last := results[len(results)-1]
+			archiveQuery.cursor = &rideSearchCursor{createdAt: last.createdAt, rideID: last.ID}
+		}
+		archived, err := s.searchArchivedRides(ctx, &archiveQuery, q.limit+1-len(results))
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		results = append(results, archived...)
+	}
+
+	res := &internalGetRidesResponse{Rides: results}
+	if len(results) > q.limit {
+		res.Rides = results[:q.limit]
+		last := res.Rides[len(res.Rides)-1]
+		res.NextCursor = (&rideSearchCursor{createdAt: last.createdAt, rideID: last.ID}).String()
+	}
+	if res.Rides == nil {
+		res.Rides = []*rideSearchResult{}
+	}
+
+	writeJSON(w, http.StatusOK, res)
+}
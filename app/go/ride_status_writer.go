@@ -0,0 +1,130 @@
+package main
+
+import (
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	isuqueue "github.com/mazrean/isucon-go-tools/v2/queue"
+	"github.com/oklog/ulid/v2"
+)
+
+// ride_statusesへの書き込みはここで非同期に行い、リクエスト処理はrideStatusesCacheだけを更新する
+// 遷移は椅子をまたいでrideStatusFlushIntervalごと(溜まりすぎたらその場で)に複数行のINSERTにまとめて書く。
+const (
+	rideStatusBatchSize     = 1000
+	rideStatusFlushInterval = 5 * time.Millisecond
+)
+
+var (
+	// isuqueue.AllResetで初期化時に作り直される
+	rideStatusQueue = isuqueue.NewChannel[*RideStatus]("rideStatusQueue", 10000)
+	// キューに積まれてからINSERTし終わるまでの遷移の数
+	pendingRideStatuses atomic.Int64
+)
+
+func init() {
+	registerReset(func() {
+		pendingRideStatuses.Store(0)
+	})
+
+	go rideStatusWriter()
+}
+
+func storeRideStatus(rideID string, status string, now time.Time) *RideStatus {
+	rideStatus := newRideStatus(rideID, status, now)
+	queueRideStatus(rideStatus)
+
+	return rideStatus
+}
+
+func newRideStatus(rideID string, status string, now time.Time) *RideStatus {
+	// app_sent_atとchair_sent_atは通知を送ったときにmarkRideStatusSentで書く
+	return &RideStatus{
+		ID:        ulid.Make().String(),
+		RideID:    rideID,
+		Status:    status,
+		CreatedAt: now,
+	}
+}
+
+// queueRideStatus stores rideStatus in rideStatusesCache and queues it for writing.
+func queueRideStatus(rideStatus *RideStatus) {
+	rideStatusesCache.Store(rideStatus.RideID, rideStatus)
+	if ride, ok := rideCache.Load(rideStatus.RideID); ok {
+		recordRideTransition(ride, rideStatus.Status)
+		recordRideTravelTransition(ride, rideStatus.Status, rideStatus.CreatedAt)
+	}
+	pushRideStatus(rideStatus)
+}
+
+func pushRideStatus(rideStatus *RideStatus) {
+	pendingRideStatuses.Add(1)
+	rideStatusQueue.Push() <- rideStatus
+}
+
+const (
+	rideStatusSentApp   = "app"
+	rideStatusSentChair = "chair"
+)
+
+// markRideStatusSent records that the notification of status was sent to side ("app" or "chair") at now.
+// rideStatusesCacheの行はwriterが読んでいるので書き換えず、送信時刻だけを入れたコピーを同じキューに積む。
+// キューは順番に書くので、遷移のINSERTより先に送信時刻が書かれることはない。
+func markRideStatusSent(rideID string, status string, side string, now time.Time) {
+	current, ok := rideStatusesCache.Load(rideID)
+	if !ok || current.Status != status {
+		// MATCHEDのようにride_statusesに行がない通知か、もう次の遷移に進んでいる
+		return
+	}
+
+	sent := *current
+	switch side {
+	case rideStatusSentApp:
+		sent.AppSentAt = &now
+	case rideStatusSentChair:
+		sent.ChairSentAt = &now
+	}
+	pushRideStatus(&sent)
+}
+
+func rideStatusWriter() {
+	ticker := time.NewTicker(rideStatusFlushInterval)
+	defer ticker.Stop()
+
+	rideStatuses := make([]*RideStatus, 0, rideStatusBatchSize)
+	for {
+		select {
+		case rideStatus, ok := <-rideStatusQueue.Pop():
+			if !ok {
+				// 初期化でキューが作り直された。初期化前の遷移は書かない
+				rideStatuses = rideStatuses[:0]
+				continue
+			}
+			rideStatuses = append(rideStatuses, rideStatus)
+			if len(rideStatuses) < rideStatusBatchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(rideStatuses) == 0 {
+				continue
+			}
+		}
+
+		flushRideStatuses(rideStatuses)
+		pendingRideStatuses.Add(-int64(len(rideStatuses)))
+		rideStatuses = rideStatuses[:0]
+	}
+}
+
+func flushRideStatuses(rideStatuses []*RideStatus) {
+	if _, err := db.NamedExec(
+		"INSERT INTO ride_statuses (id, ride_id, status, created_at, app_sent_at, chair_sent_at) VALUES (:id, :ride_id, :status, :created_at, :app_sent_at, :chair_sent_at) ON DUPLICATE KEY UPDATE app_sent_at = COALESCE(app_sent_at, VALUES(app_sent_at)), chair_sent_at = COALESCE(chair_sent_at, VALUES(chair_sent_at))",
+		rideStatuses,
+	); err != nil {
+		slog.Error("failed to insert ride statuses",
+			slog.Int("count", len(rideStatuses)),
+			slog.String("error", err.Error()),
+		)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	isucache "github.com/mazrean/isucon-go-tools/v2/cache"
+)
+
+// ライドで実際に移動した距離と時間
+// 距離はCARRYINGの間に椅子が送ってきた座標の間を足し合わせたもの、時間はPICKUPからARRIVEDまで。
+// 状態遷移(queueRideStatus)と座標の送信(chairPostCoordinate)で更新する。
+// 座標の履歴は実行中はMySQLに残らないので、距離は評価のときにridesのtravelled_distanceに書いておく。
+// 起動時と初期化時はride_statusesの時刻と、travelled_distanceか初期データのchair_locationsから組み立て直す。
+
+type rideTravel struct {
+	mu       sync.Mutex
+	distance int
+	// CARRYINGになってから最後に送られてきた座標
+	lastLatitude  int
+	lastLongitude int
+	carrying      bool
+	pickedUpAt    time.Time
+	arrivedAt     time.Time
+}
+
+var rideTravels = isucache.NewAtomicMap[string, *rideTravel]("rideTravels")
+
+func init() {
+	registerReset(rideTravels.Purge)
+}
+
+func initRideTravels() error {
+	var statuses []RideStatus
+	if err := db.Select(&statuses, "SELECT ride_id, status, created_at FROM ride_statuses WHERE status IN ('PICKUP', 'CARRYING', 'ARRIVED') ORDER BY created_at"); err != nil {
+		return fmt.Errorf("failed to select ride statuses: %w", err)
+	}
+	var distances []struct {
+		RideID   string `db:"id"`
+		Distance int    `db:"travelled_distance"`
+	}
+	if err := db.Select(&distances, "SELECT id, travelled_distance FROM rides WHERE travelled_distance IS NOT NULL"); err != nil {
+		return fmt.Errorf("failed to select travelled distances: %w", err)
+	}
+	stored := make(map[string]int, len(distances))
+	for _, d := range distances {
+		stored[d.RideID] = d.Distance
+	}
+
+	// 距離が保存されていないライドは、chair_locationsのうちCARRYINGの間の座標から数える
+	type carryingWindow struct {
+		rideID string
+		travel *rideTravel
+		from   time.Time
+	}
+	windows := map[string][]carryingWindow{}
+	for _, status := range statuses {
+		ride, ok := rideCache.Load(status.RideID)
+		if !ok || !ride.ChairID.Valid {
+			continue
+		}
+		recordRideTravelTransition(ride, status.Status, status.CreatedAt)
+		if status.Status != "CARRYING" {
+			continue
+		}
+		travel, _ := rideTravels.Load(ride.ID)
+		if distance, ok := stored[ride.ID]; ok {
+			travel.distance = distance
+			continue
+		}
+		windows[ride.ChairID.String] = append(windows[ride.ChairID.String], carryingWindow{rideID: ride.ID, travel: travel, from: status.CreatedAt})
+	}
+	if len(windows) == 0 {
+		return nil
+	}
+
+	var locations []struct {
+		ChairID   string    `db:"chair_id"`
+		Latitude  int       `db:"latitude"`
+		Longitude int       `db:"longitude"`
+		CreatedAt time.Time `db:"created_at"`
+	}
+	if err := db.Select(&locations, "SELECT chair_id, latitude, longitude, created_at FROM chair_locations ORDER BY chair_id, created_at"); err != nil {
+		return fmt.Errorf("failed to select chair locations: %w", err)
+	}
+	for _, location := range locations {
+		for _, window := range windows[location.ChairID] {
+			travel := window.travel
+			if !location.CreatedAt.After(window.from) || !travel.arrivedAt.IsZero() && location.CreatedAt.After(travel.arrivedAt) {
+				continue
+			}
+			travel.distance += calculateDistance(travel.lastLatitude, travel.lastLongitude, location.Latitude, location.Longitude)
+			travel.lastLatitude, travel.lastLongitude = location.Latitude, location.Longitude
+		}
+	}
+
+	return nil
+}
+
+// recordRideTravelTransition records when ride was picked up and arrived.
+// CARRYINGになった時点で椅子は配車位置にいるので、そこから距離を数え始める。
+func recordRideTravelTransition(ride *Ride, status string, at time.Time) {
+	if status != "PICKUP" && status != "CARRYING" && status != "ARRIVED" {
+		return
+	}
+	travel, _ := rideTravels.LoadOrStore(ride.ID, &rideTravel{})
+
+	travel.mu.Lock()
+	defer travel.mu.Unlock()
+
+	switch status {
+	case "PICKUP":
+		travel.pickedUpAt = at
+	case "CARRYING":
+		travel.carrying = true
+		travel.lastLatitude, travel.lastLongitude = ride.PickupLatitude, ride.PickupLongitude
+	case "ARRIVED":
+		travel.carrying = false
+		travel.arrivedAt = at
+	}
+}
+
+// recordRideTravelCoordinate adds the move to coordinate to the distance of the ride being carried.
+func recordRideTravelCoordinate(rideID string, coordinate *Coordinate) {
+	travel, ok := rideTravels.Load(rideID)
+	if !ok {
+		return
+	}
+
+	travel.mu.Lock()
+	defer travel.mu.Unlock()
+
+	if !travel.carrying {
+		return
+	}
+	travel.distance += calculateDistance(travel.lastLatitude, travel.lastLongitude, coordinate.Latitude, coordinate.Longitude)
+	travel.lastLatitude, travel.lastLongitude = coordinate.Latitude, coordinate.Longitude
+}
+
+// rideTravelled returns the distance and the duration of ride once it has arrived.
+func rideTravelled(rideID string) (distance int, duration time.Duration, ok bool) {
+	travel, ok := rideTravels.Load(rideID)
+	if !ok {
+		return 0, 0, false
+	}
+
+	travel.mu.Lock()
+	defer travel.mu.Unlock()
+
+	if travel.pickedUpAt.IsZero() || travel.arrivedAt.IsZero() {
+		return 0, 0, false
+	}
+	return travel.distance, travel.arrivedAt.Sub(travel.pickedUpAt), true
+}
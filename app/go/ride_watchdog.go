@@ -0,0 +1,117 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// 割り当てられた椅子がENROUTEを送ってこないライドを、椅子から外してマッチングに戻す
+// 椅子のクライアントの不具合や落ちたときに、ライドがMATCHEDのまま止まらないようにする。
+// ISUCON_MATCHED_TIMEOUT(デフォルト30s、0で無効)より前にマッチしたままのライドを見つけたら、
+//   - 椅子の割り当てを外してマッチング待ちに戻し、ユーザーにはMATCHINGを通知する
+//   - 椅子はアクティブなら空きに戻す
+//   - 監査ログ(ride.unassign)とisuride_stalled_assignments_totalに残す
+//
+// 椅子がENROUTEを送るのと同時に外すことはありうるが、外した後のENROUTEはridesを見て400になる。
+
+const rideWatchdogInterval = time.Second
+
+const watchdogActor = "watchdog"
+
+var (
+	matchedTimeout = parseMatchedTimeout(os.Getenv("ISUCON_MATCHED_TIMEOUT"))
+
+	stalledAssignmentCounter = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "isuride_stalled_assignments_total",
+		Help: "rides taken back from chairs that did not start moving in time",
+	})
+)
+
+func parseMatchedTimeout(s string) time.Duration {
+	if s == "" {
+		return 30 * time.Second
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		panic(fmt.Sprintf("invalid ISUCON_MATCHED_TIMEOUT: %q", s))
+	}
+	return d
+}
+
+func startRideWatchdog() {
+	if matchedTimeout == 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(rideWatchdogInterval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			runBackgroundWork(func() {
+				unassignStalledRides(clock.Now().Add(-matchedTimeout))
+			})
+		}
+	}()
+}
+
+// unassignStalledRides takes back the rides matched before deadline whose chair has not posted ENROUTE.
+func unassignStalledRides(deadline time.Time) {
+	// 割り当て中のライドは椅子ごとの最新のライドなので、rideCache全体は見ない
+	latestRideCache.Range(func(chairID string, ride *Ride) bool {
+		if !ride.ChairID.Valid || ride.ChairID.String != chairID || !ride.UpdatedAt.Before(deadline) {
+			return true
+		}
+		// マッチしただけのライドはMATCHINGのまま
+		if status, ok := rideStatusesCache.Load(ride.ID); !ok || status.Status != "MATCHING" {
+			return true
+		}
+
+		unassignRide(ride, chairID)
+		return true
+	})
+}
+
+func unassignRide(ride *Ride, chairID string) {
+	now := clock.Now().Truncate(time.Microsecond)
+	matchedAt := ride.UpdatedAt
+
+	// applyMatchと同じく、キャッシュの*Rideは書き換えずにコピーを差し替える
+	unassigned := *ride
+	unassigned.ChairID = sql.NullString{}
+	unassigned.UpdatedAt = now
+	ride = &unassigned
+	rideAssignmentLock.Lock()
+	storeRide(ride)
+	rideAssignmentLock.Unlock()
+	writeRide(ride, 0)
+	forgetChairRide(chairID, ride)
+	latestRideCache.Forget(chairID)
+	recordRideUnassignment(ride, chairID)
+
+	stalledAssignmentCounter.Inc()
+	recordAudit(now, watchdogActor, "ride.unassign", ride.ID, chairID, "MATCHED", "MATCHING")
+	slog.Warn("chair did not start moving, returning the ride to matching",
+		slog.String("ride_id", ride.ID),
+		slog.String("chair_id", chairID),
+		slog.Time("matched_at", matchedAt),
+	)
+
+	UserPublish(ride.UserID, &RideEvent{
+		status:    "MATCHING",
+		updatedAt: now,
+		ride:      ride,
+	})
+	enqueueMatchingRide(ride)
+
+	if chair, ok := chairCache.Load(chairID); ok && chair.IsActive {
+		releaseChairAvailability(chairID)
+		releaseCompletedChair(chair)
+	}
+}
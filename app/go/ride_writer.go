@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+const rideFlushInterval = 50 * time.Millisecond
+
+// rideCacheを正としてridesへの書き込みはまとめて後から行う(write-behind)
+type pendingRideWrite struct {
+	ride  Ride
+	sales int
+	// 評価済みのライドだけ。nilなら書き換えない
+	travelledDistance *int
+}
+
+var (
+	pendingRideWrites     = map[string]*pendingRideWrite{}
+	pendingRideWritesLock = sync.Mutex{}
+	rideFlushLock         = sync.Mutex{}
+)
+
+func init() {
+	registerReset(discardPendingRideWrites)
+
+	go func() {
+		ticker := time.NewTicker(rideFlushInterval)
+		for range ticker.C {
+			// init.shがテーブルを作り直している間に古いライドを書き戻さない
+			runBackgroundWork(func() {
+				if err := flushRides(context.Background()); err != nil {
+					slog.Error("failed to flush rides",
+						slog.String("error", err.Error()),
+					)
+				}
+			})
+		}
+	}()
+}
+
+// discardPendingRideWrites drops the writes not yet flushed, which belong to the data being initialized away.
+func discardPendingRideWrites() {
+	pendingRideWritesLock.Lock()
+	defer pendingRideWritesLock.Unlock()
+
+	pendingRideWrites = map[string]*pendingRideWrite{}
+}
+
+// writeRide schedules the current state of ride to be upserted into rides.
+// sales is only non-zero once the ride has been evaluated.
+func writeRide(ride *Ride, sales int) {
+	pendingRideWritesLock.Lock()
+	defer pendingRideWritesLock.Unlock()
+
+	w := &pendingRideWrite{
+		ride:  *ride,
+		sales: sales,
+	}
+	if sales != 0 {
+		if distance, _, ok := rideTravelled(ride.ID); ok {
+			w.travelledDistance = &distance
+		}
+	}
+	pendingRideWrites[ride.ID] = w
+}
+
+func flushRides(ctx context.Context) error {
+	rideFlushLock.Lock()
+	defer rideFlushLock.Unlock()
+
+	var writes map[string]*pendingRideWrite
+	func() {
+		pendingRideWritesLock.Lock()
+		defer pendingRideWritesLock.Unlock()
+
+		writes = pendingRideWrites
+		pendingRideWrites = map[string]*pendingRideWrite{}
+	}()
+
+	if len(writes) == 0 {
+		return nil
+	}
+
+	sb := &strings.Builder{}
+	sb.WriteString("INSERT INTO rides (id, user_id, chair_id, pickup_latitude, pickup_longitude, destination_latitude, destination_longitude, evaluation, sales, travelled_distance, created_at, updated_at) VALUES ")
+	args := make([]any, 0, len(writes)*12)
+	i := 0
+	for _, w := range writes {
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		sb.WriteString("(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)")
+		args = append(args,
+			w.ride.ID, w.ride.UserID, w.ride.ChairID, w.ride.PickupLatitude, w.ride.PickupLongitude,
+			w.ride.DestinationLatitude, w.ride.DestinationLongitude, w.ride.Evaluation, w.sales, w.travelledDistance,
+			w.ride.CreatedAt, w.ride.UpdatedAt,
+		)
+		i++
+	}
+	sb.WriteString(" ON DUPLICATE KEY UPDATE chair_id = VALUES(chair_id), evaluation = VALUES(evaluation), sales = VALUES(sales), travelled_distance = COALESCE(VALUES(travelled_distance), travelled_distance), updated_at = VALUES(updated_at)")
+
+	if _, err := db.ExecContext(ctx, sb.String(), args...); err != nil {
+		// 失敗した分は、より新しい書き込みが積まれていなければ戻して次回に回す
+		pendingRideWritesLock.Lock()
+		defer pendingRideWritesLock.Unlock()
+
+		for rideID, w := range writes {
+			if _, ok := pendingRideWrites[rideID]; !ok {
+				pendingRideWrites[rideID] = w
+			}
+		}
+
+		return fmt.Errorf("failed to upsert %d rides: %w", len(writes), err)
+	}
+
+	return nil
+}
+
+// writeEvaluatedRide writes the evaluation and sales of ride to rides right away and reports whether the ride was there.
+// 追記ではなくUPDATEなので、ridesから消えたライドを書き戻さない。
+func writeEvaluatedRide(ctx context.Context, ride *Ride, sales int) (bool, error) {
+	// 椅子の割り当てなど、先に積まれている書き込みを反映しておく
+	if err := flushRides(ctx); err != nil {
+		return false, err
+	}
+
+	var travelledDistance *int
+	if sales != 0 {
+		if distance, _, ok := rideTravelled(ride.ID); ok {
+			travelledDistance = &distance
+		}
+	}
+
+	res, err := db.ExecContext(ctx,
+		"UPDATE rides SET evaluation = ?, sales = ?, travelled_distance = COALESCE(?, travelled_distance), updated_at = ? WHERE id = ?",
+		ride.Evaluation, sales, travelledDistance, ride.UpdatedAt, ride.ID,
+	)
+	if err != nil {
+		return false, fmt.Errorf("failed to update evaluated ride: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to get affected rows: %w", err)
+	}
+
+	return n > 0, nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// インスタンスごとの役割
+// ISUCON_ROLES=web,notifier のように有効にする役割をカンマ区切りで並べ、同じバイナリを複数台に置いて役割を分ける。
+// 未指定ならすべての役割を持つ。
+//   - web: 通知以外のAPIを受ける
+//   - matcher: マッチングのtickerを動かす。webが無ければマッチング専用のサーバー(runMatcher)として動く
+//   - notifier: 通知(SSE)のストリームを返す
+//
+// 無効な役割のAPIに来たリクエストは421で返す。nginxでパスごとにupstreamを分けること。
+type roleSet uint8
+
+const (
+	roleBitWeb roleSet = 1 << iota
+	roleBitMatcher
+	roleBitNotifier
+
+	roleBitAll = roleBitWeb | roleBitMatcher | roleBitNotifier
+)
+
+var roleNames = []struct {
+	name string
+	bit  roleSet
+}{
+	{"web", roleBitWeb},
+	{"matcher", roleBitMatcher},
+	{"notifier", roleBitNotifier},
+}
+
+var instanceRoles = sync.OnceValue(func() roleSet {
+	s := os.Getenv("ISUCON_ROLES")
+	if s == "" {
+		return roleBitAll
+	}
+	roles, err := parseRoles(s)
+	if err != nil {
+		panic(err)
+	}
+	return roles
+})
+
+func parseRoles(s string) (roleSet, error) {
+	var roles roleSet
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		found := false
+		for _, r := range roleNames {
+			if r.name == name {
+				roles |= r.bit
+				found = true
+				break
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("invalid ISUCON_ROLES: unknown role %q", name)
+		}
+	}
+	return roles, nil
+}
+
+// has reports whether all roles in bits are enabled.
+func (roles roleSet) has(bits roleSet) bool {
+	return roles&bits == bits
+}
+
+func (roles roleSet) String() string {
+	names := make([]string, 0, len(roleNames))
+	for _, r := range roleNames {
+		if roles.has(r.bit) {
+			names = append(names, r.name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+func requireRole(bits roleSet) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !instanceRoles().has(bits) {
+				writeError(w, r, http.StatusMisdirectedRequest, errRoleDisabled)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import "testing"
+
+func TestParseRoles(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    roleSet
+		wantErr bool
+	}{
+		{in: "web", want: roleBitWeb},
+		{in: "web,notifier", want: roleBitWeb | roleBitNotifier},
+		{in: " matcher , web ", want: roleBitWeb | roleBitMatcher},
+		{in: "web,matcher,notifier", want: roleBitAll},
+		{in: "payment-worker", wantErr: true},
+		{in: "web,", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := parseRoles(tt.in)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseRoles(%q) = %s, want an error", tt.in, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("parseRoles(%q) = %s, want %s", tt.in, got, tt.want)
+			}
+		})
+	}
+}
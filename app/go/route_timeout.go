@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// リクエストごとのタイムアウト
+// 決済やDBが詰まったときにリクエストがいつまでも資源を握り続けないよう、r.Context()に期限を付ける。
+//   - ISUCON_REQUEST_TIMEOUT: デフォルトのタイムアウト。デフォルトは10s、0なら付けない
+//   - ISUCON_ROUTE_TIMEOUTS: ルートごとの上書き。"POST /api/app/rides=3s,GET /api/owner/sales=30s" のようにカンマ区切り
+//
+// SSEの通知(apiOperationsでstream: trueのもの)と/api/initializeには付けない。
+// 期限を過ぎたときのエラーはtoAppErrorで503になる。
+
+var (
+	defaultRouteTimeout = parseRouteTimeout("ISUCON_REQUEST_TIMEOUT", os.Getenv("ISUCON_REQUEST_TIMEOUT"), 10*time.Second)
+	routeTimeouts       = parseRouteTimeouts(os.Getenv("ISUCON_ROUTE_TIMEOUTS"))
+)
+
+func parseRouteTimeout(name string, s string, def time.Duration) time.Duration {
+	if s == "" {
+		return def
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		panic(fmt.Sprintf("invalid %s: %q", name, s))
+	}
+	return d
+}
+
+// parseRouteTimeouts parses "METHOD /path=duration" pairs keyed by the route as registered, e.g. "/api/app/rides/{ride_id}/evaluation".
+func parseRouteTimeouts(s string) map[string]time.Duration {
+	timeouts := map[string]time.Duration{}
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		route, d, ok := strings.Cut(entry, "=")
+		if !ok {
+			panic(fmt.Sprintf("invalid ISUCON_ROUTE_TIMEOUTS entry: %q", entry))
+		}
+		timeouts[strings.TrimSpace(route)] = parseRouteTimeout("ISUCON_ROUTE_TIMEOUTS", strings.TrimSpace(d), 0)
+	}
+	return timeouts
+}
+
+// routesWithoutTimeout are the routes that are expected to outlive any request timeout.
+func routesWithoutTimeout() map[string]struct{} {
+	routes := map[string]struct{}{
+		"POST /api/initialize": {},
+	}
+	for _, op := range apiOperations {
+		if op.stream {
+			routes[op.method+" "+op.path] = struct{}{}
+		}
+	}
+	return routes
+}
+
+// routeTimeoutMiddleware applies the timeout of the route that mux routes the request to.
+func routeTimeoutMiddleware(mux *chi.Mux) func(http.Handler) http.Handler {
+	excluded := routesWithoutTimeout()
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			route := r.Method + " " + r.URL.Path
+			rctx := chi.NewRouteContext()
+			if mux.Match(rctx, r.Method, r.URL.Path) {
+				route = r.Method + " " + rctx.RoutePattern()
+			}
+			if _, ok := excluded[route]; ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			timeout, ok := routeTimeouts[route]
+			if !ok {
+				timeout = defaultRouteTimeout
+			}
+			if timeout == 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			ctx, cancel := context.WithTimeout(r.Context(), timeout)
+			defer cancel()
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"log/slog"
+	"math"
+	"net/http"
+	"runtime/metrics"
+	"runtime/pprof"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	runtimeMetricGoroutines = "/sched/goroutines:goroutines"
+	runtimeMetricHeapInUse  = "/memory/classes/heap/objects:bytes"
+	runtimeMetricGCPauses   = "/sched/pauses/total/gc:seconds"
+)
+
+var gcPauseQuantiles = []float64{0.5, 0.9, 0.99, 1}
+
+func init() {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "isuride_goroutines",
+		Help: "number of live goroutines",
+	}, func() float64 {
+		return float64(readRuntimeMetric(runtimeMetricGoroutines).Uint64())
+	})
+
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "isuride_heap_inuse_bytes",
+		Help: "heap memory occupied by live and not yet swept objects",
+	}, func() float64 {
+		return float64(readRuntimeMetric(runtimeMetricHeapInUse).Uint64())
+	})
+
+	// GCの停止時間はプロセス開始からの累積のヒストグラムなので、そこからパーセンタイルを出す
+	for _, q := range gcPauseQuantiles {
+		promauto.NewGaugeFunc(prometheus.GaugeOpts{
+			Name:        "isuride_gc_pause_seconds",
+			Help:        "GC stop-the-world pause time percentiles since process start",
+			ConstLabels: prometheus.Labels{"quantile": strconv.FormatFloat(q, 'f', -1, 64)},
+		}, func() float64 {
+			return histogramQuantile(readRuntimeMetric(runtimeMetricGCPauses).Float64Histogram(), q)
+		})
+	}
+}
+
+func readRuntimeMetric(name string) metrics.Value {
+	sample := []metrics.Sample{{Name: name}}
+	metrics.Read(sample)
+	return sample[0].Value
+}
+
+// histogramQuantile returns the upper bound of the bucket containing the q-th quantile.
+func histogramQuantile(h *metrics.Float64Histogram, q float64) float64 {
+	var total uint64
+	for _, c := range h.Counts {
+		total += c
+	}
+	if total == 0 {
+		return 0
+	}
+
+	threshold := uint64(math.Ceil(float64(total) * q))
+	var cumulative uint64
+	for i, c := range h.Counts {
+		cumulative += c
+		if cumulative >= threshold {
+			upper := h.Buckets[i+1]
+			if math.IsInf(upper, 1) {
+				return h.Buckets[i]
+			}
+			return upper
+		}
+	}
+
+	return h.Buckets[len(h.Buckets)-1]
+}
+
+// 同じスタックのgoroutineをまとめて件数付きで出す(pprofのdebug=1形式)
+// イベントバスのchannelリークなどをpprofなしで確認するためのもの
+func (s *Server) internalGetDebugGoroutines(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	if err := pprof.Lookup("goroutine").WriteTo(w, 1); err != nil {
+		httpLogger.Error("failed to write goroutine profile",
+			slog.String("error", err.Error()),
+		)
+	}
+}
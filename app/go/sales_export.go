@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/bytedance/sonic"
+	"github.com/oklog/ulid/v2"
+)
+
+// オーナーの売上レポートをCSVかJSONで書き出してオブジェクトストレージに置き、署名付きURLを返す
+//
+//	POST /api/owner/sales/export?format=csv&since=...&until=...
+//
+// since/untilは/api/owner/salesと同じ。オブジェクトストレージの設定はs3.goを参照。
+const salesExportURLExpires = 15 * time.Minute
+
+var salesExportStorage = newS3ClientFromEnv()
+
+type ownerPostSalesExportResponse struct {
+	URL       string `json:"url"`
+	ExpiresAt int64  `json:"expires_at"`
+}
+
+// renderSalesReport renders sales as csv or json and returns the body and its content type.
+func renderSalesReport(format string, sales *ownerGetSalesResponse) ([]byte, string, error) {
+	switch format {
+	case "json":
+		b, err := sonic.ConfigFastest.Marshal(sales)
+		return b, "application/json", err
+	case "csv":
+		buf := &bytes.Buffer{}
+		cw := csv.NewWriter(buf)
+		cw.Write([]string{"kind", "id", "name", "sales"})
+		for _, chair := range sales.Chairs {
+			cw.Write([]string{"chair", chair.ID, chair.Name, strconv.Itoa(chair.Sales)})
+		}
+		for _, model := range sales.Models {
+			cw.Write([]string{"model", "", model.Model, strconv.Itoa(model.Sales)})
+		}
+		cw.Write([]string{"total", "", "", strconv.Itoa(sales.TotalSales)})
+		cw.Flush()
+		return buf.Bytes(), "text/csv; charset=utf-8", cw.Error()
+	}
+
+	return nil, "", fmt.Errorf("unknown sales report format: %s", format)
+}
+
+func (s *Server) ownerPostSalesExport(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+
+	if salesExportStorage == nil {
+		writeError(w, r, http.StatusServiceUnavailable, newAppError(http.StatusServiceUnavailable, "export_unavailable", "object storage is not configured"))
+		return
+	}
+
+	since, until, err := parseSalesRange(r)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "csv"
+	}
+	if format != "csv" && format != "json" {
+		writeError(w, r, http.StatusBadRequest, badRequest("format must be csv or json"))
+		return
+	}
+
+	sales, err := calculateOwnerSales(ctx, s.db, owner.ID, since, until)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	body, contentType, err := renderSalesReport(format, sales)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	key := "sales/" + owner.ID + "/" + ulid.Make().String() + "." + format
+	if err := salesExportStorage.PutObject(ctx, key, contentType, body); err != nil {
+		writeError(w, r, http.StatusBadGateway, err)
+		return
+	}
+
+	url, err := salesExportStorage.PresignGetObject(ctx, key, salesExportURLExpires)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, &ownerPostSalesExportResponse{
+		URL:       url,
+		ExpiresAt: s.clock.Now().Add(salesExportURLExpires).UnixMilli(),
+	})
+}
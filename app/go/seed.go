@@ -0,0 +1,175 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"slices"
+
+	"github.com/oklog/ulid/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// ローカルでのベンチマーク用に、本番の初期データに近い量のデータを生成して投入する
+//
+//	./isuride seed -owners 100 -chairs 1000 -users 2000 -rides 10000
+//	./isuride seed -o seed.yaml   # 投入せずにfixturesの形式で書き出す
+//
+// 生成したデータはfixturesと同じ/api/internal/fixturesで投入するので、MySQLと動いているサーバーのキャッシュの両方に入る。
+// 椅子のモデルはchairModelSpeedCacheのモデルから均等に選ぶ。過去のライドはすべて評価済みのCOMPLETEDで、
+// ユーザーには登録時と同じCP_NEW2024を付け、ライドのあるユーザーは最初のライドで使ったことにする。
+// -seedが同じなら同じデータになる(IDとトークンを除く)。
+
+var (
+	seedFirstnames = []string{"太郎", "花子", "一郎", "さくら", "健太", "美咲", "翔", "陽菜"}
+	seedLastnames  = []string{"佐藤", "鈴木", "高橋", "田中", "伊藤", "渡辺", "山本", "中村"}
+)
+
+type seedOptions struct {
+	owners  int
+	chairs  int
+	users   int
+	rides   int
+	coupons int
+}
+
+func runSeed(args []string) {
+	fs := flag.NewFlagSet("seed", flag.ExitOnError)
+	target := fs.String("target", "http://localhost:8080", "target base URL")
+	out := fs.String("o", "", "write the fixtures to this file (- for stdout) instead of loading them")
+	seed := fs.Uint64("seed", 1, "random seed")
+	opts := seedOptions{}
+	fs.IntVar(&opts.owners, "owners", 10, "number of owners")
+	fs.IntVar(&opts.chairs, "chairs", 100, "number of chairs")
+	fs.IntVar(&opts.users, "users", 200, "number of users")
+	fs.IntVar(&opts.rides, "rides", 1000, "number of completed rides")
+	fs.IntVar(&opts.coupons, "coupons", 100, "number of campaign coupons besides CP_NEW2024")
+	fs.Parse(args)
+
+	if opts.owners <= 0 && opts.chairs > 0 || (opts.users <= 0 || opts.chairs <= 0) && opts.rides > 0 || opts.users <= 0 && opts.coupons > 0 {
+		exitOnError(fmt.Errorf("chairs need owners, rides need users and chairs, coupons need users"))
+	}
+
+	fixtures := generateSeed(rand.New(rand.NewPCG(*seed, *seed)), opts)
+	b, err := yaml.Marshal(fixtures)
+	exitOnError(err)
+
+	switch *out {
+	case "":
+	case "-":
+		os.Stdout.Write(b)
+		return
+	default:
+		exitOnError(os.WriteFile(*out, b, 0644))
+		return
+	}
+
+	res, err := postFixtures(*target, b)
+	exitOnError(err)
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode >= http.StatusBadRequest {
+		exitOnError(fmt.Errorf("failed to load seed: %d: %s", res.StatusCode, body))
+	}
+
+	printJSON(map[string]int{
+		"owners":  len(fixtures.Owners),
+		"chairs":  len(fixtures.Chairs),
+		"users":   len(fixtures.Users),
+		"rides":   len(fixtures.Rides),
+		"coupons": len(fixtures.Coupons),
+	})
+}
+
+func generateSeed(r *rand.Rand, opts seedOptions) *fixtureSet {
+	fixtures := &fixtureSet{}
+
+	for i := range opts.owners {
+		fixtures.Owners = append(fixtures.Owners, fixtureOwner{
+			ID:   ulid.Make().String(),
+			Name: fmt.Sprintf("seed-owner-%d", i),
+		})
+	}
+
+	// mapの順序に左右されないように並べてから選ぶ
+	models := make([]string, 0, len(chairModelSpeedCache))
+	for model := range chairModelSpeedCache {
+		models = append(models, model)
+	}
+	slices.Sort(models)
+	for i := range opts.chairs {
+		location := seedCoordinate(r)
+		fixtures.Chairs = append(fixtures.Chairs, fixtureChair{
+			ID:       ulid.Make().String(),
+			OwnerID:  fixtures.Owners[i%len(fixtures.Owners)].ID,
+			Name:     fmt.Sprintf("seed-chair-%d", i),
+			Model:    models[r.IntN(len(models))],
+			IsActive: r.IntN(10) < 8,
+			Location: &location,
+		})
+	}
+
+	for i := range opts.users {
+		fixtures.Users = append(fixtures.Users, fixtureUser{
+			ID:           ulid.Make().String(),
+			Username:     fmt.Sprintf("seed-user-%d", i),
+			Firstname:    seedFirstnames[r.IntN(len(seedFirstnames))],
+			Lastname:     seedLastnames[r.IntN(len(seedLastnames))],
+			DateOfBirth:  fmt.Sprintf("%d-%02d-%02d", 1950+r.IntN(56), 1+r.IntN(12), 1+r.IntN(28)),
+			PaymentToken: secureRandomStr(16),
+		})
+	}
+
+	// user ID -> 最初のライド
+	firstRides := map[string]string{}
+	for range opts.rides {
+		user := fixtures.Users[r.IntN(len(fixtures.Users))]
+		chair := fixtures.Chairs[r.IntN(len(fixtures.Chairs))]
+		evaluation := 1 + r.IntN(5)
+		ride := fixtureRide{
+			ID:          ulid.Make().String(),
+			UserID:      user.ID,
+			ChairID:     chair.ID,
+			Pickup:      seedCoordinate(r),
+			Destination: seedCoordinate(r),
+			Status:      "COMPLETED",
+			Evaluation:  &evaluation,
+		}
+		fixtures.Rides = append(fixtures.Rides, ride)
+		if _, ok := firstRides[user.ID]; !ok {
+			firstRides[user.ID] = ride.ID
+		}
+	}
+
+	for _, user := range fixtures.Users {
+		coupon := fixtureCoupon{UserID: user.ID, Code: "CP_NEW2024", Discount: defaultCampaign.NewUserDiscount}
+		if rideID, ok := firstRides[user.ID]; ok {
+			coupon.UsedBy = &rideID
+		}
+		fixtures.Coupons = append(fixtures.Coupons, coupon)
+	}
+	for i := range opts.coupons {
+		fixtures.Coupons = append(fixtures.Coupons, fixtureCoupon{
+			UserID:   fixtures.Users[r.IntN(len(fixtures.Users))].ID,
+			Code:     fmt.Sprintf("SEED_%d", i),
+			Discount: 500 * (1 + r.IntN(10)),
+		})
+	}
+
+	return fixtures
+}
+
+// seedCoordinate returns a coordinate around one of the two towns of the initial data.
+func seedCoordinate(r *rand.Rand) Coordinate {
+	center := 0
+	if r.IntN(2) == 1 {
+		center = 300
+	}
+	return Coordinate{
+		Latitude:  center + r.IntN(200) - 100,
+		Longitude: center + r.IntN(200) - 100,
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"github.com/jmoiron/sqlx"
+)
+
+// Server holds the dependencies of the HTTP handlers.
+// パッケージ変数のdb, キャッシュ, イベントバスはキャッシュのローダーやマッチングなどハンドラー以外のために残してあり、
+// setupで作るServerと同じものを指す。badgerDBは/api/initializeで開き直すのでパッケージ変数のまま使う。
+type Server struct {
+	db            *sqlx.DB
+	events        *eventBus
+	rides         *sharedAtomicMap[Ride]
+	rideStatuses  *sharedAtomicMap[RideStatus]
+	paymentTokens *sharedAtomicMap[PaymentToken]
+	clock         Clock
+
+	rideRepository   RideRepository
+	chairRepository  ChairRepository
+	couponRepository CouponRepository
+}
+
+func newServer(db *sqlx.DB) *Server {
+	return &Server{
+		db:            db,
+		events:        defaultEventBus,
+		rides:         rideCache,
+		rideStatuses:  rideStatusesCache,
+		paymentTokens: paymentTokenCache,
+		clock:         clock,
+
+		rideRepository:   cachedRideRepository{},
+		chairRepository:  mysqlChairRepository{db: db},
+		couponRepository: newMySQLCouponRepository(db),
+	}
+}
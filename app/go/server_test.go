@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/dgraph-io/badger"
+)
+
+// newTestServer returns a Server backed by the in-memory repositories.
+// キャッシュはパッケージ変数なので、テストの終わりに初期化と同じようにまとめて捨てる。
+func newTestServer(t *testing.T, chairs []*Chair, coupons []Coupon) *Server {
+	t.Helper()
+	t.Cleanup(resetAll)
+
+	s := newServer(nil)
+	s.rideRepository = newMemRideRepository()
+	s.chairRepository = newMemChairRepository(chairs...)
+	s.couponRepository = newMemCouponRepository(coupons...)
+	return s
+}
+
+func withUser(r *http.Request, user *User) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), "user", user))
+}
+
+func decodeResponse[T any](t *testing.T, rec *httptest.ResponseRecorder) T {
+	t.Helper()
+
+	var v T
+	if err := json.Unmarshal(rec.Body.Bytes(), &v); err != nil {
+		t.Fatalf("failed to decode response %q: %v", rec.Body.String(), err)
+	}
+	return v
+}
+
+// openTestBadger opens badgerDB in a temporary directory for the test.
+// 監査ログの書き込みなどバックグラウンドの処理も読むので、postInitializeと同じく止めてから差し替える。
+func openTestBadger(t testing.TB) {
+	t.Helper()
+
+	bdb, err := badger.Open(badger.DefaultOptions(t.TempDir()).WithLogger(nil))
+	if err != nil {
+		t.Fatalf("failed to open badger: %v", err)
+	}
+	resume := pauseBackgroundWork()
+	original := badgerDB
+	badgerDB = bdb
+	resume()
+	t.Cleanup(func() {
+		resume := pauseBackgroundWork()
+		badgerDB = original
+		resume()
+		bdb.Close()
+	})
+}
+
+// badgerKeys returns every key in badgerDB.
+func badgerKeys(t *testing.T) []string {
+	t.Helper()
+
+	var keys []string
+	err := badgerDB.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			keys = append(keys, string(it.Item().KeyCopy(nil)))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to read badger: %v", err)
+	}
+	return keys
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bytedance/sonic"
+	isucache "github.com/mazrean/isucon-go-tools/v2/cache"
+	"github.com/oklog/ulid/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// 複数台構成のためのRedis共有キャッシュ
+//   - ISUCON_REDIS_ADDR: Redisのアドレス。未指定なら全キャッシュがプロセスローカルのまま
+//   - ISUCON_REDIS_SHARED_CACHES: 共有するキャッシュ名のカンマ区切り。例: "rideCache,paymentTokenCache"
+//
+// 書き込みはローカルとRedisの両方に行い(write-through)、他のインスタンスには無効化を通知する。
+// 無効化を受けたインスタンスは次のLoadでRedisから読み直す。
+const sharedCacheInvalidationChannel = "isuride:invalidate"
+
+var (
+	sharedCacheRedis  = newRedisClientFromEnv()
+	sharedCacheNames  = parseSharedCacheNames(os.Getenv("ISUCON_REDIS_SHARED_CACHES"))
+	sharedCacheSender = ulid.Make().String()
+
+	sharedCaches     = map[string]sharedCacheInvalidator{}
+	sharedCachesLock = sync.RWMutex{}
+)
+
+func init() {
+	if sharedCacheRedis == nil {
+		return
+	}
+
+	// 切れたらgo-redisが購読し直す
+	pubsub := sharedCacheRedis.Subscribe(context.Background(), sharedCacheInvalidationChannel)
+	go func() {
+		for msg := range pubsub.Channel() {
+			handleSharedCacheInvalidation(msg.Payload)
+		}
+	}()
+}
+
+func newRedisClientFromEnv() *redis.Client {
+	addr := os.Getenv("ISUCON_REDIS_ADDR")
+	if addr == "" {
+		return nil
+	}
+	return redis.NewClient(&redis.Options{
+		Addr:        addr,
+		DialTimeout: time.Second,
+	})
+}
+
+func handleSharedCacheInvalidation(message string) {
+	sender, rest, _ := strings.Cut(message, "\n")
+	if sender == sharedCacheSender {
+		return
+	}
+	name, key, _ := strings.Cut(rest, "\n")
+
+	sharedCachesLock.RLock()
+	cache, ok := sharedCaches[name]
+	sharedCachesLock.RUnlock()
+	if !ok {
+		return
+	}
+
+	if key == "" {
+		cache.purgeLocal()
+	} else {
+		cache.forgetLocal(key)
+	}
+}
+
+func parseSharedCacheNames(s string) map[string]struct{} {
+	names := map[string]struct{}{}
+	for _, name := range strings.Split(s, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names[name] = struct{}{}
+		}
+	}
+	return names
+}
+
+type sharedCacheInvalidator interface {
+	forgetLocal(key string)
+	purgeLocal()
+	storeLocalJSON(key string, value string)
+}
+
+// sharedAtomicMap has the same API as isucache.AtomicMap and is only backed by Redis when enabled by config.
+// ISUCON_PEERSが設定されているときは、書き込んだ値をgRPCで他インスタンスにも複製する。
+type sharedAtomicMap[T any] struct {
+	*isucache.AtomicMap[string, *T, T]
+	name       string
+	shared     bool
+	replicated bool
+}
+
+func newSharedAtomicMap[T any](name string) *sharedAtomicMap[T] {
+	m := &sharedAtomicMap[T]{
+		AtomicMap: isucache.NewAtomicMap[string, *T](name),
+		name:      name,
+	}
+
+	if _, ok := sharedCacheNames[name]; ok && sharedCacheRedis != nil {
+		m.shared = true
+	}
+	m.replicated = len(peerAddrs) > 0
+
+	if m.shared || m.replicated {
+		sharedCachesLock.Lock()
+		sharedCaches[name] = m
+		sharedCachesLock.Unlock()
+	}
+
+	return m
+}
+
+func (m *sharedAtomicMap[T]) redisKey(key string) string {
+	return "isuride:" + m.name + ":" + key
+}
+
+func (m *sharedAtomicMap[T]) Load(key string) (*T, bool) {
+	if v, ok := m.AtomicMap.Load(key); ok || !m.shared {
+		return v, ok
+	}
+
+	v, ok := m.loadRemote(key)
+	if !ok {
+		return nil, false
+	}
+	v, _ = m.AtomicMap.LoadOrStore(key, v)
+
+	return v, true
+}
+
+func (m *sharedAtomicMap[T]) Store(key string, value *T) {
+	m.AtomicMap.Store(key, value)
+	if m.shared {
+		m.storeRemote(key, value)
+	}
+	if m.replicated {
+		m.replicate(key, value)
+	}
+}
+
+func (m *sharedAtomicMap[T]) LoadOrStore(key string, value *T) (*T, bool) {
+	if !m.shared {
+		v, loaded := m.AtomicMap.LoadOrStore(key, value)
+		if !loaded && m.replicated {
+			m.replicate(key, v)
+		}
+		return v, loaded
+	}
+
+	if v, ok := m.Load(key); ok {
+		return v, true
+	}
+
+	v, loaded := m.AtomicMap.LoadOrStore(key, value)
+	if !loaded {
+		b, err := sonic.Marshal(value)
+		if err != nil {
+			m.logError("marshal", key, err)
+			return v, false
+		}
+		if err := sharedCacheRedis.SetNX(context.Background(), m.redisKey(key), b, 0).Err(); err != nil {
+			m.logError("set", key, err)
+		}
+		if m.replicated {
+			m.replicate(key, v)
+		}
+	}
+
+	return v, loaded
+}
+
+func (m *sharedAtomicMap[T]) Update(key string, f func(*T) (*T, bool)) {
+	if !m.shared && !m.replicated {
+		m.AtomicMap.Update(key, f)
+		return
+	}
+
+	// ローカルに無ければRedisから持ってきてから更新する
+	if m.shared {
+		m.Load(key)
+	}
+
+	var (
+		updated *T
+		ok      bool
+	)
+	m.AtomicMap.Update(key, func(v *T) (*T, bool) {
+		updated, ok = f(v)
+		return updated, ok
+	})
+	if !ok {
+		return
+	}
+	if m.shared {
+		m.storeRemote(key, updated)
+	}
+	if m.replicated {
+		m.replicate(key, updated)
+	}
+}
+
+func (m *sharedAtomicMap[T]) Purge() {
+	m.AtomicMap.Purge()
+	if m.shared {
+		// Redisに残すと、次のLoadで初期化前の値を読み直してしまう
+		m.purgeRemote()
+		m.publishInvalidation("")
+	}
+}
+
+func (m *sharedAtomicMap[T]) forgetLocal(key string) {
+	m.AtomicMap.Forget(key)
+}
+
+func (m *sharedAtomicMap[T]) purgeLocal() {
+	m.AtomicMap.Purge()
+}
+
+func (m *sharedAtomicMap[T]) storeLocalJSON(key string, value string) {
+	v := new(T)
+	if err := sonic.UnmarshalString(value, v); err != nil {
+		m.logError("unmarshal", key, err)
+		return
+	}
+
+	m.AtomicMap.Store(key, v)
+}
+
+func (m *sharedAtomicMap[T]) replicate(key string, value *T) {
+	b, err := sonic.Marshal(value)
+	if err != nil {
+		m.logError("marshal", key, err)
+		return
+	}
+
+	broadcastCacheUpdate(m.name, key, string(b))
+}
+
+func (m *sharedAtomicMap[T]) loadRemote(key string) (*T, bool) {
+	b, err := sharedCacheRedis.Get(context.Background(), m.redisKey(key)).Bytes()
+	if err != nil {
+		if !errors.Is(err, redis.Nil) {
+			m.logError("get", key, err)
+		}
+		return nil, false
+	}
+
+	v := new(T)
+	if err := sonic.Unmarshal(b, v); err != nil {
+		m.logError("unmarshal", key, err)
+		return nil, false
+	}
+
+	return v, true
+}
+
+func (m *sharedAtomicMap[T]) storeRemote(key string, value *T) {
+	b, err := sonic.Marshal(value)
+	if err != nil {
+		m.logError("marshal", key, err)
+		return
+	}
+
+	if err := sharedCacheRedis.Set(context.Background(), m.redisKey(key), b, 0).Err(); err != nil {
+		m.logError("set", key, err)
+		return
+	}
+	m.publishInvalidation(key)
+}
+
+const sharedCachePurgeBatchSize = 1000
+
+// purgeRemote deletes every key of the cache from Redis.
+func (m *sharedAtomicMap[T]) purgeRemote() {
+	ctx := context.Background()
+
+	keys := make([]string, 0, sharedCachePurgeBatchSize)
+	unlink := func() {
+		if len(keys) == 0 {
+			return
+		}
+		if err := sharedCacheRedis.Unlink(ctx, keys...).Err(); err != nil {
+			m.logError("unlink", "", err)
+		}
+		keys = keys[:0]
+	}
+
+	iter := sharedCacheRedis.Scan(ctx, 0, m.redisKey("*"), sharedCachePurgeBatchSize).Iterator()
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+		if len(keys) == sharedCachePurgeBatchSize {
+			unlink()
+		}
+	}
+	if err := iter.Err(); err != nil {
+		m.logError("scan", "", err)
+	}
+	unlink()
+}
+
+func (m *sharedAtomicMap[T]) publishInvalidation(key string) {
+	if err := sharedCacheRedis.Publish(context.Background(), sharedCacheInvalidationChannel, sharedCacheSender+"\n"+m.name+"\n"+key).Err(); err != nil {
+		m.logError("publish", key, err)
+	}
+}
+
+func (m *sharedAtomicMap[T]) logError(op string, key string, err error) {
+	slog.Error("shared cache operation failed",
+		slog.String("cache", m.name),
+		slog.String("op", op),
+		slog.String("key", key),
+		slog.String("error", err.Error()),
+	)
+}
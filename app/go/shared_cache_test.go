@@ -0,0 +1,120 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	isucache "github.com/mazrean/isucon-go-tools/v2/cache"
+	"github.com/redis/go-redis/v9"
+)
+
+// useTestRedis points the shared caches at an in-memory Redis for the test.
+func useTestRedis(t *testing.T) {
+	t.Helper()
+
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	original := sharedCacheRedis
+	sharedCacheRedis = client
+	t.Cleanup(func() {
+		sharedCacheRedis = original
+		client.Close()
+	})
+}
+
+// ローカルのマップはメトリクスを名前で登録するので、テストごとには作れない
+var testSharedCacheLocals = []*isucache.AtomicMap[string, *PaymentToken, PaymentToken]{
+	isucache.NewAtomicMap[string, *PaymentToken]("testSharedCacheA"),
+	isucache.NewAtomicMap[string, *PaymentToken]("testSharedCacheB"),
+}
+
+var testSharedCacheOtherLocal = isucache.NewAtomicMap[string, *PaymentToken]("testSharedCacheOther")
+
+// newTestSharedAtomicMap returns a shared cache as another instance would have it: same name, own local map.
+func newTestSharedAtomicMap(t *testing.T, name string, local *isucache.AtomicMap[string, *PaymentToken, PaymentToken]) *sharedAtomicMap[PaymentToken] {
+	t.Helper()
+
+	m := &sharedAtomicMap[PaymentToken]{
+		AtomicMap: local,
+		name:      name,
+		shared:    true,
+	}
+	sharedCachesLock.Lock()
+	sharedCaches[name] = m
+	sharedCachesLock.Unlock()
+	t.Cleanup(func() {
+		sharedCachesLock.Lock()
+		delete(sharedCaches, name)
+		sharedCachesLock.Unlock()
+		local.Purge()
+	})
+	return m
+}
+
+func TestSharedAtomicMap(t *testing.T) {
+	useTestRedis(t)
+	name := "testSharedCache"
+	a := newTestSharedAtomicMap(t, name, testSharedCacheLocals[0])
+	b := newTestSharedAtomicMap(t, name, testSharedCacheLocals[1])
+
+	// 書き込みはRedisにも入り、他のインスタンスはローカルに無ければRedisから読む
+	a.Store("user", &PaymentToken{UserID: "user", Token: "first"})
+	if v, ok := b.Load("user"); !ok || v.Token != "first" {
+		t.Fatalf("Load from another instance = %+v, %v, want token first", v, ok)
+	}
+
+	// 他のインスタンスからの無効化でローカルの値を捨て、次のLoadで読み直す
+	a.Store("user", &PaymentToken{UserID: "user", Token: "second"})
+	if v, _ := b.Load("user"); v.Token != "first" {
+		t.Fatalf("Load before invalidation = %+v, want the local token first", v)
+	}
+	handleSharedCacheInvalidation("other-instance\n" + name + "\nuser")
+	if v, ok := b.Load("user"); !ok || v.Token != "second" {
+		t.Errorf("Load after invalidation = %+v, %v, want token second", v, ok)
+	}
+
+	// 自分が送った無効化は無視する
+	b.AtomicMap.Store("user", &PaymentToken{UserID: "user", Token: "local"})
+	handleSharedCacheInvalidation(sharedCacheSender + "\n" + name + "\nuser")
+	if v, _ := b.Load("user"); v.Token != "local" {
+		t.Errorf("Load after own invalidation = %+v, want the local token", v)
+	}
+
+	// LoadOrStoreはRedisに既にある値を優先する
+	if v, loaded := b.LoadOrStore("other", &PaymentToken{UserID: "other", Token: "b"}); loaded || v.Token != "b" {
+		t.Fatalf("LoadOrStore of a new key = %+v, %v, want token b stored", v, loaded)
+	}
+	if v, loaded := a.LoadOrStore("other", &PaymentToken{UserID: "other", Token: "a"}); !loaded || v.Token != "b" {
+		t.Errorf("LoadOrStore of a stored key = %+v, %v, want token b loaded", v, loaded)
+	}
+
+	if v, ok := a.Load("missing"); ok {
+		t.Errorf("Load of a missing key = %+v, want nothing", v)
+	}
+}
+
+func TestSharedAtomicMapPurge(t *testing.T) {
+	useTestRedis(t)
+	name := "testSharedCache"
+	a := newTestSharedAtomicMap(t, name, testSharedCacheLocals[0])
+	b := newTestSharedAtomicMap(t, name, testSharedCacheLocals[1])
+	other := newTestSharedAtomicMap(t, name+"Other", testSharedCacheOtherLocal)
+
+	a.Store("user", &PaymentToken{UserID: "user", Token: "before"})
+	other.Store("user", &PaymentToken{UserID: "user", Token: "other"})
+
+	// 初期化のあとは、どのインスタンスもRedisから初期化前の値を読み直さない
+	a.Purge()
+	if v, ok := a.Load("user"); ok {
+		t.Errorf("Load after Purge = %+v, want nothing", v)
+	}
+	if v, ok := b.Load("user"); ok {
+		t.Errorf("Load from another instance after Purge = %+v, want nothing", v)
+	}
+
+	// 名前の違うキャッシュのキーは消さない
+	other.AtomicMap.Purge()
+	if v, ok := other.Load("user"); !ok || v.Token != "other" {
+		t.Errorf("Load of another cache = %+v, %v, want token other", v, ok)
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"log/slog"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// ISUCON_SLOW_QUERY_MSを超えたクエリをログに出す。0なら無効
+var slowQueryThreshold = parseSlowQueryThreshold(os.Getenv("ISUCON_SLOW_QUERY_MS"))
+
+const slowQueryMaxLength = 256
+
+func parseSlowQueryThreshold(s string) time.Duration {
+	if s == "" {
+		return 100 * time.Millisecond
+	}
+	ms, err := strconv.Atoi(s)
+	if err != nil || ms < 0 {
+		return 100 * time.Millisecond
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+// slowQueryConnect wraps the driver opened by connect so every Exec/Query is timed.
+// isudb passes its own metrics driver here, so the measured time includes it.
+func slowQueryConnect(connect func(string, string) (*sqlx.DB, error)) func(string, string) (*sqlx.DB, error) {
+	return func(driverName, dataSourceName string) (*sqlx.DB, error) {
+		db, err := connect(driverName, dataSourceName)
+		if err != nil || slowQueryThreshold == 0 {
+			return db, err
+		}
+
+		connector, err := newSlowQueryConnector(db.Driver(), dataSourceName)
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+		db.Close()
+
+		return sqlx.NewDb(sql.OpenDB(connector), driverName), nil
+	}
+}
+
+func logSlowQuery(ctx context.Context, start time.Time, query string, args []driver.NamedValue, err error) {
+	elapsed := time.Since(start)
+	if elapsed < slowQueryThreshold {
+		return
+	}
+
+	if len(query) > slowQueryMaxLength {
+		query = query[:slowQueryMaxLength] + "..."
+	}
+	attrs := []slog.Attr{
+		slog.String("query", query),
+		// 引数には個人情報やトークンが含まれるので数だけ出す
+		slog.Int("args", len(args)),
+		slog.Duration("elapsed", elapsed),
+	}
+	if err != nil {
+		attrs = append(attrs, slog.String("error", err.Error()))
+	}
+	dbLogger.LogAttrs(ctx, slog.LevelWarn, "slow query", attrs...)
+}
+
+type slowQueryConnector struct {
+	connector driver.Connector
+	driver    driver.Driver
+	dsn       string
+}
+
+func newSlowQueryConnector(d driver.Driver, dsn string) (*slowQueryConnector, error) {
+	c := &slowQueryConnector{driver: d, dsn: dsn}
+	if dc, ok := d.(driver.DriverContext); ok {
+		connector, err := dc.OpenConnector(dsn)
+		if err != nil {
+			return nil, err
+		}
+		c.connector = connector
+	}
+	return c, nil
+}
+
+func (c *slowQueryConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	var (
+		conn driver.Conn
+		err  error
+	)
+	if c.connector != nil {
+		conn, err = c.connector.Connect(ctx)
+	} else {
+		conn, err = c.driver.Open(c.dsn)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &slowQueryConn{Conn: conn}, nil
+}
+
+func (c *slowQueryConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+type slowQueryConn struct {
+	driver.Conn
+}
+
+func (c *slowQueryConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	execer, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+
+	start := time.Now()
+	res, err := execer.ExecContext(ctx, query, args)
+	if err != driver.ErrSkip {
+		logSlowQuery(ctx, start, query, args, err)
+	}
+	return res, err
+}
+
+func (c *slowQueryConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	queryer, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+
+	start := time.Now()
+	rows, err := queryer.QueryContext(ctx, query, args)
+	if err != driver.ErrSkip {
+		logSlowQuery(ctx, start, query, args, err)
+	}
+	return rows, err
+}
+
+func (c *slowQueryConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	if preparer, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		return preparer.PrepareContext(ctx, query)
+	}
+	return c.Conn.Prepare(query)
+}
+
+func (c *slowQueryConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if beginner, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return beginner.BeginTx(ctx, opts)
+	}
+	return c.Conn.Begin()
+}
+
+func (c *slowQueryConn) ResetSession(ctx context.Context) error {
+	if resetter, ok := c.Conn.(driver.SessionResetter); ok {
+		return resetter.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c *slowQueryConn) IsValid() bool {
+	if validator, ok := c.Conn.(driver.Validator); ok {
+		return validator.IsValid()
+	}
+	return true
+}
+
+func (c *slowQueryConn) CheckNamedValue(nv *driver.NamedValue) error {
+	if checker, ok := c.Conn.(driver.NamedValueChecker); ok {
+		return checker.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
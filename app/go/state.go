@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/dgraph-io/badger"
+)
+
+// 再起動をまたいでオンメモリの状態を引き継ぐためのダンプ/リストア
+// 起動時の初期化はMySQLとbadgerから組み立て直すが、マッチング待ちのキューやライドの最新状態は復元できないので、
+// 再起動前にexportした内容を起動後にimportする。
+//
+//	curl -s localhost:8080/api/internal/state/export > state.json
+//	curl -s -XPOST --data-binary @state.json localhost:8080/api/internal/state/import
+type volatileState struct {
+	Rides           []*Ride           `json:"rides"`
+	RideStatuses    []*RideStatus     `json:"ride_statuses"`
+	LatestRideIDs   map[string]string `json:"latest_ride_ids"`
+	MatchingRideIDs []string          `json:"matching_ride_ids"`
+	EmptyChairIDs   []string          `json:"empty_chair_ids"`
+	UserStatuses    map[string]bool   `json:"user_statuses"`
+	BenchStartedAt  time.Time         `json:"bench_started_at"`
+}
+
+func (s *Server) internalGetStateExport(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	// 書き込み待ちを先に反映して、MySQLとダンプの内容を揃えておく
+	if err := waitRideStatusQueue(ctx); err != nil {
+		writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	if err := flushRides(ctx); err != nil {
+		writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	state := &volatileState{
+		LatestRideIDs:  map[string]string{},
+		UserStatuses:   map[string]bool{},
+		BenchStartedAt: benchStartedAt,
+	}
+
+	s.rides.Range(func(_ string, ride *Ride) bool {
+		state.Rides = append(state.Rides, ride)
+		return true
+	})
+	s.rideStatuses.Range(func(_ string, rideStatus *RideStatus) bool {
+		state.RideStatuses = append(state.RideStatuses, rideStatus)
+		return true
+	})
+	latestRideCache.Range(func(chairID string, ride *Ride) bool {
+		state.LatestRideIDs[chairID] = ride.ID
+		return true
+	})
+
+	func() {
+		matchingRidesLock.RLock()
+		defer matchingRidesLock.RUnlock()
+
+		for _, ride := range matchingRides {
+			state.MatchingRideIDs = append(state.MatchingRideIDs, ride.ID)
+		}
+	}()
+	func() {
+		emptyChairsLocker.RLock()
+		defer emptyChairsLocker.RUnlock()
+
+		for _, chair := range emptyChairs {
+			state.EmptyChairIDs = append(state.EmptyChairIDs, chair.ID)
+		}
+	}()
+
+	err := badgerDB.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte("user")
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			userID := string(item.Key()[len("user"):])
+
+			err := item.Value(func(v []byte) error {
+				state.UserStatuses[userID] = len(v) > 0 && v[0] == 1
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, fmt.Errorf("failed to read user statuses: %w", err))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, state)
+}
+
+func (s *Server) internalPostStateImport(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	state := &volatileState{}
+	if err := bindJSON(r, state); err != nil {
+		writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	for _, ride := range state.Rides {
+		storeRide(ride)
+	}
+	for _, rideStatus := range state.RideStatuses {
+		s.rideStatuses.Store(rideStatus.RideID, rideStatus)
+	}
+	for chairID, rideID := range state.LatestRideIDs {
+		if ride, ok := s.rides.Load(rideID); ok {
+			latestRideCache.Store(chairID, ride)
+		}
+	}
+	if err := initChairAvailability(); err != nil {
+		writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	rides := make([]*Ride, 0, len(state.MatchingRideIDs))
+	for _, rideID := range state.MatchingRideIDs {
+		ride, ok := s.rides.Load(rideID)
+		if !ok {
+			writeError(w, r, http.StatusBadRequest, badRequest("unknown matching ride: "+rideID))
+			return
+		}
+		rides = append(rides, ride)
+	}
+	chairs := make([]*Chair, 0, len(state.EmptyChairIDs))
+	for _, chairID := range state.EmptyChairIDs {
+		chair, err := getChairByID(ctx, chairID)
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		chairs = append(chairs, chair)
+	}
+	func() {
+		matchingRidesLock.Lock()
+		defer matchingRidesLock.Unlock()
+
+		matchingRides = rides
+	}()
+	func() {
+		emptyChairsLocker.Lock()
+		defer emptyChairsLocker.Unlock()
+
+		emptyChairs = chairs
+	}()
+
+	for userID, status := range state.UserStatuses {
+		if err := updateUserStatusToBadger(userID, status); err != nil {
+			writeError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	benchStartedAt = state.BenchStartedAt
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// waitRideStatusQueue waits until the queued ride statuses have been written by the writer.
+func waitRideStatusQueue(ctx context.Context) error {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+
+	for pendingRideStatuses.Load() > 0 {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("failed to wait ride status queue: %w", ctx.Err())
+		case <-ticker.C:
+		}
+	}
+
+	return nil
+}
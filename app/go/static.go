@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// フロントエンドの静的ファイルをGoから直接返す。nginxのgzip_static + try_files $uri /index.htmlと同じ挙動
+//   - assets/以下はファイル名にハッシュが入っているのでimmutableで長くキャッシュさせる
+//   - index.htmlはデプロイで中身が変わるのでno-cacheにしてETagで再検証させる
+//   - .gzがあればAccept-Encodingを見てそちらを返す
+type staticFile struct {
+	body        []byte
+	gzipBody    []byte
+	etag        string
+	contentType string
+}
+
+type staticHandler struct {
+	fsys  fs.FS
+	files sync.Map
+}
+
+func newStaticHandler(fsys fs.FS) *staticHandler {
+	return &staticHandler{fsys: fsys}
+}
+
+func (h *staticHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(path.Clean(r.URL.Path), "/")
+	if name == "" {
+		name = "index.html"
+	}
+
+	file, err := h.load(name)
+	if errors.Is(err, fs.ErrNotExist) && !strings.HasPrefix(name, "api/") {
+		// SPAなので知らないパスはindex.htmlに任せる
+		name = "index.html"
+		file, err = h.load(name)
+	}
+	if err != nil {
+		writeError(w, r, http.StatusNotFound, newAppError(http.StatusNotFound, "not_found", "not found"))
+		return
+	}
+
+	header := w.Header()
+	header.Set("Content-Type", file.contentType)
+	header.Set("ETag", file.etag)
+	header.Set("Cache-Control", staticCacheControl(name))
+	if file.gzipBody != nil {
+		header.Set("Vary", "Accept-Encoding")
+	}
+
+	body := file.body
+	if file.gzipBody != nil && strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+		header.Set("Content-Encoding", "gzip")
+		body = file.gzipBody
+	}
+
+	http.ServeContent(w, r, name, time.Time{}, bytes.NewReader(body))
+}
+
+func (h *staticHandler) load(name string) (*staticFile, error) {
+	if v, ok := h.files.Load(name); ok {
+		return v.(*staticFile), nil
+	}
+
+	body, err := fs.ReadFile(h.fsys, name)
+	if err != nil {
+		return nil, err
+	}
+	gzipBody, err := fs.ReadFile(h.fsys, name+".gz")
+	if err != nil {
+		gzipBody = nil
+	}
+
+	sum := sha1.Sum(body)
+	contentType := mime.TypeByExtension(path.Ext(name))
+	if contentType == "" {
+		contentType = http.DetectContentType(body)
+	}
+	file := &staticFile{
+		body:        body,
+		gzipBody:    gzipBody,
+		etag:        `"` + hex.EncodeToString(sum[:]) + `"`,
+		contentType: contentType,
+	}
+	v, _ := h.files.LoadOrStore(name, file)
+
+	return v.(*staticFile), nil
+}
+
+func staticCacheControl(name string) string {
+	switch {
+	case name == "index.html":
+		return "no-cache"
+	case strings.HasPrefix(name, "assets/"):
+		return "public, max-age=31536000, immutable"
+	default:
+		return "public, max-age=86400"
+	}
+}
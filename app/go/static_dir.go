@@ -0,0 +1,17 @@
+//go:build !embedstatic
+
+package main
+
+import (
+	"io/fs"
+	"os"
+)
+
+// embedstaticタグなしのときは、ISUCON_PUBLIC_DIRが設定されていればそこから返す
+func staticFS() fs.FS {
+	dir := os.Getenv("ISUCON_PUBLIC_DIR")
+	if dir == "" {
+		return nil
+	}
+	return os.DirFS(dir)
+}
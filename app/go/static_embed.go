@@ -0,0 +1,22 @@
+//go:build embedstatic
+
+package main
+
+import (
+	"embed"
+	"io/fs"
+)
+
+// go:embedは親ディレクトリを参照できないので、ビルド前にgo generate -tags embedstaticでコピーしておく
+//go:generate sh -c "rm -rf public && cp -r ../public public"
+
+//go:embed all:public
+var embeddedPublic embed.FS
+
+func staticFS() fs.FS {
+	fsys, err := fs.Sub(embeddedPublic, "public")
+	if err != nil {
+		panic(err)
+	}
+	return fsys
+}
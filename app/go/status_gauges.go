@@ -0,0 +1,168 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// 椅子・ユーザーの状態ごとの数のゲージ
+// イベントの発行ではなくライドの状態遷移(queueRideStatusとapplyMatch)で数える。モデルごとの滞在時間(chair_utilization.go)もここから記録する。
+// ライドごとに最後に数えた状態を覚えておき、前の状態を減らして次の状態を増やすので、
+// 同じ遷移を二度数えたり、順序が前後した遷移で戻したりしない。
+// ライドを持っていない椅子・ユーザーはCOMPLETED、まだ一度もアクティブになっていない椅子はREGISTEREDとして数える。
+
+var (
+	chairStatusGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "chair_status",
+		Help: "chair status",
+	}, []string{"status"})
+	userStatusGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "user_status",
+		Help: "user status",
+	}, []string{"status"})
+)
+
+var rideStatusOrder = map[string]int{
+	"MATCHING":  1,
+	"MATCHED":   2,
+	"ENROUTE":   3,
+	"PICKUP":    4,
+	"CARRYING":  5,
+	"ARRIVED":   6,
+	"COMPLETED": 7,
+	// 取り消されたライドの利用者と椅子は、ライドを持っていないのと同じくCOMPLETEDとして数える
+	"CANCELED": 7,
+}
+
+var (
+	// ride ID -> 最後に数えた状態。完了したライドは消す
+	countedRideStatuses = map[string]string{}
+	// 一度でもアクティブになった椅子
+	activatedChairs  = map[string]struct{}{}
+	statusGaugesLock sync.Mutex
+)
+
+func init() {
+	registerReset(func() {
+		statusGaugesLock.Lock()
+		defer statusGaugesLock.Unlock()
+
+		countedRideStatuses = map[string]string{}
+		activatedChairs = map[string]struct{}{}
+		chairStatusGauge.Reset()
+		userStatusGauge.Reset()
+	})
+}
+
+// initStatusGauges counts the users, chairs and unfinished rides loaded into the caches.
+func initStatusGauges() error {
+	userStatusGauge.WithLabelValues("COMPLETED").Add(float64(userByIDCache.Len()))
+	chairCache.Range(func(chairID string, chair *Chair) bool {
+		recordChairRegistration()
+		if chair.IsActive {
+			recordChairActivation(chairID)
+		}
+		return true
+	})
+	rideCache.Range(func(rideID string, ride *Ride) bool {
+		if status, ok := rideStatusesCache.Load(rideID); ok && !rideFinished(status.Status) {
+			recordRideTransition(ride, status.Status)
+		}
+		return true
+	})
+
+	return nil
+}
+
+func recordUserRegistration() {
+	userStatusGauge.WithLabelValues("COMPLETED").Inc()
+}
+
+func recordChairRegistration() {
+	chairStatusGauge.WithLabelValues("REGISTERED").Inc()
+}
+
+// recordChairActivation moves chairID from REGISTERED to COMPLETED the first time it becomes active.
+func recordChairActivation(chairID string) {
+	statusGaugesLock.Lock()
+	defer statusGaugesLock.Unlock()
+
+	if _, ok := activatedChairs[chairID]; ok {
+		return
+	}
+	activatedChairs[chairID] = struct{}{}
+	chairStatusGauge.WithLabelValues("REGISTERED").Dec()
+	chairStatusGauge.WithLabelValues("COMPLETED").Inc()
+	chairUtilization.transition(chairID, "COMPLETED", clock.Now())
+}
+
+// recordRideTransition moves the user and the chair of ride to status.
+// 既に同じか先の状態まで数えているライドの遷移は無視する。
+func recordRideTransition(ride *Ride, status string) {
+	next, ok := rideStatusOrder[status]
+	if !ok {
+		return
+	}
+
+	statusGaugesLock.Lock()
+	defer statusGaugesLock.Unlock()
+
+	prev := countedRideStatuses[ride.ID]
+	if rideStatusOrder[prev] >= next {
+		return
+	}
+	if rideFinished(status) {
+		delete(countedRideStatuses, ride.ID)
+		status = "COMPLETED"
+	} else {
+		countedRideStatuses[ride.ID] = status
+	}
+
+	userStatusGauge.WithLabelValues(idleIfUnset(prev)).Dec()
+	userStatusGauge.WithLabelValues(status).Inc()
+
+	// 椅子はMATCHEDから数える
+	if !ride.ChairID.Valid || status == "MATCHING" {
+		return
+	}
+	if prev == "MATCHING" {
+		prev = ""
+	}
+	chairStatusGauge.WithLabelValues(idleIfUnset(prev)).Dec()
+	chairStatusGauge.WithLabelValues(status).Inc()
+	chairUtilization.transition(ride.ChairID.String, status, clock.Now())
+}
+
+// recordUserDeactivation removes a deactivated user from the gauge of the status of its latest ride, or COMPLETED if it has none.
+func recordUserDeactivation(latestRideID string) {
+	statusGaugesLock.Lock()
+	defer statusGaugesLock.Unlock()
+
+	userStatusGauge.WithLabelValues(idleIfUnset(countedRideStatuses[latestRideID])).Dec()
+}
+
+// recordRideUnassignment moves ride back from MATCHED to MATCHING and its former chair to COMPLETED.
+func recordRideUnassignment(ride *Ride, chairID string) {
+	statusGaugesLock.Lock()
+	defer statusGaugesLock.Unlock()
+
+	if countedRideStatuses[ride.ID] != "MATCHED" {
+		return
+	}
+	countedRideStatuses[ride.ID] = "MATCHING"
+
+	userStatusGauge.WithLabelValues("MATCHED").Dec()
+	userStatusGauge.WithLabelValues("MATCHING").Inc()
+	chairStatusGauge.WithLabelValues("MATCHED").Dec()
+	chairStatusGauge.WithLabelValues("COMPLETED").Inc()
+	chairUtilization.transition(chairID, "COMPLETED", clock.Now())
+}
+
+func idleIfUnset(status string) string {
+	if status == "" {
+		return "COMPLETED"
+	}
+	return status
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// アクセストークンはDBにハッシュだけを保存する
+// access_token(users/owners/chairs)とowners.chair_register_tokenは "sha256:" + hex(sha256(salt + token)) で保存し、
+// 平文はCookieとレスポンスで返すだけ。認証ではCookieの値をハッシュしてからキャッシュ・DBを引くので、キャッシュのキーもハッシュになる。
+// chair_register_tokenの平文は作ったとき(オーナー登録とPATCH /api/owner/meでの作り直し)のレスポンスでしか返さない。
+// ソルトはISUCON_TOKEN_SALTで必ず指定する(requireTokenSalt)。複数台で動かすときは揃えること。
+// 初期データは平文で入っているので、初期化時にhashStoredTokensでハッシュに置き換える。
+
+const tokenHashPrefix = "sha256:"
+
+var tokenSalt = os.Getenv("ISUCON_TOKEN_SALT")
+
+// requireTokenSalt returns an error to stop startup when ISUCON_TOKEN_SALT is not set.
+// 既定値のソルトはソースから分かってしまうので使わない。
+func requireTokenSalt() error {
+	if tokenSalt == "" {
+		return errors.New("ISUCON_TOKEN_SALT is not set: set it to the same random string on every instance, e.g. export ISUCON_TOKEN_SALT=$(openssl rand -hex 32)")
+	}
+	return nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(tokenSalt + token))
+	return tokenHashPrefix + hex.EncodeToString(sum[:])
+}
+
+// hashStoredTokens replaces the plaintext tokens left in MySQL with their hashes.
+// 既にハッシュになっている行は触らないので、何度呼んでもよい。
+func hashStoredTokens() error {
+	for _, column := range []struct{ table, column string }{
+		{"users", "access_token"},
+		{"owners", "access_token"},
+		{"chairs", "access_token"},
+		{"owners", "chair_register_token"},
+	} {
+		query := fmt.Sprintf(
+			"UPDATE %[1]s SET %[2]s = CONCAT(?, SHA2(CONCAT(?, %[2]s), 256)), updated_at = updated_at WHERE %[2]s NOT LIKE ?",
+			column.table, column.column,
+		)
+		if _, err := db.Exec(query, tokenHashPrefix, tokenSalt, tokenHashPrefix+"%"); err != nil {
+			return fmt.Errorf("failed to hash %s.%s: %w", column.table, column.column, err)
+		}
+	}
+
+	return nil
+}
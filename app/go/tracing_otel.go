@@ -0,0 +1,81 @@
+//go:build otel
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/XSAM/otelsql"
+	"github.com/go-chi/chi/v5"
+	"github.com/jmoiron/sqlx"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// go build -tags otel でビルドし、OTEL_EXPORTER_OTLP_ENDPOINTを指定すると有効になる
+// initより前に差し替えないとmatcherのgoroutineと競合するので変数の初期化で行う
+var tracingEnabled = setupTracing()
+
+func setupTracing() bool {
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+		return false
+	}
+
+	exporter, err := otlptracehttp.New(context.Background())
+	if err != nil {
+		panic(fmt.Sprintf("failed to create otlp exporter: %v", err))
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", "isuride"))),
+	)
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	tracer := tp.Tracer("github.com/isucon/isucon14/webapp/go")
+
+	startSpan = func(ctx context.Context, name string) (context.Context, func()) {
+		ctx, span := tracer.Start(ctx, name)
+		return ctx, func() { span.End() }
+	}
+
+	tracingMiddleware = func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+			ctx, span := tracer.Start(ctx, r.Method+" "+r.URL.Path, trace.WithSpanKind(trace.SpanKindServer))
+			defer span.End()
+
+			next.ServeHTTP(w, r.WithContext(ctx))
+
+			// IDごとにspan名が分かれないよう、ルーティング後のパターンで名前を付け直す
+			if rctx := chi.RouteContext(ctx); rctx != nil {
+				if pattern := rctx.RoutePattern(); pattern != "" {
+					span.SetName(r.Method + " " + pattern)
+				}
+			}
+		})
+	}
+
+	dbConnect = func(driverName, dataSourceName string) (*sqlx.DB, error) {
+		sqlDB, err := otelsql.Open(driverName, dataSourceName, otelsql.WithAttributes(attribute.String("db.system", "mysql")))
+		if err != nil {
+			return nil, err
+		}
+		if err := sqlDB.Ping(); err != nil {
+			sqlDB.Close()
+			return nil, err
+		}
+
+		return sqlx.NewDb(sqlDB, driverName), nil
+	}
+
+	return true
+}
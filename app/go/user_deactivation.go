@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/dgraph-io/badger"
+)
+
+// 利用者の退会(論理削除)
+// テスト用のユーザーをDBを直接触らずに片付けられるようにする。
+// アクセストークンは誰も知らないランダムな値のハッシュに差し替え、deactivated_atを記録する。行は消さないので、過去のライドや売上はそのまま残る。
+// 進行中のライドは取り消す(ride_cancellation.go)。作成中のライドは取り消せないので、保存されるまで待ってもらう。
+
+type appPostUsersDeactivateResponse struct {
+	DeactivatedAt int64 `json:"deactivated_at"`
+}
+
+func (s *Server) appPostUsersDeactivate(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := ctx.Value("user").(*User)
+
+	if _, ok := ridesInCreation.Load(user.ID); ok {
+		writeError(w, r, http.StatusConflict, errUserRideInCreation)
+		return
+	}
+	var latestRideID string
+	if ride, ok := s.rideRepository.LatestByUser(user.ID); ok {
+		if _, err := s.cancelRide(ride); err != nil {
+			writeError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		latestRideID = ride.ID
+	}
+
+	now := s.clock.Now().Truncate(time.Microsecond)
+	revokedToken := hashToken(secureRandomStr(32))
+	if _, err := s.db.ExecContext(ctx, "UPDATE users SET access_token = ?, deactivated_at = ?, updated_at = ? WHERE id = ?", revokedToken, now, now, user.ID); err != nil {
+		writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := deleteUserStatusFromBadger(user.ID); err != nil {
+		writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	// キャッシュのUserは共有しているので書き換えずに差し替える
+	updated := *user
+	updated.AccessToken = revokedToken
+	updated.UpdatedAt = now
+	userByIDCache.Store(user.ID, &updated)
+	accessTokenCache.Forget(user.AccessToken)
+	// isucache.MapのForgetはメトリクス有効時にデッドロックするので空にする
+	unusedCouponsCache.Store(user.ID, nil)
+	invitationCodeUses.Forget(user.InvitationCode)
+	recordUserDeactivation(latestRideID)
+
+	http.SetCookie(w, &http.Cookie{
+		Path:   "/",
+		Name:   "app_session",
+		Value:  "",
+		MaxAge: -1,
+	})
+
+	writeJSON(w, http.StatusOK, &appPostUsersDeactivateResponse{
+		DeactivatedAt: now.UnixMilli(),
+	})
+}
+
+func deleteUserStatusFromBadger(userID string) error {
+	err := badgerDB.Update(func(txn *badger.Txn) error {
+		return txn.Delete(append([]byte("user"), []byte(userID)...))
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete user status from badger: %w", err)
+	}
+
+	return nil
+}
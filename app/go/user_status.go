@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// 重複ライドの防止にはbadgerのユーザーフラグを使っているが、フラグを立てた後にライドの作成が失敗するとMySQLと食い違い、
+// そのユーザーはずっと409を返され続ける。
+// フラグが立っていて衝突したときだけ、rideCache(無ければMySQL)で本当に進行中のライドがあるかを確かめ、無ければフラグを下ろす。
+
+var userStatusDivergenceCounter = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "user_status_divergence_total",
+	Help: "user status flags found set without an unfinished ride",
+})
+
+// ridesInCreation holds the users whose ride is between setting the flag and being saved.
+// その間はrideCacheにもMySQLにもライドが無いので、食い違いとはみなさない。
+var ridesInCreation sync.Map
+
+func beginRideCreation(userID string) (end func()) {
+	ridesInCreation.Store(userID, struct{}{})
+	return func() {
+		ridesInCreation.Delete(userID)
+	}
+}
+
+// hasUnfinishedRide reports whether the user status flag of userID is backed by a ride that is not COMPLETED yet.
+// If it is not, the flag is cleared so that the user can request a ride again.
+func (s *Server) hasUnfinishedRide(ctx context.Context, userID string) (bool, error) {
+	if _, ok := ridesInCreation.Load(userID); ok {
+		return true, nil
+	}
+
+	unfinished, err := s.latestRideUnfinished(ctx, userID)
+	if err != nil {
+		return false, err
+	}
+	if unfinished {
+		return true, nil
+	}
+
+	userStatusDivergenceCounter.Inc()
+	slog.Warn("user status flag diverged from rides, clearing it", slog.String("user_id", userID))
+	if err := updateUserStatusToBadger(userID, false); err != nil {
+		return false, err
+	}
+
+	return false, nil
+}
+
+func (s *Server) latestRideUnfinished(ctx context.Context, userID string) (bool, error) {
+	if ride, ok := s.rideRepository.LatestByUser(userID); ok {
+		status, err := getLatestRideStatus(ctx, s.db, ride.ID)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return false, err
+		}
+		// ステータスがまだ無いのは作成直後なので進行中として扱う
+		return !rideFinished(status), nil
+	}
+
+	// キャッシュに無いときはMySQLを見る
+	var status string
+	err := s.db.GetContext(ctx, &status, `SELECT rs.status FROM rides r JOIN ride_statuses rs ON rs.ride_id = r.id WHERE r.user_id = ? ORDER BY r.created_at DESC, rs.created_at DESC LIMIT 1`, userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to get latest ride status: %w", err)
+	}
+
+	return !rideFinished(status), nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import "strconv"
+
+// リクエストボディの検証
+// Validateを持つリクエストはbindJSONがデコードした直後に検証し、失敗したフィールドをfieldsとして返す。
+//
+//	{"code":"bad_request","message":"required fields(name) are empty","retryable":false,"retry_after_ms":0,"fields":{"name":"required"}}
+type validator interface {
+	Validate() error
+}
+
+type validation struct {
+	fields map[string]string
+}
+
+func (v *validation) fail(field string, reason string) {
+	if v.fields == nil {
+		v.fields = map[string]string{}
+	}
+	if _, ok := v.fields[field]; !ok {
+		v.fields[field] = reason
+	}
+}
+
+func (v *validation) required(field string, value string) {
+	if value == "" {
+		v.fail(field, "required")
+	}
+}
+
+func (v *validation) requiredCoordinate(field string, value *Coordinate) {
+	if value == nil {
+		v.fail(field, "required")
+	}
+}
+
+func (v *validation) between(field string, value int, lo int, hi int) {
+	if value < lo || value > hi {
+		v.fail(field, "must be between "+strconv.Itoa(lo)+" and "+strconv.Itoa(hi))
+	}
+}
+
+// err returns a bad request with message if any field failed.
+func (v *validation) err(message string) error {
+	if len(v.fields) == 0 {
+		return nil
+	}
+
+	appErr := badRequest(message)
+	appErr.Fields = v.fields
+	return appErr
+}
+
+func (req *appPostUsersRequest) Validate() error {
+	v := validation{}
+	v.required("username", req.Username)
+	v.required("firstname", req.FirstName)
+	v.required("lastname", req.LastName)
+	v.required("date_of_birth", req.DateOfBirth)
+	return v.err("required fields(username, firstname, lastname, date_of_birth) are empty")
+}
+
+func (req *appPostPaymentMethodsRequest) Validate() error {
+	v := validation{}
+	v.required("token", req.Token)
+	return v.err("token is required but was empty")
+}
+
+func (req *appPostRidesRequest) Validate() error {
+	v := validation{}
+	v.requiredCoordinate("pickup_coordinate", req.PickupCoordinate)
+	v.requiredCoordinate("destination_coordinate", req.DestinationCoordinate)
+	return v.err("required fields(pickup_coordinate, destination_coordinate) are empty")
+}
+
+func (req *appPostRidesEstimatedFareRequest) Validate() error {
+	v := validation{}
+	v.requiredCoordinate("pickup_coordinate", req.PickupCoordinate)
+	v.requiredCoordinate("destination_coordinate", req.DestinationCoordinate)
+	return v.err("required fields(pickup_coordinate, destination_coordinate) are empty")
+}
+
+func (req *appPostRideEvaluationRequest) Validate() error {
+	v := validation{}
+	v.between("evaluation", req.Evaluation, 1, 5)
+	return v.err("evaluation must be between 1 and 5")
+}
+
+func (req *chairPostChairsRequest) Validate() error {
+	v := validation{}
+	v.required("name", req.Name)
+	v.required("model", req.Model)
+	v.required("chair_register_token", req.ChairRegisterToken)
+	return v.err("some of required fields(name, model, chair_register_token) are empty")
+}
+
+func (req *ownerPostOwnersRequest) Validate() error {
+	v := validation{}
+	v.required("name", req.Name)
+	return v.err("some of required fields(name) are empty")
+}
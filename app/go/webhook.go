@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/bytedance/sonic"
+	isucache "github.com/mazrean/isucon-go-tools/v2/cache"
+	"github.com/oklog/ulid/v2"
+)
+
+// オーナーが登録したURLに、配下の椅子のライド完了と稼働状態の変更を通知する
+// 本文はJSONで、X-Isuride-Signatureにwebhookのシークレットで計算したHMAC-SHA256を付ける。
+//
+//	X-Isuride-Event: ride.completed
+//	X-Isuride-Signature: sha256=<hex>
+//
+// 送信はwebhookWorkers個のワーカーが行い、5xxや接続エラーは間隔を倍にしながらwebhookMaxAttempts回まで試す。
+const (
+	webhookWorkers     = 4
+	webhookMaxAttempts = 4
+	webhookRetryBase   = time.Second
+	webhookTimeout     = 5 * time.Second
+
+	webhookEventRideCompleted = "ride.completed"
+	webhookEventChairActivity = "chair.activity"
+)
+
+var (
+	// owner ID -> webhooks
+	ownerWebhooksCache = isucache.NewMap[string, []*OwnerWebhook]("ownerWebhooksCache")
+
+	webhookQueue  = make(chan *webhookDelivery, 10000)
+	webhookClient = &http.Client{Timeout: webhookTimeout}
+)
+
+type webhookDelivery struct {
+	webhook *OwnerWebhook
+	event   string
+	body    []byte
+}
+
+func init() {
+	registerReset(ownerWebhooksCache.Purge)
+	registerReset(func() {
+		for {
+			select {
+			case <-webhookQueue:
+			default:
+				return
+			}
+		}
+	})
+
+	defaultEventBus.OnChairPublish(notifyRideCompleted)
+
+	for range webhookWorkers {
+		go webhookWorker()
+	}
+}
+
+func initOwnerWebhookCache() error {
+	var webhooks []*OwnerWebhook
+	if err := db.Select(&webhooks, "SELECT "+ownerWebhookColumns+" FROM owner_webhooks ORDER BY created_at"); err != nil {
+		return err
+	}
+
+	for _, webhook := range webhooks {
+		addOwnerWebhook(webhook)
+	}
+
+	return nil
+}
+
+func addOwnerWebhook(webhook *OwnerWebhook) {
+	ownerWebhooksCache.Update(webhook.OwnerID, func(webhooks []*OwnerWebhook) ([]*OwnerWebhook, bool) {
+		return append(webhooks, webhook), true
+	})
+}
+
+type webhookRideCompletedPayload struct {
+	Event       string `json:"event"`
+	ChairID     string `json:"chair_id"`
+	RideID      string `json:"ride_id"`
+	Evaluation  int    `json:"evaluation"`
+	CompletedAt int64  `json:"completed_at"`
+}
+
+type webhookChairActivityPayload struct {
+	Event     string `json:"event"`
+	ChairID   string `json:"chair_id"`
+	IsActive  bool   `json:"is_active"`
+	ChangedAt int64  `json:"changed_at"`
+}
+
+func notifyRideCompleted(chairID string, message *RideEvent) {
+	if message.status != "COMPLETED" || message.ride == nil {
+		return
+	}
+	chair, ok := chairCache.Load(chairID)
+	if !ok {
+		return
+	}
+
+	enqueueOwnerWebhooks(chair.OwnerID, webhookEventRideCompleted, &webhookRideCompletedPayload{
+		Event:       webhookEventRideCompleted,
+		ChairID:     chairID,
+		RideID:      message.ride.ID,
+		Evaluation:  message.evaluation,
+		CompletedAt: message.updatedAt.UnixMilli(),
+	})
+}
+
+func notifyChairActivity(chair *Chair, isActive bool, now time.Time) {
+	enqueueOwnerWebhooks(chair.OwnerID, webhookEventChairActivity, &webhookChairActivityPayload{
+		Event:     webhookEventChairActivity,
+		ChairID:   chair.ID,
+		IsActive:  isActive,
+		ChangedAt: now.UnixMilli(),
+	})
+}
+
+// enqueueOwnerWebhooks queues payload for every webhook of the owner without blocking.
+func enqueueOwnerWebhooks(ownerID string, event string, payload any) {
+	webhooks, _ := ownerWebhooksCache.Load(ownerID)
+	if len(webhooks) == 0 {
+		return
+	}
+
+	body, err := sonic.ConfigFastest.Marshal(payload)
+	if err != nil {
+		slog.Error("failed to encode webhook payload", slog.String("event", event), slog.String("error", err.Error()))
+		return
+	}
+
+	for _, webhook := range webhooks {
+		select {
+		case webhookQueue <- &webhookDelivery{webhook: webhook, event: event, body: body}:
+		default:
+			slog.Warn("webhook queue is full, dropping delivery",
+				slog.String("webhook_id", webhook.ID),
+				slog.String("event", event),
+			)
+		}
+	}
+}
+
+func signWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func webhookWorker() {
+	for delivery := range webhookQueue {
+		var err error
+		for attempt := range webhookMaxAttempts {
+			if attempt > 0 {
+				time.Sleep(webhookRetryBase << (attempt - 1))
+			}
+
+			var retry bool
+			retry, err = deliverWebhook(delivery)
+			if err == nil || !retry {
+				break
+			}
+		}
+		if err != nil {
+			slog.Warn("failed to deliver webhook",
+				slog.String("webhook_id", delivery.webhook.ID),
+				slog.String("event", delivery.event),
+				slog.String("error", err.Error()),
+			)
+		}
+	}
+}
+
+// deliverWebhook sends delivery once and reports whether a failure is worth retrying.
+func deliverWebhook(delivery *webhookDelivery) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.webhook.URL, bytes.NewReader(delivery.body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Isuride-Event", delivery.event)
+	req.Header.Set("X-Isuride-Delivery", ulid.Make().String())
+	req.Header.Set("X-Isuride-Signature", signWebhook(delivery.webhook.Secret, delivery.body))
+
+	res, err := webhookClient.Do(req)
+	if err != nil {
+		return true, err
+	}
+	res.Body.Close()
+
+	if res.StatusCode >= http.StatusInternalServerError || res.StatusCode == http.StatusTooManyRequests {
+		return true, fmt.Errorf("unexpected status code: %d", res.StatusCode)
+	}
+	if res.StatusCode >= http.StatusBadRequest {
+		return false, fmt.Errorf("unexpected status code: %d", res.StatusCode)
+	}
+	return false, nil
+}
+
+type ownerPostWebhooksRequest struct {
+	URL string `json:"url"`
+}
+
+func (req *ownerPostWebhooksRequest) Validate() error {
+	v := validation{}
+	v.required("url", req.URL)
+	if req.URL != "" {
+		if u, err := url.Parse(req.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			v.fail("url", "must be an http(s) URL")
+		}
+	}
+	return v.err("url must be an http(s) URL")
+}
+
+type ownerPostWebhooksResponse struct {
+	ID     string `json:"id"`
+	Secret string `json:"secret"`
+}
+
+type ownerGetWebhooksResponse struct {
+	Webhooks []ownerGetWebhooksResponseWebhook `json:"webhooks"`
+}
+
+type ownerGetWebhooksResponseWebhook struct {
+	ID           string `json:"id"`
+	URL          string `json:"url"`
+	RegisteredAt int64  `json:"registered_at"`
+}
+
+func (s *Server) ownerPostWebhooks(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+
+	req := &ownerPostWebhooksRequest{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	webhook := &OwnerWebhook{
+		ID:        ulid.Make().String(),
+		OwnerID:   owner.ID,
+		URL:       req.URL,
+		Secret:    secureRandomStr(32),
+		CreatedAt: s.clock.Now().Truncate(time.Microsecond),
+	}
+	if _, err := s.db.NamedExecContext(ctx, "INSERT INTO owner_webhooks ("+ownerWebhookColumns+") VALUES (:id, :owner_id, :url, :secret, :created_at)", webhook); err != nil {
+		writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	addOwnerWebhook(webhook)
+
+	writeJSON(w, http.StatusCreated, &ownerPostWebhooksResponse{
+		ID:     webhook.ID,
+		Secret: webhook.Secret,
+	})
+}
+
+func (s *Server) ownerGetWebhooks(w http.ResponseWriter, r *http.Request) {
+	owner := r.Context().Value("owner").(*Owner)
+
+	webhooks, _ := ownerWebhooksCache.Load(owner.ID)
+	res := &ownerGetWebhooksResponse{Webhooks: make([]ownerGetWebhooksResponseWebhook, 0, len(webhooks))}
+	for _, webhook := range webhooks {
+		res.Webhooks = append(res.Webhooks, ownerGetWebhooksResponseWebhook{
+			ID:           webhook.ID,
+			URL:          webhook.URL,
+			RegisteredAt: webhook.CreatedAt.UnixMilli(),
+		})
+	}
+
+	writeJSON(w, http.StatusOK, res)
+}
@@ -28,6 +28,7 @@ CREATE TABLE chairs
   owner_id     VARCHAR(26)  NOT NULL COMMENT 'オーナーID',
   name         VARCHAR(30)  NOT NULL COMMENT '椅子の名前',
   model        TEXT         NOT NULL COMMENT '椅子のモデル',
+  speed        INTEGER      NOT NULL DEFAULT 0 COMMENT 'モデルの移動速度',
   is_active    TINYINT(1)   NOT NULL COMMENT '配椅子受付中かどうか',
   access_token VARCHAR(255) NOT NULL COMMENT 'アクセストークン',
   created_at   DATETIME(6)  NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '登録日時',
@@ -60,6 +61,7 @@ CREATE TABLE users
   date_of_birth   VARCHAR(30)  NOT NULL COMMENT '生年月日',
   access_token    VARCHAR(255) NOT NULL COMMENT 'アクセストークン',
   invitation_code VARCHAR(30)  NOT NULL COMMENT '招待トークン',
+  deactivated_at  DATETIME(6)  NULL     COMMENT '退会日時',
   created_at      DATETIME(6)  NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '登録日時',
   updated_at      DATETIME(6)  NOT NULL DEFAULT CURRENT_TIMESTAMP(6) ON UPDATE CURRENT_TIMESTAMP(6) COMMENT '更新日時',
   PRIMARY KEY (id),
@@ -91,6 +93,7 @@ CREATE TABLE rides
   destination_longitude INTEGER     NOT NULL COMMENT '目的地(緯度)',
   evaluation            INTEGER     NULL     COMMENT '評価',
   sales                 INTEGER     NOT NULL DEFAULT 0 INVISIBLE COMMENT '売上',
+  travelled_distance    INTEGER     NULL     INVISIBLE COMMENT '実際に移動した距離',
   created_at            DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '要求日時',
   updated_at            DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '状態更新日時',
   PRIMARY KEY (id)
@@ -103,12 +106,12 @@ CREATE INDEX idx_rides_chair_created_at ON rides (chair_id, created_at DESC);
 DROP TABLE IF EXISTS ride_statuses;
 CREATE TABLE ride_statuses
 (
-  id              VARCHAR(26)                                                                NOT NULL,
-  ride_id VARCHAR(26)                                                                        NOT NULL COMMENT 'ライドID',
-  status          ENUM ('MATCHING', 'ENROUTE', 'PICKUP', 'CARRYING', 'ARRIVED', 'COMPLETED') NOT NULL COMMENT '状態',
-  created_at      DATETIME(6)                                                                NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '状態変更日時',
-  app_sent_at     DATETIME(6)                                                                NULL COMMENT 'ユーザーへの状態通知日時',
-  chair_sent_at   DATETIME(6)                                                                NULL COMMENT '椅子への状態通知日時',
+  id              VARCHAR(26)                                                                            NOT NULL,
+  ride_id VARCHAR(26)                                                                                    NOT NULL COMMENT 'ライドID',
+  status          ENUM ('MATCHING', 'ENROUTE', 'PICKUP', 'CARRYING', 'ARRIVED', 'COMPLETED', 'CANCELED') NOT NULL COMMENT '状態',
+  created_at      DATETIME(6)                                                                            NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '状態変更日時',
+  app_sent_at     DATETIME(6)                                                                            NULL COMMENT 'ユーザーへの状態通知日時',
+  chair_sent_at   DATETIME(6)                                                                            NULL COMMENT '椅子への状態通知日時',
   PRIMARY KEY (id)
 )
   COMMENT = 'ライドステータスの変更履歴テーブル';
@@ -131,6 +134,19 @@ CREATE TABLE owners
 )
   COMMENT = '椅子のオーナー情報テーブル';
 
+DROP TABLE IF EXISTS owner_webhooks;
+CREATE TABLE owner_webhooks
+(
+  id         VARCHAR(26)  NOT NULL COMMENT 'webhook ID',
+  owner_id   VARCHAR(26)  NOT NULL COMMENT 'オーナーID',
+  url        VARCHAR(255) NOT NULL COMMENT '送信先URL',
+  secret     VARCHAR(255) NOT NULL COMMENT '署名用のシークレット',
+  created_at DATETIME(6)  NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '登録日時',
+  PRIMARY KEY (id)
+)
+  COMMENT = 'オーナーのwebhook登録テーブル';
+CREATE INDEX idx_owner_webhooks_owner_id ON owner_webhooks (owner_id);
+
 DROP TABLE IF EXISTS coupons;
 CREATE TABLE coupons
 (
@@ -139,7 +155,44 @@ CREATE TABLE coupons
   discount   INTEGER      NOT NULL COMMENT '割引額',
   created_at DATETIME(6)  NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '付与日時',
   used_by    VARCHAR(26)  NULL COMMENT 'クーポンが適用されたライドのID',
+  expires_at DATETIME(6)  NULL COMMENT '有効期限。NULLなら無期限',
   PRIMARY KEY (user_id, code)
 )
   COMMENT 'クーポンテーブル';
 CREATE INDEX idx_used_by ON coupons (used_by);
+
+DROP TABLE IF EXISTS campaigns;
+CREATE TABLE campaigns
+(
+  id                  VARCHAR(26)  NOT NULL COMMENT 'キャンペーンID',
+  name                VARCHAR(255) NOT NULL COMMENT 'キャンペーン名',
+  new_user_discount   INTEGER      NOT NULL COMMENT '初回登録クーポンの割引額',
+  invitee_discount    INTEGER      NOT NULL COMMENT '招待されたユーザーのクーポンの割引額',
+  inviter_discount    INTEGER      NOT NULL COMMENT '招待したユーザーのクーポンの割引額',
+  max_invitation_uses INTEGER      NOT NULL COMMENT '招待コードの使用回数の上限',
+  is_active           TINYINT(1)   NOT NULL DEFAULT 0 COMMENT '適用中かどうか',
+  created_at          DATETIME(6)  NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '登録日時',
+  PRIMARY KEY (id)
+)
+  COMMENT = '登録キャンペーンテーブル';
+
+DROP TABLE IF EXISTS invitation_uses;
+CREATE TABLE invitation_uses
+(
+  invitation_code VARCHAR(255) NOT NULL COMMENT '招待コード',
+  uses            INTEGER      NOT NULL COMMENT '使用回数',
+  updated_at      DATETIME(6)  NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '更新日時',
+  PRIMARY KEY (invitation_code)
+)
+  COMMENT = '招待コードの使用回数テーブル';
+
+DROP TABLE IF EXISTS coupon_abuse_flags;
+CREATE TABLE coupon_abuse_flags
+(
+  user_id     VARCHAR(26)  NOT NULL COMMENT 'ユーザーID',
+  reason      VARCHAR(64)  NOT NULL COMMENT '検知した理由',
+  detail      VARCHAR(255) NOT NULL COMMENT '詳細',
+  detected_at DATETIME(6)  NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '検知日時',
+  PRIMARY KEY (user_id, reason)
+)
+  COMMENT = 'クーポンの不正取得の検知結果テーブル';
@@ -6,6 +6,9 @@ USE isuride;
 INSERT INTO settings (name, value)
 VALUES ('payment_gateway_url', 'http://localhost:12345');
 
+INSERT INTO campaigns (id, name, new_user_discount, invitee_discount, inviter_discount, max_invitation_uses, is_active)
+VALUES ('default', 'default', 3000, 1500, 1000, 3, 1);
+
 INSERT INTO chair_models (name, speed)
 VALUES ('リラックスシート NEO', 2),
        ('エアシェル ライト', 2),